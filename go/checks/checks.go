@@ -179,3 +179,11 @@ func CheckAlpha(label string, alpha float64) error {
 	}
 	return nil
 }
+
+// CheckBudgetFraction returns an error if the supplied fraction of a privacy budget is not strictly between 0 and 1.
+func CheckBudgetFraction(label, name string, fraction float64) error {
+	if fraction <= 0 || fraction >= 1 || math.IsNaN(fraction) {
+		return fmt.Errorf("%s: %s is %f, should be strictly between 0 and 1 (and cannot be NaN)", label, name, fraction)
+	}
+	return nil
+}
@@ -532,3 +532,23 @@ func TestCheckAlpha(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckBudgetFraction(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		fraction float64
+		wantErr  bool
+	}{
+		{"negative fraction", -0.5, true},
+		{"zero fraction", 0, true},
+		{"fraction of 1", 1, true},
+		{"fraction larger than 1", 2, true},
+		{"positive infinity fraction", math.Inf(1), true},
+		{"NaN fraction", math.NaN(), true},
+		{"arbitrary fraction", 0.3, false},
+	} {
+		if err := CheckBudgetFraction("test", "fraction", tc.fraction); (err != nil) != tc.wantErr {
+			t.Errorf("CheckBudgetFraction: when %s for err got %v, want %t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
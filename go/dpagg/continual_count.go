@@ -0,0 +1,243 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math/bits"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/noise"
+)
+
+// ContinualCount calculates differentially private running totals of a stream
+// of increments under continual observation: the stream is split into time
+// steps, and a running total is released at the end of each time step.
+//
+// It uses the binary tree mechanism (also known as tree aggregation): each
+// node of a binary tree over the time steps holds the noisy count of a range
+// of time steps, and the running total at a time step is the sum of the nodes
+// of its binary decomposition. Each increment is part of at most one node per
+// level of the tree, so with MaxTimeSteps time steps, each node is noised with
+// the sensitivity of a count scaled by the number of levels,
+// ⌊log₂(MaxTimeSteps)⌋+1, and each running total is the sum of at most as many
+// nodes. The error of each running total thus grows polylogarithmically with
+// MaxTimeSteps, instead of linearly when releasing a Count per time step
+// with a budget of ε/MaxTimeSteps each.
+//
+// All the running totals together are (ε,δ)-differentially private.
+//
+// Like Count, it supports privacy units that contribute to multiple partitions
+// (via the MaxPartitionsContributed parameter), and privacy units that
+// contribute several times to a single partition, possibly in different time
+// steps (via the MaxContributionsPerPartition parameter).
+//
+// The released running totals are unbiased estimates of the raw running
+// totals.
+//
+// For general details and key definitions, see
+// https://github.com/google/differential-privacy/blob/main/differential_privacy.md#key-definitions.
+//
+// Note: Do not use when your results may cause overflows for int64 values.
+// This aggregation is not hardened for such applications yet.
+//
+// Not thread-safe.
+type ContinualCount struct {
+	// Parameters
+	epsilon      float64
+	delta        float64
+	maxTimeSteps int64
+	// Sensitivities of the nodes of the tree: l0Sensitivity is the maximum
+	// number of nodes a privacy unit contributes to, over all partitions.
+	l0Sensitivity   int64
+	lInfSensitivity int64
+	noise           noise.Noise
+	noiseKind       noise.Kind // necessary for serializing noise.Noise information
+
+	// State variables
+	timeStep int64 // number of time steps that already ended
+	count    int64 // raw count of the current time step
+	// Raw and noisy counts of the last completed node of each level.
+	nodes      []int64
+	noisyNodes []int64
+}
+
+// ContinualCountOptions contains the options necessary to initialize a
+// ContinualCount.
+type ContinualCountOptions struct {
+	Epsilon                      float64     // Privacy parameter ε. Required.
+	Delta                        float64     // Privacy parameter δ. Required with Gaussian noise, must be 0 with Laplace noise.
+	MaxTimeSteps                 int64       // Maximum number of time steps, i.e. of released running totals. Required.
+	MaxPartitionsContributed     int64       // How many distinct partitions may a single privacy unit contribute to? Defaults to 1.
+	MaxContributionsPerPartition int64       // How many times may a single privacy unit contribute to a single partition, over all time steps? Defaults to 1.
+	Noise                        noise.Noise // Type of noise used. Defaults to Laplace noise.
+}
+
+// NewContinualCount returns a new ContinualCount, initialized at 0 and at the
+// first time step.
+func NewContinualCount(opt *ContinualCountOptions) *ContinualCount {
+	if opt == nil {
+		opt = &ContinualCountOptions{}
+	}
+	if opt.MaxTimeSteps <= 0 {
+		log.Fatalf("NewContinualCount requires a strictly positive MaxTimeSteps, got %d", opt.MaxTimeSteps)
+	}
+	// Set defaults.
+	l0 := opt.MaxPartitionsContributed
+	if l0 == 0 {
+		l0 = 1
+	}
+	lInf := opt.MaxContributionsPerPartition
+	if lInf == 0 {
+		lInf = 1
+	}
+	n := opt.Noise
+	if n == nil {
+		n = noise.Laplace()
+	}
+	levels := treeLevels(opt.MaxTimeSteps)
+	// Check that the parameters are compatible with the noise chosen by calling
+	// the noise on some dummy value.
+	eps, del := opt.Epsilon, opt.Delta
+	n.AddNoiseInt64(0, l0*levels, lInf, eps, del)
+
+	return &ContinualCount{
+		epsilon:         eps,
+		delta:           del,
+		maxTimeSteps:    opt.MaxTimeSteps,
+		l0Sensitivity:   l0 * levels,
+		lInfSensitivity: lInf,
+		noise:           n,
+		noiseKind:       noise.ToKind(n),
+		nodes:           make([]int64, levels),
+		noisyNodes:      make([]int64, levels),
+	}
+}
+
+// treeLevels returns the number of levels of a binary tree over maxTimeSteps
+// time steps, i.e. the number of bits of maxTimeSteps.
+func treeLevels(maxTimeSteps int64) int64 {
+	return int64(bits.Len64(uint64(maxTimeSteps)))
+}
+
+// Increment increments the count of the current time step by one.
+func (c *ContinualCount) Increment() {
+	c.IncrementBy(1)
+}
+
+// IncrementBy increments the count of the current time step by the given
+// value. Note that this shouldn't be used to count more contributions to a
+// single partition from the same privacy unit than
+// MaxContributionsPerPartition.
+func (c *ContinualCount) IncrementBy(count int64) {
+	if c.timeStep >= c.maxTimeSteps {
+		log.Fatalf("The running totals of all %d time steps have already been returned. The count cannot be amended.", c.maxTimeSteps)
+	}
+	c.count += count
+}
+
+// EndTimeStep ends the current time step, and returns a differentially
+// private estimate of the running total, i.e. of the count of all the
+// increments since the first time step. It can be called at most MaxTimeSteps
+// times.
+//
+// The returned value is an unbiased estimate of the raw running total. It may
+// sometimes be negative, and running totals of consecutive time steps may
+// decrease.
+func (c *ContinualCount) EndTimeStep() int64 {
+	if c.timeStep >= c.maxTimeSteps {
+		log.Fatalf("The running totals of all %d time steps have already been returned.", c.maxTimeSteps)
+	}
+	c.timeStep++
+	// The node completed at this time step is at the level of the lowest set
+	// bit of timeStep, and covers the last completed nodes of the lower levels.
+	level := bits.TrailingZeros64(uint64(c.timeStep))
+	node := c.count
+	for i := 0; i < level; i++ {
+		node += c.nodes[i]
+		c.nodes[i], c.noisyNodes[i] = 0, 0
+	}
+	c.nodes[level] = node
+	c.noisyNodes[level] = c.noise.AddNoiseInt64(node, c.l0Sensitivity, c.lInfSensitivity, c.epsilon, c.delta)
+	c.count = 0
+	// The running total is the sum of the nodes of the binary decomposition of
+	// timeStep.
+	var total int64
+	for i, noisyNode := range c.noisyNodes {
+		if c.timeStep&(1<<uint(i)) != 0 {
+			total += noisyNode
+		}
+	}
+	return total
+}
+
+// encodableContinualCount can be encoded by the gob package.
+type encodableContinualCount struct {
+	Epsilon         float64
+	Delta           float64
+	MaxTimeSteps    int64
+	L0Sensitivity   int64
+	LInfSensitivity int64
+	NoiseKind       noise.Kind
+	TimeStep        int64
+	Count           int64
+	Nodes           []int64
+	NoisyNodes      []int64
+}
+
+// GobEncode encodes ContinualCount. The ContinualCount can still be used
+// afterwards: encoding it is a way to checkpoint its state between time steps.
+// Only one of the ContinualCount and its decoded copies may be used afterwards,
+// since the noisy nodes of the others would be re-used.
+func (c *ContinualCount) GobEncode() ([]byte, error) {
+	enc := encodableContinualCount{
+		Epsilon:         c.epsilon,
+		Delta:           c.delta,
+		MaxTimeSteps:    c.maxTimeSteps,
+		L0Sensitivity:   c.l0Sensitivity,
+		LInfSensitivity: c.lInfSensitivity,
+		NoiseKind:       noise.ToKind(c.noise),
+		TimeStep:        c.timeStep,
+		Count:           c.count,
+		Nodes:           c.nodes,
+		NoisyNodes:      c.noisyNodes,
+	}
+	return encode(enc)
+}
+
+// GobDecode decodes ContinualCount.
+func (c *ContinualCount) GobDecode(data []byte) error {
+	var enc encodableContinualCount
+	err := decode(&enc, data)
+	if err != nil {
+		log.Fatalf("GobDecode: couldn't decode ContinualCount from bytes")
+		return err
+	}
+	*c = ContinualCount{
+		epsilon:         enc.Epsilon,
+		delta:           enc.Delta,
+		maxTimeSteps:    enc.MaxTimeSteps,
+		l0Sensitivity:   enc.L0Sensitivity,
+		lInfSensitivity: enc.LInfSensitivity,
+		noiseKind:       enc.NoiseKind,
+		noise:           noise.ToNoise(enc.NoiseKind),
+		timeStep:        enc.TimeStep,
+		count:           enc.Count,
+		nodes:           enc.Nodes,
+		noisyNodes:      enc.NoisyNodes,
+	}
+	return nil
+}
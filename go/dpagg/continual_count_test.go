@@ -0,0 +1,294 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"math/bits"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/google/go-cmp/cmp"
+	"github.com/grd/stat"
+)
+
+func TestNewContinualCount(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		opt  *ContinualCountOptions
+		want *ContinualCount
+	}{
+		{"MaxPartitionsContributed and MaxContributionsPerPartition are not set",
+			&ContinualCountOptions{
+				Epsilon:      ln3,
+				Delta:        tenten,
+				MaxTimeSteps: 7,
+				Noise:        noNoise{},
+			},
+			&ContinualCount{
+				epsilon:         ln3,
+				delta:           tenten,
+				maxTimeSteps:    7,
+				l0Sensitivity:   3,
+				lInfSensitivity: 1,
+				noise:           noNoise{},
+				nodes:           make([]int64, 3),
+				noisyNodes:      make([]int64, 3),
+			}},
+		{"Noise is not set",
+			&ContinualCountOptions{
+				Epsilon:                      ln3,
+				Delta:                        0,
+				MaxTimeSteps:                 8,
+				MaxPartitionsContributed:     2,
+				MaxContributionsPerPartition: 5,
+			},
+			&ContinualCount{
+				epsilon:         ln3,
+				delta:           0,
+				maxTimeSteps:    8,
+				l0Sensitivity:   8,
+				lInfSensitivity: 5,
+				noise:           noise.Laplace(),
+				noiseKind:       noise.LaplaceNoise,
+				nodes:           make([]int64, 4),
+				noisyNodes:      make([]int64, 4),
+			}},
+	} {
+		got := NewContinualCount(tc.opt)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("NewContinualCount: when %s got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestTreeLevels(t *testing.T) {
+	for _, tc := range []struct {
+		maxTimeSteps int64
+		want         int64
+	}{
+		{1, 1},
+		{2, 2},
+		{3, 2},
+		{4, 3},
+		{1000, 10},
+		{1024, 11},
+	} {
+		if got := treeLevels(tc.maxTimeSteps); got != tc.want {
+			t.Errorf("treeLevels(%d): got %d, want %d", tc.maxTimeSteps, got, tc.want)
+		}
+	}
+}
+
+func TestContinualCountNoNoise(t *testing.T) {
+	increments := []int64{3, 0, 5, 1, 2, 7, 4, 0, 6, 1, 1}
+	c := NewContinualCount(&ContinualCountOptions{Epsilon: ln3, MaxTimeSteps: int64(len(increments)), Noise: noNoise{}})
+	var want int64
+	for i, inc := range increments {
+		c.IncrementBy(inc)
+		want += inc
+		if got := c.EndTimeStep(); got != want {
+			t.Errorf("EndTimeStep: at time step %d got %d, want %d", i+1, got, want)
+		}
+	}
+}
+
+// addOneNoise is a Noise instance that adds 1 to the data, to count the
+// number of noisy nodes summed in each running total.
+type addOneNoise struct {
+	noise.Noise
+}
+
+func (addOneNoise) AddNoiseInt64(x, _, _ int64, _, _ float64) int64 {
+	return x + 1
+}
+
+// Checks that each running total is the sum of the nodes of the binary
+// decomposition of the time step, so it contains as many noise values as the
+// number of bits set in the time step.
+func TestContinualCountSumsBinaryDecomposition(t *testing.T) {
+	const maxTimeSteps = 100
+	c := NewContinualCount(&ContinualCountOptions{Epsilon: ln3, MaxTimeSteps: maxTimeSteps, Noise: addOneNoise{}})
+	var rawTotal int64
+	for timeStep := 1; timeStep <= maxTimeSteps; timeStep++ {
+		c.IncrementBy(int64(timeStep % 3))
+		rawTotal += int64(timeStep % 3)
+		want := rawTotal + int64(bits.OnesCount(uint(timeStep)))
+		if got := c.EndTimeStep(); got != want {
+			t.Errorf("EndTimeStep: at time step %d got %d, want %d", timeStep, got, want)
+		}
+	}
+}
+
+type mockNoiseContinualCount struct {
+	t *testing.T
+	noise.Noise
+	calls *int
+}
+
+// AddNoiseInt64 checks that the parameters passed are the ones we expect.
+func (mn mockNoiseContinualCount) AddNoiseInt64(x, l0, lInf int64, eps, del float64) int64 {
+	*mn.calls++
+	// With MaxTimeSteps=5, there are 3 levels, and 3 partitions per privacy unit.
+	if l0 != 9 {
+		mn.t.Errorf("AddNoiseInt64: for parameter l0Sensitivity got %d, want %d", l0, 9)
+	}
+	if lInf != 2 {
+		mn.t.Errorf("AddNoiseInt64: for parameter lInfSensitivity got %d, want %d", lInf, 2)
+	}
+	if !ApproxEqual(eps, ln3) {
+		mn.t.Errorf("AddNoiseInt64: for parameter epsilon got %f, want %f", eps, ln3)
+	}
+	if !ApproxEqual(del, tenten) {
+		mn.t.Errorf("AddNoiseInt64: for parameter delta got %f, want %f", del, tenten)
+	}
+	return x
+}
+
+func TestContinualCountNoiseIsCorrectlyCalled(t *testing.T) {
+	calls := 0
+	c := NewContinualCount(&ContinualCountOptions{
+		Epsilon:                      ln3,
+		Delta:                        tenten,
+		MaxTimeSteps:                 5,
+		MaxPartitionsContributed:     3,
+		MaxContributionsPerPartition: 2,
+		Noise:                        mockNoiseContinualCount{t: t, calls: &calls},
+	})
+	for i := 0; i < 5; i++ {
+		c.Increment()
+		c.EndTimeStep() // will fail if parameters are wrong
+	}
+	// NewContinualCount calls the noise once with a dummy value, and a single
+	// node is noised at each time step.
+	if calls != 6 {
+		t.Errorf("AddNoiseInt64 was called %d times, want %d", calls, 6)
+	}
+}
+
+func compareContinualCount(c1, c2 *ContinualCount) bool {
+	return c1.epsilon == c2.epsilon &&
+		c1.delta == c2.delta &&
+		c1.maxTimeSteps == c2.maxTimeSteps &&
+		c1.l0Sensitivity == c2.l0Sensitivity &&
+		c1.lInfSensitivity == c2.lInfSensitivity &&
+		c1.noise == c2.noise &&
+		c1.noiseKind == c2.noiseKind &&
+		c1.timeStep == c2.timeStep &&
+		c1.count == c2.count &&
+		reflect.DeepEqual(c1.nodes, c2.nodes) &&
+		reflect.DeepEqual(c1.noisyNodes, c2.noisyNodes)
+}
+
+// Tests that serialization for ContinualCount works as expected.
+func TestContinualCountSerialization(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		opts *ContinualCountOptions
+	}{
+		{"default options", &ContinualCountOptions{
+			Epsilon:      ln3,
+			MaxTimeSteps: 10,
+		}},
+		{"non-default options", &ContinualCountOptions{
+			Epsilon:                      ln3,
+			Delta:                        1e-5,
+			MaxTimeSteps:                 100,
+			MaxPartitionsContributed:     5,
+			MaxContributionsPerPartition: 2,
+			Noise:                        noise.Gaussian(),
+		}},
+	} {
+		c := NewContinualCount(tc.opts)
+		// Serialize the ContinualCount in the middle of a time step.
+		for i := 0; i < 3; i++ {
+			c.IncrementBy(4)
+			c.EndTimeStep()
+		}
+		c.Increment()
+		bytes, err := encode(c)
+		if err != nil {
+			t.Fatalf("encode(ContinualCount) error: %v", err)
+		}
+		cUnmarshalled := new(ContinualCount)
+		if err := decode(cUnmarshalled, bytes); err != nil {
+			t.Fatalf("decode(ContinualCount) error: %v", err)
+		}
+		// Check that encoding -> decoding is the identity function.
+		if !cmp.Equal(c, cUnmarshalled, cmp.Comparer(compareContinualCount)) {
+			t.Errorf("decode(encode(_)): when %s got %+v, want %+v", tc.desc, cUnmarshalled, c)
+		}
+	}
+}
+
+func TestContinualCountIsUnbiased(t *testing.T) {
+	const numberOfSamples = 10000
+	const maxTimeSteps = 16
+	for _, tc := range []struct {
+		opt *ContinualCountOptions
+	}{
+		{&ContinualCountOptions{Epsilon: ln3, MaxTimeSteps: maxTimeSteps, Noise: noise.Laplace()}},
+		{&ContinualCountOptions{Epsilon: ln3, Delta: 1e-5, MaxTimeSteps: maxTimeSteps, Noise: noise.Gaussian()}},
+	} {
+		// Samples of the running totals of time steps 15 and 16, whose binary
+		// decompositions have 4 and 1 nodes.
+		samples15, samples16 := make(stat.IntSlice, numberOfSamples), make(stat.IntSlice, numberOfSamples)
+		for i := 0; i < numberOfSamples; i++ {
+			c := NewContinualCount(tc.opt)
+			for timeStep := 1; timeStep <= maxTimeSteps; timeStep++ {
+				c.IncrementBy(10)
+				total := c.EndTimeStep()
+				if timeStep == 15 {
+					samples15[i] = total
+				}
+				if timeStep == 16 {
+					samples16[i] = total
+				}
+			}
+		}
+		// The variance of the running total of time step 15 is the sum of the
+		// variances of its 4 nodes, which is the variance of a Count with the
+		// same parameters and l0Sensitivity=5, times 4.
+		countSamples := make(stat.IntSlice, numberOfSamples)
+		for i := 0; i < numberOfSamples; i++ {
+			countSamples[i] = tc.opt.Noise.AddNoiseInt64(0, 5, 1, tc.opt.Epsilon, tc.opt.Delta)
+		}
+		nodeVariance := stat.Variance(countSamples)
+		for _, s := range []struct {
+			samples  stat.IntSlice
+			rawTotal float64
+			numNodes float64
+		}{
+			{samples15, 150, 4},
+			{samples16, 160, 1},
+		} {
+			// The tolerance is set to the 99.9995% quantile of the anticipated
+			// distribution of the sample mean. Thus, the test falsely rejects with
+			// a probability of 10⁻⁵.
+			tolerance := 4.41717 * math.Sqrt(s.numNodes*nodeVariance/float64(numberOfSamples))
+			if mean := stat.Mean(s.samples); math.Abs(mean-s.rawTotal) > tolerance {
+				t.Errorf("got mean = %f, want %f (parameters %+v)", mean, s.rawTotal, tc.opt)
+			}
+			// The sample variance is much less noisy than the sample mean: a
+			// relative tolerance of 20% is very unlikely to be exceeded.
+			if variance := stat.Variance(s.samples); math.Abs(variance-s.numNodes*nodeVariance) > 0.2*s.numNodes*nodeVariance {
+				t.Errorf("got variance = %f, want %f (parameters %+v)", variance, s.numNodes*nodeVariance, tc.opt)
+			}
+		}
+	}
+}
@@ -82,6 +82,23 @@ type BoundedMeanFloat64Options struct {
 	// Lower and Upper bounds for clamping. Default to 0; must be such that Lower < Upper.
 	Lower, Upper                 float64
 	Noise                        noise.Noise // Type of noise used in BoundedMean. Defaults to Laplace noise.
+	// Fraction of the privacy budget used for the count, the rest being used for
+	// the normalized sum. Must be strictly between 0 and 1. Defaults to 0.5,
+	// which minimizes the bound on the variance of the mean over all possible
+	// means, with both Laplace and Gaussian noise (see
+	// defaultCountBudgetFraction).
+	//
+	// The noise of the count affects the result proportionally to the distance
+	// between the mean and the midpoint of [Lower, Upper], whereas the noise of
+	// the normalized sum does not depend on it. If the mean is expected to be
+	// close to the midpoint, a smaller fraction typically yields a more accurate
+	// result: set ExpectedMean instead to use the best fraction for it.
+	CountBudgetFraction float64
+	// An estimate of the mean, which doesn't need to be differentially private
+	// but must not depend on the private data. If set, CountBudgetFraction is
+	// derived from it (see CountBudgetFractionForExpectedMean), and must not be
+	// set.
+	ExpectedMean *float64
 }
 
 // NewBoundedMeanFloat64 returns a new BoundedMeanFloat64.
@@ -120,15 +137,41 @@ func NewBoundedMeanFloat64(opt *BoundedMeanFloat64Options) *BoundedMeanFloat64 {
 	midPoint := lower + (upper-lower)/2.0
 	maxDistFromMidpoint := math.Abs(upper - midPoint)
 
-	eps, del := opt.Epsilon, opt.Delta
-	// We split the budget in half to calculate the count and the noised normalized sum
-	// TODO: this can be optimized for the Gaussian noise
-	halfEpsilon := eps / 2
-	halfDelta := del / 2
+	countBudgetFraction := opt.CountBudgetFraction
+	if opt.ExpectedMean != nil {
+		if countBudgetFraction != 0 {
+			// TODO: do not exit the program from within library code
+			log.Fatalf("NewBoundedMeanFloat64: CountBudgetFraction (%f) and ExpectedMean (%f) cannot both be set", countBudgetFraction, *opt.ExpectedMean)
+		}
+		var err error
+		countBudgetFraction, err = CountBudgetFractionForExpectedMean(n, lower, upper, *opt.ExpectedMean)
+		if err != nil {
+			// TODO: do not exit the program from within library code
+			log.Fatalf("CountBudgetFractionForExpectedMean failed with %v", err)
+		}
+	}
+	if countBudgetFraction == 0 {
+		countBudgetFraction = defaultCountBudgetFraction
+	}
+	if err := checks.CheckBudgetFraction("NewBoundedMeanFloat64", "CountBudgetFraction", countBudgetFraction); err != nil {
+		// TODO: do not exit the program from within library code
+		log.Fatalf("CheckBudgetFraction failed with %v", err)
+	}
 
+	eps, del := opt.Epsilon, opt.Delta
 	// Check that the parameters are compatible with the noise chosen by calling
 	// the noise on some dummy value.
-	n.AddNoiseFloat64(0, 1, 1, halfEpsilon, halfDelta)
+	n.AddNoiseFloat64(0, 1, 1, eps*countBudgetFraction, del*countBudgetFraction)
+
+	// Split the budget between the count and the noised normalized sum.
+	var countEpsilon, countDelta, sumEpsilon, sumDelta float64
+	if n == noise.Gaussian() {
+		countEpsilon, sumEpsilon = splitGaussianBudgetForMean(maxPartitionsContributed, maxContributionsPerPartition, maxDistFromMidpoint, eps, del, countBudgetFraction)
+		countDelta, sumDelta = del, del
+	} else {
+		countEpsilon, sumEpsilon = eps*countBudgetFraction, eps*(1-countBudgetFraction)
+		countDelta, sumDelta = del*countBudgetFraction, del*(1-countBudgetFraction)
+	}
 
 	// normalizedSum yields a differentially private sum of the position of the entries e_i relative
 	// to the midpoint m = (lower + upper) / 2 of the range of the bounded mean, i.e., Σ_i (e_i - m)
@@ -144,16 +187,16 @@ func NewBoundedMeanFloat64(opt *BoundedMeanFloat64Options) *BoundedMeanFloat64 {
 	//
 	// the rest follows from the code.
 	count := NewCount(&CountOptions{
-		Epsilon:                      halfEpsilon,
-		Delta:                        halfDelta,
+		Epsilon:                      countEpsilon,
+		Delta:                        countDelta,
 		MaxPartitionsContributed:     maxPartitionsContributed,
 		Noise:                        n,
 		maxContributionsPerPartition: maxContributionsPerPartition,
 	})
 
 	normalizedSum := NewBoundedSumFloat64(&BoundedSumFloat64Options{
-		Epsilon:                      halfEpsilon,
-		Delta:                        halfDelta,
+		Epsilon:                      sumEpsilon,
+		Delta:                        sumDelta,
 		MaxPartitionsContributed:     maxPartitionsContributed,
 		Lower:                        -maxDistFromMidpoint,
 		Upper:                        maxDistFromMidpoint,
@@ -171,6 +214,98 @@ func NewBoundedMeanFloat64(opt *BoundedMeanFloat64Options) *BoundedMeanFloat64 {
 	}
 }
 
+// defaultCountBudgetFraction is the fraction of the budget used for the count
+// of a BoundedMeanFloat64 when CountBudgetFraction is not set.
+//
+// With a count c and a normalized sum s, whose noises have standard deviations
+// σ_count and σ_sum, the variance of the mean m + s/c is approximately
+//   (σ_sum² + (s/c)² * σ_count²) / c²
+// to the first order. Since |s/c| is at most the maximal distance D from the
+// midpoint, it is bounded by (σ_sum² + D² * σ_count²) / c². With a fraction f
+// of the budget used for the count:
+//   - With Gaussian noise, σ_count = σ / sqrt(f) and σ_sum = D * σ / sqrt(1-f)
+//     (see splitGaussianBudgetForMean), so the bound is proportional to
+//     1/f + 1/(1-f).
+//   - With Laplace noise, ε is split, so σ_count and σ_sum / D are inversely
+//     proportional to f and 1-f, and the bound is proportional to
+//     1/f² + 1/(1-f)².
+// In both cases, the bound is minimized by f = 0.5, whatever the sensitivities
+// and the budget. When the mean is expected to be closer to the midpoint, a
+// smaller fraction is better (see CountBudgetFractionForExpectedMean).
+const defaultCountBudgetFraction = 0.5
+
+// minCountBudgetFraction is the smallest fraction of the budget returned by
+// CountBudgetFractionForExpectedMean. The variance of the mean only depends on
+// the noise of the count through the distance from the mean to the midpoint
+// to the first order, which assumes that the noisy count stays close to the
+// count.
+const minCountBudgetFraction = 0.1
+
+// CountBudgetFractionForExpectedMean returns the CountBudgetFraction that
+// minimizes the variance of a BoundedMeanFloat64 with noise n (Laplace noise if
+// nil) and bounds [lower, upper], if its mean is expectedMean.
+//
+// With the notations of defaultCountBudgetFraction and d the distance from
+// expectedMean to the midpoint, the variance of the mean is approximately
+// proportional to (σ_sum² + d² * σ_count²) / c². It is minimized by f such
+// that f/(1-f) = d/D with Gaussian noise, and f/(1-f) = (d/D)^(2/3) with
+// Laplace noise. The returned fraction is 0.5, the default, when expectedMean
+// is one of the bounds, and at least minCountBudgetFraction = 0.1.
+//
+// expectedMean doesn't need to be differentially private, but must not depend
+// on the private data: e.g. it can come from a previous release or from public
+// knowledge. It is clamped to [lower, upper].
+func CountBudgetFractionForExpectedMean(n noise.Noise, lower, upper, expectedMean float64) (float64, error) {
+	if err := checks.CheckBoundsFloat64("CountBudgetFractionForExpectedMean", lower, upper); err != nil {
+		return 0, err
+	}
+	if math.IsNaN(expectedMean) {
+		return 0, fmt.Errorf("CountBudgetFractionForExpectedMean: expectedMean can't be NaN")
+	}
+	if lower == upper {
+		return defaultCountBudgetFraction, nil
+	}
+	midPoint := lower + (upper-lower)/2.0
+	maxDistFromMidpoint := math.Abs(upper - midPoint)
+	clamped := math.Min(math.Max(expectedMean, lower), upper)
+	ratio := math.Abs(clamped-midPoint) / maxDistFromMidpoint
+	if n != noise.Gaussian() {
+		ratio = math.Pow(ratio, 2.0/3.0)
+	}
+	return math.Max(ratio/(1+ratio), minCountBudgetFraction), nil
+}
+
+// splitGaussianBudgetForMean returns the budgets for the count and the normalized
+// sum of a BoundedMeanFloat64 with Gaussian noise.
+//
+// Splitting ε and δ between the two aggregations is wasteful for Gaussian noise:
+// the count and the normalized sum can instead be seen as a single Gaussian
+// mechanism whose squared L2 sensitivity is the sum of the squared L2
+// sensitivities of both aggregations, each one divided by the variance of its
+// noise. If σ is the standard deviation needed by the count on its own with the
+// entire (ε,δ) budget and D is the maximal distance from the midpoint, adding
+// noise with standard deviations
+//   σ_count = σ / sqrt(countBudgetFraction)
+//   σ_sum   = D * σ / sqrt(1 - countBudgetFraction)
+// to the count and the normalized sum is thus (ε,δ)-differentially private. For
+// countBudgetFraction = 0.5, this adds less noise than splitting ε and δ in half.
+//
+// Since Count and BoundedSumFloat64 are parametrized by ε and δ, the budgets
+// returned are the smallest ε (with the entire δ) that yield at least these
+// standard deviations.
+func splitGaussianBudgetForMean(l0Sensitivity, maxContributionsPerPartition int64, maxDistFromMidpoint, epsilon, delta, countBudgetFraction float64) (countEpsilon, sumEpsilon float64) {
+	countLInf := float64(maxContributionsPerPartition)
+	sumLInf := float64(maxContributionsPerPartition) * maxDistFromMidpoint
+	sigma := noise.SigmaForGaussian(l0Sensitivity, countLInf, epsilon, delta)
+	countEpsilon = noise.EpsilonForGaussian(sigma/math.Sqrt(countBudgetFraction), l0Sensitivity, countLInf, delta)
+	sumEpsilon = noise.EpsilonForGaussian(maxDistFromMidpoint*sigma/math.Sqrt(1-countBudgetFraction), l0Sensitivity, sumLInf, delta)
+	if countEpsilon == 0 || sumEpsilon == 0 {
+		// TODO: do not exit the program from within library code
+		log.Fatalf("NewBoundedMeanFloat64: CountBudgetFraction %f is too close to 0 or 1 for ε=%f and δ=%e", countBudgetFraction, epsilon, delta)
+	}
+	return countEpsilon, sumEpsilon
+}
+
 // Add an entry to a BoundedMeanFloat64. It skips NaN entries and doesn't count them in the final result
 // because introducing even a single NaN entry will result in a NaN mean
 // regardless of other entries, which would break the indistinguishability
@@ -104,6 +104,44 @@ func TestNewBoundedMeanFloat64(t *testing.T) {
 					resultReturned:  false,
 				},
 			}},
+		{"CountBudgetFraction is set",
+			&BoundedMeanFloat64Options{
+				Epsilon:                      1,
+				Delta:                        0,
+				Lower:                        -1,
+				Upper:                        5,
+				MaxContributionsPerPartition: 2,
+				MaxPartitionsContributed:     1,
+				CountBudgetFraction:          0.25,
+			},
+			&BoundedMeanFloat64{
+				lower:          -1,
+				upper:          5,
+				resultReturned: false,
+				midPoint:       2,
+				count: Count{
+					epsilon:         0.25,
+					delta:           0,
+					l0Sensitivity:   1,
+					lInfSensitivity: 2,
+					noiseKind:       noise.LaplaceNoise,
+					noise:           noise.Laplace(),
+					count:           0,
+					resultReturned:  false,
+				},
+				normalizedSum: BoundedSumFloat64{
+					epsilon:         0.75,
+					delta:           0,
+					l0Sensitivity:   1,
+					lInfSensitivity: 6,
+					lower:           -3,
+					upper:           3,
+					noiseKind:       noise.LaplaceNoise,
+					noise:           noise.Laplace(),
+					sum:             0,
+					resultReturned:  false,
+				},
+			}},
 	} {
 		got := NewBoundedMeanFloat64(tc.opt)
 		if !reflect.DeepEqual(got, tc.want) {
@@ -112,6 +150,176 @@ func TestNewBoundedMeanFloat64(t *testing.T) {
 	}
 }
 
+func TestNewBoundedMeanFloat64GaussianBudgetSplit(t *testing.T) {
+	for _, tc := range []struct {
+		desc                string
+		countBudgetFraction float64
+	}{
+		{"CountBudgetFraction is not set", 0},
+		{"small CountBudgetFraction", 0.1},
+		{"large CountBudgetFraction", 0.9},
+	} {
+		var l0, maxContributions int64 = 3, 2
+		eps, del := ln3, tenfive
+		bm := NewBoundedMeanFloat64(&BoundedMeanFloat64Options{
+			Epsilon:                      eps,
+			Delta:                        del,
+			MaxPartitionsContributed:     l0,
+			MaxContributionsPerPartition: maxContributions,
+			Lower:                        -1,
+			Upper:                        5,
+			Noise:                        noise.Gaussian(),
+			CountBudgetFraction:          tc.countBudgetFraction,
+		})
+		countLInf, sumLInf := float64(maxContributions), float64(maxContributions)*3
+		countSigma := noise.SigmaForGaussian(l0, countLInf, bm.count.epsilon, bm.count.delta)
+		sumSigma := noise.SigmaForGaussian(l0, sumLInf, bm.normalizedSum.epsilon, bm.normalizedSum.delta)
+		// The count and the normalized sum together form a single Gaussian mechanism,
+		// which must be (ε,δ)-DP.
+		sigma := noise.SigmaForGaussian(l0, countLInf, eps, del)
+		got := math.Pow(countLInf/countSigma, 2) + math.Pow(sumLInf/sumSigma, 2)
+		want := math.Pow(countLInf/sigma, 2)
+		if got > want {
+			t.Errorf("NewBoundedMeanFloat64: when %s got squared L2 sensitivity over variance %f, want at most %f", tc.desc, got, want)
+		}
+		// Splitting ε and δ evenly adds more noise to both aggregations than the
+		// default split.
+		if tc.countBudgetFraction == 0 {
+			if evenSplitSigma := noise.SigmaForGaussian(l0, countLInf, eps/2, del/2); countSigma >= evenSplitSigma {
+				t.Errorf("NewBoundedMeanFloat64: when %s got count sigma %f, want less than %f", tc.desc, countSigma, evenSplitSigma)
+			}
+			if evenSplitSigma := noise.SigmaForGaussian(l0, sumLInf, eps/2, del/2); sumSigma >= evenSplitSigma {
+				t.Errorf("NewBoundedMeanFloat64: when %s got normalized sum sigma %f, want less than %f", tc.desc, sumSigma, evenSplitSigma)
+			}
+		}
+	}
+}
+
+// Checks that the default CountBudgetFraction minimizes the bound on the
+// variance of the mean, σ_sum² + D² * σ_count², with Gaussian and Laplace
+// noise.
+func TestNewBoundedMeanFloat64DefaultCountBudgetFraction(t *testing.T) {
+	var l0, maxContributions int64 = 3, 2
+	lower, upper, maxDistFromMidpoint := -1.0, 5.0, 3.0
+	for _, tc := range []struct {
+		desc  string
+		noise noise.Noise
+		delta float64
+	}{
+		{"Gaussian noise", noise.Gaussian(), tenfive},
+		{"Laplace noise", noise.Laplace(), 0},
+	} {
+		varianceBound := func(countBudgetFraction float64) float64 {
+			bm := NewBoundedMeanFloat64(&BoundedMeanFloat64Options{
+				Epsilon:                      ln3,
+				Delta:                        tc.delta,
+				MaxPartitionsContributed:     l0,
+				MaxContributionsPerPartition: maxContributions,
+				Lower:                        lower,
+				Upper:                        upper,
+				Noise:                        tc.noise,
+				CountBudgetFraction:          countBudgetFraction,
+			})
+			countLInf, sumLInf := float64(maxContributions), float64(maxContributions)*maxDistFromMidpoint
+			countSigma, err := tc.noise.ComputeConfidenceIntervalFloat64(0, l0, countLInf, bm.count.epsilon, bm.count.delta, 0.5)
+			if err != nil {
+				t.Fatalf("With %s, ComputeConfidenceIntervalFloat64: got error %v", tc.desc, err)
+			}
+			sumSigma, err := tc.noise.ComputeConfidenceIntervalFloat64(0, l0, sumLInf, bm.normalizedSum.epsilon, bm.normalizedSum.delta, 0.5)
+			if err != nil {
+				t.Fatalf("With %s, ComputeConfidenceIntervalFloat64: got error %v", tc.desc, err)
+			}
+			// The half-width of a confidence interval is proportional to the
+			// standard deviation of the noise.
+			return math.Pow(sumSigma.UpperBound, 2) + math.Pow(maxDistFromMidpoint*countSigma.UpperBound, 2)
+		}
+		want := varianceBound(0)
+		for _, fraction := range []float64{0.1, 0.3, 0.45, 0.55, 0.7, 0.9} {
+			if got := varianceBound(fraction); got < want*(1-1e-9) {
+				t.Errorf("With %s, CountBudgetFraction %f: got variance bound %f, want at least the bound %f of the default fraction", tc.desc, fraction, got, want)
+			}
+		}
+	}
+}
+
+// Checks that the CountBudgetFraction derived from an expected mean minimizes
+// the variance of the mean at this expected mean, σ_sum² + d² * σ_count², with
+// Gaussian and Laplace noise.
+func TestNewBoundedMeanFloat64ExpectedMean(t *testing.T) {
+	var l0, maxContributions int64 = 3, 2
+	lower, upper, midPoint := -1.0, 5.0, 2.0
+	for _, tc := range []struct {
+		desc         string
+		noise        noise.Noise
+		delta        float64
+		expectedMean float64
+	}{
+		{"Gaussian noise", noise.Gaussian(), tenfive, 2.75},
+		{"Laplace noise", noise.Laplace(), 0, 2.75},
+		{"Gaussian noise with a mean below the midpoint", noise.Gaussian(), tenfive, 0.5},
+		{"Laplace noise with a mean below the midpoint", noise.Laplace(), 0, 0.5},
+	} {
+		d := math.Abs(tc.expectedMean - midPoint)
+		variance := func(opt *BoundedMeanFloat64Options) float64 {
+			opt.Epsilon, opt.Delta, opt.Noise = ln3, tc.delta, tc.noise
+			opt.MaxPartitionsContributed, opt.MaxContributionsPerPartition = l0, maxContributions
+			opt.Lower, opt.Upper = lower, upper
+			bm := NewBoundedMeanFloat64(opt)
+			countLInf, sumLInf := float64(maxContributions), float64(maxContributions)*(upper-midPoint)
+			countSigma, err := tc.noise.ComputeConfidenceIntervalFloat64(0, l0, countLInf, bm.count.epsilon, bm.count.delta, 0.5)
+			if err != nil {
+				t.Fatalf("With %s, ComputeConfidenceIntervalFloat64: got error %v", tc.desc, err)
+			}
+			sumSigma, err := tc.noise.ComputeConfidenceIntervalFloat64(0, l0, sumLInf, bm.normalizedSum.epsilon, bm.normalizedSum.delta, 0.5)
+			if err != nil {
+				t.Fatalf("With %s, ComputeConfidenceIntervalFloat64: got error %v", tc.desc, err)
+			}
+			return math.Pow(sumSigma.UpperBound, 2) + math.Pow(d*countSigma.UpperBound, 2)
+		}
+		expectedMean := tc.expectedMean
+		want := variance(&BoundedMeanFloat64Options{ExpectedMean: &expectedMean})
+		for _, fraction := range []float64{0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.5, 0.7} {
+			if got := variance(&BoundedMeanFloat64Options{CountBudgetFraction: fraction}); got < want*(1-1e-3) {
+				t.Errorf("With %s, CountBudgetFraction %f: got variance %f, want at least the variance %f with ExpectedMean", tc.desc, fraction, got, want)
+			}
+		}
+		if defaultVariance := variance(&BoundedMeanFloat64Options{}); want >= defaultVariance {
+			t.Errorf("With %s, got variance %f with ExpectedMean, want less than the variance %f with the default CountBudgetFraction", tc.desc, want, defaultVariance)
+		}
+	}
+}
+
+func TestCountBudgetFractionForExpectedMean(t *testing.T) {
+	for _, tc := range []struct {
+		desc         string
+		noise        noise.Noise
+		expectedMean float64
+		want         float64
+	}{
+		{"Gaussian noise with a mean at a bound", noise.Gaussian(), 5, 0.5},
+		{"Laplace noise with a mean at a bound", noise.Laplace(), -1, 0.5},
+		{"mean out of the bounds", noise.Gaussian(), 10, 0.5},
+		{"Gaussian noise", noise.Gaussian(), 2.75, 0.2},
+		{"Laplace noise", noise.Laplace(), 2.75, math.Pow(0.25, 2.0/3.0) / (1 + math.Pow(0.25, 2.0/3.0))},
+		{"nil noise", nil, 2.75, math.Pow(0.25, 2.0/3.0) / (1 + math.Pow(0.25, 2.0/3.0))},
+		{"mean at the midpoint", noise.Gaussian(), 2, minCountBudgetFraction},
+	} {
+		got, err := CountBudgetFractionForExpectedMean(tc.noise, -1, 5, tc.expectedMean)
+		if err != nil {
+			t.Fatalf("With %s, got error %v", tc.desc, err)
+		}
+		if !ApproxEqual(got, tc.want) {
+			t.Errorf("With %s, got %f, want %f", tc.desc, got, tc.want)
+		}
+	}
+	if _, err := CountBudgetFractionForExpectedMean(noise.Laplace(), 5, -1, 0); err == nil {
+		t.Errorf("With invalid bounds, got no error, want error")
+	}
+	if _, err := CountBudgetFractionForExpectedMean(noise.Laplace(), -1, 5, math.NaN()); err == nil {
+		t.Errorf("With a NaN expectedMean, got no error, want error")
+	}
+}
+
 func TestBMNoInputFloat64(t *testing.T) {
 	bmf := getNoiselessBMF()
 	got := bmf.Result()
@@ -0,0 +1,246 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/google/differential-privacy/go/rand"
+)
+
+// PartitionSelectionStrategy specifies how a PartitionSelection decides
+// whether to keep a partition.
+type PartitionSelectionStrategy int
+
+const (
+	// PreAggPartitionSelection keeps a partition with the optimal probability
+	// described in PreAggSelectPartition's godoc comment. It is the default
+	// strategy.
+	PreAggPartitionSelection PartitionSelectionStrategy = iota
+	// LaplacePartitionSelection adds Laplace noise to the number of privacy
+	// units in a partition and keeps the partition if the noisy count is larger
+	// than or equal to a threshold.
+	LaplacePartitionSelection
+	// GaussianPartitionSelection adds Gaussian noise to the number of privacy
+	// units in a partition and keeps the partition if the noisy count is larger
+	// than or equal to a threshold.
+	GaussianPartitionSelection
+)
+
+func (strategy PartitionSelectionStrategy) String() string {
+	switch strategy {
+	case PreAggPartitionSelection:
+		return "PreAggPartitionSelection"
+	case LaplacePartitionSelection:
+		return "LaplacePartitionSelection"
+	case GaussianPartitionSelection:
+		return "GaussianPartitionSelection"
+	}
+	return fmt.Sprintf("PartitionSelectionStrategy(%d)", int(strategy))
+}
+
+// PartitionSelection is the common interface of partition selection strategies.
+// A PartitionSelection makes an (ε,δ)-differentially private decision of
+// whether to materialize a partition, given the number of privacy units
+// contributing to it. Unlike PreAggSelectPartition, it does not keep track of
+// this number: the caller is responsible for counting each privacy unit at most
+// once per partition.
+type PartitionSelection interface {
+	// ShouldKeep returns whether a partition containing idCount privacy units
+	// should be materialized. The result is randomized, so ShouldKeep must be
+	// called at most once per partition.
+	ShouldKeep(idCount int64) bool
+	// ProbabilityOfKeep returns the probability with which ShouldKeep
+	// materializes a partition containing idCount privacy units.
+	ProbabilityOfKeep(idCount int64) float64
+}
+
+// PartitionSelectionOptions is used to set the privacy parameters and the
+// strategy when constructing a PartitionSelection.
+type PartitionSelectionOptions struct {
+	// Strategy used for selecting partitions. Defaults to
+	// PreAggPartitionSelection.
+	Strategy PartitionSelectionStrategy
+	// Epsilon and Delta specify the (ε,δ)-differential privacy budget used for
+	// partition selection. Required.
+	Epsilon float64
+	Delta   float64
+	// MaxPartitionsContributed is the number of distinct partitions a single
+	// privacy unit can contribute to. Defaults to 1.
+	MaxPartitionsContributed int64
+}
+
+// NewPartitionSelection constructs a new PartitionSelection from opt.
+func NewPartitionSelection(opt *PartitionSelectionOptions) PartitionSelection {
+	l0Sensitivity := opt.MaxPartitionsContributed
+	if l0Sensitivity == 0 {
+		l0Sensitivity = 1
+	}
+	if err := checkArgsPartitionSelection("dpagg.NewPartitionSelection", opt.Strategy, opt.Epsilon, opt.Delta, l0Sensitivity); err != nil {
+		log.Fatalf("dpagg.NewPartitionSelection(%+v): checks failed with %v", *opt, err)
+	}
+	return newPartitionSelection(opt.Strategy, opt.Epsilon, opt.Delta, l0Sensitivity)
+}
+
+// newPartitionSelection constructs a new PartitionSelection without checking
+// its arguments.
+func newPartitionSelection(strategy PartitionSelectionStrategy, epsilon, delta float64, l0Sensitivity int64) PartitionSelection {
+	if strategy == PreAggPartitionSelection {
+		return preAggPartitionSelection{epsilon: epsilon, delta: delta, l0Sensitivity: l0Sensitivity}
+	}
+	return newThresholdingPartitionSelection(strategy, epsilon, delta, l0Sensitivity)
+}
+
+func checkPartitionSelectionStrategy(label string, strategy PartitionSelectionStrategy) error {
+	switch strategy {
+	case PreAggPartitionSelection, LaplacePartitionSelection, GaussianPartitionSelection:
+		return nil
+	}
+	return fmt.Errorf("%s: unknown partition selection strategy %v", label, strategy)
+}
+
+func checkArgsPartitionSelection(label string, strategy PartitionSelectionStrategy, epsilon, delta float64, l0Sensitivity int64) error {
+	if err := checkPartitionSelectionStrategy(label, strategy); err != nil {
+		return err
+	}
+	// ε=0 is theoretically acceptable, but in practice it's probably an error,
+	// so we do not accept it as argument.
+	if err := checks.CheckEpsilonStrict(label, epsilon); err != nil {
+		return err
+	}
+	if err := checks.CheckDeltaStrict(label, delta); err != nil {
+		return err
+	}
+	return checks.CheckL0Sensitivity(label, l0Sensitivity)
+}
+
+// preAggPartitionSelection implements PartitionSelection with the
+// PreAggPartitionSelection strategy.
+type preAggPartitionSelection struct {
+	epsilon       float64
+	delta         float64
+	l0Sensitivity int64
+}
+
+func (s preAggPartitionSelection) ShouldKeep(idCount int64) bool {
+	return rand.Uniform() < s.ProbabilityOfKeep(idCount)
+}
+
+func (s preAggPartitionSelection) ProbabilityOfKeep(idCount int64) float64 {
+	return keepPartitionProbability(idCount, s.l0Sensitivity, s.epsilon, s.delta)
+}
+
+// ThresholdingPartitionSelection implements PartitionSelection with the
+// LaplacePartitionSelection and GaussianPartitionSelection strategies. It adds
+// noise to the number of privacy units in a partition, with an L_∞ sensitivity
+// of 1, and keeps the partition if the noisy count is larger than or equal to
+// Threshold().
+//
+// With Laplace noise, the entire δ is used for thresholding. With Gaussian
+// noise, δ is split equally between the noise and the thresholding.
+//
+// Since the noisy count is itself differentially private, a noisy count of
+// privacy units that has already been computed with the same noise and privacy
+// parameters, e.g. by a Count with MaxPartitionsContributed l0Sensitivity and a
+// Delta of NoiseDelta(), can be thresholded with ShouldKeepNoisyCount without
+// consuming additional privacy budget.
+type ThresholdingPartitionSelection struct {
+	strategy       PartitionSelectionStrategy
+	noise          noise.Noise
+	epsilon        float64
+	noiseDelta     float64
+	thresholdDelta float64
+	l0Sensitivity  int64
+	threshold      float64
+}
+
+// NewThresholdingPartitionSelection constructs a new
+// ThresholdingPartitionSelection from opt. opt.Strategy must be either
+// LaplacePartitionSelection or GaussianPartitionSelection.
+func NewThresholdingPartitionSelection(opt *PartitionSelectionOptions) *ThresholdingPartitionSelection {
+	l0Sensitivity := opt.MaxPartitionsContributed
+	if l0Sensitivity == 0 {
+		l0Sensitivity = 1
+	}
+	if opt.Strategy == PreAggPartitionSelection {
+		log.Fatalf("dpagg.NewThresholdingPartitionSelection(%+v): strategy must be LaplacePartitionSelection or GaussianPartitionSelection", *opt)
+	}
+	if err := checkArgsPartitionSelection("dpagg.NewThresholdingPartitionSelection", opt.Strategy, opt.Epsilon, opt.Delta, l0Sensitivity); err != nil {
+		log.Fatalf("dpagg.NewThresholdingPartitionSelection(%+v): checks failed with %v", *opt, err)
+	}
+	return newThresholdingPartitionSelection(opt.Strategy, opt.Epsilon, opt.Delta, l0Sensitivity)
+}
+
+func newThresholdingPartitionSelection(strategy PartitionSelectionStrategy, epsilon, delta float64, l0Sensitivity int64) *ThresholdingPartitionSelection {
+	s := &ThresholdingPartitionSelection{strategy: strategy, epsilon: epsilon, l0Sensitivity: l0Sensitivity}
+	if strategy == GaussianPartitionSelection {
+		s.noise, s.noiseDelta, s.thresholdDelta = noise.Gaussian(), delta/2, delta/2
+	} else {
+		s.noise, s.noiseDelta, s.thresholdDelta = noise.Laplace(), 0, delta
+	}
+	s.threshold = s.noise.Threshold(s.l0Sensitivity, 1, s.epsilon, s.noiseDelta, s.thresholdDelta)
+	return s
+}
+
+// Threshold returns the threshold that a noisy count of privacy units must
+// reach for its partition to be kept.
+func (s *ThresholdingPartitionSelection) Threshold() float64 {
+	return s.threshold
+}
+
+// NoiseDelta returns the δ used for adding noise to the count of privacy
+// units. The rest of the δ budget is used for thresholding.
+func (s *ThresholdingPartitionSelection) NoiseDelta() float64 {
+	return s.noiseDelta
+}
+
+// ShouldKeep returns whether a partition containing idCount privacy units
+// should be materialized.
+func (s *ThresholdingPartitionSelection) ShouldKeep(idCount int64) bool {
+	return s.ShouldKeepNoisyCount(s.noise.AddNoiseFloat64(float64(idCount), s.l0Sensitivity, 1, s.epsilon, s.noiseDelta))
+}
+
+// ShouldKeepNoisyCount returns whether the partition of a noisy count of
+// privacy units should be materialized. The noisy count must have been computed
+// with the same noise and privacy parameters as s.
+func (s *ThresholdingPartitionSelection) ShouldKeepNoisyCount(noisyIDCount float64) bool {
+	return noisyIDCount >= s.threshold
+}
+
+// ProbabilityOfKeep returns the probability with which ShouldKeep materializes
+// a partition containing idCount privacy units.
+func (s *ThresholdingPartitionSelection) ProbabilityOfKeep(idCount int64) float64 {
+	if idCount == 0 {
+		return 0
+	}
+	// The partition is dropped iff the noise is strictly smaller than
+	// threshold-idCount. Since the noise distribution is continuous, the
+	// probability of this event is the CDF at that point.
+	cdf, err := s.noise.CDF(s.threshold-float64(idCount), s.l0Sensitivity, 1, s.epsilon, s.noiseDelta)
+	if err != nil {
+		log.Fatalf("%v: CDF failed with %v", s, err)
+	}
+	return 1 - cdf
+}
+
+func (s *ThresholdingPartitionSelection) String() string {
+	return fmt.Sprintf("&ThresholdingPartitionSelection(strategy %v, epsilon %f, noiseDelta %e, thresholdDelta %e, l0Sensitivity %d, threshold %f)",
+		s.strategy, s.epsilon, s.noiseDelta, s.thresholdDelta, s.l0Sensitivity, s.threshold)
+}
@@ -0,0 +1,235 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/noise"
+)
+
+func TestNewPartitionSelection(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		strategy PartitionSelectionStrategy
+		want     PartitionSelection
+	}{
+		{"PreAgg", PreAggPartitionSelection,
+			preAggPartitionSelection{epsilon: ln3, delta: 1e-5, l0Sensitivity: 2}},
+		{"Laplace", LaplacePartitionSelection,
+			&ThresholdingPartitionSelection{
+				strategy:       LaplacePartitionSelection,
+				noise:          noise.Laplace(),
+				epsilon:        ln3,
+				noiseDelta:     0,
+				thresholdDelta: 1e-5,
+				l0Sensitivity:  2,
+				threshold:      noise.Laplace().Threshold(2, 1, ln3, 0, 1e-5),
+			}},
+		{"Gaussian", GaussianPartitionSelection,
+			&ThresholdingPartitionSelection{
+				strategy:       GaussianPartitionSelection,
+				noise:          noise.Gaussian(),
+				epsilon:        ln3,
+				noiseDelta:     5e-6,
+				thresholdDelta: 5e-6,
+				l0Sensitivity:  2,
+				threshold:      noise.Gaussian().Threshold(2, 1, ln3, 5e-6, 5e-6),
+			}},
+	} {
+		got := NewPartitionSelection(&PartitionSelectionOptions{
+			Strategy:                 tc.strategy,
+			Epsilon:                  ln3,
+			Delta:                    1e-5,
+			MaxPartitionsContributed: 2,
+		})
+		if got, ok := got.(*ThresholdingPartitionSelection); ok {
+			want := tc.want.(*ThresholdingPartitionSelection)
+			if *got != *want {
+				t.Errorf("NewPartitionSelection: when %s got %v, want %v", tc.desc, got, want)
+			}
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("NewPartitionSelection: when %s got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestPartitionSelectionProbabilityOfKeep(t *testing.T) {
+	for _, tc := range []struct {
+		desc                     string
+		strategy                 PartitionSelectionStrategy
+		maxPartitionsContributed int64
+		// The probability of keeping a partition with a single privacy unit,
+		// i.e. the per-partition δ used for thresholding.
+		wantOneIDProbability float64
+	}{
+		{"PreAgg", PreAggPartitionSelection, 1, 1e-5},
+		{"PreAgg with multiple partitions", PreAggPartitionSelection, 4, 1e-5 / 4},
+		{"Laplace", LaplacePartitionSelection, 1, 1e-5},
+		{"Laplace with multiple partitions", LaplacePartitionSelection, 4, 1 - math.Pow(1-1e-5, 0.25)},
+		{"Gaussian", GaussianPartitionSelection, 1, 5e-6},
+		{"Gaussian with multiple partitions", GaussianPartitionSelection, 4, 1 - math.Pow(1-5e-6, 0.25)},
+	} {
+		s := NewPartitionSelection(&PartitionSelectionOptions{
+			Strategy:                 tc.strategy,
+			Epsilon:                  ln3,
+			Delta:                    1e-5,
+			MaxPartitionsContributed: tc.maxPartitionsContributed,
+		})
+		if got := s.ProbabilityOfKeep(0); got != 0 {
+			t.Errorf("ProbabilityOfKeep(0): when %s got %f, want 0", tc.desc, got)
+		}
+		if got := s.ProbabilityOfKeep(1); math.Abs(got-tc.wantOneIDProbability) > 1e-6*tc.wantOneIDProbability {
+			t.Errorf("ProbabilityOfKeep(1): when %s got %e, want %e", tc.desc, got, tc.wantOneIDProbability)
+		}
+		// ProbabilityOfKeep is increasing and converges to 1.
+		previous := 0.0
+		for idCount := int64(1); idCount <= 1000; idCount++ {
+			got := s.ProbabilityOfKeep(idCount)
+			if got < previous {
+				t.Errorf("ProbabilityOfKeep(%d): when %s got %f, want at least ProbabilityOfKeep(%d)=%f", idCount, tc.desc, got, idCount-1, previous)
+			}
+			previous = got
+		}
+		if previous != 1 {
+			t.Errorf("ProbabilityOfKeep(1000): when %s got %f, want 1", tc.desc, previous)
+		}
+	}
+}
+
+func TestPartitionSelectionShouldKeep(t *testing.T) {
+	for _, strategy := range []PartitionSelectionStrategy{PreAggPartitionSelection, LaplacePartitionSelection, GaussianPartitionSelection} {
+		s := NewPartitionSelection(&PartitionSelectionOptions{
+			Strategy: strategy,
+			Epsilon:  ln3,
+			Delta:    1e-5,
+		})
+		// Find the number of privacy units for which partitions are kept with
+		// probability closest to 0.5.
+		idCount := int64(1)
+		for s.ProbabilityOfKeep(idCount) < 0.5 {
+			idCount++
+		}
+		if 0.5-s.ProbabilityOfKeep(idCount-1) < s.ProbabilityOfKeep(idCount)-0.5 {
+			idCount--
+		}
+		wantSelectionRate := s.ProbabilityOfKeep(idCount)
+		// This test is non-deterministic. The binomial distribution with
+		// parameters (100,000, p) where p is close to 0.5 yields a value within
+		// 100,000*p +/- 1,500 with probability at least 1 - 1e-11. Running this
+		// test has a 1e-11 flakiness rate, so we retry up to 2 times upon
+		// failure.
+		const numTrials, tolerance, retriesForFlakiness = 100_000, 0.015, 2
+		for testAttempt := 0; testAttempt <= retriesForFlakiness; testAttempt++ {
+			var selections int
+			for trial := 0; trial < numTrials; trial++ {
+				if s.ShouldKeep(idCount) {
+					selections++
+				}
+			}
+			gotSelectionRate := float64(selections) / float64(numTrials)
+			if math.Abs(wantSelectionRate-gotSelectionRate) <= tolerance {
+				break
+			}
+			if testAttempt == retriesForFlakiness {
+				t.Errorf("ShouldKeep(%d): with %v failed on attempt %d: wantSelectionRate: %v, gotSelectionRate: %v",
+					idCount, strategy, testAttempt, wantSelectionRate, gotSelectionRate)
+			}
+		}
+	}
+}
+
+func TestThresholdingPartitionSelectionShouldKeepNoisyCount(t *testing.T) {
+	s := NewThresholdingPartitionSelection(&PartitionSelectionOptions{
+		Strategy: LaplacePartitionSelection,
+		Epsilon:  ln3,
+		Delta:    1e-5,
+	})
+	threshold := s.Threshold()
+	for _, tc := range []struct {
+		noisyIDCount float64
+		want         bool
+	}{
+		{threshold - 1, false},
+		{math.Nextafter(threshold, math.Inf(-1)), false},
+		{threshold, true},
+		{threshold + 1, true},
+	} {
+		if got := s.ShouldKeepNoisyCount(tc.noisyIDCount); got != tc.want {
+			t.Errorf("ShouldKeepNoisyCount(%f) with threshold %f: got %t, want %t", tc.noisyIDCount, threshold, got, tc.want)
+		}
+	}
+}
+
+func TestThresholdingPartitionSelectionMatchesCountThreshold(t *testing.T) {
+	// Thresholding a Count of privacy units with the NoiseDelta of a
+	// ThresholdingPartitionSelection uses the same threshold as the partition
+	// selection itself.
+	for _, tc := range []struct {
+		strategy PartitionSelectionStrategy
+		noise    noise.Noise
+	}{
+		{LaplacePartitionSelection, noise.Laplace()},
+		{GaussianPartitionSelection, noise.Gaussian()},
+	} {
+		s := NewThresholdingPartitionSelection(&PartitionSelectionOptions{
+			Strategy:                 tc.strategy,
+			Epsilon:                  ln3,
+			Delta:                    1e-5,
+			MaxPartitionsContributed: 3,
+		})
+		want := tc.noise.Threshold(3, 1, ln3, s.NoiseDelta(), 1e-5-s.NoiseDelta())
+		if got := s.Threshold(); got != want {
+			t.Errorf("Threshold: with %v got %f, want %f", tc.strategy, got, want)
+		}
+	}
+}
+
+func TestPreAggSelectPartitionWithStrategy(t *testing.T) {
+	for _, strategy := range []PartitionSelectionStrategy{PreAggPartitionSelection, LaplacePartitionSelection, GaussianPartitionSelection} {
+		opt := &PreAggSelectPartitionOptions{
+			Epsilon:                  ln3,
+			Delta:                    1e-5,
+			MaxPartitionsContributed: 2,
+			Strategy:                 strategy,
+		}
+		selection := NewPartitionSelection(&PartitionSelectionOptions{
+			Strategy:                 strategy,
+			Epsilon:                  ln3,
+			Delta:                    1e-5,
+			MaxPartitionsContributed: 2,
+		})
+		hardThreshold := NewPreAggSelectPartition(opt).GetHardThreshold()
+		if got := selection.ProbabilityOfKeep(int64(hardThreshold)); got != 1 {
+			t.Errorf("GetHardThreshold: with %v got %d, for which the probability of keeping a partition is %f, want 1", strategy, hardThreshold, got)
+		}
+		if got := selection.ProbabilityOfKeep(int64(hardThreshold) - 1); got == 1 {
+			t.Errorf("GetHardThreshold: with %v got %d, but the probability of keeping a partition with %d privacy units is already 1", strategy, hardThreshold, hardThreshold-1)
+		}
+		// A partition with enough privacy units is always kept.
+		s := NewPreAggSelectPartition(opt)
+		for i := 0; i < hardThreshold; i++ {
+			s.Increment()
+		}
+		if !s.ShouldKeepPartition() {
+			t.Errorf("ShouldKeepPartition: with %v and %d privacy units got false, want true", strategy, hardThreshold)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/noise"
+)
+
+// The functions in this file help choosing privacy parameters that satisfy
+// accuracy requirements, by inverting the noise calibration and the partition
+// selection probability.
+
+// epsilonPlanningAccuracy approximates the relative accuracy up to which the
+// smallest ε satisfying an accuracy requirement is computed.
+const epsilonPlanningAccuracy = 1e-3
+
+// minPlanningEpsilon is the smallest ε considered when planning. It is the
+// smallest ε accepted by Laplace noise.
+var minPlanningEpsilon = math.Exp2(-50)
+
+// EpsilonForConfidenceInterval returns the smallest ε such that the confidence
+// interval at confidence level 1-alpha of a value with noise n added to it has
+// a half-width of at most halfWidth, given the L_0 and L_∞ sensitivities and δ
+// used to add the noise. For example, the half-width of the confidence interval
+// of a Count with MaxPartitionsContributed l0 and noise n is bounded by
+// halfWidth with ε=EpsilonForConfidenceInterval(n, l0, 1, δ, alpha, halfWidth).
+//
+// The result will be larger than the exact value by at most
+// epsilonPlanningAccuracy*ε, so that the half-width is guaranteed to be at most
+// halfWidth.
+func EpsilonForConfidenceInterval(n noise.Noise, l0Sensitivity int64, lInfSensitivity, delta, alpha, halfWidth float64) (float64, error) {
+	if err := checks.CheckAlpha("dpagg.EpsilonForConfidenceInterval", alpha); err != nil {
+		return 0, err
+	}
+	if halfWidth <= 0 || math.IsNaN(halfWidth) {
+		return 0, fmt.Errorf("dpagg.EpsilonForConfidenceInterval: halfWidth is %f, should be strictly positive", halfWidth)
+	}
+	return smallestEpsilon(func(epsilon float64) (bool, error) {
+		// The confidence interval is symmetric, so its half-width is the
+		// absolute value of the alpha/2 quantile of the noise.
+		z, err := n.InverseCDF(alpha/2, l0Sensitivity, lInfSensitivity, epsilon, delta)
+		if err != nil {
+			return false, err
+		}
+		return math.Abs(z) <= halfWidth, nil
+	})
+}
+
+// PrivacyUnitsForPartitionSelection returns the smallest number of privacy
+// units that a partition must contain to be kept by a PreAggSelectPartition
+// initialized with opt with probability at least keepProbability. With a
+// keepProbability of 1, this is the hard threshold of the partition selection
+// (see PreAggSelectPartition.GetHardThreshold).
+func PrivacyUnitsForPartitionSelection(opt *PreAggSelectPartitionOptions, keepProbability float64) (int64, error) {
+	l0Sensitivity := opt.MaxPartitionsContributed
+	if l0Sensitivity == 0 {
+		l0Sensitivity = 1
+	}
+	if err := checkArgsPartitionSelectionPlanning("dpagg.PrivacyUnitsForPartitionSelection", l0Sensitivity, opt.Delta, keepProbability); err != nil {
+		return 0, err
+	}
+	if err := checkArgsPartitionSelection("dpagg.PrivacyUnitsForPartitionSelection", opt.Strategy, opt.Epsilon, opt.Delta, l0Sensitivity); err != nil {
+		return 0, err
+	}
+	return smallestPrivacyUnits(newPartitionSelection(opt.Strategy, opt.Epsilon, opt.Delta, l0Sensitivity), keepProbability)
+}
+
+// smallestPrivacyUnits returns the smallest number of privacy units for which
+// selection keeps a partition with probability at least keepProbability, or an
+// error if it is larger than math.MaxInt64/2.
+func smallestPrivacyUnits(selection PartitionSelection, keepProbability float64) (int64, error) {
+	// The probability of keeping a partition is an increasing function with
+	// respect to the number of privacy units, and converges to 1. Doubling the
+	// upper bound stops before it overflows.
+	upperBound := int64(1)
+	for selection.ProbabilityOfKeep(upperBound) < keepProbability {
+		if upperBound > math.MaxInt64/2 {
+			return 0, fmt.Errorf("dpagg.PrivacyUnitsForPartitionSelection: partitions are kept with probability %f only with more than %d privacy units", keepProbability, upperBound)
+		}
+		upperBound *= 2
+	}
+	lowerBound := upperBound / 2
+	for upperBound-lowerBound > 1 {
+		middle := lowerBound + (upperBound-lowerBound)/2
+		if selection.ProbabilityOfKeep(middle) < keepProbability {
+			lowerBound = middle
+		} else {
+			upperBound = middle
+		}
+	}
+	return upperBound, nil
+}
+
+// EpsilonForPartitionSelection returns the smallest ε such that a
+// PreAggSelectPartition initialized with opt, with its Epsilon replaced by ε,
+// keeps a partition containing idCount privacy units with probability at least
+// keepProbability. opt.Epsilon is ignored.
+//
+// The result will be larger than the exact value by at most
+// epsilonPlanningAccuracy*ε, so that the partition is guaranteed to be kept
+// with probability at least keepProbability.
+func EpsilonForPartitionSelection(opt *PreAggSelectPartitionOptions, idCount int64, keepProbability float64) (float64, error) {
+	l0Sensitivity := opt.MaxPartitionsContributed
+	if l0Sensitivity == 0 {
+		l0Sensitivity = 1
+	}
+	if err := checkArgsPartitionSelectionPlanning("dpagg.EpsilonForPartitionSelection", l0Sensitivity, opt.Delta, keepProbability); err != nil {
+		return 0, err
+	}
+	if err := checkPartitionSelectionStrategy("dpagg.EpsilonForPartitionSelection", opt.Strategy); err != nil {
+		return 0, err
+	}
+	if idCount <= 0 {
+		return 0, fmt.Errorf("dpagg.EpsilonForPartitionSelection: idCount is %d, should be strictly positive", idCount)
+	}
+	return smallestEpsilon(func(epsilon float64) (bool, error) {
+		selection := newPartitionSelection(opt.Strategy, epsilon, opt.Delta, l0Sensitivity)
+		return selection.ProbabilityOfKeep(idCount) >= keepProbability, nil
+	})
+}
+
+func checkArgsPartitionSelectionPlanning(label string, l0Sensitivity int64, delta, keepProbability float64) error {
+	if err := checks.CheckL0Sensitivity(label, l0Sensitivity); err != nil {
+		return err
+	}
+	if err := checks.CheckDeltaStrict(label, delta); err != nil {
+		return err
+	}
+	if keepProbability <= 0 || keepProbability > 1 || math.IsNaN(keepProbability) {
+		return fmt.Errorf("%s: keepProbability is %f, should be in (0, 1]", label, keepProbability)
+	}
+	return nil
+}
+
+// smallestEpsilon returns the smallest ε > 0 for which satisfied(ε) is true,
+// assuming that satisfied is monotone with respect to ε. It uses binary search,
+// and returns a result larger than the exact value by at most
+// epsilonPlanningAccuracy*ε, or an ε close to minPlanningEpsilon if the
+// requirement is satisfied for all values of ε.
+func smallestEpsilon(satisfied func(epsilon float64) (bool, error)) (float64, error) {
+	// Find an upper and a lower bound of ε by doubling or halving a guess.
+	upperBound, lowerBound := 1.0, 0.5
+	ok, err := satisfied(upperBound)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		for {
+			if lowerBound < minPlanningEpsilon {
+				// The requirement is satisfied by any ε that can be used in practice.
+				return upperBound, nil
+			}
+			ok, err := satisfied(lowerBound)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				break
+			}
+			upperBound, lowerBound = lowerBound, lowerBound/2
+		}
+	} else {
+		for !ok {
+			lowerBound, upperBound = upperBound, upperBound*2
+			if math.IsInf(upperBound, 1) {
+				return 0, fmt.Errorf("no ε satisfies the requirement")
+			}
+			if ok, err = satisfied(upperBound); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for upperBound-lowerBound > epsilonPlanningAccuracy*lowerBound {
+		middle := lowerBound*0.5 + upperBound*0.5
+		ok, err := satisfied(middle)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			upperBound = middle
+		} else {
+			lowerBound = middle
+		}
+	}
+	return upperBound, nil
+}
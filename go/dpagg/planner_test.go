@@ -0,0 +1,211 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dpagg
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/noise"
+)
+
+func TestEpsilonForConfidenceInterval(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		noise           noise.Noise
+		l0Sensitivity   int64
+		lInfSensitivity float64
+		delta           float64
+		alpha           float64
+		halfWidth       float64
+	}{
+		{"Laplace count", noise.Laplace(), 5, 1, 0, 0.05, 10},
+		{"Laplace sum", noise.Laplace(), 1, 100, 0, 0.01, 5},
+		{"Laplace with a small ε", noise.Laplace(), 1, 1, 0, 0.05, 1e6},
+		{"Gaussian count", noise.Gaussian(), 5, 1, 1e-5, 0.05, 10},
+		{"Gaussian sum", noise.Gaussian(), 1, 100, 1e-10, 0.01, 5},
+	} {
+		eps, err := EpsilonForConfidenceInterval(tc.noise, tc.l0Sensitivity, tc.lInfSensitivity, tc.delta, tc.alpha, tc.halfWidth)
+		if err != nil {
+			t.Fatalf("EpsilonForConfidenceInterval: when %s got error %v", tc.desc, err)
+		}
+		// The confidence interval with the returned ε must be narrow enough, but
+		// not with a slightly smaller ε.
+		for _, e := range []struct {
+			epsilon   float64
+			wantWider bool
+		}{
+			{eps, false},
+			{eps * (1 - 2*epsilonPlanningAccuracy), true},
+		} {
+			confInt, err := tc.noise.ComputeConfidenceIntervalFloat64(0, tc.l0Sensitivity, tc.lInfSensitivity, e.epsilon, tc.delta, tc.alpha)
+			if err != nil {
+				t.Fatalf("ComputeConfidenceIntervalFloat64: when %s got error %v", tc.desc, err)
+			}
+			if gotWider := confInt.UpperBound > tc.halfWidth; gotWider != e.wantWider {
+				t.Errorf("EpsilonForConfidenceInterval: when %s got half-width %f with ε=%f, want wider than %f: %t",
+					tc.desc, confInt.UpperBound, e.epsilon, tc.halfWidth, e.wantWider)
+			}
+		}
+	}
+}
+
+func TestEpsilonForConfidenceIntervalLaplaceClosedForm(t *testing.T) {
+	// For Laplace noise, the half-width of the confidence interval is
+	// l0Sensitivity*lInfSensitivity*ln(1/alpha)/ε.
+	got, err := EpsilonForConfidenceInterval(noise.Laplace(), 5, 1, 0, 0.05, 10)
+	if err != nil {
+		t.Fatalf("EpsilonForConfidenceInterval: got error %v", err)
+	}
+	want := 5 * math.Log(20) / 10
+	if got < want || got > want*(1+epsilonPlanningAccuracy) {
+		t.Errorf("EpsilonForConfidenceInterval: got %f, want %f", got, want)
+	}
+}
+
+func TestEpsilonForConfidenceIntervalReturnsErrorForInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		noise     noise.Noise
+		delta     float64
+		alpha     float64
+		halfWidth float64
+	}{
+		{"Zero alpha", noise.Laplace(), 0, 0, 10},
+		{"Zero halfWidth", noise.Laplace(), 0, 0.05, 0},
+		{"Laplace with delta", noise.Laplace(), 1e-5, 0.05, 10},
+		{"Gaussian without delta", noise.Gaussian(), 0, 0.05, 10},
+	} {
+		if _, err := EpsilonForConfidenceInterval(tc.noise, 1, 1, tc.delta, tc.alpha, tc.halfWidth); err == nil {
+			t.Errorf("EpsilonForConfidenceInterval: when %s got no error, want error", tc.desc)
+		}
+	}
+}
+
+func TestPrivacyUnitsForPartitionSelection(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		opt             *PreAggSelectPartitionOptions
+		keepProbability float64
+	}{
+		{"Median", &PreAggSelectPartitionOptions{Epsilon: ln3, Delta: 1e-5}, 0.5},
+		{"High probability", &PreAggSelectPartitionOptions{Epsilon: ln3, Delta: 1e-5, MaxPartitionsContributed: 4}, 0.99},
+		{"Low probability", &PreAggSelectPartitionOptions{Epsilon: 0.1, Delta: 1e-10, MaxPartitionsContributed: 2}, 1e-8},
+	} {
+		got, err := PrivacyUnitsForPartitionSelection(tc.opt, tc.keepProbability)
+		if err != nil {
+			t.Fatalf("PrivacyUnitsForPartitionSelection: when %s got error %v", tc.desc, err)
+		}
+		l0 := tc.opt.MaxPartitionsContributed
+		if l0 == 0 {
+			l0 = 1
+		}
+		if p := keepPartitionProbability(got, l0, tc.opt.Epsilon, tc.opt.Delta); p < tc.keepProbability {
+			t.Errorf("PrivacyUnitsForPartitionSelection: when %s got %d privacy units, which are kept with probability %f, want at least %f",
+				tc.desc, got, p, tc.keepProbability)
+		}
+		if p := keepPartitionProbability(got-1, l0, tc.opt.Epsilon, tc.opt.Delta); p >= tc.keepProbability {
+			t.Errorf("PrivacyUnitsForPartitionSelection: when %s got %d privacy units, but %d are kept with probability %f, want less than %f",
+				tc.desc, got, got-1, p, tc.keepProbability)
+		}
+	}
+}
+
+func TestPrivacyUnitsForPartitionSelectionIsHardThresholdForProbability1(t *testing.T) {
+	opt := &PreAggSelectPartitionOptions{Epsilon: ln3, Delta: 1e-5, MaxPartitionsContributed: 3}
+	got, err := PrivacyUnitsForPartitionSelection(opt, 1)
+	if err != nil {
+		t.Fatalf("PrivacyUnitsForPartitionSelection: got error %v", err)
+	}
+	if want := NewPreAggSelectPartition(opt).GetHardThreshold(); got != int64(want) {
+		t.Errorf("PrivacyUnitsForPartitionSelection: got %d, want %d", got, want)
+	}
+}
+
+func TestEpsilonForPartitionSelection(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		opt             *PreAggSelectPartitionOptions
+		idCount         int64
+		keepProbability float64
+	}{
+		{"Median", &PreAggSelectPartitionOptions{Delta: 1e-5}, 20, 0.5},
+		{"High probability", &PreAggSelectPartitionOptions{Delta: 1e-10, MaxPartitionsContributed: 5}, 100, 0.99},
+		{"Certainty", &PreAggSelectPartitionOptions{Delta: 1e-5}, 50, 1},
+		{"Laplace thresholding", &PreAggSelectPartitionOptions{Delta: 1e-5, Strategy: LaplacePartitionSelection}, 20, 0.5},
+		{"Gaussian thresholding", &PreAggSelectPartitionOptions{Delta: 1e-5, MaxPartitionsContributed: 3, Strategy: GaussianPartitionSelection}, 100, 0.99},
+	} {
+		eps, err := EpsilonForPartitionSelection(tc.opt, tc.idCount, tc.keepProbability)
+		if err != nil {
+			t.Fatalf("EpsilonForPartitionSelection: when %s got error %v", tc.desc, err)
+		}
+		l0 := tc.opt.MaxPartitionsContributed
+		if l0 == 0 {
+			l0 = 1
+		}
+		if p := newPartitionSelection(tc.opt.Strategy, eps, tc.opt.Delta, l0).ProbabilityOfKeep(tc.idCount); p < tc.keepProbability {
+			t.Errorf("EpsilonForPartitionSelection: when %s got ε=%f, for which the partition is kept with probability %f, want at least %f",
+				tc.desc, eps, p, tc.keepProbability)
+		}
+		smallerEps := eps * (1 - 2*epsilonPlanningAccuracy)
+		if p := newPartitionSelection(tc.opt.Strategy, smallerEps, tc.opt.Delta, l0).ProbabilityOfKeep(tc.idCount); p >= tc.keepProbability {
+			t.Errorf("EpsilonForPartitionSelection: when %s got ε=%f, but the partition is kept with probability %f for ε=%f, want less than %f",
+				tc.desc, eps, p, smallerEps, tc.keepProbability)
+		}
+	}
+}
+
+// neverKeepPartitionSelection is a PartitionSelection that never keeps a
+// partition.
+type neverKeepPartitionSelection struct{}
+
+func (neverKeepPartitionSelection) ShouldKeep(int64) bool           { return false }
+func (neverKeepPartitionSelection) ProbabilityOfKeep(int64) float64 { return 0 }
+
+// Checks that smallestPrivacyUnits returns an error instead of overflowing when
+// no int64 number of privacy units is large enough.
+func TestSmallestPrivacyUnitsOverflow(t *testing.T) {
+	if got, err := smallestPrivacyUnits(neverKeepPartitionSelection{}, 0.5); err == nil {
+		t.Errorf("smallestPrivacyUnits: got %d privacy units, want error", got)
+	}
+}
+
+func TestPartitionSelectionPlanningReturnsErrorForInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		idCount         int64
+		delta           float64
+		keepProbability float64
+	}{
+		{"Zero delta", 10, 0, 0.5},
+		{"Zero keepProbability", 10, 1e-5, 0},
+		{"keepProbability larger than 1", 10, 1e-5, 1.5},
+	} {
+		if _, err := PrivacyUnitsForPartitionSelection(&PreAggSelectPartitionOptions{Epsilon: 1, Delta: tc.delta}, tc.keepProbability); err == nil {
+			t.Errorf("PrivacyUnitsForPartitionSelection: when %s got no error, want error", tc.desc)
+		}
+		if _, err := EpsilonForPartitionSelection(&PreAggSelectPartitionOptions{Delta: tc.delta}, tc.idCount, tc.keepProbability); err == nil {
+			t.Errorf("EpsilonForPartitionSelection: when %s got no error, want error", tc.desc)
+		}
+	}
+	if _, err := EpsilonForPartitionSelection(&PreAggSelectPartitionOptions{Delta: 1e-5}, 0, 0.5); err == nil {
+		t.Errorf("EpsilonForPartitionSelection: when idCount is 0 got no error, want error")
+	}
+	if _, err := EpsilonForPartitionSelection(&PreAggSelectPartitionOptions{Delta: 1e-5, Strategy: PartitionSelectionStrategy(-1)}, 10, 0.5); err == nil {
+		t.Errorf("EpsilonForPartitionSelection: when the strategy is unknown got no error, want error")
+	}
+}
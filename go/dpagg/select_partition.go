@@ -23,7 +23,6 @@ import (
 
 	log "github.com/golang/glog"
 	"github.com/google/differential-privacy/go/checks"
-	"github.com/google/differential-privacy/go/rand"
 )
 
 // PreAggSelectPartition is used to compute an (ε,δ)-differentially private decision
@@ -68,11 +67,20 @@ import (
 // partition and then determining whether the partition should be
 // materialized. Use Increment() to increment the count of IDs and ShouldKeepPartition() to decide
 // if the partition should be materialized.
+//
+// The decision is made using the probability above by default. Other
+// partition selection strategies can be used by setting the Strategy option
+// (see PartitionSelectionStrategy).
 type PreAggSelectPartition struct {
 	// parameters
 	epsilon       float64
 	delta         float64
 	l0Sensitivity int64
+	strategy      PartitionSelectionStrategy
+	// selection implements strategy with the parameters above. It is built
+	// once, since building it can be costly (e.g. computing the threshold of
+	// thresholding strategies), and is not encoded.
+	selection PartitionSelection
 
 	// State variables
 	// idCount is the count of unique privacy IDs in the partition.
@@ -82,8 +90,8 @@ type PreAggSelectPartition struct {
 }
 
 func (s *PreAggSelectPartition) String() string {
-	return fmt.Sprintf("&PreAggSelectPartition(epsilon %f, delta %e, l0Sensitivity %d, resultReturned %t)",
-		s.epsilon, s.delta, s.l0Sensitivity, s.resultReturned)
+	return fmt.Sprintf("&PreAggSelectPartition(epsilon %f, delta %e, l0Sensitivity %d, strategy %v, resultReturned %t)",
+		s.epsilon, s.delta, s.l0Sensitivity, s.strategy, s.resultReturned)
 }
 
 // PreAggSelectPartitionOptions is used to set the privacy parameters when
@@ -96,6 +104,9 @@ type PreAggSelectPartitionOptions struct {
 	// MaxPartitionsContributed is the number of distinct partitions a single
 	// privacy unit can contribute to. Defaults to 1.
 	MaxPartitionsContributed int64
+	// Strategy used for deciding whether to keep a partition. Defaults to
+	// PreAggPartitionSelection.
+	Strategy PartitionSelectionStrategy
 }
 
 // NewPreAggSelectPartition constructs a new PreAggSelectPartition from opt.
@@ -104,6 +115,7 @@ func NewPreAggSelectPartition(opt *PreAggSelectPartitionOptions) *PreAggSelectPa
 		epsilon:       opt.Epsilon,
 		delta:         opt.Delta,
 		l0Sensitivity: opt.MaxPartitionsContributed,
+		strategy:      opt.Strategy,
 	}
 	// Override the 0-default, but do not override any explicitly set (i.e., negative) values
 	// for l0Sensitivity.
@@ -122,6 +134,10 @@ func NewPreAggSelectPartition(opt *PreAggSelectPartitionOptions) *PreAggSelectPa
 	if err := checks.CheckL0Sensitivity("dpagg.NewPreAggSelectPartition", s.l0Sensitivity); err != nil {
 		log.Fatalf("%s: CheckL0Sensitivity failed with %v", &s, err)
 	}
+	if err := checkArgsPartitionSelection("dpagg.NewPreAggSelectPartition", s.strategy, s.epsilon, s.delta, s.l0Sensitivity); err != nil {
+		log.Fatalf("%s: checkArgsPartitionSelection failed with %v", &s, err)
+	}
+	s.selection = newPartitionSelection(s.strategy, s.epsilon, s.delta, s.l0Sensitivity)
 	return &s
 }
 
@@ -159,6 +175,7 @@ func checkMergePreAggSelectPartition(s PreAggSelectPartition, s2 PreAggSelectPar
 	}
 
 	s.idCount, s2.idCount = 0, 0
+	s.selection, s2.selection = nil, nil
 	if !reflect.DeepEqual(s, s2) {
 		return fmt.Errorf("s and s2 are not compatible")
 	}
@@ -171,7 +188,16 @@ func (s *PreAggSelectPartition) ShouldKeepPartition() bool {
 		log.Exitf("This PreAggSelectPartition has already returned a ShouldKeepPartition. It can only be used once.")
 	}
 	s.resultReturned = true
-	return rand.Uniform() < keepPartitionProbability(s.idCount, s.l0Sensitivity, s.epsilon, s.delta)
+	return s.partitionSelection().ShouldKeep(s.idCount)
+}
+
+// partitionSelection returns the PartitionSelection implementing the strategy
+// of s. It is only built here if s was decoded.
+func (s *PreAggSelectPartition) partitionSelection() PartitionSelection {
+	if s.selection == nil {
+		s.selection = newPartitionSelection(s.strategy, s.epsilon, s.delta, s.l0Sensitivity)
+	}
+	return s.selection
 }
 
 // sumExpPowers returns the evaluation of
@@ -271,8 +297,9 @@ func keepPartitionProbability(idCount, l0Sensitivity int64, epsilon, delta float
 // This is the conceptual equivalent of the post-aggregation threshold of the
 // noise.Noise interface.
 func (s *PreAggSelectPartition) GetHardThreshold() int {
+	selection := s.partitionSelection()
 	for i := int64(1); ; i++ {
-		if keepPartitionProbability(i, s.l0Sensitivity, s.epsilon, s.delta) == 1 { // keepPartitionProbability converges to 1.
+		if selection.ProbabilityOfKeep(i) == 1 { // ProbabilityOfKeep converges to 1.
 			return int(i)
 		}
 	}
@@ -283,6 +310,7 @@ type encodablePreAggSelectPartition struct {
 	Epsilon        float64
 	Delta          float64
 	L0Sensitivity  int64
+	Strategy       PartitionSelectionStrategy
 	IDCount        int64
 	ResultReturned bool
 }
@@ -293,6 +321,7 @@ func (s *PreAggSelectPartition) GobEncode() ([]byte, error) {
 		Epsilon:        s.epsilon,
 		Delta:          s.delta,
 		L0Sensitivity:  s.l0Sensitivity,
+		Strategy:       s.strategy,
 		IDCount:        s.idCount,
 		ResultReturned: s.resultReturned,
 	}
@@ -308,6 +337,7 @@ func (s *PreAggSelectPartition) GobDecode(data []byte) error {
 		epsilon:        enc.Epsilon,
 		delta:          enc.Delta,
 		l0Sensitivity:  enc.L0Sensitivity,
+		strategy:       enc.Strategy,
 		idCount:        enc.IDCount,
 		resultReturned: enc.ResultReturned,
 	}
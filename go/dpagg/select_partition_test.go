@@ -38,6 +38,7 @@ func comparePreAggSelectPartitionSelection(s1, s2 *PreAggSelectPartition) bool {
 	return s1.epsilon == s2.epsilon &&
 		s1.delta == s2.delta &&
 		s1.l0Sensitivity == s2.l0Sensitivity &&
+		s1.strategy == s2.strategy &&
 		s1.idCount == s2.idCount &&
 		s1.resultReturned == s2.resultReturned
 }
@@ -57,6 +58,11 @@ func TestPreAggSelectPartitionSerialization(t *testing.T) {
 			Delta:                    1e-5,
 			MaxPartitionsContributed: 5,
 		}},
+		{"non-default strategy", &PreAggSelectPartitionOptions{
+			Epsilon:  ln3,
+			Delta:    1e-5,
+			Strategy: GaussianPartitionSelection,
+		}},
 	} {
 		s, sUnchanged := NewPreAggSelectPartition(tc.opts), NewPreAggSelectPartition(tc.opts)
 		bytes, err := encode(s)
@@ -78,6 +84,31 @@ func TestPreAggSelectPartitionSerialization(t *testing.T) {
 	}
 }
 
+// Tests that the partition selection of a PreAggSelectPartition is built once,
+// and rebuilt after decoding.
+func TestPreAggSelectPartitionCachesSelection(t *testing.T) {
+	s := NewPreAggSelectPartition(&PreAggSelectPartitionOptions{Epsilon: ln3, Delta: 1e-5, Strategy: LaplacePartitionSelection})
+	selection, ok := s.selection.(*ThresholdingPartitionSelection)
+	if !ok {
+		t.Fatalf("NewPreAggSelectPartition: got selection %v, want a *ThresholdingPartitionSelection", s.selection)
+	}
+	if got := s.partitionSelection(); got != selection {
+		t.Errorf("partitionSelection: got %v, want the selection built by NewPreAggSelectPartition %v", got, selection)
+	}
+	bytes, err := encode(s)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	decoded := new(PreAggSelectPartition)
+	if err := decode(decoded, bytes); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	got, ok := decoded.partitionSelection().(*ThresholdingPartitionSelection)
+	if !ok || got.Threshold() != selection.Threshold() {
+		t.Errorf("partitionSelection after decoding: got %v, want %v", decoded.selection, selection)
+	}
+}
+
 func TestPreAggSelectPartitionKeepPartitionProbability(t *testing.T) {
 	for _, tc := range []struct {
 		name          string
@@ -362,6 +393,7 @@ func TestMergePreAggSelectPartition(t *testing.T) {
 		epsilon:        0.1,
 		delta:          0.2,
 		l0Sensitivity:  1,
+		selection:      preAggPartitionSelection{epsilon: 0.1, delta: 0.2, l0Sensitivity: 1},
 		idCount:        8,
 		resultReturned: false,
 	}
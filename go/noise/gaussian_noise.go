@@ -44,6 +44,9 @@ var (
 	// gaussianSigmaAccuracy approximates the accuracy up to which the smallest sigma that
 	// satisfies the given DP parameters.
 	gaussianSigmaAccuracy = 1e-3
+	// gaussianEpsilonAccuracy approximates the accuracy up to which the smallest epsilon
+	// that is satisfied by a given sigma is calculated.
+	gaussianEpsilonAccuracy = 1e-3
 )
 
 type gaussian struct{}
@@ -147,6 +150,44 @@ func (gaussian) ComputeConfidenceIntervalFloat64(noisedX float64, l0Sensitivity
 	return computeConfidenceIntervalGaussian(noisedX, sigma, alpha), nil
 }
 
+// StdDev returns the standard deviation of the Gaussian noise added with the specified parameters.
+func (gaussian) StdDev(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsGaussian("StdDev (Gaussian)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	return SigmaForGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta), nil
+}
+
+// Variance returns the variance of the Gaussian noise added with the specified parameters.
+func (gaussian) Variance(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsGaussian("Variance (Gaussian)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	sigma := SigmaForGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta)
+	return sigma * sigma, nil
+}
+
+// CDF returns the probability that the Gaussian noise added with the specified parameters
+// is smaller than or equal to x.
+func (gaussian) CDF(x float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsGaussian("CDF (Gaussian)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	return cdfGaussian(SigmaForGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta), x), nil
+}
+
+// InverseCDF returns the quantile z such that the Gaussian noise added with the specified
+// parameters is smaller than or equal to z with probability p.
+func (gaussian) InverseCDF(p float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsGaussian("InverseCDF (Gaussian)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	if err := checkProbability("InverseCDF (Gaussian)", p); err != nil {
+		return 0, err
+	}
+	return inverseCDFGaussian(SigmaForGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta), p), nil
+}
+
 func checkArgsGaussian(label string, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) error {
 	if err := checks.CheckL0Sensitivity(label, l0Sensitivity); err != nil {
 		return err
@@ -189,6 +230,12 @@ func computeConfidenceIntervalGaussian(noisedX, sigma, alpha float64) Confidence
 	return ConfidenceInterval{LowerBound: FloatLowerBound, UpperBound: FloatUpperBound}
 }
 
+// cdfGaussian computes the probability Pr[Y <= x] for a random variable Y that is Gaussian
+// distributed with the specified sigma and mean 0.
+func cdfGaussian(sigma, x float64) float64 {
+	return 0.5 * math.Erfc(-x/(sigma*math.Sqrt2))
+}
+
 // inverseCDFGaussian computes the quantile z satisfying Pr[Y <= z] = p for a random variable Y that is Gaussian
 // distributed with the specified sigma and mean 0.
 func inverseCDFGaussian(sigma, p float64) float64 {
@@ -339,3 +386,41 @@ func SigmaForGaussian(l0Sensitivity int64, lInfSensitivity, epsilon, delta float
 
 	return upperBound
 }
+
+// EpsilonForGaussian calculates the smallest ε such that Gaussian noise with
+// standard deviation σ achieves (ε,δ)-approximate differential privacy. It is
+// the inverse of SigmaForGaussian with respect to ε.
+//
+// EpsilonForGaussian uses binary search. The result ε will be smaller than the
+// exact value ε_tight by at most gaussianEpsilonAccuracy*ε_tight, so that the
+// standard deviation of Gaussian noise calibrated to (ε,δ) is at least σ. If σ
+// is large enough to achieve (0,δ)-approximate differential privacy, 0 is
+// returned.
+func EpsilonForGaussian(sigma float64, l0Sensitivity int64, lInfSensitivity, delta float64) float64 {
+	// deltaForGaussian(sigma, l0Sensitivity, lInfSensitivity, epsilon) is a
+	// decreasing function with respect to epsilon.
+	if deltaForGaussian(sigma, l0Sensitivity, lInfSensitivity, 0) <= delta {
+		return 0
+	}
+
+	// Increase upperBound until it is actually an upper bound of ε_tight.
+	upperBound := 1.0
+	var lowerBound float64
+	for deltaForGaussian(sigma, l0Sensitivity, lInfSensitivity, upperBound) > delta {
+		lowerBound = upperBound
+		upperBound = upperBound * 2
+	}
+
+	// At all times, lowerBound < ε_tight <= upperBound holds. Returning lowerBound
+	// thus guarantees that the result does not exceed ε_tight.
+	for upperBound-lowerBound > gaussianEpsilonAccuracy*upperBound {
+		middle := lowerBound*0.5 + upperBound*0.5
+		if deltaForGaussian(sigma, l0Sensitivity, lInfSensitivity, middle) > delta {
+			lowerBound = middle
+		} else {
+			upperBound = middle
+		}
+	}
+
+	return lowerBound
+}
@@ -351,6 +351,77 @@ func TestSigmaForGaussianWithDeltaOf1(t *testing.T) {
 	}
 }
 
+func TestEpsilonForGaussianInvertsDeltaForGaussian(t *testing.T) {
+	// For these tests, we specify the value of epsilon that we want to compute
+	// and use DeltaForGaussian to determine the corresponding delta for a fixed
+	// sigma. We then verify whether (given said delta) we can reconstruct
+	// epsilon within the desired tolerance, without exceeding it.
+	for _, tc := range []struct {
+		desc            string
+		sigma           float64
+		l0Sensitivity   int64
+		lInfSensitivity float64
+		epsilon         float64
+	}{
+		{
+			desc:            "sigma smaller than l2Sensitivity",
+			sigma:           0.3,
+			l0Sensitivity:   1,
+			lInfSensitivity: 0.5,
+			epsilon:         0.5,
+		},
+		{
+			desc:            "sigma larger than l2Sensitivity",
+			sigma:           15,
+			l0Sensitivity:   1,
+			lInfSensitivity: 10,
+			epsilon:         0.5,
+		},
+		{
+			desc:            "non-trivial l0Sensitivity",
+			sigma:           0.3,
+			l0Sensitivity:   5,
+			lInfSensitivity: 0.5,
+			epsilon:         0.5,
+		},
+		{
+			desc:            "large epsilon",
+			sigma:           1,
+			l0Sensitivity:   1,
+			lInfSensitivity: 1,
+			epsilon:         20,
+		},
+		{
+			desc:            "small epsilon",
+			sigma:           100,
+			l0Sensitivity:   1,
+			lInfSensitivity: 1,
+			epsilon:         0.001,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			deltaTight := deltaForGaussian(tc.sigma, tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon)
+			gotEpsilon := EpsilonForGaussian(tc.sigma, tc.l0Sensitivity, tc.lInfSensitivity, deltaTight)
+			if !((1-gaussianEpsilonAccuracy)*tc.epsilon <= gotEpsilon && gotEpsilon <= tc.epsilon) {
+				t.Errorf("Got epsilon: %f, want epsilon in [%f, %f]", gotEpsilon, (1-gaussianEpsilonAccuracy)*tc.epsilon, tc.epsilon)
+			}
+			// Noise calibrated to the returned epsilon must be at least as large as sigma.
+			if gotSigma := SigmaForGaussian(tc.l0Sensitivity, tc.lInfSensitivity, gotEpsilon, deltaTight); gotSigma < tc.sigma {
+				t.Errorf("Got sigma: %f for epsilon %f, want sigma >= %f", gotSigma, gotEpsilon, tc.sigma)
+			}
+		})
+	}
+}
+
+// This tests that EpsilonForGaussian returns 0 if sigma is large enough to
+// achieve (0,δ)-differential privacy.
+func TestEpsilonForGaussianWithEpsilonOf0(t *testing.T) {
+	delta := deltaForGaussian(0.5 /* σ */, 1 /* l0 */, 1 /* lInf */, 0 /* ε */)
+	if got := EpsilonForGaussian(1 /* σ */, 1 /* l0 */, 1 /* lInf */, delta); got != 0 {
+		t.Errorf("Got epsilon: %f, want epsilon: 0", got)
+	}
+}
+
 var thresholdGaussianTestCases = []struct {
 	desc            string
 	l0Sensitivity   int64
@@ -495,6 +566,102 @@ func TestInverseCDFGaussian(t *testing.T) {
 	}
 }
 
+func TestStdDevAndVarianceGaussian(t *testing.T) {
+	for _, tc := range []struct {
+		l0Sensitivity                   int64
+		lInfSensitivity, epsilon, delta float64
+	}{
+		{1, 1, 1, 1e-5},
+		{5, 2, ln3, 1e-10},
+	} {
+		want := SigmaForGaussian(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta)
+		stdDev, err := gauss.StdDev(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta)
+		if err != nil {
+			t.Fatalf("StdDev: got error %v", err)
+		}
+		if !approxEqual(stdDev, want) {
+			t.Errorf("StdDev(%d, %f, %f, %e)=%f, want %f", tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta, stdDev, want)
+		}
+		variance, err := gauss.Variance(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta)
+		if err != nil {
+			t.Fatalf("Variance: got error %v", err)
+		}
+		if !approxEqual(variance, want*want) {
+			t.Errorf("Variance(%d, %f, %f, %e)=%f, want %f", tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta, variance, want*want)
+		}
+	}
+}
+
+func TestCDFGaussian(t *testing.T) {
+	sigma := SigmaForGaussian(1, 1, 1, 1e-5)
+	for _, tc := range []struct {
+		desc string
+		x    float64
+		want float64
+	}{
+		{"Zero", 0, 0.5},
+		{"One sigma below the mean", -sigma, 0.15865525393145707},
+		{"Two sigmas above the mean", 2 * sigma, 0.9772498680518208},
+	} {
+		got, err := gauss.CDF(tc.x, 1, 1, 1, 1e-5)
+		if err != nil {
+			t.Fatalf("CDF: got error %v", err)
+		}
+		if !approxEqual(got, tc.want) {
+			t.Errorf("CDF: when %s got %f, want %f", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestInverseCDFInvertsCDFGaussian(t *testing.T) {
+	for _, p := range []float64{1e-10, 0.05, 0.5, 0.7875404240919761168041, 0.999} {
+		z, err := gauss.InverseCDF(p, 2, 3, ln3, 1e-5)
+		if err != nil {
+			t.Fatalf("InverseCDF: got error %v", err)
+		}
+		got, err := gauss.CDF(z, 2, 3, ln3, 1e-5)
+		if err != nil {
+			t.Fatalf("CDF: got error %v", err)
+		}
+		if !approxEqual(got, p) {
+			t.Errorf("CDF(InverseCDF(%f))=%f, want %f", p, got, p)
+		}
+	}
+}
+
+func TestDistributionFunctionsGaussianReturnErrorForInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		l0Sensitivity   int64
+		lInfSensitivity float64
+		epsilon         float64
+		delta           float64
+	}{
+		{"Zero delta", 1, 1, 1, 0},
+		{"Negative epsilon", 1, 1, -1, 1e-5},
+		{"Zero l0Sensitivity", 0, 1, 1, 1e-5},
+		{"Negative lInfSensitivity", 1, -1, 1, 1e-5},
+	} {
+		if _, err := gauss.StdDev(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("StdDev: when %s got no error, want error", tc.desc)
+		}
+		if _, err := gauss.Variance(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("Variance: when %s got no error, want error", tc.desc)
+		}
+		if _, err := gauss.CDF(0, tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("CDF: when %s got no error, want error", tc.desc)
+		}
+		if _, err := gauss.InverseCDF(0.5, tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("InverseCDF: when %s got no error, want error", tc.desc)
+		}
+	}
+	for _, p := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := gauss.InverseCDF(p, 1, 1, 1, 1e-5); err == nil {
+			t.Errorf("InverseCDF: when p=%f got no error, want error", p)
+		}
+	}
+}
+
 func TestComputeConfidenceIntervalGaussian(t *testing.T) {
 	// Tests for ComputeConfidenceIntervalGaussian function.
 	for _, tc := range []struct {
@@ -191,6 +191,44 @@ func (laplace) ComputeConfidenceIntervalFloat64(noisedX float64, l0Sensitivity i
 	return computeConfidenceIntervalLaplace(noisedX, lambda, alpha), nil
 }
 
+// StdDev returns the standard deviation of the Laplace noise added with the specified parameters.
+func (laplace) StdDev(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsLaplace("StdDev (Laplace)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	return math.Sqrt2 * laplaceLambda(l0Sensitivity, lInfSensitivity, epsilon), nil
+}
+
+// Variance returns the variance of the Laplace noise added with the specified parameters.
+func (laplace) Variance(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsLaplace("Variance (Laplace)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	lambda := laplaceLambda(l0Sensitivity, lInfSensitivity, epsilon)
+	return 2 * lambda * lambda, nil
+}
+
+// CDF returns the probability that the Laplace noise added with the specified parameters
+// is smaller than or equal to x.
+func (laplace) CDF(x float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsLaplace("CDF (Laplace)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	return cdfLaplace(laplaceLambda(l0Sensitivity, lInfSensitivity, epsilon), x), nil
+}
+
+// InverseCDF returns the quantile z such that the Laplace noise added with the specified
+// parameters is smaller than or equal to z with probability p.
+func (laplace) InverseCDF(p float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error) {
+	if err := checkArgsLaplace("InverseCDF (Laplace)", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		return 0, err
+	}
+	if err := checkProbability("InverseCDF (Laplace)", p); err != nil {
+		return 0, err
+	}
+	return inverseCDFLaplace(laplaceLambda(l0Sensitivity, lInfSensitivity, epsilon), p), nil
+}
+
 func checkArgsLaplace(label string, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) error {
 	if err := checks.CheckL0Sensitivity(label, l0Sensitivity); err != nil {
 		return err
@@ -246,6 +284,15 @@ func computeConfidenceIntervalLaplace(noisedX float64, lambda, alpha float64) Co
 	return ConfidenceInterval{noisedX + Z, noisedX - Z}
 }
 
+// cdfLaplace computes the probability Pr[Y <= x] for a random variable Y that is Laplace
+// distributed with the specified lambda where mean is zero.
+func cdfLaplace(lambda, x float64) float64 {
+	if x < 0 {
+		return 0.5 * math.Exp(x/lambda)
+	}
+	return 1 - 0.5*math.Exp(-x/lambda)
+}
+
 // inverseCDFLaplace computes the quantile z satisfying Pr[Y <= z] = p for a random variable Y
 // that is Laplace distributed with the specified lambda where mean is zero.
 func inverseCDFLaplace(lambda, p float64) float64 {
@@ -225,6 +225,102 @@ func TestInverseCDFLaplace(t *testing.T) {
 	}
 }
 
+func TestStdDevAndVarianceLaplace(t *testing.T) {
+	for _, tc := range []struct {
+		l0Sensitivity                              int64
+		lInfSensitivity, epsilon, stdDev, variance float64
+	}{
+		{1, 1, 1, math.Sqrt2, 2},
+		{1, 1, ln3, math.Sqrt2 / ln3, 2 / (ln3 * ln3)},
+		{3, 2, ln3, 6 * math.Sqrt2 / ln3, 72 / (ln3 * ln3)},
+	} {
+		stdDev, err := lap.StdDev(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, 0)
+		if err != nil {
+			t.Fatalf("StdDev: got error %v", err)
+		}
+		if !approxEqual(stdDev, tc.stdDev) {
+			t.Errorf("StdDev(%d, %f, %f)=%f, want %f", tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, stdDev, tc.stdDev)
+		}
+		variance, err := lap.Variance(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, 0)
+		if err != nil {
+			t.Fatalf("Variance: got error %v", err)
+		}
+		if !approxEqual(variance, tc.variance) {
+			t.Errorf("Variance(%d, %f, %f)=%f, want %f", tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, variance, tc.variance)
+		}
+	}
+}
+
+func TestCDFLaplace(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		x, epsilon float64
+		want       float64
+	}{
+		{"Zero", 0, 1, 0.5},
+		{"Negative value", -2, 1, 0.5 * math.Exp(-2)},
+		{"Positive value", 2, 0.5, 1 - 0.5*math.Exp(-1)},
+	} {
+		got, err := lap.CDF(tc.x, 1, 1, tc.epsilon, 0)
+		if err != nil {
+			t.Fatalf("CDF: got error %v", err)
+		}
+		if !approxEqual(got, tc.want) {
+			t.Errorf("CDF: when %s got %f, want %f", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestInverseCDFInvertsCDFLaplace(t *testing.T) {
+	for _, p := range []float64{1e-10, 0.05, 0.5, 0.7875404240919761168041, 0.999} {
+		z, err := lap.InverseCDF(p, 2, 3, ln3, 0)
+		if err != nil {
+			t.Fatalf("InverseCDF: got error %v", err)
+		}
+		got, err := lap.CDF(z, 2, 3, ln3, 0)
+		if err != nil {
+			t.Fatalf("CDF: got error %v", err)
+		}
+		if !approxEqual(got, p) {
+			t.Errorf("CDF(InverseCDF(%f))=%f, want %f", p, got, p)
+		}
+	}
+}
+
+func TestDistributionFunctionsLaplaceReturnErrorForInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		p               float64
+		l0Sensitivity   int64
+		lInfSensitivity float64
+		epsilon         float64
+		delta           float64
+	}{
+		{"Non-zero delta", 0.5, 1, 1, 1, 1e-5},
+		{"Zero epsilon", 0.5, 1, 1, 0, 0},
+		{"Zero l0Sensitivity", 0.5, 0, 1, 1, 0},
+		{"Negative lInfSensitivity", 0.5, 1, -1, 1, 0},
+	} {
+		if _, err := lap.StdDev(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("StdDev: when %s got no error, want error", tc.desc)
+		}
+		if _, err := lap.Variance(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("Variance: when %s got no error, want error", tc.desc)
+		}
+		if _, err := lap.CDF(0, tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("CDF: when %s got no error, want error", tc.desc)
+		}
+		if _, err := lap.InverseCDF(tc.p, tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("InverseCDF: when %s got no error, want error", tc.desc)
+		}
+	}
+	for _, p := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, err := lap.InverseCDF(p, 1, 1, 1, 0); err == nil {
+			t.Errorf("InverseCDF: when p=%f got no error, want error", p)
+		}
+	}
+}
+
 func TestComputeConfidenceIntervalLaplace(t *testing.T) {
 	for _, tc := range []struct {
 		desc          string
@@ -18,9 +18,11 @@
 package noise
 
 import (
+	"fmt"
 	"math"
 
 	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
 )
 
 // Kind is an enum type. Its values are the supported noise distributions types
@@ -59,6 +61,60 @@ func ToKind(n Noise) Kind {
 	return GaussianNoise
 }
 
+// KindAdvice holds the noise kind recommended by AdviseKind, along with the
+// properties of the noise of that kind.
+type KindAdvice struct {
+	// The noise kind with the smallest standard deviation.
+	Kind Kind
+	// The standard deviation of the noise of kind Kind.
+	StdDev float64
+	// The smallest threshold to use in a differentially private histogram with
+	// added noise of kind Kind (see Noise.Threshold).
+	Threshold float64
+}
+
+// AdviseKind returns the kind of noise with the smallest standard deviation
+// given the L_0 and L_∞ sensitivities of the database and the privacy budget,
+// along with the standard deviation and the threshold of that noise.
+//
+// δ is the total budget of a thresholded histogram: with Laplace noise, all of
+// it is used for thresholding, whereas with Gaussian noise, it is split evenly
+// between the noise and thresholding. If δ is 0, Gaussian noise cannot be used,
+// so Laplace noise is returned with an infinite threshold. If both kinds of noise
+// have the same standard deviation, Laplace noise is returned.
+func AdviseKind(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (KindAdvice, error) {
+	if err := checkArgsAdviseKind("AdviseKind", l0Sensitivity, lInfSensitivity, epsilon, delta); err != nil {
+		err = fmt.Errorf("AdviseKind(l0sensitivity %d, lInfSensitivity %f, epsilon %f, delta %e) checks failed with %v",
+			l0Sensitivity, lInfSensitivity, epsilon, delta, err)
+		return KindAdvice{}, err
+	}
+	advice := KindAdvice{
+		Kind:      LaplaceNoise,
+		StdDev:    math.Sqrt2 * laplaceLambda(l0Sensitivity, lInfSensitivity, epsilon),
+		Threshold: Laplace().Threshold(l0Sensitivity, lInfSensitivity, epsilon, 0, delta),
+	}
+	if delta == 0 {
+		return advice, nil
+	}
+	if sigma := SigmaForGaussian(l0Sensitivity, lInfSensitivity, epsilon, delta/2); sigma < advice.StdDev {
+		advice = KindAdvice{
+			Kind:      GaussianNoise,
+			StdDev:    sigma,
+			Threshold: Gaussian().Threshold(l0Sensitivity, lInfSensitivity, epsilon, delta/2, delta/2),
+		}
+	}
+	return advice, nil
+}
+
+// checkArgsAdviseKind checks the parameters for AdviseKind, i.e. the parameters
+// for Laplace noise without δ, as well as the total δ.
+func checkArgsAdviseKind(label string, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) error {
+	if err := checkArgsLaplace(label, l0Sensitivity, lInfSensitivity, epsilon, 0); err != nil {
+		return err
+	}
+	return checks.CheckDelta(label, delta)
+}
+
 // ConfidenceInterval holds lower and upper bounds as float64 for the confidence interval.
 type ConfidenceInterval struct {
 	LowerBound, UpperBound float64
@@ -121,4 +177,31 @@ type Noise interface {
 	// ComputeConfidenceIntervalFloat64 computes a confidence interval that contains the raw value x from which float64
 	// noisedX is computed with a probability equal to 1 - alpha based on the specified noise parameters.
 	ComputeConfidenceIntervalFloat64(noisedX float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta, alpha float64) (ConfidenceInterval, error)
+
+	// The following functions describe the distribution of the noise added by AddNoiseFloat64
+	// with the specified parameters. Since the noise is sampled securely, its actual distribution
+	// is a discretization of that distribution, at a granularity much smaller than the standard
+	// deviation.
+
+	// StdDev returns the standard deviation of the noise added with the specified parameters.
+	StdDev(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error)
+
+	// Variance returns the variance of the noise added with the specified parameters.
+	Variance(l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error)
+
+	// CDF returns the probability that the noise added with the specified parameters is
+	// smaller than or equal to x.
+	CDF(x float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error)
+
+	// InverseCDF returns the quantile z such that the noise added with the specified parameters
+	// is smaller than or equal to z with probability p.
+	InverseCDF(p float64, l0Sensitivity int64, lInfSensitivity, epsilon, delta float64) (float64, error)
+}
+
+// checkProbability returns an error if the supplied probability is not between 0 and 1.
+func checkProbability(label string, p float64) error {
+	if p < 0 || p > 1 || math.IsNaN(p) {
+		return fmt.Errorf("%s: p is %f, should be between 0 and 1 (and cannot be NaN)", label, p)
+	}
+	return nil
 }
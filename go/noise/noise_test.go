@@ -50,3 +50,79 @@ func approxEqual(a, b float64) bool {
 	}
 	return math.Abs(a-b) <= 1e-6*maxMagnitude
 }
+
+func TestAdviseKind(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		l0Sensitivity   int64
+		lInfSensitivity float64
+		epsilon         float64
+		delta           float64
+		want            KindAdvice
+	}{
+		{
+			desc:            "delta is 0",
+			l0Sensitivity:   100,
+			lInfSensitivity: 1,
+			epsilon:         1,
+			delta:           0,
+			want: KindAdvice{
+				Kind:      LaplaceNoise,
+				StdDev:    math.Sqrt2 * 100,
+				Threshold: math.Inf(1),
+			},
+		},
+		{
+			desc:            "small l0Sensitivity",
+			l0Sensitivity:   1,
+			lInfSensitivity: 2,
+			epsilon:         1,
+			delta:           1e-5,
+			want: KindAdvice{
+				Kind:      LaplaceNoise,
+				StdDev:    math.Sqrt2 * 2,
+				Threshold: lap.Threshold(1, 2, 1, 0, 1e-5),
+			},
+		},
+		{
+			desc:            "large l0Sensitivity",
+			l0Sensitivity:   100,
+			lInfSensitivity: 2,
+			epsilon:         1,
+			delta:           1e-5,
+			want: KindAdvice{
+				Kind:      GaussianNoise,
+				StdDev:    SigmaForGaussian(100, 2, 1, 5e-6),
+				Threshold: gauss.Threshold(100, 2, 1, 5e-6, 5e-6),
+			},
+		},
+	} {
+		got, err := AdviseKind(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta)
+		if err != nil {
+			t.Fatalf("AdviseKind: when %s got error %v", tc.desc, err)
+		}
+		if got.Kind != tc.want.Kind || !approxEqual(got.StdDev, tc.want.StdDev) || !approxEqual(got.Threshold, tc.want.Threshold) {
+			t.Errorf("AdviseKind: when %s got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestAdviseKindReturnsErrorForInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		l0Sensitivity   int64
+		lInfSensitivity float64
+		epsilon         float64
+		delta           float64
+	}{
+		{"l0Sensitivity is 0", 0, 1, 1, 1e-5},
+		{"lInfSensitivity is 0", 1, 0, 1, 1e-5},
+		{"epsilon is 0", 1, 1, 0, 1e-5},
+		{"delta is negative", 1, 1, 1, -1},
+		{"delta is larger than 1", 1, 1, 1, 2},
+	} {
+		if _, err := AdviseKind(tc.l0Sensitivity, tc.lInfSensitivity, tc.epsilon, tc.delta); err == nil {
+			t.Errorf("AdviseKind: when %s got no error, want error", tc.desc)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package pbeam
 
 import (
 	"bytes"
+	"container/heap"
 	"fmt"
 	"math/rand"
 	"reflect"
@@ -29,7 +30,6 @@ import (
 	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
-	"github.com/apache/beam/sdks/go/pkg/beam/transforms/top"
 )
 
 // This file contains methods & ParDos used by multiple DP aggregations.
@@ -38,34 +38,20 @@ func init() {
 	beam.RegisterType(reflect.TypeOf((*boundedSumFloat64Fn)(nil)))
 	beam.RegisterType(reflect.TypeOf((*decodePairInt64Fn)(nil)))
 	beam.RegisterType(reflect.TypeOf((*decodePairFloat64Fn)(nil)))
-	beam.RegisterFunction(randBool)
+	beam.RegisterType(reflect.TypeOf((*reservoirSampleFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*groupPartitionValuesFn)(nil)))
+	beam.RegisterType(reflect.TypeOf(partitionValues{}))
 	beam.RegisterFunction(clampNegativePartitionsInt64Fn)
 	beam.RegisterFunction(clampNegativePartitionsFloat64Fn)
 	// TODO: add tests to make sure we don't forget anything here
 }
 
-// randBool returns a uniformly random boolean. The randomness used here is not
-// cryptographically secure, and using this with top.LargestPerKey doesn't
-// necessarily result in a uniformly random permutation: the distribution of
-// the permutation depends on the exact sorting algorithm used by Beam and the
-// order in which the input values are processed within the pipeline.
-//
-// The fact that the resulting permutation is not nesessarily uniformly random is
-// not a problem, since all we require from this function to satisfy DP properties
-// is that it doesn't depend on the data. More specifically, in order to satisfy DP
-// properties, a privacy unit's data should not influence another privacy unit's
-// permutation of contributions. We assume that the order Beam processes the
-// input values for a privacy unit is independent of other privacy units'
-// inputs, in which case this requirement is satisfied.
-func randBool(_, _ beam.V) bool {
-	return rand.Uint32()%2 == 0
-}
-
 // boundContributions takes a PCollection<K,V> as input, and for each key, selects and returns
-// at most contributionLimit records with this key. The selection is "mostly random":
-// the records returned are selected randomly, but the randomness isn't secure.
-// This is fine to use in the cross-partition bounding stage or in the per-partition bounding stage,
-// since the privacy guarantee doesn't depend on the privacy unit contributions being selected randomly.
+// at most contributionLimit records with this key. The records are selected uniformly at
+// random, using reservoir sampling: each record has the same probability of being selected.
+// The randomness used here isn't cryptographically secure. This is fine to use in the
+// cross-partition bounding stage or in the per-partition bounding stage, since the privacy
+// guarantee doesn't depend on the privacy unit contributions being selected randomly.
 //
 // In order to do the cross-partition contribution bounding we need:
 // 	1. the key to be the privacy ID.
@@ -78,12 +64,12 @@ func randBool(_, _ beam.V) bool {
 // 	(there could be multiple entries with the same key).
 func boundContributions(s beam.Scope, kvCol beam.PCollection, contributionLimit int64) beam.PCollection {
 	s = s.Scope("boundContributions")
+	_, valueT := beam.ValidateKVType(kvCol)
 	// Transform the PCollection<K,V> into a PCollection<K,[]V>, where
-	// there are at most contributionLimit elements per slice, chosen randomly. To
-	// do that, the easiest solution seems to be to use the LargestPerKey
-	// function (that returns the contributionLimit "largest" elements), except
-	// the function used to sort elements is random.
-	sampled := top.LargestPerKey(s, kvCol, int(contributionLimit), randBool)
+	// there are at most contributionLimit elements per slice, chosen uniformly
+	// at random. Only contributionLimit elements per key are kept in memory at
+	// any time, so keys with a very large number of elements are supported.
+	sampled := beam.CombinePerKey(s, newReservoirSampleFn(contributionLimit, valueT.Type()), kvCol)
 	// Flatten the values for each key to get back a PCollection<K,V>.
 	return beam.ParDo(s, flattenValuesFn, sampled)
 }
@@ -95,6 +81,103 @@ func flattenValuesFn(key beam.T, values []beam.V, emit func(beam.T, beam.V)) {
 	}
 }
 
+// sampledValue is an encoded value with the random priority it was assigned
+// during reservoir sampling.
+type sampledValue struct {
+	Priority float64
+	Value    []byte
+}
+
+// reservoir is a max-heap of sampled values, ordered by priority. It
+// implements heap.Interface.
+type reservoir []sampledValue
+
+func (r reservoir) Len() int            { return len(r) }
+func (r reservoir) Less(i, j int) bool  { return r[i].Priority > r[j].Priority }
+func (r reservoir) Swap(i, j int)       { r[i], r[j] = r[j], r[i] }
+func (r *reservoir) Push(x interface{}) { *r = append(*r, x.(sampledValue)) }
+func (r *reservoir) Pop() interface{} {
+	old := *r
+	n := len(old)
+	v := old[n-1]
+	*r = old[:n-1]
+	return v
+}
+
+type reservoirSampleAccum struct {
+	Sample reservoir
+}
+
+// reservoirSampleFn is a combineFn selecting Limit elements uniformly at
+// random among its inputs. Each input is assigned a uniformly random priority,
+// and the Limit elements with the lowest priorities are kept. Since priorities
+// are independent of the inputs, each subset of Limit elements is equally
+// likely to be selected, regardless of how inputs are split across
+// accumulators.
+type reservoirSampleFn struct {
+	Limit     int64
+	ValueType beam.EncodedType
+	valueEnc  beam.ElementEncoder
+	valueDec  beam.ElementDecoder
+}
+
+func newReservoirSampleFn(limit int64, t reflect.Type) *reservoirSampleFn {
+	return &reservoirSampleFn{Limit: limit, ValueType: beam.EncodedType{t}}
+}
+
+func (fn *reservoirSampleFn) Setup() {
+	fn.valueEnc = beam.NewElementEncoder(fn.ValueType.T)
+	fn.valueDec = beam.NewElementDecoder(fn.ValueType.T)
+}
+
+func (fn *reservoirSampleFn) CreateAccumulator() reservoirSampleAccum {
+	return reservoirSampleAccum{}
+}
+
+func (fn *reservoirSampleFn) AddInput(a reservoirSampleAccum, value beam.V) reservoirSampleAccum {
+	var valueBuf bytes.Buffer
+	if err := fn.valueEnc.Encode(value, &valueBuf); err != nil {
+		log.Exitf("pbeam.reservoirSampleFn.AddInput: couldn't encode value %v: %v", value, err)
+	}
+	fn.add(&a, sampledValue{Priority: rand.Float64(), Value: valueBuf.Bytes()})
+	return a
+}
+
+func (fn *reservoirSampleFn) MergeAccumulators(a, b reservoirSampleAccum) reservoirSampleAccum {
+	for _, v := range b.Sample {
+		fn.add(&a, v)
+	}
+	return a
+}
+
+func (fn *reservoirSampleFn) ExtractOutput(a reservoirSampleAccum) []beam.V {
+	values := make([]beam.V, 0, len(a.Sample))
+	for _, v := range a.Sample {
+		value, err := fn.valueDec.Decode(bytes.NewBuffer(v.Value))
+		if err != nil {
+			log.Exitf("pbeam.reservoirSampleFn.ExtractOutput: couldn't decode value: %v", err)
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// add inserts v in the sample of a if its priority is among the Limit lowest.
+func (fn *reservoirSampleFn) add(a *reservoirSampleAccum, v sampledValue) {
+	if int64(len(a.Sample)) < fn.Limit {
+		heap.Push(&a.Sample, v)
+		return
+	}
+	if fn.Limit > 0 && v.Priority < a.Sample[0].Priority {
+		a.Sample[0] = v
+		heap.Fix(&a.Sample, 0)
+	}
+}
+
+func (fn *reservoirSampleFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
 // vToInt64Fn converts the second element of a KV<K,int> pair to an int64.
 func vToInt64Fn(k beam.T, v int) (beam.T, int64) {
 	return k, int64(v)
@@ -194,17 +277,17 @@ func (fn *decodePairFloat64Fn) ProcessElement(pair pairFloat64) (beam.X, float64
 	return x, pair.M
 }
 
-func newBoundedSumFn(epsilon, delta float64, maxPartitionsContributed int64, lower, upper float64, noiseKind noise.Kind, vKind reflect.Kind, partitionsSpecified bool) interface{} {
+func newBoundedSumFn(epsilon, delta float64, maxPartitionsContributed int64, lower, upper float64, noiseKind noise.Kind, vKind reflect.Kind, partitionsSpecified bool, partitionSelectionStrategy dpagg.PartitionSelectionStrategy) interface{} {
 	var err error
 	var bsFn interface{}
 
 	switch vKind {
 	case reflect.Int64:
 		err = checks.CheckBoundsFloat64AsInt64("pbeam.newBoundedSumFn", lower, upper)
-		bsFn = newBoundedSumInt64Fn(epsilon, delta, maxPartitionsContributed, int64(lower), int64(upper), noiseKind, partitionsSpecified)
+		bsFn = newBoundedSumInt64Fn(epsilon, delta, maxPartitionsContributed, int64(lower), int64(upper), noiseKind, partitionsSpecified, partitionSelectionStrategy)
 	case reflect.Float64:
 		err = checks.CheckBoundsFloat64("pbeam.newBoundedSumFn", lower, upper)
-		bsFn = newBoundedSumFloat64Fn(epsilon, delta, maxPartitionsContributed, lower, upper, noiseKind, partitionsSpecified)
+		bsFn = newBoundedSumFloat64Fn(epsilon, delta, maxPartitionsContributed, lower, upper, noiseKind, partitionsSpecified, partitionSelectionStrategy)
 	default:
 		log.Exitf("pbeam.newBoundedSumFn: vKind(%v) should be int64 or float64", vKind)
 	}
@@ -225,26 +308,28 @@ type boundedSumAccumInt64 struct {
 // initialize it yourself, use newBoundedSumInt64Fn to create a boundedSumInt64Fn instance.
 type boundedSumInt64Fn struct {
 	// Privacy spec parameters (set during initial construction).
-	NoiseEpsilon              float64
-	PartitionSelectionEpsilon float64
-	NoiseDelta                float64
-	PartitionSelectionDelta   float64
-	MaxPartitionsContributed  int64
-	Lower                     int64
-	Upper                     int64
-	NoiseKind                 noise.Kind
-	noise                     noise.Noise // Set during Setup phase according to NoiseKind.
-	PartitionsSpecified       bool
+	NoiseEpsilon               float64
+	PartitionSelectionEpsilon  float64
+	NoiseDelta                 float64
+	PartitionSelectionDelta    float64
+	MaxPartitionsContributed   int64
+	Lower                      int64
+	Upper                      int64
+	NoiseKind                  noise.Kind
+	noise                      noise.Noise // Set during Setup phase according to NoiseKind.
+	PartitionsSpecified        bool
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
 }
 
 // newBoundedSumInt64Fn returns a boundedSumInt64Fn with the given budget and parameters.
-func newBoundedSumInt64Fn(epsilon, delta float64, maxPartitionsContributed, lower, upper int64, noiseKind noise.Kind, partitionsSpecified bool) *boundedSumInt64Fn {
+func newBoundedSumInt64Fn(epsilon, delta float64, maxPartitionsContributed, lower, upper int64, noiseKind noise.Kind, partitionsSpecified bool, partitionSelectionStrategy dpagg.PartitionSelectionStrategy) *boundedSumInt64Fn {
 	fn := &boundedSumInt64Fn{
-		MaxPartitionsContributed: maxPartitionsContributed,
-		Lower:                    lower,
-		Upper:                    upper,
-		NoiseKind:                noiseKind,
-		PartitionsSpecified:      partitionsSpecified,
+		MaxPartitionsContributed:   maxPartitionsContributed,
+		Lower:                      lower,
+		Upper:                      upper,
+		NoiseKind:                  noiseKind,
+		PartitionsSpecified:        partitionsSpecified,
+		PartitionSelectionStrategy: partitionSelectionStrategy,
 	}
 	if fn.PartitionsSpecified {
 		fn.NoiseEpsilon = epsilon
@@ -285,6 +370,7 @@ func (fn *boundedSumInt64Fn) CreateAccumulator() boundedSumAccumInt64 {
 			Epsilon:                  fn.PartitionSelectionEpsilon,
 			Delta:                    fn.PartitionSelectionDelta,
 			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+			Strategy:                 fn.PartitionSelectionStrategy,
 		})
 	}
 	return accum
@@ -337,18 +423,20 @@ type boundedSumFloat64Fn struct {
 	Upper                     float64
 	NoiseKind                 noise.Kind
 	// Noise, set during Setup phase according to NoiseKind.
-	noise               noise.Noise
-	PartitionsSpecified bool
+	noise                      noise.Noise
+	PartitionsSpecified        bool
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
 }
 
 // newBoundedSumFloat64Fn returns a boundedSumFloat64Fn with the given budget and parameters.
-func newBoundedSumFloat64Fn(epsilon, delta float64, maxPartitionsContributed int64, lower, upper float64, noiseKind noise.Kind, partitionsSpecified bool) *boundedSumFloat64Fn {
+func newBoundedSumFloat64Fn(epsilon, delta float64, maxPartitionsContributed int64, lower, upper float64, noiseKind noise.Kind, partitionsSpecified bool, partitionSelectionStrategy dpagg.PartitionSelectionStrategy) *boundedSumFloat64Fn {
 	fn := &boundedSumFloat64Fn{
-		MaxPartitionsContributed: maxPartitionsContributed,
-		Lower:                    lower,
-		Upper:                    upper,
-		NoiseKind:                noiseKind,
-		PartitionsSpecified:      partitionsSpecified,
+		MaxPartitionsContributed:   maxPartitionsContributed,
+		Lower:                      lower,
+		Upper:                      upper,
+		NoiseKind:                  noiseKind,
+		PartitionsSpecified:        partitionsSpecified,
+		PartitionSelectionStrategy: partitionSelectionStrategy,
 	}
 	if fn.PartitionsSpecified {
 		fn.NoiseEpsilon = epsilon
@@ -389,6 +477,7 @@ func (fn *boundedSumFloat64Fn) CreateAccumulator() boundedSumAccumFloat64 {
 			Epsilon:                  fn.PartitionSelectionEpsilon,
 			Delta:                    fn.PartitionSelectionDelta,
 			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+			Strategy:                 fn.PartitionSelectionStrategy,
 		})
 	}
 	return accum
@@ -529,8 +618,8 @@ func addDummyValuesToSpecifiedPartitionsFloat64Fn(partition beam.X) (k beam.X, v
 	return partition, 0
 }
 
-func addDummyValuesForMeanToSpecifiedPartitionsFloat64Fn(partition beam.X) (k beam.X, v []float64) {
-	return partition, []float64{}
+func addDummyValuesForMeanToSpecifiedPartitionsFloat64Fn(partition beam.X) (k beam.X, v boundedMeanPartialFloat64) {
+	return partition, boundedMeanPartialFloat64{}
 }
 
 // dropUnspecifiedPartitionsKVFn drops partitions not specified in partitionsCol from pcol. It can be used for aggregations on <K,V> pairs, e.g. sum and mean.
@@ -673,3 +762,38 @@ func (fn *emitPartitionsNotInTheDataFn) ProcessElement(partitionKey beam.X, valu
 		emit(partitionKey, value)
 	}
 }
+
+// partitionValues contains an encoded partition and the encoded values
+// contributed to this partition by a single privacy ID.
+type partitionValues struct {
+	Partition []byte
+	Values    [][]byte
+}
+
+// groupPartitionValuesFn takes a PCollection<kv.Pair{ID,K},[]V> as input, and
+// returns a PCollection<ID,partitionValues>, where ID is kept encoded.
+type groupPartitionValuesFn struct {
+	ValueType beam.EncodedType
+	valueEnc  beam.ElementEncoder
+}
+
+func newGroupPartitionValuesFn(valueType beam.EncodedType) *groupPartitionValuesFn {
+	return &groupPartitionValuesFn{ValueType: valueType}
+}
+
+func (fn *groupPartitionValuesFn) Setup() {
+	fn.valueEnc = beam.NewElementEncoder(fn.ValueType.T)
+}
+
+func (fn *groupPartitionValuesFn) ProcessElement(idAndPartition kv.Pair, valuesIter func(*beam.V) bool) ([]byte, partitionValues) {
+	pv := partitionValues{Partition: idAndPartition.V}
+	var v beam.V
+	for valuesIter(&v) {
+		var buf bytes.Buffer
+		if err := fn.valueEnc.Encode(v, &buf); err != nil {
+			log.Exitf("pbeam.groupPartitionValuesFn.ProcessElement: couldn't encode value %v: %v", v, err)
+		}
+		pv.Values = append(pv.Values, buf.Bytes())
+	}
+	return idAndPartition.K, pv
+}
@@ -20,6 +20,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/google/differential-privacy/go/dpagg"
 	"github.com/google/differential-privacy/go/noise"
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
@@ -87,7 +88,7 @@ func TestNewBoundedSumFn(t *testing.T) {
 				PartitionsSpecified:       false,
 			}},
 	} {
-		got := newBoundedSumFn(1, 1e-5, 17, 0, 10, tc.noiseKind, tc.vKind, false)
+		got := newBoundedSumFn(1, 1e-5, 17, 0, 10, tc.noiseKind, tc.vKind, false, dpagg.PreAggPartitionSelection)
 		if diff := cmp.Diff(tc.want, got, opts...); diff != "" {
 			t.Errorf("newBoundedSumFn mismatch for '%s' (-want +got):\n%s", tc.desc, diff)
 		}
@@ -102,7 +103,7 @@ func TestBoundedSumFloat64FnSetup(t *testing.T) {
 	}{
 		{"Laplace noise kind", noise.LaplaceNoise, noise.Laplace()},
 		{"Gaussian noise kind", noise.GaussianNoise, noise.Gaussian()}} {
-		got := newBoundedSumFloat64Fn(1, 1e-5, 17, 0, 10, tc.noiseKind, false)
+		got := newBoundedSumFloat64Fn(1, 1e-5, 17, 0, 10, tc.noiseKind, false, dpagg.PreAggPartitionSelection)
 		got.Setup()
 		if !cmp.Equal(tc.wantNoise, got.noise) {
 			t.Errorf("Setup: for %s got %v, want %v", tc.desc, got.noise, tc.wantNoise)
@@ -118,7 +119,7 @@ func TestBoundedSumInt64FnSetup(t *testing.T) {
 	}{
 		{"Laplace noise kind", noise.LaplaceNoise, noise.Laplace()},
 		{"Gaussian noise kind", noise.GaussianNoise, noise.Gaussian()}} {
-		got := newBoundedSumInt64Fn(1, 1e-5, 17, 0, 10, tc.noiseKind, false)
+		got := newBoundedSumInt64Fn(1, 1e-5, 17, 0, 10, tc.noiseKind, false, dpagg.PreAggPartitionSelection)
 		got.Setup()
 		if !cmp.Equal(tc.wantNoise, got.noise) {
 			t.Errorf("Setup: for %s got %v, want %v", tc.desc, got.noise, tc.wantNoise)
@@ -130,7 +131,7 @@ func TestBoundedSumInt64FnAddInput(t *testing.T) {
 	// Since δ=0.5 and 2 entries are added, PreAggPartitionSelection always emits.
 	// Since ε=1e100, the noise is added with probability in the order of exp(-1e100),
 	// which means we don't have to worry about tolerance/flakiness calculations.
-	fn := newBoundedSumInt64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false)
+	fn := newBoundedSumInt64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 	fn.Setup()
 
 	accum := fn.CreateAccumulator()
@@ -151,7 +152,7 @@ func TestBoundedSumInt64FnMergeAccumulators(t *testing.T) {
 	//
 	// Since ε=1e100, the noise is added with probability in the order of exp(-1e100),
 	// which means we don't have to worry about tolerance/flakiness calculations.
-	fn := newBoundedSumInt64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false)
+	fn := newBoundedSumInt64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 	fn.Setup()
 
 	accum1 := fn.CreateAccumulator()
@@ -177,7 +178,7 @@ func TestBoundedSumInt64FnExtractOutputReturnsNilForSmallPartitions(t *testing.T
 		// The probability of keeping a partition with 1 privacy unit is equal to δ=1e-23 which results in a flakiness of 10⁻²³.
 		{"Input with 1 privacy unit", 1}} {
 
-		fn := newBoundedSumInt64Fn(1, 1e-23, 1, 0, 2, noise.LaplaceNoise, false)
+		fn := newBoundedSumInt64Fn(1, 1e-23, 1, 0, 2, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 		fn.Setup()
 		accum := fn.CreateAccumulator()
 		for i := 0; i < tc.inputSize; i++ {
@@ -203,7 +204,7 @@ func TestBoundedSumInt64FnExtractOutputWithSpecifiedPartitionsDoesNotThreshold(t
 		{"Input with 10 users", 10},
 		{"Input with 100 users", 100}} {
 
-		fn := newBoundedSumInt64Fn(1, 0, 1, 0, 2, noise.LaplaceNoise, true)
+		fn := newBoundedSumInt64Fn(1, 0, 1, 0, 2, noise.LaplaceNoise, true, dpagg.PreAggPartitionSelection)
 		fn.Setup()
 		accum := fn.CreateAccumulator()
 		for i := 0; i < tc.inputSize; i++ {
@@ -221,7 +222,7 @@ func TestBoundedSumInt64FnExtractOutputWithSpecifiedPartitionsDoesNotThreshold(t
 func TestBoundedSumFloat64FnAddInput(t *testing.T) {
 	// Since δ=0.5 and 2 entries are added, PreAggPartitionSelection always emits.
 	// Since ε=1e100, added noise is negligible.
-	fn := newBoundedSumFloat64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false)
+	fn := newBoundedSumFloat64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 	fn.Setup()
 
 	accum := fn.CreateAccumulator()
@@ -241,7 +242,7 @@ func TestBoundedSumFloat64FnMergeAccumulators(t *testing.T) {
 	// accumulators is also effecting our partition selection outcome.
 	//
 	// Since ε=1e100, added noise is negligible.
-	fn := newBoundedSumFloat64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false)
+	fn := newBoundedSumFloat64Fn(1e100, 0.5, 1, 0, 2, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 	fn.Setup()
 
 	accum1 := fn.CreateAccumulator()
@@ -267,7 +268,7 @@ func TestBoundedSumFloat64FnExtractOutputReturnsNilForSmallPartitions(t *testing
 		// The probability of keeping a partition with 1 privacy unit is equal to δ=1e-23 which results in a flakiness of 10⁻²³.
 		{"Input with 1 privacy unit", 1}} {
 
-		fn := newBoundedSumFloat64Fn(1, 1e-23, 1, 0, 2, noise.LaplaceNoise, false)
+		fn := newBoundedSumFloat64Fn(1, 1e-23, 1, 0, 2, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 		fn.Setup()
 		accum := fn.CreateAccumulator()
 		for i := 0; i < tc.inputSize; i++ {
@@ -293,7 +294,7 @@ func TestBoundedSumFloat64FnExtractOutputWithSpecifiedPartitionsDoesNotThreshold
 		{"Input with 10 users", 10},
 		{"Input with 100 users", 100}} {
 		partitionsSpecified := true
-		fn := newBoundedSumFloat64Fn(1, 0, 1, 0, 2, noise.LaplaceNoise, partitionsSpecified)
+		fn := newBoundedSumFloat64Fn(1, 0, 1, 0, 2, noise.LaplaceNoise, partitionsSpecified, dpagg.PreAggPartitionSelection)
 		fn.Setup()
 		accum := fn.CreateAccumulator()
 		for i := 0; i < tc.inputSize; i++ {
@@ -420,3 +421,75 @@ func TestDropUnspecifiedPartitionsFloat(t *testing.T) {
 		t.Fatalf("DropUnspecifiedPartitionsFloat: for %v got: %v, want %v", col, got, want)
 	}
 }
+
+// Checks that reservoirSampleFn keeps exactly Limit distinct input elements
+// when there are more inputs than that.
+func TestReservoirSampleFnKeepsLimitElements(t *testing.T) {
+	for _, limit := range []int64{1, 5, 1000} {
+		fn := newReservoirSampleFn(limit, reflect.TypeOf(0))
+		fn.Setup()
+		accum := fn.CreateAccumulator()
+		other := fn.CreateAccumulator()
+		for i := 0; i < 300; i++ {
+			accum = fn.AddInput(accum, i)
+			other = fn.AddInput(other, 300+i)
+		}
+		got := fn.ExtractOutput(fn.MergeAccumulators(accum, other))
+		wantLen := int(limit)
+		if limit > 600 {
+			wantLen = 600
+		}
+		if len(got) != wantLen {
+			t.Errorf("ExtractOutput with limit %d: got %d elements, want %d", limit, len(got), wantLen)
+		}
+		seen := make(map[int]bool)
+		for _, v := range got {
+			i := v.(int)
+			if i < 0 || i >= 600 || seen[i] {
+				t.Errorf("ExtractOutput with limit %d: got unexpected or duplicate element %d", limit, i)
+			}
+			seen[i] = true
+		}
+	}
+}
+
+// Checks that reservoirSampleFn selects each element with equal probability,
+// even when the inputs are split unevenly across accumulators.
+func TestReservoirSampleFnIsUniform(t *testing.T) {
+	fn := newReservoirSampleFn(2, reflect.TypeOf(0))
+	fn.Setup()
+	// This test is non-deterministic. Each of the 10 elements is selected with
+	// probability 0.2; the binomial distribution with parameters (100,000, 0.2)
+	// yields a value within 20,000 +/- 1,000 with probability at least
+	// 1 - 1e-12. With 10 elements, this test has a flakiness rate lower than
+	// 1e-11, so we retry up to 2 times upon failure.
+	const numTrials, tolerance, retriesForFlakiness = 100_000, 0.01, 2
+	for testAttempt := 0; testAttempt <= retriesForFlakiness; testAttempt++ {
+		selections := make([]int, 10)
+		for trial := 0; trial < numTrials; trial++ {
+			// Elements 0 to 7 are added to a first accumulator, and 8 and 9 to a
+			// second one.
+			a, b := fn.CreateAccumulator(), fn.CreateAccumulator()
+			for i := 0; i < 8; i++ {
+				a = fn.AddInput(a, i)
+			}
+			b = fn.AddInput(b, 8)
+			b = fn.AddInput(b, 9)
+			for _, v := range fn.ExtractOutput(fn.MergeAccumulators(a, b)) {
+				selections[v.(int)]++
+			}
+		}
+		uniform := true
+		for i, c := range selections {
+			if rate := float64(c) / numTrials; rate < 0.2-tolerance || rate > 0.2+tolerance {
+				uniform = false
+				if testAttempt == retriesForFlakiness {
+					t.Errorf("reservoirSampleFn failed on attempt %d: element %d was selected with rate %f, want 0.2", testAttempt, i, rate)
+				}
+			}
+		}
+		if uniform {
+			break
+		}
+	}
+}
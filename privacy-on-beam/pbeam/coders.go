@@ -31,7 +31,9 @@ func init() {
 	beam.RegisterCoder(reflect.TypeOf(boundedSumAccumInt64{}), encodeBoundedSumAccumInt64, decodeBoundedSumAccumInt64)
 	beam.RegisterCoder(reflect.TypeOf(boundedSumAccumFloat64{}), encodeBoundedSumAccumFloat64, decodeBoundedSumAccumFloat64)
 	beam.RegisterCoder(reflect.TypeOf(boundedMeanAccumFloat64{}), encodeBoundedMeanAccumFloat64, decodeBoundedMeanAccumFloat64)
-	beam.RegisterCoder(reflect.TypeOf(expandValuesAccum{}), encodeExpandValuesAccum, decodeExpandValuesAccum)
+	beam.RegisterCoder(reflect.TypeOf(boundedMeanPartialFloat64{}), encodeBoundedMeanPartialFloat64, decodeBoundedMeanPartialFloat64)
+	beam.RegisterCoder(reflect.TypeOf(pairBoundedMeanPartialFloat64{}), encodePairBoundedMeanPartialFloat64, decodePairBoundedMeanPartialFloat64)
+	beam.RegisterCoder(reflect.TypeOf(partitionSelectionAccum{}), encodePartitionSelectionAccum, decodePartitionSelectionAccum)
 }
 
 func encodeCountAccum(ca countAccum) ([]byte, error) {
@@ -74,12 +76,32 @@ func decodeBoundedMeanAccumFloat64(data []byte) (boundedMeanAccumFloat64, error)
 	return ret, err
 }
 
-func encodeExpandValuesAccum(v expandValuesAccum) ([]byte, error) {
+func encodeBoundedMeanPartialFloat64(v boundedMeanPartialFloat64) ([]byte, error) {
 	return encode(v)
 }
 
-func decodeExpandValuesAccum(data []byte) (expandValuesAccum, error) {
-	var ret expandValuesAccum
+func decodeBoundedMeanPartialFloat64(data []byte) (boundedMeanPartialFloat64, error) {
+	var ret boundedMeanPartialFloat64
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodePairBoundedMeanPartialFloat64(v pairBoundedMeanPartialFloat64) ([]byte, error) {
+	return encode(v)
+}
+
+func decodePairBoundedMeanPartialFloat64(data []byte) (pairBoundedMeanPartialFloat64, error) {
+	var ret pairBoundedMeanPartialFloat64
+	err := decode(&ret, data)
+	return ret, err
+}
+
+func encodePartitionSelectionAccum(v partitionSelectionAccum) ([]byte, error) {
+	return encode(v)
+}
+
+func decodePartitionSelectionAccum(data []byte) (partitionSelectionAccum, error) {
+	var ret partitionSelectionAccum
 	err := decode(&ret, data)
 	return ret, err
 }
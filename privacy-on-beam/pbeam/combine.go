@@ -0,0 +1,451 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/filter"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*keepPartitionValuesFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*decodePartitionFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*emptyCombineOutputFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*addNoiseFloat64Fn)(nil)))
+	beam.RegisterFunction(joinPairFn)
+	beam.RegisterFunction(keepSelectedPartitionsFloat64Fn)
+}
+
+// CombineParams specifies the parameters associated with a CombinePerKey
+// aggregation.
+type CombineParams struct {
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed.
+	Epsilon, Delta float64
+	// The maximum number of distinct keys that a given privacy identifier can
+	// influence, i.e. the l0 sensitivity of the output. If a privacy
+	// identifier is associated with more keys, random keys will be dropped.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of values that a given privacy identifier can
+	// contribute to a single key. If a privacy identifier is associated with
+	// more values for a key, random values will be dropped.
+	//
+	// Required.
+	MaxContributionsPerPartition int64
+	// The maximum absolute change in the output of the CombineFn for a given
+	// key when adding or removing all the values of a single privacy
+	// identifier for this key, i.e. the l∞ sensitivity of the output. This
+	// must hold for any input with at most MaxContributionsPerPartition values
+	// per privacy identifier; typically, the CombineFn clamps its inputs to
+	// guarantee it. pbeam cannot check this declaration: if it is wrong, the
+	// output is not differentially private.
+	//
+	// Required.
+	LInfSensitivity float64
+	// You can input the list of partitions present in the output if you know
+	// them in advance. When you specify partitions, partition selection /
+	// thresholding will be disabled and partitions will appear in the output
+	// if and only if they appear in the set of public partitions.
+	//
+	// You should not derive the list of partitions non-privately from private
+	// data. You should only use this in either of the following cases:
+	// 	1. The list of partitions is data-independent. For example, if you are
+	// 	aggregating a metric by hour, you could provide a list of all possible
+	// 	hourly period.
+	// 	2. You use a differentially private operation to come up with the list of
+	// 	partitions. For example, you could use the keys of a DistinctPrivacyID
+	// 	operation as the list of specified partitions.
+	//
+	// Note that current implementation limitations only allow up to millions of
+	// public partitions.
+	//
+	// Optional.
+	PublicPartitions beam.PCollection
+	// Strategy used for selecting partitions when PublicPartitions is not set
+	// (see dpagg.PartitionSelectionStrategy).
+	//
+	// Defaults to dpagg.PreAggPartitionSelection.
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+}
+
+// CombinePerKey combines the values associated with each key in a
+// PrivatePCollection<K,V> using a user-provided CombineFn, and adds
+// differentially private noise to the results. pbeam takes care of the
+// contribution bounding, of the noise and of the partition selection, using
+// the sensitivities declared in params.
+//
+// combineFn must be a pointer to a struct implementing a Beam CombineFn on
+// values of type V, whose output has type float64: it has a MergeAccumulators
+// method, and optionally CreateAccumulator, AddInput and ExtractOutput methods.
+// Its exported fields are serialized like for beam.CombinePerKey. combineFn is
+// also used to compute the output of public partitions without any value, by
+// calling ExtractOutput on an empty accumulator.
+//
+// CombinePerKey transforms a PrivatePCollection<K,V> into a
+// PCollection<K,float64>.
+func CombinePerKey(s beam.Scope, combineFn interface{}, pcol PrivatePCollection, params CombineParams) beam.PCollection {
+	s = s.Scope("pbeam.CombinePerKey")
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) {
+		log.Exitf("CombinePerKey must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+	if pcol.codec == nil {
+		log.Exitf("CombinePerKey: no codec found for the input PrivatePCollection.")
+	}
+	if err := checkCombineFn(combineFn); err != nil {
+		log.Exitf("pbeam.CombinePerKey: %v", err)
+	}
+
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	noiseKind, delta := getNoiseKind(params.NoiseKind, maxPartitionsContributed, epsilon, delta, (params.PublicPartitions).IsValid())
+	err = checkCombinePerKeyParams(params, epsilon, delta, noiseKind)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	maxContributionsPerPartition := getMaxContributionsPerPartition(pcol, params.MaxContributionsPerPartition)
+	partitionT := pcol.codec.KType
+	// Drop unspecified partitions, if partitions are specified.
+	if (params.PublicPartitions).IsValid() {
+		if partitionT.T != (params.PublicPartitions).Type().Type() {
+			log.Exitf("Specified partitions must be of type %v. Got type %v instead.",
+				partitionT.T, params.PublicPartitions.Type().Type())
+		}
+		params.PublicPartitions = windowPublicPartitions(s, pcol, params.PublicPartitions)
+		pcol.col = dropUnspecifiedPartitionsKVFn(s, params.PublicPartitions, pcol, partitionT)
+	}
+	// First, group together the privacy ID and the partition ID, and do
+	// per-partition contribution bounding.
+	decoded := beam.ParDo(s,
+		newPrepareMeanFn(idT, pcol.codec),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	decoded = boundContributions(s, decoded, maxContributionsPerPartition)
+	// Second, do cross-partition contribution bounding on the distinct
+	// (privacy ID, partition) pairs, re-keyed by privacy ID.
+	idsAndPartitions := filter.Distinct(s, beam.DropValue(s, decoded))
+	boundedPairs := boundContributions(s, beam.ParDo(s, splitPairFn, idsAndPartitions), maxPartitionsContributed)
+	keptPairs := beam.ParDo(s, joinPairFn, boundedPairs)
+	// Third, now that contribution bounding is done, keep the values of the
+	// kept (privacy ID, partition) pairs without the privacy keys, and combine
+	// the values of each partition with the user CombineFn.
+	values := beam.ParDo(s,
+		newKeepPartitionValuesFn(partitionT),
+		beam.CoGroupByKey(s, decoded, keptPairs),
+		beam.TypeDefinition{Var: beam.XType, T: partitionT.T})
+	combined := beam.CombinePerKey(s, combineFn, values)
+	if _, outputT := beam.ValidateKVType(combined); outputT.Type() != reflect.TypeOf(float64(0)) {
+		log.Exitf("pbeam.CombinePerKey: the output of combineFn must have type float64, got %v instead", outputT)
+	}
+
+	if (params.PublicPartitions).IsValid() {
+		// Add the output of the CombineFn for an empty input to the specified
+		// partitions that are not in the data, and add noise.
+		partitionMap := beam.Combine(s, newPartitionsMapFn(partitionT), beam.DropValue(s, combined))
+		dummyValues := beam.ParDo(s, addOneValueFn, params.PublicPartitions)
+		emptyPartitions := beam.ParDo(s,
+			newEmitPartitionsNotInTheDataFn(typex.New(partitionT.T)),
+			dummyValues,
+			beam.SideInput{Input: partitionMap})
+		emptyOutputs := beam.ParDo(s, newEmptyCombineOutputFn(combineFn), emptyPartitions)
+		allOutputs := beam.Flatten(s, combined, emptyOutputs)
+		return beam.ParDo(s, newAddNoiseFloat64Fn(epsilon, delta, maxPartitionsContributed, params.LInfSensitivity, noiseKind), allOutputs)
+	}
+	// Otherwise, split the budget between the noise and the partition
+	// selection, keep the selected partitions and add noise.
+	noiseEpsilon, noiseDelta, partitionSelectionEpsilon, partitionSelectionDelta := splitBudgetForPartitionSelection(epsilon, delta, noiseKind)
+	dummyCounts := beam.ParDo(s,
+		newDecodePartitionFn(partitionT),
+		keptPairs,
+		beam.TypeDefinition{Var: beam.XType, T: partitionT.T})
+	selected := beam.CombinePerKey(s,
+		newPartitionSelectionFn(partitionSelectionEpsilon, partitionSelectionDelta, maxPartitionsContributed, params.PartitionSelectionStrategy),
+		dummyCounts)
+	kept := beam.ParDo(s, keepSelectedPartitionsFloat64Fn, beam.CoGroupByKey(s, combined, selected))
+	return beam.ParDo(s, newAddNoiseFloat64Fn(noiseEpsilon, noiseDelta, maxPartitionsContributed, params.LInfSensitivity, noiseKind), kept)
+}
+
+// splitBudgetForPartitionSelection splits the budget between the noise and
+// the partition selection, like the built-in aggregations do.
+func splitBudgetForPartitionSelection(epsilon, delta float64, noiseKind noise.Kind) (noiseEpsilon, noiseDelta, partitionSelectionEpsilon, partitionSelectionDelta float64) {
+	noiseEpsilon = epsilon / 2
+	partitionSelectionEpsilon = epsilon - noiseEpsilon
+	if noiseKind == noise.GaussianNoise {
+		noiseDelta = delta / 2
+		partitionSelectionDelta = delta - noiseDelta
+		return
+	}
+	return noiseEpsilon, 0, partitionSelectionEpsilon, delta
+}
+
+func checkCombinePerKeyParams(params CombineParams, epsilon, delta float64, noiseKind noise.Kind) error {
+	err := checks.CheckEpsilon("pbeam.CombinePerKey", epsilon)
+	if err != nil {
+		return err
+	}
+	if (params.PublicPartitions).IsValid() && noiseKind == noise.LaplaceNoise {
+		err = checks.CheckNoDelta("pbeam.CombinePerKey", delta)
+	} else {
+		err = checks.CheckDeltaStrict("pbeam.CombinePerKey", delta)
+	}
+	if err != nil {
+		return err
+	}
+	err = checks.CheckLInfSensitivity("pbeam.CombinePerKey", params.LInfSensitivity)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionStrategy("pbeam.CombinePerKey", params.PartitionSelectionStrategy)
+	if err != nil {
+		return err
+	}
+	return checks.CheckMaxPartitionsContributed("pbeam.CombinePerKey", params.MaxPartitionsContributed)
+}
+
+// checkCombineFn checks that combineFn is a pointer to a struct implementing a
+// CombineFn whose output has type float64.
+func checkCombineFn(combineFn interface{}) error {
+	t := reflect.TypeOf(combineFn)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("combineFn must be a pointer to a struct, got %v", t)
+	}
+	v := reflect.ValueOf(combineFn)
+	merge := v.MethodByName("MergeAccumulators")
+	if !merge.IsValid() {
+		return fmt.Errorf("combineFn %v has no MergeAccumulators method", t)
+	}
+	outputT := merge.Type().Out(0)
+	if extract := v.MethodByName("ExtractOutput"); extract.IsValid() {
+		if extract.Type().NumOut() == 0 {
+			return fmt.Errorf("the ExtractOutput method of combineFn %v has no output", t)
+		}
+		outputT = extract.Type().Out(0)
+	}
+	if outputT != reflect.TypeOf(float64(0)) {
+		return fmt.Errorf("the output of combineFn %v must have type float64, got %v instead", t, outputT)
+	}
+	return nil
+}
+
+// joinPairFn takes a PCollection<codedID,codedK> as input, and returns a
+// PCollection<kv.Pair{ID,K},bool> where each pair is associated with true, so
+// that it can be grouped with the values of the pair.
+func joinPairFn(id, partition []byte) (kv.Pair, bool) {
+	return kv.Pair{K: id, V: partition}, true
+}
+
+// keepPartitionValuesFn takes the CoGroupByKey of a PCollection<kv.Pair{ID,K},V>
+// and of a PCollection<kv.Pair{ID,K},bool> as input, and returns a
+// PCollection<K,V> containing the values of the pairs that are in the second
+// PCollection. The values are iterated over without being kept in memory.
+type keepPartitionValuesFn struct {
+	PartitionType beam.EncodedType
+	partitionDec  beam.ElementDecoder
+}
+
+func newKeepPartitionValuesFn(partitionType beam.EncodedType) *keepPartitionValuesFn {
+	return &keepPartitionValuesFn{PartitionType: partitionType}
+}
+
+func (fn *keepPartitionValuesFn) Setup() {
+	fn.partitionDec = beam.NewElementDecoder(fn.PartitionType.T)
+}
+
+func (fn *keepPartitionValuesFn) ProcessElement(idAndPartition kv.Pair, valuesIter func(*beam.V) bool, keepIter func(*bool) bool, emit func(beam.X, beam.V)) {
+	var keep bool
+	if !keepIter(&keep) || !keep {
+		return
+	}
+	partition, err := fn.partitionDec.Decode(bytes.NewBuffer(idAndPartition.V))
+	if err != nil {
+		log.Exitf("pbeam.keepPartitionValuesFn.ProcessElement: couldn't decode partition %v: %v", idAndPartition.V, err)
+	}
+	var v beam.V
+	for valuesIter(&v) {
+		emit(partition, v)
+	}
+}
+
+// decodePartitionFn takes a PCollection<kv.Pair{ID,K},bool> as input, and
+// returns a PCollection<K,int64> where each partition is associated with the
+// value 1, to count the privacy IDs contributing to each partition.
+type decodePartitionFn struct {
+	PartitionType beam.EncodedType
+	partitionDec  beam.ElementDecoder
+}
+
+func newDecodePartitionFn(partitionType beam.EncodedType) *decodePartitionFn {
+	return &decodePartitionFn{PartitionType: partitionType}
+}
+
+func (fn *decodePartitionFn) Setup() {
+	fn.partitionDec = beam.NewElementDecoder(fn.PartitionType.T)
+}
+
+func (fn *decodePartitionFn) ProcessElement(idAndPartition kv.Pair, _ bool) (beam.X, int64) {
+	partition, err := fn.partitionDec.Decode(bytes.NewBuffer(idAndPartition.V))
+	if err != nil {
+		log.Exitf("pbeam.decodePartitionFn.ProcessElement: couldn't decode partition %v: %v", idAndPartition.V, err)
+	}
+	return partition, 1
+}
+
+// keepSelectedPartitionsFloat64Fn emits the output of the partitions that are
+// selected.
+func keepSelectedPartitionsFloat64Fn(partition beam.X, outputIter func(*float64) bool, keepIter func(*bool) bool, emit func(beam.X, float64)) {
+	var keep bool
+	if !keepIter(&keep) || !keep {
+		return
+	}
+	var output float64
+	if outputIter(&output) {
+		emit(partition, output)
+	}
+}
+
+// emptyCombineOutputFn associates partitions with the output of a user
+// CombineFn for an empty input. The CombineFn is serialized like structural
+// DoFns in ParDo.
+type emptyCombineOutputFn struct {
+	CombineFnType beam.EncodedType
+	CombineFnData []byte
+	output        float64
+}
+
+func newEmptyCombineOutputFn(combineFn interface{}) *emptyCombineOutputFn {
+	data, err := json.Marshal(combineFn)
+	if err != nil {
+		log.Exitf("pbeam.CombinePerKey: couldn't encode combineFn %v: %v", reflect.TypeOf(combineFn), err)
+	}
+	return &emptyCombineOutputFn{
+		CombineFnType: beam.EncodedType{T: reflect.TypeOf(combineFn).Elem()},
+		CombineFnData: data,
+	}
+}
+
+func (fn *emptyCombineOutputFn) Setup(ctx context.Context) error {
+	combineFn := reflect.New(fn.CombineFnType.T)
+	if err := json.Unmarshal(fn.CombineFnData, combineFn.Interface()); err != nil {
+		return fmt.Errorf("couldn't decode combineFn %v: %v", fn.CombineFnType.T, err)
+	}
+	call := func(name string, args ...reflect.Value) ([]reflect.Value, error) {
+		m := combineFn.MethodByName(name)
+		if !m.IsValid() {
+			return nil, nil
+		}
+		if m.Type().NumIn() > len(args) {
+			args = append([]reflect.Value{reflect.ValueOf(ctx)}, args...)
+		}
+		out := m.Call(args)
+		if n := len(out); n > 0 && m.Type().Out(n-1) == reflect.TypeOf((*error)(nil)).Elem() {
+			if !out[n-1].IsNil() {
+				return nil, out[n-1].Interface().(error)
+			}
+			out = out[:n-1]
+		}
+		return out, nil
+	}
+	if _, err := call("Setup"); err != nil {
+		return err
+	}
+	// Without CreateAccumulator, the accumulator is the zero value of the
+	// accumulator type.
+	accum := reflect.Zero(combineFn.MethodByName("MergeAccumulators").Type().In(0))
+	out, err := call("CreateAccumulator")
+	if err != nil {
+		return err
+	}
+	if len(out) == 1 {
+		accum = out[0]
+	}
+	output := accum
+	out, err = call("ExtractOutput", accum)
+	if err != nil {
+		return err
+	}
+	if len(out) == 1 {
+		output = out[0]
+	}
+	fn.output = output.Float()
+	return nil
+}
+
+func (fn *emptyCombineOutputFn) ProcessElement(partition beam.X, _ int64) (beam.X, float64) {
+	return partition, fn.output
+}
+
+// addNoiseFloat64Fn adds noise to the output of each partition. Do not
+// initialize it yourself, use newAddNoiseFloat64Fn to create an
+// addNoiseFloat64Fn instance.
+type addNoiseFloat64Fn struct {
+	// Privacy spec parameters (set during initial construction).
+	Epsilon         float64
+	Delta           float64
+	L0Sensitivity   int64
+	LInfSensitivity float64
+	NoiseKind       noise.Kind
+	noise           noise.Noise // Set during Setup phase according to NoiseKind.
+}
+
+// newAddNoiseFloat64Fn returns an addNoiseFloat64Fn with the given budget and
+// sensitivities.
+func newAddNoiseFloat64Fn(epsilon, delta float64, l0Sensitivity int64, lInfSensitivity float64, noiseKind noise.Kind) *addNoiseFloat64Fn {
+	return &addNoiseFloat64Fn{
+		Epsilon:         epsilon,
+		Delta:           delta,
+		L0Sensitivity:   l0Sensitivity,
+		LInfSensitivity: lInfSensitivity,
+		NoiseKind:       noiseKind,
+	}
+}
+
+func (fn *addNoiseFloat64Fn) Setup() {
+	fn.noise = noise.ToNoise(fn.NoiseKind)
+}
+
+func (fn *addNoiseFloat64Fn) ProcessElement(partition beam.X, output float64) (beam.X, float64) {
+	return partition, fn.noise.AddNoiseFloat64(output, fn.L0Sensitivity, fn.LInfSensitivity, fn.Epsilon, fn.Delta)
+}
+
+func (fn *addNoiseFloat64Fn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
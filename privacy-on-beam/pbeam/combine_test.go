@@ -0,0 +1,335 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+)
+
+// clampedSumFn sums float32 values clamped to [0, MaxValue], and adds Base to
+// the result. Its l∞ sensitivity is MaxValue times the maximum number of
+// contributions per partition.
+type clampedSumFn struct {
+	MaxValue float64
+	Base     float64
+}
+
+func (fn *clampedSumFn) AddInput(sum float64, v float32) float64 {
+	return sum + math.Min(math.Max(float64(v), 0), fn.MaxValue)
+}
+
+func (fn *clampedSumFn) MergeAccumulators(a, b float64) float64 {
+	return a + b
+}
+
+func (fn *clampedSumFn) ExtractOutput(sum float64) float64 {
+	return sum + fn.Base
+}
+
+// intOutputFn is a CombineFn whose output doesn't have type float64.
+type intOutputFn struct{}
+
+func (fn *intOutputFn) MergeAccumulators(a, b int) int {
+	return a + b
+}
+
+// noMergeFn is not a CombineFn.
+type noMergeFn struct{}
+
+func (fn *noMergeFn) ExtractOutput(a float64) float64 {
+	return a
+}
+
+// Checks that CombinePerKey bounds contributions, drops small partitions and
+// returns a correct answer.
+func TestCombinePerKeyNoNoise(t *testing.T) {
+	triples := concatenateTriplesWithFloatValue(
+		makeTripleWithFloatValue(7, 0, 2.0),
+		makeTripleWithFloatValueStartingFromKey(7, 100, 1, 0.5),
+		makeTripleWithFloatValueStartingFromKey(107, 150, 1, 2.5),
+		// Privacy ID 7 contributes a second value to partition 1, which must be
+		// dropped by per-partition contribution bounding.
+		makeTripleWithFloatValueStartingFromKey(7, 1, 1, 0.5))
+	result := []testFloat64Metric{
+		{1, 0.5*100 + 1.0*150},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, extractIDFromTripleWithFloatValue, col)
+
+	// ε=50, δ=10⁻²⁰⁰ and l0Sensitivity=1 gives a threshold of ≈11 for
+	// partition selection, so partition 0 is dropped.
+	// We have 2 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 10⁻²⁵ probability (k=25).
+	epsilon := 50.0
+	delta := 1e-200
+
+	// ε is split by 2 for noise and for partition selection, so we use 2*ε to get a Laplace noise with ε.
+	pcol := MakePrivate(s, col, NewPrivacySpec(2*epsilon, delta))
+	pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
+	got := CombinePerKey(s, &clampedSumFn{MaxValue: 1.0}, pcol, CombineParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		LInfSensitivity:              1.0,
+		NoiseKind:                    LaplaceNoise{},
+	})
+
+	want = beam.ParDo(s, float64MetricToKV, want)
+	if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(25, 1.0, epsilon)); err != nil {
+		t.Fatalf("TestCombinePerKeyNoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCombinePerKeyNoNoise: CombinePerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+// Checks that CombinePerKey with public partitions returns a correct answer,
+// including for public partitions that are not in the data.
+func TestCombinePerKeyWithPartitionsNoNoise(t *testing.T) {
+	triples := concatenateTriplesWithFloatValue(
+		makeTripleWithFloatValue(7, 0, 2.0),
+		makeTripleWithFloatValueStartingFromKey(7, 100, 1, 0.5),
+		makeTripleWithFloatValueStartingFromKey(107, 10, 3, 1.0))
+	// Partition 2 is not in the data, so its output is the output of the
+	// CombineFn for an empty input, i.e. Base. Partition 3 is not public.
+	result := []testFloat64Metric{
+		{0, 7.0 + 5.0},
+		{1, 0.5*100 + 5.0},
+		{2, 5.0},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, extractIDFromTripleWithFloatValue, col)
+	partitionsCol := beam.CreateList(s, []int{0, 1, 2})
+
+	// We have ε=50, δ=0 and l0Sensitivity=1. No thresholding is done because partitions are specified.
+	// We have 3 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 10⁻²⁵ probability (k=25).
+	epsilon := 50.0
+	delta := 0.0
+
+	// ε is not split because partitions are specified.
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
+	got := CombinePerKey(s, &clampedSumFn{MaxValue: 1.0, Base: 5.0}, pcol, CombineParams{
+		MaxPartitionsContributed:     1,
+		MaxContributionsPerPartition: 1,
+		LInfSensitivity:              1.0,
+		NoiseKind:                    LaplaceNoise{},
+		PublicPartitions:             partitionsCol,
+	})
+
+	want = beam.ParDo(s, float64MetricToKV, want)
+	if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(25, 1.0, epsilon)); err != nil {
+		t.Fatalf("TestCombinePerKeyWithPartitionsNoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCombinePerKeyWithPartitionsNoNoise: CombinePerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+// Checks that CombinePerKey bounds the number of partitions each privacy ID
+// contributes to.
+func TestCombinePerKeyCrossPartitionContributionBounding(t *testing.T) {
+	// triples contains {1,0,1.0}, {2,0,1.0}, …, {50,0,1.0}, {1,1,1.0}, …, {50,1,1.0}, {1,2,1.0}, …, {50,9,1.0}.
+	var triples []tripleWithFloatValue
+	for i := 0; i < 10; i++ {
+		triples = append(triples, makeDummyTripleWithFloatValue(50, i)...)
+	}
+	result := []testFloat64Metric{
+		{0, 150.0},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, extractIDFromTripleWithFloatValue, col)
+	partitionsCol := beam.CreateList(s, []int{0, 1, 2, 3, 4})
+
+	// We have ε=50, δ=0.0 and l1Sensitivity=3.
+	// We have 5 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁵ probability (k=25).
+	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
+	got := CombinePerKey(s, &clampedSumFn{MaxValue: 1.0}, pcol, CombineParams{
+		MaxPartitionsContributed:     3,
+		MaxContributionsPerPartition: 1,
+		LInfSensitivity:              1.0,
+		NoiseKind:                    LaplaceNoise{},
+		PublicPartitions:             partitionsCol,
+	})
+	// With a max contribution of 3, all of the data for three partitions should be kept.
+	// The sum of all elements must then be 150.
+	sums := beam.DropKey(s, got)
+	sumOverPartitions := stats.Sum(s, sums)
+	got = beam.AddFixedKey(s, sumOverPartitions) // Adds a fixed key of 0.
+	want = beam.ParDo(s, float64MetricToKV, want)
+	if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestCombinePerKeyCrossPartitionContributionBounding: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCombinePerKeyCrossPartitionContributionBounding: CombinePerKey(%v) = %v, expected elements to sum to 150.0: %v", col, got, err)
+	}
+}
+
+func TestCheckCombinePerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		params    CombineParams
+		epsilon   float64
+		delta     float64
+		noiseKind noise.Kind
+		wantErr   bool
+	}{
+		{
+			desc:      "valid parameters",
+			params:    CombineParams{LInfSensitivity: 1, MaxPartitionsContributed: 1},
+			epsilon:   1.0,
+			delta:     1e-5,
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   false,
+		},
+		{
+			desc:      "negative epsilon",
+			params:    CombineParams{LInfSensitivity: 1, MaxPartitionsContributed: 1},
+			epsilon:   -1.0,
+			delta:     1e-5,
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "zero delta without public partitions",
+			params:    CombineParams{LInfSensitivity: 1, MaxPartitionsContributed: 1},
+			epsilon:   1.0,
+			delta:     0,
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "zero LInfSensitivity",
+			params:    CombineParams{MaxPartitionsContributed: 1},
+			epsilon:   1.0,
+			delta:     1e-5,
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "infinite LInfSensitivity",
+			params:    CombineParams{LInfSensitivity: math.Inf(1), MaxPartitionsContributed: 1},
+			epsilon:   1.0,
+			delta:     1e-5,
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "negative MaxPartitionsContributed",
+			params:    CombineParams{LInfSensitivity: 1, MaxPartitionsContributed: -1},
+			epsilon:   1.0,
+			delta:     1e-5,
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+		{
+			desc:      "invalid partition selection strategy",
+			params:    CombineParams{LInfSensitivity: 1, MaxPartitionsContributed: 1, PartitionSelectionStrategy: dpagg.PartitionSelectionStrategy(-1)},
+			epsilon:   1.0,
+			delta:     1e-5,
+			noiseKind: noise.LaplaceNoise,
+			wantErr:   true,
+		},
+	} {
+		if err := checkCombinePerKeyParams(tc.params, tc.epsilon, tc.delta, tc.noiseKind); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckCombineFn(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		combineFn interface{}
+		wantErr   bool
+	}{
+		{"valid CombineFn", &clampedSumFn{}, false},
+		{"nil", nil, true},
+		{"struct instead of pointer", clampedSumFn{}, true},
+		{"function", func(a, b float64) float64 { return a + b }, true},
+		{"no MergeAccumulators", &noMergeFn{}, true},
+		{"non-float64 output", &intOutputFn{}, true},
+	} {
+		if err := checkCombineFn(tc.combineFn); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that CombinePerKey keeps all the values of the (privacy ID, partition)
+// pairs that are kept by cross-partition contribution bounding.
+func TestCombinePerKeyKeepsValuesOfKeptPartitions(t *testing.T) {
+	// Each of the 50 privacy IDs contributes the value 1.0 twice to each of the
+	// partitions 0 to 9.
+	var triples []tripleWithFloatValue
+	for i := 0; i < 10; i++ {
+		triples = append(triples, makeDummyTripleWithFloatValue(50, i)...)
+		triples = append(triples, makeDummyTripleWithFloatValue(50, i)...)
+	}
+	result := []testFloat64Metric{
+		{0, 300.0},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, extractIDFromTripleWithFloatValue, col)
+	partitionsCol := beam.CreateList(s, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+
+	// We have ε=50, δ=0.0 and l1Sensitivity=6.
+	// We have 10 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁵ probability (k=25).
+	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 6.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
+	got := CombinePerKey(s, &clampedSumFn{MaxValue: 1.0}, pcol, CombineParams{
+		MaxPartitionsContributed:     3,
+		MaxContributionsPerPartition: 2,
+		LInfSensitivity:              2.0,
+		NoiseKind:                    LaplaceNoise{},
+		PublicPartitions:             partitionsCol,
+	})
+	// Each privacy ID contributes both of its values to three partitions, so the
+	// sum of all elements must be 300.
+	sumOverPartitions := stats.Sum(s, beam.DropKey(s, got))
+	got = beam.AddFixedKey(s, sumOverPartitions) // Adds a fixed key of 0.
+	want = beam.ParDo(s, float64MetricToKV, want)
+	if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestCombinePerKeyKeepsValuesOfKeptPartitions: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCombinePerKeyKeepsValuesOfKeptPartitions: CombinePerKey(%v) = %v, expected elements to sum to 300.0: %v", col, got, err)
+	}
+}
+
+func TestEmptyCombineOutputFn(t *testing.T) {
+	fn := newEmptyCombineOutputFn(&clampedSumFn{MaxValue: 1.0, Base: 3.5})
+	if err := fn.Setup(context.Background()); err != nil {
+		t.Fatalf("Setup: got error %v", err)
+	}
+	if _, got := fn.ProcessElement(0, 1); got != 3.5 {
+		t.Errorf("ProcessElement: got %f, want 3.5", got)
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 	log "github.com/golang/glog"
 	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/dpagg"
 	"github.com/google/differential-privacy/go/noise"
 	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
 	"github.com/apache/beam/sdks/go/pkg/beam"
@@ -29,7 +30,7 @@ import (
 
 // CountParams specifies the parameters associated with a Count aggregation.
 type CountParams struct {
-	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
 	//
 	// Defaults to LaplaceNoise{}.
 	NoiseKind NoiseKind
@@ -57,10 +58,23 @@ type CountParams struct {
 	//
 	// Required.
 	MaxValue int64
-	// Client-specified partitions.
+	// Strategy used for selecting the partitions that are kept in the output,
+	// when partitions are not specified. Instead of the default pre-aggregation
+	// partition selection, partitions can be selected by adding Laplace or
+	// Gaussian noise to the number of privacy identifiers and thresholding it
+	// (see dpagg.PartitionSelectionStrategy).
+	//
+	// Defaults to dpagg.PreAggPartitionSelection.
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+	// Partitions to keep in the output, if they are known in advance. When
+	// PublicPartitions is set, no budget is spent on partition selection:
+	// partitions that are not in PublicPartitions are dropped, and partitions
+	// in PublicPartitions without any data are added to the output.
+	// PublicPartitions must not depend on private data, except through a
+	// differentially private transform such as SelectPartitions.
 	//
 	// Optional.
-	partitionsCol beam.PCollection
+	PublicPartitions beam.PCollection
 }
 
 // Count counts the number of times a value appears in a PrivatePCollection,
@@ -78,33 +92,28 @@ func Count(s beam.Scope, pcol PrivatePCollection, params CountParams) beam.PColl
 	idT, partitionT := beam.ValidateKVType(pcol.col)
 
 	// Get privacy parameters.
-	spec := pcol.privacySpec
-	epsilon, delta, err := spec.consumeBudget(params.Epsilon, params.Delta)
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
 
 	if err != nil {
 		log.Exitf("couldn't consume budget: %v", err)
 	}
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
-	}
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	noiseKind, delta := getNoiseKind(params.NoiseKind, maxPartitionsContributed, epsilon, delta, (params.PublicPartitions).IsValid())
 	err = checkCountParams(params, epsilon, delta, noiseKind)
 	if err != nil {
 		log.Exit(err)
 	}
 
-	maxPartitionsContributed := getMaxPartitionsContributed(spec, params.MaxPartitionsContributed)
+	params.MaxValue = boundByMaxContributions(pcol, params.MaxValue)
 	// Drop unspecified partitions, if partitions are specified.
-	if (params.partitionsCol).IsValid() {
-		if partitionT.Type() != params.partitionsCol.Type().Type() {
+	if (params.PublicPartitions).IsValid() {
+		if partitionT.Type() != params.PublicPartitions.Type().Type() {
 			log.Exitf("Specified partitions must be of type %v. Got type %v instead.",
-				partitionT.Type(), params.partitionsCol.Type().Type())
+				partitionT.Type(), params.PublicPartitions.Type().Type())
 		}
+		params.PublicPartitions = windowPublicPartitions(s, pcol, params.PublicPartitions)
 		partitionEncodedType := beam.EncodedType{partitionT.Type()}
-		pcol.col = dropUnspecifiedPartitionsVFn(s, params.partitionsCol, pcol, partitionEncodedType)
+		pcol.col = dropUnspecifiedPartitionsVFn(s, params.PublicPartitions, pcol, partitionEncodedType)
 	}
 	// First, encode KV pairs, count how many times each one appears,
 	// and re-key by the original privacy key.
@@ -122,11 +131,11 @@ func Count(s beam.Scope, pcol PrivatePCollection, params CountParams) beam.PColl
 		countPairs,
 		beam.TypeDefinition{Var: beam.XType, T: partitionT.Type()})
 	// Add specified partitions and return the aggregation output, if partitions are specified.
-	if (params.partitionsCol).IsValid() {
+	if (params.PublicPartitions).IsValid() {
 		return addSpecifiedPartitionsForCount(s, epsilon, delta, maxPartitionsContributed, params, noiseKind, countsKV)
 	}
 	sums := beam.CombinePerKey(s,
-		newBoundedSumInt64Fn(epsilon, delta, maxPartitionsContributed, 0, params.MaxValue, noiseKind, false),
+		newBoundedSumInt64Fn(epsilon, delta, maxPartitionsContributed, 0, params.MaxValue, noiseKind, false, params.PartitionSelectionStrategy),
 		countsKV)
 	// Drop thresholded partitions.
 	counts := beam.ParDo(s, dropThresholdedPartitionsInt64Fn, sums)
@@ -139,7 +148,7 @@ func checkCountParams(params CountParams, epsilon, delta float64, noiseKind nois
 	if err != nil {
 		return err
 	}
-	if (params.partitionsCol).IsValid() && noiseKind == noise.LaplaceNoise {
+	if (params.PublicPartitions).IsValid() && noiseKind == noise.LaplaceNoise {
 		err = checks.CheckNoDelta("pbeam.Count", delta)
 	} else {
 		err = checks.CheckDeltaStrict("pbeam.Count", delta)
@@ -154,17 +163,17 @@ func checkCountParams(params CountParams, epsilon, delta float64, noiseKind nois
 	if params.MaxValue <= 0 {
 		return fmt.Errorf("pbeam.Count: MaxValue should be strictly positive, got %d", params.MaxValue)
 	}
-	return nil
+	return checkPartitionSelectionStrategy("pbeam.Count", params.PartitionSelectionStrategy)
 }
 
 func addSpecifiedPartitionsForCount(s beam.Scope, epsilon, delta float64, maxPartitionsContributed int64, params CountParams, noiseKind noise.Kind, countsKV beam.PCollection) beam.PCollection {
 	// Turn partitionsCol from PCollection<K> into PCollection<K, int64> by adding
 	// the value zero to each K.
-	dummyCounts := beam.ParDo(s, addDummyValuesToSpecifiedPartitionsInt64Fn, params.partitionsCol)
+	dummyCounts := beam.ParDo(s, addDummyValuesToSpecifiedPartitionsInt64Fn, params.PublicPartitions)
 	// Merge countsKV and dummyCounts.
 	allPartitions := beam.Flatten(s, dummyCounts, countsKV)
 	// Sum and add noise.
-	sums := beam.CombinePerKey(s, newBoundedSumInt64Fn(epsilon, delta, maxPartitionsContributed, 0, params.MaxValue, noiseKind, true), allPartitions)
+	sums := beam.CombinePerKey(s, newBoundedSumInt64Fn(epsilon, delta, maxPartitionsContributed, 0, params.MaxValue, noiseKind, true, params.PartitionSelectionStrategy), allPartitions)
 	finalPartitions := beam.ParDo(s, dereferenceValueToInt64, sums)
 	// Clamp negative counts to zero and return.
 	return beam.ParDo(s, clampNegativePartitionsInt64Fn, finalPartitions)
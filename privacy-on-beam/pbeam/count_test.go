@@ -88,7 +88,7 @@ func TestCountWithPartitionsNoNoise(t *testing.T) {
 	// we need to have each partition pass with 1-10⁻²⁵ probability (k=25).
 	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 2.0
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
-	got := Count(s, pcol, CountParams{MaxValue: 2, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+	got := Count(s, pcol, CountParams{MaxValue: 2, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 	want = beam.ParDo(s, int64MetricToKV, want)
 	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
 		t.Fatalf("TestCountWithPartitionsNoNoise: %v", err)
@@ -98,6 +98,36 @@ func TestCountWithPartitionsNoNoise(t *testing.T) {
 	}
 }
 
+// Checks that Count with AutoNoise and public partitions can use Laplace noise
+// even with a non-zero δ.
+func TestCountWithPartitionsAutoNoise(t *testing.T) {
+	var pairs []pairII
+	for i := 0; i < 10; i++ {
+		pairs = append(pairs, pairII{i, 1})
+	}
+	result := []testInt64Metric{
+		{1, 10},
+		{2, 0},
+	}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, pairToKV, col)
+	partitionsCol := beam.CreateList(s, []int{1, 2})
+	// With MaxPartitionsContributed=1, AutoNoise chooses Laplace noise, which
+	// doesn't use δ. We use ε=50 and l1Sensitivity=1. We have 2 partitions. So,
+	// to get an overall flakiness of 10⁻²³, we need to have each partition pass
+	// with 1-10⁻²⁵ probability (k=25).
+	epsilon, delta, k, l1Sensitivity := 50.0, 1e-5, 25.0, 1.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	got := Count(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, NoiseKind: AutoNoise{}, PublicPartitions: partitionsCol})
+	want = beam.ParDo(s, int64MetricToKV, want)
+	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestCountWithPartitionsAutoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountWithPartitionsAutoNoise: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
 // Checks that Count is performing a random partition selection.
 func TestCountPartitionSelectionNonDeterministic(t *testing.T) {
 	for _, tc := range []struct {
@@ -176,6 +206,55 @@ func TestCountPartitionSelectionNonDeterministic(t *testing.T) {
 	}
 }
 
+// Checks that Count is performing a random partition selection with the
+// thresholding partition selection strategies.
+func TestCountPartitionSelectionStrategyNonDeterministic(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		strategy dpagg.PartitionSelectionStrategy
+	}{
+		{
+			// With Laplace noise, the entire δ is used for partition selection,
+			// and LaplacePartitionSelection uses all of it for thresholding.
+			// countPerValue=1 yields a 60% chance of emitting any particular
+			// partition (since δ_emit=0.6).
+			name:     "Laplace thresholding",
+			strategy: dpagg.LaplacePartitionSelection,
+		},
+		{
+			// GaussianPartitionSelection uses half of δ for thresholding, so
+			// countPerValue=1 yields a 30% chance of emitting any particular
+			// partition (since δ_emit=0.3).
+			name:     "Gaussian thresholding",
+			strategy: dpagg.GaussianPartitionSelection,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// 143 distinct partitions with a single privacy unit each implies that
+			// some (but not all) partitions are emitted with high probability (at
+			// least 1 - 1e-20).
+			numPartitions := 143
+			var pairs []pairII
+			for i := 0; i < numPartitions; i++ {
+				pairs = append(pairs, pairII{i, i})
+			}
+			p, s, col := ptest.CreateList(pairs)
+			col = beam.ParDo(s, pairToKV, col)
+
+			// Run Count on pairs
+			pcol := MakePrivate(s, col, NewPrivacySpec(2, 0.6))
+			got := Count(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}, PartitionSelectionStrategy: tc.strategy})
+			got = beam.ParDo(s, kvToInt64Metric, got)
+
+			// Validate that partitions are selected randomly (i.e., some emitted and some dropped).
+			checkSomePartitionsAreDropped(s, got, numPartitions)
+			if err := ptest.Run(p); err != nil {
+				t.Errorf("%v", err)
+			}
+		})
+	}
+}
+
 // Checks that Count adds noise to its output.
 func TestCountAddsNoise(t *testing.T) {
 	for _, tc := range []struct {
@@ -276,7 +355,7 @@ func TestCountAddsNoiseWithPartitions(t *testing.T) {
 		col = beam.ParDo(s, pairToKV, col)
 		partitionsCol := beam.CreateList(s, []int{0})
 		pcol := MakePrivate(s, col, NewPrivacySpec(tc.epsilon, tc.delta))
-		got := Count(s, pcol, CountParams{MaxPartitionsContributed: 1, MaxValue: 1, NoiseKind: tc.noiseKind, partitionsCol: partitionsCol})
+		got := Count(s, pcol, CountParams{MaxPartitionsContributed: 1, MaxValue: 1, NoiseKind: tc.noiseKind, PublicPartitions: partitionsCol})
 		got = beam.ParDo(s, kvToInt64Metric, got)
 		checkInt64MetricsAreNoisy(s, got, 10, tolerance)
 		if err := ptest.Run(p); err != nil {
@@ -338,7 +417,7 @@ func TestCountWithPartitionsCrossPartitionContributionBounding(t *testing.T) {
 	// we need to have each partition pass with 1-10⁻²⁵ probability (k=25).
 	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
-	got := Count(s, pcol, CountParams{MaxPartitionsContributed: 3, MaxValue: 1, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+	got := Count(s, pcol, CountParams{MaxPartitionsContributed: 3, MaxValue: 1, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 	// With a max contribution of 3, 40% of the data from the specified partitions should be dropped.
 	// The sum of all elements must then be 150.
 	counts := beam.DropKey(s, got)
@@ -391,7 +470,7 @@ func TestCountWithPartitionsReturnsNonNegative(t *testing.T) {
 	// a high delta keeps many partitions.
 	epsilon, delta, maxValue := 0.001, 0.999, int64(1e8)
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
-	counts := Count(s, pcol, CountParams{MaxValue: maxValue, MaxPartitionsContributed: 1, NoiseKind: GaussianNoise{}, partitionsCol: partitionsCol})
+	counts := Count(s, pcol, CountParams{MaxValue: maxValue, MaxPartitionsContributed: 1, NoiseKind: GaussianNoise{}, PublicPartitions: partitionsCol})
 	values := beam.DropKey(s, counts)
 	// Check if we have negative elements.
 	beam.ParDo0(s, checkNoNegativeValuesInt64Fn, values)
@@ -37,7 +37,7 @@ func init() {
 // DistinctPrivacyIDParams specifies the parameters associated with a
 // DistinctPrivacyID aggregation.
 type DistinctPrivacyIDParams struct {
-	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
 	//
 	// Defaults to LaplaceNoise{}.
 	NoiseKind NoiseKind
@@ -55,10 +55,15 @@ type DistinctPrivacyIDParams struct {
 	//
 	// Required.
 	MaxPartitionsContributed int64
-	// Client-specified partitions.
+	// Partitions to keep in the output, if they are known in advance. When
+	// PublicPartitions is set, no budget is spent on partition selection:
+	// partitions that are not in PublicPartitions are dropped, and partitions
+	// in PublicPartitions without any data are added to the output.
+	// PublicPartitions must not depend on private data, except through a
+	// differentially private transform such as SelectPartitions.
 	//
 	// Optional.
-	partitionsCol beam.PCollection
+	PublicPartitions beam.PCollection
 }
 
 // DistinctPrivacyID counts the number of distinct privacy identifiers
@@ -68,6 +73,19 @@ type DistinctPrivacyIDParams struct {
 // MaxValue=1, but is specifically optimized for this use case.
 // Client can also specify a PCollection of partitions.
 //
+// Thresholding the noisy counts is equivalent to selecting partitions with
+// dpagg.LaplacePartitionSelection or dpagg.GaussianPartitionSelection
+// (depending on NoiseKind), so no separate budget is spent on partition
+// selection. The partitions of the output can then be used as the
+// PublicPartitions of other aggregations, which don't spend budget on
+// partition selection either.
+//
+// pbeam doesn't provide a transform thresholding noisy counts that were
+// computed without thresholding (e.g. with PublicPartitions): it couldn't
+// check that they were computed with the privacy parameters of the
+// thresholding. Such counts can be thresholded with
+// dpagg.ThresholdingPartitionSelection.ShouldKeepNoisyCount instead.
+//
 // Note: Do not use when your results may cause overflows for Int64 values.
 // This aggregation is not hardened for such applications yet.
 //
@@ -78,33 +96,27 @@ func DistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params DistinctPri
 	// Obtain type information from the underlying PCollection<K,V>.
 	idT, partitionT := beam.ValidateKVType(pcol.col)
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
-	}
 	// Get privacy parameters.
-	spec := pcol.privacySpec
-	epsilon, delta, err := spec.consumeBudget(params.Epsilon, params.Delta)
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
 	if err != nil {
 		log.Exitf("couldn't consume budget: %v", err)
 	}
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	noiseKind, delta := getNoiseKind(params.NoiseKind, maxPartitionsContributed, epsilon, delta, (params.PublicPartitions).IsValid())
 	err = checkDistinctPrivacyIDParams(params, epsilon, delta, noiseKind)
 	if err != nil {
 		log.Exit(err)
 	}
 
-	maxPartitionsContributed := getMaxPartitionsContributed(spec, params.MaxPartitionsContributed)
 	// Drop unspecified partitions, if partitions are specified.
-	if (params.partitionsCol).IsValid() {
-		if partitionT.Type() != (params.partitionsCol).Type().Type() {
+	if (params.PublicPartitions).IsValid() {
+		if partitionT.Type() != (params.PublicPartitions).Type().Type() {
 			log.Exitf("Specified partitions must be of type %v. Got type %v instead.",
-				partitionT.Type(), (params.partitionsCol).Type().Type())
+				partitionT.Type(), (params.PublicPartitions).Type().Type())
 		}
+		params.PublicPartitions = windowPublicPartitions(s, pcol, params.PublicPartitions)
 		partitionEncodedType := beam.EncodedType{partitionT.Type()}
-		pcol.col = dropUnspecifiedPartitionsVFn(s, params.partitionsCol, pcol, partitionEncodedType)
+		pcol.col = dropUnspecifiedPartitionsVFn(s, params.PublicPartitions, pcol, partitionEncodedType)
 	}
 	// First, deduplicate KV pairs by encoding them and calling Distinct.
 	coded := beam.ParDo(s, kv.NewEncodeFn(idT, partitionT), pcol.col)
@@ -121,7 +133,7 @@ func DistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params DistinctPri
 	values := beam.DropKey(s, decoded)
 	dummyCounts := beam.ParDo(s, addOneValueFn, values)
 	// Add specified partitions and return the aggregation output, if partitions are specified.
-	if (params.partitionsCol).IsValid() {
+	if (params.PublicPartitions).IsValid() {
 		return addSpecifiedPartitionsForDistinctID(s, params, epsilon, delta, maxPartitionsContributed, noiseKind, dummyCounts)
 	}
 	noisedCounts := beam.CombinePerKey(s,
@@ -133,7 +145,7 @@ func DistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params DistinctPri
 
 func addSpecifiedPartitionsForDistinctID(s beam.Scope, params DistinctPrivacyIDParams, epsilon, delta float64,
 	maxPartitionsContributed int64, noiseKind noise.Kind, countsKV beam.PCollection) beam.PCollection {
-	prepareAddSpecifiedPartitions := beam.ParDo(s, addDummyValuesToSpecifiedPartitionsInt64Fn, params.partitionsCol)
+	prepareAddSpecifiedPartitions := beam.ParDo(s, addDummyValuesToSpecifiedPartitionsInt64Fn, params.PublicPartitions)
 	// Merge countsKV and prepareAddSpecifiedPartitions.
 	allAddPartitions := beam.Flatten(s, countsKV, prepareAddSpecifiedPartitions)
 	noisedCounts := beam.CombinePerKey(s,
@@ -149,7 +161,7 @@ func checkDistinctPrivacyIDParams(params DistinctPrivacyIDParams, epsilon, delta
 	}
 	if noiseKind == noise.LaplaceNoise {
 		err = checks.CheckDelta("pbeam.DistinctPrivacyID", delta)
-		if (params.partitionsCol).IsValid() {
+		if (params.PublicPartitions).IsValid() {
 			err = checks.CheckNoDelta("pbeam.DistinctPrivacyID", delta)
 		}
 	} else {
@@ -0,0 +1,456 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/filter"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+)
+
+// This file contains global aggregations, which compute a single aggregate
+// over a whole PrivatePCollection. The contributions of each privacy
+// identifier are first bounded, then combined with a differentially private
+// combineFn without partition selection, so no budget is spent on partition
+// selection and the output always contains exactly one element.
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*emitGlobalInt64Fn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*emitGlobalFloat64Fn)(nil)))
+	beam.RegisterFunction(oneRecordInt64Fn)
+}
+
+// GlobalCountParams specifies the parameters associated with a GlobalCount
+// aggregation.
+type GlobalCountParams struct {
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed. Since there is
+	// no partition selection, Delta must be 0 with Laplace noise.
+	Epsilon, Delta float64
+	// The maximum number of records that a privacy identifier can contribute
+	// to the count. If a privacy identifier is associated with more records,
+	// only MaxValue of them are counted. There is an inherent trade-off when
+	// choosing MaxValue: a larger parameter means that less records are lost,
+	// but a larger noise.
+	//
+	// Required.
+	MaxValue int64
+}
+
+// GlobalCount counts the number of records in a PrivatePCollection, adding
+// differentially private noise to the count.
+//
+// Note: Do not use when your results may cause overflows for Int64 values.
+// This aggregation is not hardened for such applications yet.
+//
+// GlobalCount transforms a PrivatePCollection<V> or a PrivatePCollection<K,V>
+// into a PCollection<int64> containing a single element.
+func GlobalCount(s beam.Scope, pcol PrivatePCollection, params GlobalCountParams) beam.PCollection {
+	s = s.Scope("pbeam.GlobalCount")
+	if err := checkNotWindowed("pbeam.GlobalCount", pcol); err != nil {
+		log.Exit(err)
+	}
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	noiseKind, delta := getNoiseKind(params.NoiseKind, 1, epsilon, delta, true)
+	err = checkGlobalCountParams(params, epsilon, delta, noiseKind)
+	if err != nil {
+		log.Exit(err)
+	}
+	maxValue := boundByMaxContributions(pcol, params.MaxValue)
+	// First, count the records of each privacy identifier.
+	perID := stats.SumPerKey(s, beam.ParDo(s, oneRecordInt64Fn, pcol.col))
+	// Second, drop the privacy identifiers and do a DP sum of the counts, each
+	// of them being clamped to MaxValue.
+	sumFn := newBoundedSumInt64Fn(epsilon, delta, 1, 0, maxValue, noiseKind, true, dpagg.PreAggPartitionSelection)
+	count := beam.Combine(s, sumFn, beam.DropKey(s, perID))
+	// Finally, emit the count, clamping it to zero if it is negative.
+	return emitGlobalInt64(s, &emitGlobalInt64Fn{Sum: sumFn, ClampNegative: true}, count)
+}
+
+func checkGlobalCountParams(params GlobalCountParams, epsilon, delta float64, noiseKind noise.Kind) error {
+	err := checkGlobalBudget("pbeam.GlobalCount", epsilon, delta, noiseKind)
+	if err != nil {
+		return err
+	}
+	if params.MaxValue <= 0 {
+		return fmt.Errorf("pbeam.GlobalCount: MaxValue should be strictly positive, got %d", params.MaxValue)
+	}
+	return nil
+}
+
+func oneRecordInt64Fn(id beam.W, _ beam.V) (beam.W, int64) {
+	return id, 1
+}
+
+// GlobalSumParams specifies the parameters associated with a GlobalSum
+// aggregation.
+type GlobalSumParams struct {
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed. Since there is
+	// no partition selection, Delta must be 0 with Laplace noise.
+	Epsilon, Delta float64
+	// The total contribution of a given privacy identifier to the sum should
+	// be at least MinValue, and at most MaxValue; otherwise it will be clamped
+	// to these bounds. There is an inherent trade-off when choosing MinValue
+	// and MaxValue: a small MinValue and a large MaxValue means that less
+	// records will be clamped, but that more noise will be added.
+	//
+	// Required, unless MinValueInt64 or MaxValueInt64 is set.
+	MinValue, MaxValue float64
+	// Integer bounds on the total contribution of a given privacy identifier
+	// (see SumParams.MinValueInt64 and SumParams.MaxValueInt64).
+	MinValueInt64, MaxValueInt64 int64
+}
+
+// GlobalSum sums the values of a PrivatePCollection, adding differentially
+// private noise to the sum.
+//
+// Note: Do not use when your results may cause overflows for Int64 and Float64
+// values. This aggregation is not hardened for such applications yet.
+//
+// GlobalSum transforms a PrivatePCollection<V> either into a PCollection<int64>
+// or a PCollection<float64> containing a single element, depending on whether
+// its input is an integer type or a float type.
+func GlobalSum(s beam.Scope, pcol PrivatePCollection, params GlobalSumParams) beam.PCollection {
+	s = s.Scope("pbeam.GlobalSum")
+	if err := checkNotWindowed("pbeam.GlobalSum", pcol); err != nil {
+		log.Exit(err)
+	}
+	_, valueT := beam.ValidateKVType(pcol.col)
+	if valueT.Type() == reflect.TypeOf(kv.Pair{}) {
+		log.Exitf("GlobalSum must be used on a PrivatePCollection of type <V>, got type <K,V> instead")
+	}
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	noiseKind, delta := getNoiseKind(params.NoiseKind, 1, epsilon, delta, true)
+	sumParams := SumParams{
+		MinValue:      params.MinValue,
+		MaxValue:      params.MaxValue,
+		MinValueInt64: params.MinValueInt64,
+		MaxValueInt64: params.MaxValueInt64,
+	}
+	err = checkGlobalSumParams(sumParams, epsilon, delta, noiseKind)
+	if err != nil {
+		log.Exit(err)
+	}
+	// Convert the values to int64 or float64 before summing them, so that the
+	// sums cannot overflow the input type.
+	convertFn, err := findConvertFn(valueT)
+	if err != nil {
+		log.Exit(err)
+	}
+	vKind, err := getKind(convertFn)
+	if err != nil {
+		log.Exit(err)
+	}
+	if hasInt64Bounds(sumParams) && vKind != reflect.Int64 {
+		log.Exitf("pbeam.GlobalSum: MinValueInt64 and MaxValueInt64 can only be used with integer values, got values of type %v", valueT)
+	}
+	// First, sum the values of each privacy identifier.
+	perID := stats.SumPerKey(s, beam.ParDo(s, convertFn, pcol.col))
+	// Second, drop the privacy identifiers and do a DP sum of the partial sums,
+	// each of them being clamped to the bounds.
+	sumFn := newSumPerKeyFn(epsilon, delta, 1, sumParams, noiseKind, vKind, true)
+	sum := beam.Combine(s, sumFn, beam.DropKey(s, perID))
+	// Finally, emit the sum, clamping it to zero if it is negative and the lower
+	// bound is non-negative.
+	clampNegative := hasNonNegativeLowerBound(sumParams)
+	switch fn := sumFn.(type) {
+	case *boundedSumInt64Fn:
+		return emitGlobalInt64(s, &emitGlobalInt64Fn{Sum: fn, ClampNegative: clampNegative}, sum)
+	case *boundedSumFloat64Fn:
+		return emitGlobalFloat64(s, &emitGlobalFloat64Fn{Sum: fn, ClampNegative: clampNegative}, sum)
+	default:
+		log.Exitf("pbeam.GlobalSum: unexpected combineFn %T", sumFn)
+	}
+	return beam.PCollection{}
+}
+
+// checkGlobalSumParams checks the parameters of a GlobalSum, given as the
+// SumParams with the same bounds.
+func checkGlobalSumParams(params SumParams, epsilon, delta float64, noiseKind noise.Kind) error {
+	err := checkGlobalBudget("pbeam.GlobalSum", epsilon, delta, noiseKind)
+	if err != nil {
+		return err
+	}
+	if hasInt64Bounds(params) {
+		if params.MinValue != 0 || params.MaxValue != 0 {
+			return fmt.Errorf("pbeam.GlobalSum: MinValue (%f) and MaxValue (%f) must be 0 when MinValueInt64 or MaxValueInt64 is set", params.MinValue, params.MaxValue)
+		}
+		return checks.CheckBoundsInt64("pbeam.GlobalSum", params.MinValueInt64, params.MaxValueInt64)
+	}
+	return checks.CheckBoundsFloat64("pbeam.GlobalSum", params.MinValue, params.MaxValue)
+}
+
+// GlobalMeanParams specifies the parameters associated with a GlobalMean
+// aggregation.
+type GlobalMeanParams struct {
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed. Since there is
+	// no partition selection, Delta must be 0 with Laplace noise.
+	Epsilon, Delta float64
+	// The maximum number of records that a privacy identifier can contribute
+	// to the mean. If a privacy identifier is associated with more records,
+	// random records will be dropped. There is an inherent trade-off when
+	// choosing MaxContributions: a larger parameter means that less records
+	// are lost, but a larger noise.
+	//
+	// Required.
+	MaxContributions int64
+	// Each value contributed to the mean should be at least MinValue, and at
+	// most MaxValue; otherwise it will be clamped to these bounds.
+	//
+	// Required.
+	MinValue, MaxValue float64
+	// Fraction of the budget used for the count of the mean (see
+	// MeanParams.CountBudgetFraction).
+	//
+	// Defaults to 0.5.
+	CountBudgetFraction float64
+	// An estimate of the mean, from which CountBudgetFraction is derived if set
+	// (see MeanParams.ExpectedMean).
+	//
+	// Optional.
+	ExpectedMean *float64
+}
+
+// GlobalMean obtains the mean of the values of a PrivatePCollection, adding
+// differentially private noise to the mean.
+//
+// Note: Do not use when your results may cause overflows for Int64 or Float64
+// values. This aggregation is not hardened for such applications yet.
+//
+// GlobalMean transforms a PrivatePCollection<V> into a PCollection<float64>
+// containing a single element.
+func GlobalMean(s beam.Scope, pcol PrivatePCollection, params GlobalMeanParams) beam.PCollection {
+	s = s.Scope("pbeam.GlobalMean")
+	if err := checkNotWindowed("pbeam.GlobalMean", pcol); err != nil {
+		log.Exit(err)
+	}
+	_, valueT := beam.ValidateKVType(pcol.col)
+	if valueT.Type() == reflect.TypeOf(kv.Pair{}) {
+		log.Exitf("GlobalMean must be used on a PrivatePCollection of type <V>, got type <K,V> instead")
+	}
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	noiseKind, delta := getNoiseKind(params.NoiseKind, 1, epsilon, delta, true)
+	err = checkGlobalMeanParams(params, epsilon, delta, noiseKind)
+	if err != nil {
+		log.Exit(err)
+	}
+	maxContributions := getMaxContributionsPerPartition(pcol, params.MaxContributions)
+	countBudgetFraction := getCountBudgetFraction(params.CountBudgetFraction, params.ExpectedMean, noiseKind, params.MinValue, params.MaxValue)
+	meanFn := newBoundedMeanFloat64Fn(epsilon, delta, 1, maxContributions, params.MinValue, params.MaxValue, countBudgetFraction, noiseKind, true, dpagg.PreAggPartitionSelection)
+	convertFn, err := findConvertToFloat64Fn(valueT)
+	if err != nil {
+		log.Exit(err)
+	}
+	// First, bound the number of values of each privacy identifier, and
+	// pre-aggregate them into a partial mean.
+	converted := boundContributions(s, beam.ParDo(s, convertFn, pcol.col), maxContributions)
+	perID := beam.CombinePerKey(s, newMeanPartialFloat64Fn(meanFn), converted)
+	// Second, drop the privacy identifiers and compute the DP mean of the
+	// partial means.
+	mean := beam.Combine(s, meanFn, beam.DropKey(s, perID))
+	return emitGlobalFloat64(s, &emitGlobalFloat64Fn{Mean: meanFn}, mean)
+}
+
+func checkGlobalMeanParams(params GlobalMeanParams, epsilon, delta float64, noiseKind noise.Kind) error {
+	err := checkGlobalBudget("pbeam.GlobalMean", epsilon, delta, noiseKind)
+	if err != nil {
+		return err
+	}
+	if params.MaxContributions <= 0 {
+		return fmt.Errorf("pbeam.GlobalMean: MaxContributions should be strictly positive, got %d", params.MaxContributions)
+	}
+	err = checks.CheckBoundsFloat64("pbeam.GlobalMean", params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	return checkCountBudgetFraction("pbeam.GlobalMean", params.CountBudgetFraction, params.ExpectedMean)
+}
+
+// GlobalDistinctPrivacyIDParams specifies the parameters associated with a
+// GlobalDistinctPrivacyID aggregation.
+type GlobalDistinctPrivacyIDParams struct {
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
+	//
+	// Defaults to LaplaceNoise{}.
+	NoiseKind NoiseKind
+	// Differential privacy budget consumed by this aggregation. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed. Since there is
+	// no partition selection, Delta must be 0 with Laplace noise.
+	Epsilon, Delta float64
+}
+
+// GlobalDistinctPrivacyID counts the number of distinct privacy identifiers in
+// a PrivatePCollection, adding differentially private noise to the count.
+//
+// GlobalDistinctPrivacyID transforms a PrivatePCollection<V> or a
+// PrivatePCollection<K,V> into a PCollection<int64> containing a single
+// element.
+func GlobalDistinctPrivacyID(s beam.Scope, pcol PrivatePCollection, params GlobalDistinctPrivacyIDParams) beam.PCollection {
+	s = s.Scope("pbeam.GlobalDistinctPrivacyID")
+	if err := checkNotWindowed("pbeam.GlobalDistinctPrivacyID", pcol); err != nil {
+		log.Exit(err)
+	}
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	noiseKind, delta := getNoiseKind(params.NoiseKind, 1, epsilon, delta, true)
+	err = checkGlobalBudget("pbeam.GlobalDistinctPrivacyID", epsilon, delta, noiseKind)
+	if err != nil {
+		log.Exit(err)
+	}
+	// First, keep each privacy identifier once.
+	ids := filter.Distinct(s, beam.DropValue(s, pcol.col))
+	// Second, do a DP count of the privacy identifiers.
+	countFn := newCountFn(epsilon, delta, 1, noiseKind, true)
+	count := beam.Combine(s, countFn, ids)
+	// Finally, emit the count, clamping it to zero if it is negative.
+	return emitGlobalInt64(s, &emitGlobalInt64Fn{Count: countFn, ClampNegative: true}, count)
+}
+
+// checkGlobalBudget checks the budget of a global aggregation. Since there is
+// no partition selection, delta must be 0 with Laplace noise.
+func checkGlobalBudget(label string, epsilon, delta float64, noiseKind noise.Kind) error {
+	err := checks.CheckEpsilon(label, epsilon)
+	if err != nil {
+		return err
+	}
+	if noiseKind == noise.LaplaceNoise {
+		return checks.CheckNoDelta(label, delta)
+	}
+	return checks.CheckDeltaStrict(label, delta)
+}
+
+// emitGlobalInt64 returns a PCollection<int64> containing the single output of
+// fn, given the output of its combineFn on the contributions, which is empty
+// if there are no contributions.
+func emitGlobalInt64(s beam.Scope, fn *emitGlobalInt64Fn, combined beam.PCollection) beam.PCollection {
+	return beam.ParDo(s, fn, beam.Impulse(s), beam.SideInput{Input: combined})
+}
+
+// emitGlobalFloat64 is the float64 equivalent of emitGlobalInt64.
+func emitGlobalFloat64(s beam.Scope, fn *emitGlobalFloat64Fn, combined beam.PCollection) beam.PCollection {
+	return beam.ParDo(s, fn, beam.Impulse(s), beam.SideInput{Input: combined})
+}
+
+// emitGlobalInt64Fn emits the output of the combineFn of a global aggregation,
+// which is either Sum or Count, given as a side input. beam.Combine has no
+// output on an empty input: in that case, emitGlobalInt64Fn emits the output
+// of the combineFn without any contribution instead, so that there is always
+// exactly one output.
+type emitGlobalInt64Fn struct {
+	Sum           *boundedSumInt64Fn
+	Count         *countFn
+	ClampNegative bool
+}
+
+func (fn *emitGlobalInt64Fn) Setup() {
+	if fn.Sum != nil {
+		fn.Sum.Setup()
+	}
+	if fn.Count != nil {
+		fn.Count.Setup()
+	}
+}
+
+func (fn *emitGlobalInt64Fn) ProcessElement(_ []byte, combined func(**int64) bool, emit func(int64)) {
+	var result *int64
+	if !combined(&result) {
+		if fn.Sum != nil {
+			result = fn.Sum.ExtractOutput(fn.Sum.CreateAccumulator())
+		} else {
+			result = fn.Count.ExtractOutput(fn.Count.CreateAccumulator())
+		}
+	}
+	if fn.ClampNegative && *result < 0 {
+		emit(0)
+		return
+	}
+	emit(*result)
+}
+
+// emitGlobalFloat64Fn is the float64 equivalent of emitGlobalInt64Fn, for
+// global aggregations whose combineFn is either Sum or Mean.
+type emitGlobalFloat64Fn struct {
+	Sum           *boundedSumFloat64Fn
+	Mean          *boundedMeanFloat64Fn
+	ClampNegative bool
+}
+
+func (fn *emitGlobalFloat64Fn) Setup() {
+	if fn.Sum != nil {
+		fn.Sum.Setup()
+	}
+	if fn.Mean != nil {
+		fn.Mean.Setup()
+	}
+}
+
+func (fn *emitGlobalFloat64Fn) ProcessElement(_ []byte, combined func(**float64) bool, emit func(float64)) {
+	var result *float64
+	if !combined(&result) {
+		if fn.Sum != nil {
+			result = fn.Sum.ExtractOutput(fn.Sum.CreateAccumulator())
+		} else {
+			result = fn.Mean.ExtractOutput(fn.Mean.CreateAccumulator())
+		}
+	}
+	if fn.ClampNegative && *result < 0 {
+		emit(0)
+		return
+	}
+	emit(*result)
+}
@@ -0,0 +1,264 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+// globalInt64ToKV associates the output of a global aggregation with the key 0,
+// so that it can be compared using approxEqualsKVInt64.
+func globalInt64ToKV(m int64) (int, int64) {
+	return 0, m
+}
+
+// globalFloat64ToKV associates the output of a global aggregation with the key
+// 0, so that it can be compared using approxEqualsKVFloat64.
+func globalFloat64ToKV(m float64) (int, float64) {
+	return 0, m
+}
+
+// Checks that GlobalCount returns a correct answer, and bounds the number of
+// records per privacy unit.
+func TestGlobalCountNoNoise(t *testing.T) {
+	// Privacy units 0 to 99 have 3 records each, but MaxValue is 2, so each of
+	// them should be counted twice. Privacy units 100 to 149 have 1 record each.
+	pairs := concatenatePairs(
+		makePairsWithFixedV(100, 0),
+		makePairsWithFixedV(100, 1),
+		makePairsWithFixedV(100, 2),
+		makePairsWithFixedVStartingFromKey(100, 50, 3),
+	)
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	// We use ε=50, δ=0 and l1Sensitivity=2. There is a single output, so to get
+	// a flakiness of 10⁻²³, we use k=23.
+	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 23.0, 2.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	got := GlobalCount(s, pcol, GlobalCountParams{MaxValue: 2, NoiseKind: LaplaceNoise{}})
+	want := beam.Create(s, int64(250))
+	if err := approxEqualsKVInt64(s, beam.ParDo(s, globalInt64ToKV, got), beam.ParDo(s, globalInt64ToKV, want), laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestGlobalCountNoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestGlobalCountNoNoise: GlobalCount(%v) = %v, expected 250: %v", col, got, err)
+	}
+}
+
+// Checks that GlobalSum returns a correct answer, and clamps the total
+// contribution of each privacy unit.
+func TestGlobalSumNoNoise(t *testing.T) {
+	// Privacy units 0 to 99 contribute 3 twice, for a total of 6 that is clamped
+	// to 5.
+	pairs := concatenatePairs(
+		makePairsWithFixedV(100, 3),
+		makePairsWithFixedV(100, 3),
+	)
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	// We use ε=50, δ=0 and l1Sensitivity=5. There is a single output, so to get
+	// a flakiness of 10⁻²³, we use k=23.
+	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 23.0, 5.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	got := GlobalSum(s, pcol, GlobalSumParams{MinValue: 0, MaxValue: 5, NoiseKind: LaplaceNoise{}})
+	want := beam.Create(s, int64(500))
+	if err := approxEqualsKVInt64(s, beam.ParDo(s, globalInt64ToKV, got), beam.ParDo(s, globalInt64ToKV, want), laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestGlobalSumNoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestGlobalSumNoNoise: GlobalSum(%v) = %v, expected 500: %v", col, got, err)
+	}
+}
+
+// Checks that GlobalMean returns a correct answer.
+func TestGlobalMeanNoNoise(t *testing.T) {
+	pairs := concatenatePairs(
+		makePairsWithFixedV(100, 1),
+		makePairsWithFixedVStartingFromKey(100, 150, 2),
+	)
+	exactCount := 250.0
+	exactMean := (100.0 + 2.0*150.0) / exactCount
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	// We use ε=50, δ=0, and the midpoint of [0, 2] is 1, so the normalized sum
+	// is 150. There is a single output, so to get a flakiness of 10⁻²³, we use
+	// k=23.
+	maxContributions := int64(1)
+	epsilon, delta, k, lower, upper := 50.0, 0.0, 23.0, 0.0, 2.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	got := GlobalMean(s, pcol, GlobalMeanParams{
+		MaxContributions: maxContributions,
+		MinValue:         lower,
+		MaxValue:         upper,
+		NoiseKind:        LaplaceNoise{},
+	})
+	want := beam.Create(s, exactMean)
+	tolerance, err := laplaceToleranceForMean(k, lower, upper, maxContributions, 1, epsilon, 150, exactCount, exactMean)
+	if err != nil {
+		t.Fatalf("laplaceToleranceForMean: got error %v", err)
+	}
+	if err := approxEqualsKVFloat64(s, beam.ParDo(s, globalFloat64ToKV, got), beam.ParDo(s, globalFloat64ToKV, want), tolerance); err != nil {
+		t.Fatalf("TestGlobalMeanNoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestGlobalMeanNoNoise: GlobalMean(%v) = %v, expected %f: %v", col, got, exactMean, err)
+	}
+}
+
+// Checks that GlobalDistinctPrivacyID returns a correct answer on a
+// PrivatePCollection<K,V>.
+func TestGlobalDistinctPrivacyIDNoNoise(t *testing.T) {
+	// 100 privacy units contribute several values to several partitions.
+	triples := concatenateTriplesWithIntValue(
+		makeTripleWithIntValue(100, 0, 1),
+		makeTripleWithIntValue(100, 0, 2),
+		makeTripleWithIntValue(100, 1, 1),
+	)
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	// We use ε=50, δ=0 and l1Sensitivity=1. There is a single output, so to get
+	// a flakiness of 10⁻²³, we use k=23.
+	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 23.0, 1.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	got := GlobalDistinctPrivacyID(s, pcol, GlobalDistinctPrivacyIDParams{NoiseKind: LaplaceNoise{}})
+	want := beam.Create(s, int64(100))
+	if err := approxEqualsKVInt64(s, beam.ParDo(s, globalInt64ToKV, got), beam.ParDo(s, globalInt64ToKV, want), laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestGlobalDistinctPrivacyIDNoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestGlobalDistinctPrivacyIDNoNoise: GlobalDistinctPrivacyID(%v) = %v, expected 100: %v", col, got, err)
+	}
+}
+
+// dropAllPairsFn drops all its inputs, returning an empty PCollection<int,int>.
+func dropAllPairsFn(_ pairII, _ func(int, int)) {}
+
+// Checks that global aggregations return a single value even when their input
+// is empty. Each output is mapped to 1 to check that it has exactly one element.
+func TestGlobalAggregationsEmptyInput(t *testing.T) {
+	p, s, col := ptest.CreateList([]pairII{{0, 0}})
+	col = beam.ParDo(s, dropAllPairsFn, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(4, 0))
+	passert.Equals(s, beam.ParDo(s, oneFn, GlobalCount(s, pcol, GlobalCountParams{Epsilon: 1, MaxValue: 1})), 1)
+	passert.Equals(s, beam.ParDo(s, oneFn, GlobalSum(s, pcol, GlobalSumParams{Epsilon: 1, MinValue: 0, MaxValue: 1})), 1)
+	passert.Equals(s, beam.ParDo(s, oneFn, GlobalMean(s, pcol, GlobalMeanParams{Epsilon: 1, MaxContributions: 1, MinValue: 0, MaxValue: 1})), 1)
+	passert.Equals(s, beam.ParDo(s, oneFn, GlobalDistinctPrivacyID(s, pcol, GlobalDistinctPrivacyIDParams{Epsilon: 1})), 1)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestGlobalAggregationsEmptyInput: %v", err)
+	}
+}
+
+// Checks that emitGlobalInt64Fn and emitGlobalFloat64Fn emit the output of
+// the combineFn, clamped to zero if it is negative only when ClampNegative is
+// set.
+func TestEmitGlobalClampsNegativeResults(t *testing.T) {
+	for _, clampNegative := range []bool{true, false} {
+		want := -5.0
+		if clampNegative {
+			want = 0
+		}
+		intFn := &emitGlobalInt64Fn{ClampNegative: clampNegative}
+		intFn.ProcessElement(nil, func(r **int64) bool {
+			*r = new(int64)
+			**r = -5
+			return true
+		}, func(got int64) {
+			if float64(got) != want {
+				t.Errorf("emitGlobalInt64Fn with ClampNegative=%t: got %d, want %f", clampNegative, got, want)
+			}
+		})
+		floatFn := &emitGlobalFloat64Fn{ClampNegative: clampNegative}
+		floatFn.ProcessElement(nil, func(r **float64) bool {
+			*r = new(float64)
+			**r = -5
+			return true
+		}, func(got float64) {
+			if got != want {
+				t.Errorf("emitGlobalFloat64Fn with ClampNegative=%t: got %f, want %f", clampNegative, got, want)
+			}
+		})
+	}
+}
+
+func TestCheckGlobalParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		check   func() error
+		wantErr bool
+	}{
+		{"valid count parameters",
+			func() error {
+				return checkGlobalCountParams(GlobalCountParams{MaxValue: 1}, 1, 0, noise.LaplaceNoise)
+			}, false},
+		{"zero MaxValue",
+			func() error {
+				return checkGlobalCountParams(GlobalCountParams{MaxValue: 0}, 1, 0, noise.LaplaceNoise)
+			}, true},
+		{"non-zero delta with Laplace noise",
+			func() error {
+				return checkGlobalCountParams(GlobalCountParams{MaxValue: 1}, 1, 1e-5, noise.LaplaceNoise)
+			}, true},
+		{"zero delta with Gaussian noise",
+			func() error {
+				return checkGlobalCountParams(GlobalCountParams{MaxValue: 1}, 1, 0, noise.GaussianNoise)
+			}, true},
+		{"valid sum parameters",
+			func() error {
+				return checkGlobalSumParams(SumParams{MinValue: -1, MaxValue: 1}, 1, 1e-5, noise.GaussianNoise)
+			}, false},
+		{"float and integer sum bounds",
+			func() error {
+				return checkGlobalSumParams(SumParams{MaxValue: 1, MaxValueInt64: 1}, 1, 0, noise.LaplaceNoise)
+			}, true},
+		{"valid mean parameters",
+			func() error {
+				return checkGlobalMeanParams(GlobalMeanParams{MaxContributions: 1, MaxValue: 1}, 1, 0, noise.LaplaceNoise)
+			}, false},
+		{"zero MaxContributions",
+			func() error {
+				return checkGlobalMeanParams(GlobalMeanParams{MaxValue: 1}, 1, 0, noise.LaplaceNoise)
+			}, true},
+		{"invalid CountBudgetFraction",
+			func() error {
+				return checkGlobalMeanParams(GlobalMeanParams{MaxContributions: 1, MaxValue: 1, CountBudgetFraction: 1}, 1, 0, noise.LaplaceNoise)
+			}, true},
+		{"both CountBudgetFraction and ExpectedMean",
+			func() error {
+				expectedMean := 0.5
+				return checkGlobalMeanParams(GlobalMeanParams{MaxContributions: 1, MaxValue: 1, CountBudgetFraction: 0.5, ExpectedMean: &expectedMean}, 1, 0, noise.LaplaceNoise)
+			}, true},
+		{"negative epsilon",
+			func() error {
+				return checkGlobalBudget("pbeam.GlobalDistinctPrivacyID", -1, 0, noise.LaplaceNoise)
+			}, true},
+	} {
+		if err := tc.check(); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
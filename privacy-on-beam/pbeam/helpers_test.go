@@ -109,11 +109,11 @@ func pairICodedKVToKV(p pairICodedKV) (k int, v kv.Pair) {
 }
 
 type protoPair struct {
-	key string
+	key int64
 	pb  *testpb.TestAnon
 }
 
-func kvToProtoPair(key string, pb *testpb.TestAnon) protoPair {
+func kvToProtoPair(key int64, pb *testpb.TestAnon) protoPair {
 	return protoPair{key, pb}
 }
 
@@ -607,12 +607,17 @@ func complementaryLaplaceToleranceForMean(flakinessK, lower, upper float64, maxC
 // See https://github.com/google/differential-privacy/blob/main/privacy-on-beam/docs/Tolerance_Calculation.pdf
 func complementaryGaussianToleranceForMean(flakinessK, lower, upper float64, maxContributionsPerPartition, maxPartitionsContributed int64, epsilon, delta float64, exactNormalizedSum, exactCount, exactMean float64) (float64, error) {
 	halfFlakiness := flakinessK / 2
-	epsilonCount, epsilonSum := epsilon/2, epsilon/2
-	deltaCount, deltaSum := delta/2, delta/2
 
 	l0Count, _, lInfCount := sensitivitiesForCount(maxContributionsPerPartition, maxPartitionsContributed)
 	l0NormalizedSum, _, lInfNormalizedSum := sensitivitiesForNormalizedSum(lower, upper, maxContributionsPerPartition, maxPartitionsContributed)
 
+	// With Gaussian noise, the budget is split between the count and the normalized
+	// sum such that each of them gets √2 times the noise needed on its own.
+	sigma := noise.SigmaForGaussian(int64(l0Count), lInfCount, epsilon, delta)
+	epsilonCount := noise.EpsilonForGaussian(sigma*math.Sqrt2, int64(l0Count), lInfCount, delta)
+	epsilonSum := noise.EpsilonForGaussian(sigma*math.Sqrt2*lInfNormalizedSum/lInfCount, int64(l0NormalizedSum), lInfNormalizedSum, delta)
+	deltaCount, deltaSum := delta, delta
+
 	countTolerance := math.Round(oneSidedComplementaryGaussianTolerance(halfFlakiness, l0Count, lInfCount, epsilonCount, deltaCount))
 	normalizedSumTolerance := oneSidedComplementaryGaussianTolerance(halfFlakiness, l0NormalizedSum, lInfNormalizedSum, epsilonSum, deltaSum)
 	return toleranceForMean(lower, upper, exactNormalizedSum, exactCount, exactMean, countTolerance, normalizedSumTolerance)
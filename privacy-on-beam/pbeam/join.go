@@ -0,0 +1,370 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/reflectx"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*joinWithPublicFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*keyByPrivacyIDAndPartitionFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*joinPrivateFn)(nil)))
+}
+
+// JoinWithPublic joins a PrivatePCollection<K,V> with a public PCollection<K,W>
+// on their keys, e.g. to enrich private records with public metadata before
+// aggregating them. For each record (k,v) of a privacy identifier and each
+// value w associated with k in the public PCollection, the output contains
+// the record (k, joinFn(v,w)) associated with the same privacy identifier.
+// Records of pcol whose key doesn't appear in public are dropped.
+//
+// joinFn must have the type func(V, W) X. Since the public PCollection is not
+// private, its values can be used freely; but if a key is associated with
+// several public values, each private record is duplicated accordingly, which
+// is taken into account by the contribution bounding of later aggregations.
+//
+// The public PCollection is read as a side input, so it must be small enough
+// to fit in the memory of each worker.
+//
+// JoinWithPublic transforms a PrivatePCollection<K,V> into a
+// PrivatePCollection<K,X>.
+func JoinWithPublic(s beam.Scope, joinFn interface{}, pcol PrivatePCollection, public beam.PCollection) PrivatePCollection {
+	s = s.Scope("pbeam.JoinWithPublic")
+	if pcol.codec == nil {
+		log.Exitf("pbeam.JoinWithPublic: the input PrivatePCollection must be of type <K,V>")
+	}
+	publicKeyT, publicValueT := beam.ValidateKVType(public)
+	if publicKeyT.Type() != pcol.codec.KType.T {
+		log.Exitf("pbeam.JoinWithPublic: the keys of the public PCollection must have type %v, got %v instead", pcol.codec.KType.T, publicKeyT.Type())
+	}
+	if err := checkJoinFn(joinFn, pcol.codec.VType.T, publicValueT.Type()); err != nil {
+		log.Exitf("pbeam.JoinWithPublic: %v", err)
+	}
+	outputCodec := kv.NewCodec(pcol.codec.KType.T, reflect.TypeOf(joinFn).Out(0))
+
+	// The public PCollection is read as a side input, so that private records
+	// are not shuffled and a key with many private records doesn't make its
+	// public values a hot spot.
+	joined := beam.ParDo(s,
+		newJoinWithPublicFn(joinFn, pcol.codec, outputCodec, publicKeyT),
+		pcol.col,
+		beam.SideInput{Input: public})
+	return PrivatePCollection{
+		col:         joined,
+		codec:       outputCodec,
+		privacySpec: pcol.privacySpec,
+		windowFn:    pcol.windowFn,
+		sampling:    pcol.sampling,
+	}
+}
+
+// checkJoinFn checks that joinFn is a function taking a private value of type
+// privateT and a public value of type publicT, and returning a single value.
+func checkJoinFn(joinFn interface{}, privateT, publicT reflect.Type) error {
+	if joinFn == nil || reflect.TypeOf(joinFn).Kind() != reflect.Func {
+		return fmt.Errorf("joinFn must be a function, got %T instead", joinFn)
+	}
+	fnT := reflect.TypeOf(joinFn)
+	if fnT.NumIn() != 2 || fnT.NumOut() != 1 {
+		return fmt.Errorf("joinFn must have the type func(%v, %v) X, got %v instead", privateT, publicT, fnT)
+	}
+	if !privateT.AssignableTo(fnT.In(0)) {
+		return fmt.Errorf("the first argument of joinFn must have type %v, got %v instead", privateT, fnT.In(0))
+	}
+	if !publicT.AssignableTo(fnT.In(1)) {
+		return fmt.Errorf("the second argument of joinFn must have type %v, got %v instead", publicT, fnT.In(1))
+	}
+	return nil
+}
+
+// joinWithPublicFn joins private records with the public values of their
+// partition, read from a side input, and emits the joined records with their
+// privacy identifiers.
+type joinWithPublicFn struct {
+	JoinFn          beam.EncodedFunc
+	jfn             reflectx.Func2x1
+	PublicKeyType   beam.EncodedType
+	publicKeyEnc    beam.ElementEncoder
+	InputPairCodec  *kv.Codec
+	OutputPairCodec *kv.Codec
+	// The public values of each encoded partition in window, read from the side
+	// input when processing the first record of window.
+	window       typex.Window
+	publicValues map[string][]beam.Y
+}
+
+func newJoinWithPublicFn(joinFn interface{}, inputCodec, outputCodec *kv.Codec, publicKeyType typex.FullType) *joinWithPublicFn {
+	return &joinWithPublicFn{
+		JoinFn:          beam.EncodedFunc{Fn: reflectx.MakeFunc(joinFn)},
+		PublicKeyType:   beam.EncodedType{publicKeyType.Type()},
+		InputPairCodec:  inputCodec,
+		OutputPairCodec: outputCodec,
+	}
+}
+
+func (fn *joinWithPublicFn) Setup() error {
+	fn.jfn = reflectx.ToFunc2x1(fn.JoinFn.Fn)
+	fn.publicKeyEnc = beam.NewElementEncoder(fn.PublicKeyType.T)
+	if err := fn.InputPairCodec.Setup(); err != nil {
+		return err
+	}
+	return fn.OutputPairCodec.Setup()
+}
+
+func (fn *joinWithPublicFn) ProcessElement(w typex.Window, id beam.W, pair kv.Pair, publicIter func(*beam.X, *beam.Y) bool, emit func(beam.W, kv.Pair)) {
+	if fn.publicValues == nil || !w.Equals(fn.window) {
+		fn.window = w
+		fn.readPublicValues(publicIter)
+	}
+	publicValues := fn.publicValues[string(pair.K)]
+	if len(publicValues) == 0 {
+		return
+	}
+	k, v := fn.InputPairCodec.Decode(pair)
+	for _, publicValue := range publicValues {
+		emit(id, fn.OutputPairCodec.Encode(k, fn.jfn.Call2x1(v, publicValue)))
+	}
+}
+
+// readPublicValues groups the public values by partition. Partitions are
+// encoded like the keys of the private records, so that they can be looked up
+// without decoding them.
+func (fn *joinWithPublicFn) readPublicValues(publicIter func(*beam.X, *beam.Y) bool) {
+	fn.publicValues = make(map[string][]beam.Y)
+	var k beam.X
+	var v beam.Y
+	for publicIter(&k, &v) {
+		var kBuf bytes.Buffer
+		if err := fn.publicKeyEnc.Encode(k, &kBuf); err != nil {
+			log.Exitf("pbeam.joinWithPublicFn.readPublicValues: couldn't encode partition %v: %v", k, err)
+		}
+		fn.publicValues[kBuf.String()] = append(fn.publicValues[kBuf.String()], v)
+	}
+}
+
+// JoinParams specifies the parameters associated with a Join transform.
+type JoinParams struct {
+	// The maximum number of joined records that a given privacy identifier can
+	// contribute to the output. Joining two PrivatePCollections can multiply
+	// the number of records of a privacy identifier: if it has n records with
+	// a given key on the left side and m records with the same key on the
+	// right side, it has n×m joined records with this key. If a privacy
+	// identifier is associated with more than MaxFanOut joined records, random
+	// joined records will be dropped, so that its contributions to later
+	// aggregations stay bounded.
+	//
+	// Required.
+	MaxFanOut int64
+}
+
+// Join joins two PrivatePCollections<K,V> and <K,W> sharing the same privacy
+// unit: a record (k,v) of the left side and a record (k,w) of the right side
+// are joined if they are associated with the same privacy identifier and have
+// the same key k. The output contains the record (k, joinFn(v,w)) associated
+// with this privacy identifier. Records are never joined across privacy
+// identifiers, so no privacy budget is consumed.
+//
+// joinFn must have the type func(V, W) X. Both PrivatePCollections must have
+// been created with the same PrivacySpec and have the same windowing function,
+// and their privacy identifiers must have the same type. The number of joined
+// records per privacy identifier is bounded by params.MaxFanOut, and later
+// aggregations use this bound like after BoundSubUnitContributions.
+//
+// Join transforms a PrivatePCollection<K,V> and a PrivatePCollection<K,W> into
+// a PrivatePCollection<K,X>.
+func Join(s beam.Scope, joinFn interface{}, left, right PrivatePCollection, params JoinParams) PrivatePCollection {
+	s = s.Scope("pbeam.Join")
+	if err := checkJoinParams(params); err != nil {
+		log.Exit(err)
+	}
+	if left.codec == nil || right.codec == nil {
+		log.Exitf("pbeam.Join: both input PrivatePCollections must be of type <K,V>")
+	}
+	if left.privacySpec != right.privacySpec {
+		log.Exitf("pbeam.Join: both input PrivatePCollections must have the same PrivacySpec")
+	}
+	if !sameWindowFn(left, right) {
+		log.Exitf("pbeam.Join: both input PrivatePCollections must have the same windowing function, got %v and %v", left.windowFn, right.windowFn)
+	}
+	leftIDT, _ := beam.ValidateKVType(left.col)
+	rightIDT, _ := beam.ValidateKVType(right.col)
+	if leftIDT.Type() != rightIDT.Type() {
+		log.Exitf("pbeam.Join: both input PrivatePCollections must have privacy identifiers of the same type, got %v and %v", leftIDT.Type(), rightIDT.Type())
+	}
+	if left.codec.KType.T != right.codec.KType.T {
+		log.Exitf("pbeam.Join: both input PrivatePCollections must have keys of the same type, got %v and %v", left.codec.KType.T, right.codec.KType.T)
+	}
+	if err := checkJoinFn(joinFn, left.codec.VType.T, right.codec.VType.T); err != nil {
+		log.Exitf("pbeam.Join: %v", err)
+	}
+	outputCodec := kv.NewCodec(left.codec.KType.T, reflect.TypeOf(joinFn).Out(0))
+
+	// First, key the records of both sides by (privacy ID, partition) pairs,
+	// and group them.
+	leftKeyed := beam.ParDo(s, newKeyByPrivacyIDAndPartitionFn(leftIDT), left.col)
+	rightKeyed := beam.ParDo(s, newKeyByPrivacyIDAndPartitionFn(rightIDT), right.col)
+	grouped := beam.CoGroupByKey(s, leftKeyed, rightKeyed)
+	// Second, join the records of each (privacy ID, partition) pair. At most
+	// MaxFanOut joined records are kept for each pair.
+	joined := beam.ParDo(s,
+		newJoinPrivateFn(joinFn, leftIDT, left.codec, right.codec, outputCodec, params.MaxFanOut),
+		grouped,
+		beam.TypeDefinition{Var: beam.WType, T: leftIDT.Type()})
+	// Finally, bound the number of joined records per privacy ID across
+	// partitions. The output is only derived from a sample if both inputs are
+	// derived from it.
+	var sampling *poissonSampling
+	if left.sampling == right.sampling {
+		sampling = left.sampling
+	}
+	return PrivatePCollection{
+		col:              boundContributions(s, joined, params.MaxFanOut),
+		codec:            outputCodec,
+		privacySpec:      left.privacySpec,
+		maxContributions: params.MaxFanOut,
+		windowFn:         left.windowFn,
+		sampling:         sampling,
+	}
+}
+
+func checkJoinParams(params JoinParams) error {
+	if params.MaxFanOut <= 0 {
+		return fmt.Errorf("pbeam.Join: MaxFanOut should be strictly positive, got %d", params.MaxFanOut)
+	}
+	return nil
+}
+
+// keyByPrivacyIDAndPartitionFn takes a PCollection<ID,kv.Pair{K,V}> as input,
+// and returns a PCollection<kv.Pair{ID,K},V>; where ID has been coded, and V
+// is kept coded.
+type keyByPrivacyIDAndPartitionFn struct {
+	IDType beam.EncodedType
+	idEnc  beam.ElementEncoder
+}
+
+func newKeyByPrivacyIDAndPartitionFn(idType typex.FullType) *keyByPrivacyIDAndPartitionFn {
+	return &keyByPrivacyIDAndPartitionFn{IDType: beam.EncodedType{idType.Type()}}
+}
+
+func (fn *keyByPrivacyIDAndPartitionFn) Setup() {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+}
+
+func (fn *keyByPrivacyIDAndPartitionFn) ProcessElement(id beam.W, pair kv.Pair) (kv.Pair, []byte) {
+	var idBuf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
+		log.Exitf("pbeam.keyByPrivacyIDAndPartitionFn.ProcessElement: couldn't encode ID %v: %v", id, err)
+	}
+	return kv.Pair{idBuf.Bytes(), pair.K}, pair.V
+}
+
+// joinPrivateFn joins the left and right records of a (privacy ID, partition)
+// pair, and emits at most MaxFanOut joined records, chosen uniformly at random,
+// with their privacy identifier. The partition is kept encoded.
+type joinPrivateFn struct {
+	MaxFanOut      int64
+	JoinFn         beam.EncodedFunc
+	jfn            reflectx.Func2x1
+	IDType         beam.EncodedType
+	idDec          beam.ElementDecoder
+	LeftValueType  beam.EncodedType
+	leftDec        beam.ElementDecoder
+	RightValueType beam.EncodedType
+	rightDec       beam.ElementDecoder
+	OutputType     beam.EncodedType
+	outputEnc      beam.ElementEncoder
+}
+
+func newJoinPrivateFn(joinFn interface{}, idType typex.FullType, leftCodec, rightCodec, outputCodec *kv.Codec, maxFanOut int64) *joinPrivateFn {
+	return &joinPrivateFn{
+		MaxFanOut:      maxFanOut,
+		JoinFn:         beam.EncodedFunc{Fn: reflectx.MakeFunc(joinFn)},
+		IDType:         beam.EncodedType{idType.Type()},
+		LeftValueType:  leftCodec.VType,
+		RightValueType: rightCodec.VType,
+		OutputType:     outputCodec.VType,
+	}
+}
+
+func (fn *joinPrivateFn) Setup() {
+	fn.jfn = reflectx.ToFunc2x1(fn.JoinFn.Fn)
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+	fn.leftDec = beam.NewElementDecoder(fn.LeftValueType.T)
+	fn.rightDec = beam.NewElementDecoder(fn.RightValueType.T)
+	fn.outputEnc = beam.NewElementEncoder(fn.OutputType.T)
+}
+
+func (fn *joinPrivateFn) ProcessElement(key kv.Pair, leftIter, rightIter func(*[]byte) bool, emit func(beam.W, kv.Pair)) {
+	var rightValues []interface{}
+	var encoded []byte
+	for rightIter(&encoded) {
+		w, err := fn.rightDec.Decode(bytes.NewBuffer(encoded))
+		if err != nil {
+			log.Exitf("pbeam.joinPrivateFn.ProcessElement: couldn't decode right value %v: %v", encoded, err)
+		}
+		rightValues = append(rightValues, w)
+	}
+	if len(rightValues) == 0 {
+		return
+	}
+	id, err := fn.idDec.Decode(bytes.NewBuffer(key.K))
+	if err != nil {
+		log.Exitf("pbeam.joinPrivateFn.ProcessElement: couldn't decode ID %v: %v", key.K, err)
+	}
+	// Sample MaxFanOut (left, right) pairs with reservoir sampling while
+	// generating them, so that joinFn is only called on sampled pairs and at
+	// most MaxFanOut pairs are kept in memory.
+	var sampled []joinedPair
+	var seen int64
+	for leftIter(&encoded) {
+		v, err := fn.leftDec.Decode(bytes.NewBuffer(encoded))
+		if err != nil {
+			log.Exitf("pbeam.joinPrivateFn.ProcessElement: couldn't decode left value %v: %v", encoded, err)
+		}
+		for _, w := range rightValues {
+			seen++
+			if int64(len(sampled)) < fn.MaxFanOut {
+				sampled = append(sampled, joinedPair{v, w})
+			} else if i := rand.Int63n(seen); i < fn.MaxFanOut {
+				sampled[i] = joinedPair{v, w}
+			}
+		}
+	}
+	for _, pair := range sampled {
+		x := fn.jfn.Call2x1(pair.left, pair.right)
+		var outputBuf bytes.Buffer
+		if err := fn.outputEnc.Encode(x, &outputBuf); err != nil {
+			log.Exitf("pbeam.joinPrivateFn.ProcessElement: couldn't encode joined value %v: %v", x, err)
+		}
+		emit(id, kv.Pair{key.V, outputBuf.Bytes()})
+	}
+}
+
+// joinedPair is a left value and a right value to be joined by joinPrivateFn.
+type joinedPair struct {
+	left, right interface{}
+}
@@ -0,0 +1,251 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Checks that JoinWithPublic joins private records with the public values of
+// their partition, keeps privacy identifiers, and drops records without public
+// values.
+func TestJoinWithPublic(t *testing.T) {
+	triples := []tripleWithIntValue{
+		{1, 0, 1},
+		{1, 1, 2},
+		{2, 1, 3},
+		{3, 2, 4}, // partition 2 has no public value, this record is dropped
+	}
+	public := []pairII{
+		{0, 10},
+		{1, 100},
+		{1, 1000}, // records in partition 1 are joined with both public values
+		{3, 7},    // partition 3 has no private record
+	}
+	want := []pairII{{1, 10}, {1, 200}, {1, 2000}, {2, 300}, {2, 3000}}
+	p, s, col, publicCol := ptest.CreateList2(triples, public)
+	wantCol := beam.CreateList(s, want)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+	publicCol = beam.ParDo(s, pairToKV, publicCol)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	pcol = JoinWithPublic(s, func(v, w int) int { return v * w }, pcol, publicCol)
+	values := ParDo(s, func(k, v int) int { return v }, pcol)
+	got := beam.ParDo(s, kvToPair, values.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestJoinWithPublic: JoinWithPublic(%v, %v) = %v, expected %v: %v", col, publicCol, got, wantCol, err)
+	}
+}
+
+// Checks that JoinWithPublic returns a PrivatePCollection whose codec has the
+// output type of joinFn, and whose results can be aggregated.
+func TestJoinWithPublicCodecAndAggregation(t *testing.T) {
+	var triples []tripleWithIntValue
+	for id := 1; id <= 100; id++ {
+		triples = append(triples, tripleWithIntValue{id, 0, 1})
+	}
+	public := []pairII{{0, 3}}
+	result := []testFloat64Metric{{0, 150}}
+	p, s, col, publicCol := ptest.CreateList2(triples, public)
+	want := beam.ParDo(s, float64MetricToKV, beam.CreateList(s, result))
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+	publicCol = beam.ParDo(s, pairToKV, publicCol)
+
+	// ε=50, δ=0 and l1Sensitivity=2 gives a tolerance of ≈1 with k=23.
+	epsilon, k, l1Sensitivity := 50.0, 23.0, 2.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, 0))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	pcol = JoinWithPublic(s, func(v, w int) float64 { return float64(v*w) / 2 }, pcol, publicCol)
+	wantCodec := kv.NewCodec(reflect.TypeOf(0), reflect.TypeOf(0.0))
+	if diff := cmp.Diff(pcol.codec, wantCodec, cmp.Comparer(compareCodecs)); diff != "" {
+		t.Errorf("TestJoinWithPublicCodecAndAggregation: JoinWithPublic returned a PrivatePCollection with unexpected codec, diff=%s", diff)
+	}
+	got := SumPerKey(s, pcol, SumParams{
+		MaxPartitionsContributed: 1,
+		MinValue:                 0,
+		MaxValue:                 2,
+		NoiseKind:                LaplaceNoise{},
+		PublicPartitions:         beam.Create(s, 0),
+	})
+	if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestJoinWithPublicCodecAndAggregation: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestJoinWithPublicCodecAndAggregation: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestCheckJoinFn(t *testing.T) {
+	intT, stringT := reflect.TypeOf(0), reflect.TypeOf("")
+	for _, tc := range []struct {
+		desc              string
+		joinFn            interface{}
+		privateT, publicT reflect.Type
+		wantErr           bool
+	}{
+		{"valid joinFn", func(int, string) string { return "" }, intT, stringT, false},
+		{"joinFn with interface arguments", func(interface{}, interface{}) int { return 0 }, intT, stringT, false},
+		{"not a function", 42, intT, stringT, true},
+		{"nil function", nil, intT, stringT, true},
+		{"one argument", func(int) int { return 0 }, intT, stringT, true},
+		{"two returns", func(int, string) (int, error) { return 0, nil }, intT, stringT, true},
+		{"wrong private type", func(string, string) int { return 0 }, intT, stringT, true},
+		{"wrong public type", func(int, int) int { return 0 }, intT, stringT, true},
+	} {
+		if err := checkJoinFn(tc.joinFn, tc.privateT, tc.publicT); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that Join only joins records associated with the same privacy
+// identifier and the same key.
+func TestJoin(t *testing.T) {
+	left := []tripleWithIntValue{
+		{1, 0, 1},
+		{1, 1, 2},
+		{2, 0, 3},
+		{3, 0, 4}, // privacy unit 3 has no record on the right side
+	}
+	right := []tripleWithIntValue{
+		{1, 0, 10},
+		{1, 0, 100}, // the record (1, 0, 1) is joined with both right records
+		{2, 0, 10},
+		{2, 1, 10}, // privacy unit 2 has no record with key 1 on the left side
+		{4, 0, 10}, // privacy unit 4 has no record on the left side
+	}
+	want := []pairII{{1, 11}, {1, 101}, {2, 13}}
+	p, s, leftCol, rightCol := ptest.CreateList2(left, right)
+	wantCol := beam.CreateList(s, want)
+	leftCol = beam.ParDo(s, extractIDFromTripleWithIntValue, leftCol)
+	rightCol = beam.ParDo(s, extractIDFromTripleWithIntValue, rightCol)
+
+	spec := NewPrivacySpec(1, 1e-10)
+	leftPCol := ParDo(s, tripleWithIntValueToKV, MakePrivate(s, leftCol, spec))
+	rightPCol := ParDo(s, tripleWithIntValueToKV, MakePrivate(s, rightCol, spec))
+	pcol := Join(s, func(v, w int) int { return v + w }, leftPCol, rightPCol, JoinParams{MaxFanOut: 10})
+	values := ParDo(s, func(k, v int) int { return v }, pcol)
+	got := beam.ParDo(s, kvToPair, values.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestJoin: Join(%v, %v) = %v, expected %v: %v", leftCol, rightCol, got, wantCol, err)
+	}
+}
+
+// Checks that Join bounds the number of joined records per privacy identifier.
+func TestJoinBoundsFanOut(t *testing.T) {
+	// Privacy unit 1 has 3 records with key 0 on each side, so 9 joined
+	// records, and privacy unit 2 has a single joined record.
+	records := []tripleWithIntValue{{1, 0, 1}, {1, 0, 2}, {1, 0, 3}, {2, 0, 1}}
+	p, s, col := ptest.CreateList(records)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	spec := NewPrivacySpec(1, 1e-10)
+	pcol := ParDo(s, tripleWithIntValueToKV, MakePrivate(s, col, spec))
+	joined := Join(s, func(v, w int) int { return v * w }, pcol, pcol, JoinParams{MaxFanOut: 4})
+	ids := beam.DropValue(s, joined.col)
+	got := beam.ParDo(s, kvToPair, stats.Count(s, ids))
+	passert.Equals(s, got, beam.CreateList(s, []pairII{{1, 4}, {2, 1}}))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestJoinBoundsFanOut: %v", err)
+	}
+	if joined.maxContributions != 4 {
+		t.Errorf("TestJoinBoundsFanOut: got maxContributions=%d, want 4", joined.maxContributions)
+	}
+}
+
+// Checks that joinPrivateFn keeps MaxFanOut joined records of a (privacy ID,
+// partition) pair, each of them with the same probability.
+func TestJoinPrivateFnSamplesUniformly(t *testing.T) {
+	intT := reflect.TypeOf(0)
+	codec := kv.NewCodec(intT, intT)
+	fn := newJoinPrivateFn(func(v, w int) int { return 10*v + w }, typex.New(intT), codec, codec, codec, 4)
+	fn.Setup()
+	enc := beam.NewElementEncoder(intT)
+	encode := func(x int) []byte {
+		var buf bytes.Buffer
+		if err := enc.Encode(x, &buf); err != nil {
+			t.Fatalf("couldn't encode %d: %v", x, err)
+		}
+		return buf.Bytes()
+	}
+	iter := func(values []int) func(*[]byte) bool {
+		return func(encoded *[]byte) bool {
+			if len(values) == 0 {
+				return false
+			}
+			*encoded = encode(values[0])
+			values = values[1:]
+			return true
+		}
+	}
+	dec := beam.NewElementDecoder(intT)
+	// Each of the 9 joined records is kept with probability 4/9.
+	const runs = 9000
+	counts := make(map[int]int)
+	for i := 0; i < runs; i++ {
+		var emitted int
+		fn.ProcessElement(kv.Pair{encode(1), encode(0)}, iter([]int{1, 2, 3}), iter([]int{1, 2, 3}), func(_ beam.W, pair kv.Pair) {
+			emitted++
+			x, err := dec.Decode(bytes.NewBuffer(pair.V))
+			if err != nil {
+				t.Fatalf("couldn't decode %v: %v", pair.V, err)
+			}
+			counts[x.(int)]++
+		})
+		if emitted != 4 {
+			t.Fatalf("joinPrivateFn emitted %d records, want 4", emitted)
+		}
+	}
+	// The count of each record has a standard deviation of ≈47, so a tolerance
+	// of 300 makes the test fail with negligible probability.
+	for v := 1; v <= 3; v++ {
+		for w := 1; w <= 3; w++ {
+			if got, want := counts[10*v+w], runs*4/9; got < want-300 || got > want+300 {
+				t.Errorf("joinPrivateFn kept the joined record of (%d, %d) %d times, want %d±300", v, w, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckJoinParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  JoinParams
+		wantErr bool
+	}{
+		{"valid parameters", JoinParams{MaxFanOut: 1}, false},
+		{"zero MaxFanOut", JoinParams{}, true},
+		{"negative MaxFanOut", JoinParams{MaxFanOut: -1}, true},
+	} {
+		if err := checkJoinParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
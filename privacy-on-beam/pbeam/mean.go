@@ -19,6 +19,7 @@ package pbeam
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"reflect"
 
 	log "github.com/golang/glog"
@@ -33,13 +34,14 @@ import (
 func init() {
 	beam.RegisterType(reflect.TypeOf((*boundedMeanFloat64Fn)(nil)))
 	beam.RegisterType(reflect.TypeOf((*prepareMeanFn)(nil)))
-	beam.RegisterType(reflect.TypeOf((*expandValuesCombineFn)(nil)))
-	beam.RegisterType(reflect.TypeOf((*decodePairArrayFloat64Fn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*meanPartialFloat64Fn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*decodePairBoundedMeanPartialFloat64Fn)(nil)))
+	beam.RegisterFunction(rekeyBoundedMeanPartialFloat64Fn)
 }
 
 // MeanParams specifies the parameters associated with a Mean aggregation.
 type MeanParams struct {
-	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
 	//
 	// Defaults to LaplaceNoise{}.
 	NoiseKind NoiseKind
@@ -78,10 +80,43 @@ type MeanParams struct {
 	//
 	// Required.
 	MinValue, MaxValue float64
-	// Client-specified partitions.
+	// Fraction of the noise budget used for the count underlying the mean, the
+	// rest being used for the sum. A smaller fraction adds less noise to the
+	// sum, at the cost of a noisier count, which makes sense when the means
+	// are expected to be close to the midpoint of [MinValue, MaxValue] (see
+	// ExpectedMean to choose the best fraction for an estimate of the means).
+	// With GaussianNoise{}, the count and the sum share the budget more
+	// efficiently than by splitting Epsilon and Delta, so both are less noisy
+	// than with an even split of the budget.
+	//
+	// Optional. Defaults to 0.5, which minimizes the worst-case variance of the
+	// means with both noise kinds (see dpagg.BoundedMeanFloat64Options); must
+	// be strictly between 0 and 1 if set.
+	CountBudgetFraction float64
+	// An estimate of the means, which must not depend on the private data. If
+	// set, CountBudgetFraction is derived from it to minimize the variance of
+	// the means close to ExpectedMean (see
+	// dpagg.CountBudgetFractionForExpectedMean), and must not be set.
+	//
+	// Optional.
+	ExpectedMean *float64
+	// Strategy used for selecting the partitions that are kept in the output,
+	// when partitions are not specified. Instead of the default pre-aggregation
+	// partition selection, partitions can be selected by adding Laplace or
+	// Gaussian noise to the number of privacy identifiers and thresholding it
+	// (see dpagg.PartitionSelectionStrategy).
+	//
+	// Defaults to dpagg.PreAggPartitionSelection.
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+	// Partitions to keep in the output, if they are known in advance. When
+	// PublicPartitions is set, no budget is spent on partition selection:
+	// partitions that are not in PublicPartitions are dropped, and partitions
+	// in PublicPartitions without any data are added to the output.
+	// PublicPartitions must not depend on private data, except through a
+	// differentially private transform such as SelectPartitions.
 	//
 	// Optional.
-	partitionsCol beam.PCollection
+	PublicPartitions beam.PCollection
 }
 
 // MeanPerKey obtains the mean of the values associated with each key in a
@@ -105,32 +140,31 @@ func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.P
 	}
 
 	// Get privacy parameters.
-	spec := pcol.privacySpec
-	epsilon, delta, err := spec.consumeBudget(params.Epsilon, params.Delta)
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
 	if err != nil {
 		log.Exitf("couldn't consume budget: %v", err)
 	}
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
-	}
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	noiseKind, delta := getNoiseKind(params.NoiseKind, maxPartitionsContributed, epsilon, delta, (params.PublicPartitions).IsValid())
 	err = checkMeanPerKeyParams(params, epsilon, delta, noiseKind)
 	if err != nil {
 		log.Exit(err)
 	}
 
 	// Drop unspecified partitions, if partitions are specified.
-	if (params.partitionsCol).IsValid() { // Partitions are specified.
-		if pcol.codec.KType.T != (params.partitionsCol).Type().Type() {
+	if (params.PublicPartitions).IsValid() { // Partitions are specified.
+		if pcol.codec.KType.T != (params.PublicPartitions).Type().Type() {
 			log.Exitf("Specified partitions must be of type %v. Got type %v instead.",
-				pcol.codec.KType.T, (params.partitionsCol).Type().Type())
+				pcol.codec.KType.T, (params.PublicPartitions).Type().Type())
 		}
-		pcol.col = dropUnspecifiedPartitionsKVFn(s, params.partitionsCol, pcol, pcol.codec.KType)
+		params.PublicPartitions = windowPublicPartitions(s, pcol, params.PublicPartitions)
+		pcol.col = dropUnspecifiedPartitionsKVFn(s, params.PublicPartitions, pcol, pcol.codec.KType)
 	}
 
+	maxContributionsPerPartition := getMaxContributionsPerPartition(pcol, params.MaxContributionsPerPartition)
+	countBudgetFraction := getCountBudgetFraction(params.CountBudgetFraction, params.ExpectedMean, noiseKind, params.MinValue, params.MaxValue)
+	meanFn := newBoundedMeanFloat64Fn(epsilon, delta, maxPartitionsContributed, maxContributionsPerPartition, params.MinValue, params.MaxValue, countBudgetFraction, noiseKind, (params.PublicPartitions).IsValid(), params.PartitionSelectionStrategy)
+
 	// First, group together the privacy ID and the partition ID and do per-partition contribution bounding.
 	// Result is PCollection<kv.Pair{ID,K},V>
 	decoded := beam.ParDo(s,
@@ -138,7 +172,6 @@ func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.P
 		pcol.col,
 		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
 
-	maxContributionsPerPartition := getMaxContributionsPerPartition(params.MaxContributionsPerPartition)
 	decoded = boundContributions(s, decoded, maxContributionsPerPartition)
 
 	// Convert value to float64.
@@ -150,58 +183,51 @@ func MeanPerKey(s beam.Scope, pcol PrivatePCollection, params MeanParams) beam.P
 	}
 	converted := beam.ParDo(s, convertFn, decoded)
 
-	// Combine all values for <id, partition> into a slice.
-	// Result is PCollection<kv.Pair{ID,K},[]float64>.
-	combined := beam.CombinePerKey(s,
-		&expandValuesCombineFn{},
+	// Pre-aggregate all values for <id, partition> into a partial mean, whose
+	// size doesn't depend on the number of values.
+	// Result is PCollection<kv.Pair{ID,K},boundedMeanPartialFloat64>.
+	partials := beam.CombinePerKey(s,
+		newMeanPartialFloat64Fn(meanFn),
 		converted)
 
-	// Result is PCollection<ID, pairArrayFloat64>.
-	maxPartitionsContributed := getMaxPartitionsContributed(spec, params.MaxPartitionsContributed)
-	rekeyed := beam.ParDo(s, rekeyArrayFloat64Fn, combined)
+	// Result is PCollection<ID, pairBoundedMeanPartialFloat64>.
+	rekeyed := beam.ParDo(s, rekeyBoundedMeanPartialFloat64Fn, partials)
 	// Do cross-partition contribution bounding.
 	rekeyed = boundContributions(s, rekeyed, maxPartitionsContributed)
 
 	// Now that the cross-partition contribution bounding is done, remove the privacy keys and decode the values.
-	// Result is PCollection<partition, []float64>.
+	// Result is PCollection<partition, boundedMeanPartialFloat64>.
 	partialPairs := beam.DropKey(s, rekeyed)
 	partitionT := pcol.codec.KType.T
 	partialKV := beam.ParDo(s,
-		newDecodePairArrayFloat64Fn(partitionT),
+		newDecodePairBoundedMeanPartialFloat64Fn(partitionT),
 		partialPairs,
 		beam.TypeDefinition{Var: beam.XType, T: partitionT})
 	// Add specified partitions and return the aggregation output, if partitions are specified.
-	if (params.partitionsCol).IsValid() {
-		return addSpecifiedPartitionsForMean(s, epsilon, delta, maxPartitionsContributed,
-			params, noiseKind, partialKV)
+	if (params.PublicPartitions).IsValid() {
+		return addSpecifiedPartitionsForMean(s, params, meanFn, partialKV)
 	}
 	// Compute the mean for each partition. Result is PCollection<partition, float64>.
-	means := beam.CombinePerKey(s,
-		newBoundedMeanFloat64Fn(epsilon, delta, maxPartitionsContributed, params.MaxContributionsPerPartition, params.MinValue, params.MaxValue, noiseKind, false),
-		partialKV)
+	means := beam.CombinePerKey(s, meanFn, partialKV)
 	// Finally, drop thresholded partitions.
 	return beam.ParDo(s, dropThresholdedPartitionsFloat64Fn, means)
 }
 
-func addSpecifiedPartitionsForMean(s beam.Scope, epsilon, delta float64, maxPartitionsContributed int64, params MeanParams, noiseKind noise.Kind, partialKV beam.PCollection) beam.PCollection {
+func addSpecifiedPartitionsForMean(s beam.Scope, params MeanParams, meanFn *boundedMeanFloat64Fn, partialKV beam.PCollection) beam.PCollection {
 	// Compute the mean for each partition with unspecified partitions dropped. Result is PCollection<partition, float64>.
-	means := beam.CombinePerKey(s,
-		newBoundedMeanFloat64Fn(epsilon, delta, maxPartitionsContributed, params.MaxContributionsPerPartition, params.MinValue, params.MaxValue, noiseKind, true),
-		partialKV)
+	means := beam.CombinePerKey(s, meanFn, partialKV)
 	partitionT, _ := beam.ValidateKVType(means)
 	dummyMeans := means
 	meansPartitions := beam.DropValue(s, dummyMeans)
 	// Create map with partitions in the data as keys.
 	partitionMap := beam.Combine(s, newPartitionsMapFn(beam.EncodedType{partitionT.Type()}), meansPartitions)
-	partitionsCol := params.partitionsCol
-	// Add value of empty array to each partition key in partitionsCol.
+	partitionsCol := params.PublicPartitions
+	// Add an empty partial mean to each partition key in partitionsCol.
 	specifiedPartitionsWithValues := beam.ParDo(s, addDummyValuesForMeanToSpecifiedPartitionsFloat64Fn, partitionsCol)
 	// emptySpecifiedPartitions are the partitions that are specified but not found in the data.
 	emptySpecifiedPartitions := beam.ParDo(s, newEmitPartitionsNotInTheDataFn(partitionT), specifiedPartitionsWithValues, beam.SideInput{Input: partitionMap})
 	// Add noise to the empty specified partitions.
-	unspecifiedMeans := beam.CombinePerKey(s,
-		newBoundedMeanFloat64Fn(epsilon, delta, maxPartitionsContributed, params.MaxContributionsPerPartition, params.MinValue, params.MaxValue, noiseKind, true),
-		emptySpecifiedPartitions)
+	unspecifiedMeans := beam.CombinePerKey(s, meanFn, emptySpecifiedPartitions)
 	means = beam.ParDo(s, dereferenceValueToFloat64, means)
 	unspecifiedMeans = beam.ParDo(s, dereferenceValueToFloat64, unspecifiedMeans)
 	// Merge means from data with means from the empty specified partitions.
@@ -214,7 +240,7 @@ func checkMeanPerKeyParams(params MeanParams, epsilon, delta float64, noiseKind
 	if err != nil {
 		return err
 	}
-	if (params.partitionsCol).IsValid() && noiseKind == noise.LaplaceNoise {
+	if (params.PublicPartitions).IsValid() && noiseKind == noise.LaplaceNoise {
 		err = checks.CheckNoDelta("pbeam.MeanPerKey", delta)
 	} else {
 		err = checks.CheckDeltaStrict("pbeam.MeanPerKey", delta)
@@ -226,28 +252,70 @@ func checkMeanPerKeyParams(params MeanParams, epsilon, delta float64, noiseKind
 	if err != nil {
 		return err
 	}
+	err = checkCountBudgetFraction("pbeam.MeanPerKey", params.CountBudgetFraction, params.ExpectedMean)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionStrategy("pbeam.MeanPerKey", params.PartitionSelectionStrategy)
+	if err != nil {
+		return err
+	}
 	return checks.CheckMaxPartitionsContributed("pbeam.MeanPerKey", params.MaxPartitionsContributed)
 }
 
-// decodePairArrayFloat64Fn transforms a PCollection<pairArrayFloat64<codedX,[]float64>> into a
-// PCollection<X,[]float64>.
-type decodePairArrayFloat64Fn struct {
+// checkCountBudgetFraction returns an error if countBudgetFraction is set but
+// not strictly between 0 and 1, or if both countBudgetFraction and
+// expectedMean are set.
+func checkCountBudgetFraction(label string, countBudgetFraction float64, expectedMean *float64) error {
+	if expectedMean != nil {
+		if countBudgetFraction != 0 {
+			return fmt.Errorf("%s: CountBudgetFraction (%f) and ExpectedMean (%f) cannot both be set", label, countBudgetFraction, *expectedMean)
+		}
+		if math.IsNaN(*expectedMean) {
+			return fmt.Errorf("%s: ExpectedMean can't be NaN", label)
+		}
+		return nil
+	}
+	if countBudgetFraction != 0 {
+		return checks.CheckBudgetFraction(label, "CountBudgetFraction", countBudgetFraction)
+	}
+	return nil
+}
+
+// getCountBudgetFraction returns the CountBudgetFraction of a mean with the
+// given parameters, which must have been checked by checkCountBudgetFraction:
+// it is derived from expectedMean if set.
+func getCountBudgetFraction(countBudgetFraction float64, expectedMean *float64, noiseKind noise.Kind, minValue, maxValue float64) float64 {
+	if expectedMean == nil {
+		return countBudgetFraction
+	}
+	fraction, err := dpagg.CountBudgetFractionForExpectedMean(noise.ToNoise(noiseKind), minValue, maxValue, *expectedMean)
+	if err != nil {
+		log.Exit(err)
+	}
+	return fraction
+}
+
+// decodePairBoundedMeanPartialFloat64Fn transforms a
+// PCollection<pairBoundedMeanPartialFloat64<codedX,boundedMeanPartialFloat64>> into a
+// PCollection<X,boundedMeanPartialFloat64>.
+type decodePairBoundedMeanPartialFloat64Fn struct {
 	XType beam.EncodedType
 	xDec  beam.ElementDecoder
 }
 
-func newDecodePairArrayFloat64Fn(t reflect.Type) *decodePairArrayFloat64Fn {
-	return &decodePairArrayFloat64Fn{XType: beam.EncodedType{t}}
+func newDecodePairBoundedMeanPartialFloat64Fn(t reflect.Type) *decodePairBoundedMeanPartialFloat64Fn {
+	return &decodePairBoundedMeanPartialFloat64Fn{XType: beam.EncodedType{t}}
 }
 
-func (fn *decodePairArrayFloat64Fn) Setup() {
+func (fn *decodePairBoundedMeanPartialFloat64Fn) Setup() {
 	fn.xDec = beam.NewElementDecoder(fn.XType.T)
 }
 
-func (fn *decodePairArrayFloat64Fn) ProcessElement(pair pairArrayFloat64) (beam.X, []float64) {
+func (fn *decodePairBoundedMeanPartialFloat64Fn) ProcessElement(pair pairBoundedMeanPartialFloat64) (beam.X, boundedMeanPartialFloat64) {
 	x, err := fn.xDec.Decode(bytes.NewBuffer(pair.X))
 	if err != nil {
-		log.Exitf("pbeam.decodePairArrayFloat64Fn.ProcessElement: couldn't decode pair %v: %v", pair, err)
+		log.Exitf("pbeam.decodePairBoundedMeanPartialFloat64Fn.ProcessElement: couldn't decode pair %v: %v", pair, err)
 	}
 	return x, pair.M
 }
@@ -315,30 +383,6 @@ func convertUint64ToFloat64Fn(z beam.Z, i uint64) (beam.Z, float64) {
 	return z, float64(i)
 }
 
-type expandValuesAccum struct {
-	Values []float64
-}
-
-type expandValuesCombineFn struct{}
-
-func (fn *expandValuesCombineFn) CreateAccumulator() expandValuesAccum {
-	return expandValuesAccum{Values: make([]float64, 0)}
-}
-
-func (fn *expandValuesCombineFn) AddInput(a expandValuesAccum, value float64) expandValuesAccum {
-	a.Values = append(a.Values, value)
-	return a
-}
-
-func (fn *expandValuesCombineFn) MergeAccumulators(a, b expandValuesAccum) expandValuesAccum {
-	a.Values = append(a.Values, b.Values...)
-	return a
-}
-
-func (fn *expandValuesCombineFn) ExtractOutput(a expandValuesAccum) []float64 {
-	return a.Values
-}
-
 // prepareMeanFn takes a PCollection<ID,kv.Pair{K,V}> as input, and returns a
 // PCollection<kv.Pair{ID,K},V>; where ID has been coded, and V has been
 // decoded.
@@ -369,16 +413,74 @@ func (fn *prepareMeanFn) ProcessElement(id beam.W, pair kv.Pair) (kv.Pair, beam.
 	return kv.Pair{idBuf.Bytes(), pair.K}, v
 }
 
-// pairArrayFloat64 contains an encoded value and a slice of float64 metrics.
-type pairArrayFloat64 struct {
+// boundedMeanPartialFloat64 contains the values of a single privacy ID in a
+// partition, pre-aggregated into their number and the sum of their distances
+// to the midpoint of [Lower, Upper] after clamping, like in a
+// dpagg.BoundedMeanFloat64.
+type boundedMeanPartialFloat64 struct {
+	Count         int64
+	NormalizedSum float64
+}
+
+// meanPartialFloat64Fn is a combineFn pre-aggregating the values of each
+// (privacy ID, partition) pair into a boundedMeanPartialFloat64, with the same
+// bounds as a boundedMeanFloat64Fn. Do not initialize it yourself, use
+// newMeanPartialFloat64Fn to create a meanPartialFloat64Fn instance.
+type meanPartialFloat64Fn struct {
+	Lower float64
+	Upper float64
+}
+
+// newMeanPartialFloat64Fn returns a meanPartialFloat64Fn whose partial means can
+// be merged by meanFn.
+func newMeanPartialFloat64Fn(meanFn *boundedMeanFloat64Fn) *meanPartialFloat64Fn {
+	return &meanPartialFloat64Fn{Lower: meanFn.Lower, Upper: meanFn.Upper}
+}
+
+func (fn *meanPartialFloat64Fn) CreateAccumulator() boundedMeanPartialFloat64 {
+	return boundedMeanPartialFloat64{}
+}
+
+func (fn *meanPartialFloat64Fn) AddInput(a boundedMeanPartialFloat64, value float64) boundedMeanPartialFloat64 {
+	// NaN values are skipped, like in dpagg.BoundedMeanFloat64.
+	if math.IsNaN(value) {
+		return a
+	}
+	a.Count++
+	a.NormalizedSum += math.Min(math.Max(value, fn.Lower), fn.Upper) - midPoint(fn.Lower, fn.Upper)
+	return a
+}
+
+func (fn *meanPartialFloat64Fn) MergeAccumulators(a, b boundedMeanPartialFloat64) boundedMeanPartialFloat64 {
+	a.Count += b.Count
+	a.NormalizedSum += b.NormalizedSum
+	return a
+}
+
+func (fn *meanPartialFloat64Fn) ExtractOutput(a boundedMeanPartialFloat64) boundedMeanPartialFloat64 {
+	return a
+}
+
+func (fn *meanPartialFloat64Fn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+// midPoint returns the midpoint of [lower, upper], computed like in
+// dpagg.BoundedMeanFloat64.
+func midPoint(lower, upper float64) float64 {
+	return lower + (upper-lower)/2.0
+}
+
+// pairBoundedMeanPartialFloat64 contains an encoded value and a partial mean.
+type pairBoundedMeanPartialFloat64 struct {
 	X []byte
-	M []float64
+	M boundedMeanPartialFloat64
 }
 
-// rekeyArrayFloat64Fn transforms a PCollection<kv.Pair<codedK,codedV>,[]float64> into a
-// PCollection<codedK,pairArrayFloat64<codedV,[]float64>>.
-func rekeyArrayFloat64Fn(kv kv.Pair, m []float64) ([]byte, pairArrayFloat64) {
-	return kv.K, pairArrayFloat64{kv.V, m}
+// rekeyBoundedMeanPartialFloat64Fn transforms a PCollection<kv.Pair<codedK,codedV>,boundedMeanPartialFloat64> into a
+// PCollection<codedK,pairBoundedMeanPartialFloat64<codedV,boundedMeanPartialFloat64>>.
+func rekeyBoundedMeanPartialFloat64Fn(kv kv.Pair, m boundedMeanPartialFloat64) ([]byte, pairBoundedMeanPartialFloat64) {
+	return kv.K, pairBoundedMeanPartialFloat64{kv.V, m}
 }
 
 type boundedMeanAccumFloat64 struct {
@@ -399,20 +501,24 @@ type boundedMeanFloat64Fn struct {
 	MaxContributionsPerPartition int64
 	Lower                        float64
 	Upper                        float64
+	CountBudgetFraction          float64
 	NoiseKind                    noise.Kind
 	noise                        noise.Noise // Set during Setup phase according to NoiseKind.
 	PartitionsSpecified          bool
+	PartitionSelectionStrategy   dpagg.PartitionSelectionStrategy
 }
 
 // newBoundedMeanFloat6464Fn returns a boundedMeanFloat64Fn with the given budget and parameters.
-func newBoundedMeanFloat64Fn(epsilon, delta float64, maxPartitionsContributed, maxContributionsPerPartition int64, lower, upper float64, noiseKind noise.Kind, PartitionsSpecified bool) *boundedMeanFloat64Fn {
+func newBoundedMeanFloat64Fn(epsilon, delta float64, maxPartitionsContributed, maxContributionsPerPartition int64, lower, upper, countBudgetFraction float64, noiseKind noise.Kind, PartitionsSpecified bool, partitionSelectionStrategy dpagg.PartitionSelectionStrategy) *boundedMeanFloat64Fn {
 	fn := &boundedMeanFloat64Fn{
 		MaxPartitionsContributed:     maxPartitionsContributed,
 		MaxContributionsPerPartition: maxContributionsPerPartition,
 		Lower:                        lower,
 		Upper:                        upper,
+		CountBudgetFraction:          countBudgetFraction,
 		NoiseKind:                    noiseKind,
 		PartitionsSpecified:          PartitionsSpecified,
+		PartitionSelectionStrategy:   partitionSelectionStrategy,
 	}
 	if fn.PartitionsSpecified {
 		fn.NoiseEpsilon = epsilon
@@ -449,23 +555,30 @@ func (fn *boundedMeanFloat64Fn) CreateAccumulator() boundedMeanAccumFloat64 {
 			Lower:                        fn.Lower,
 			Upper:                        fn.Upper,
 			Noise:                        fn.noise,
+			CountBudgetFraction:          fn.CountBudgetFraction,
 		}), PartitionsSpecified: fn.PartitionsSpecified}
 	if !fn.PartitionsSpecified {
 		accum.SP = dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
 			Epsilon:                  fn.PartitionSelectionEpsilon,
 			Delta:                    fn.PartitionSelectionDelta,
 			MaxPartitionsContributed: fn.MaxPartitionsContributed,
+			Strategy:                 fn.PartitionSelectionStrategy,
 		})
 	}
 	return accum
 }
 
-func (fn *boundedMeanFloat64Fn) AddInput(a boundedMeanAccumFloat64, values []float64) boundedMeanAccumFloat64 {
-	// We can have multiple values for each (privacy_key, partition_key) pair.
-	// We need to add each value to BoundedMean as input but we need to add a single input
-	// for each privacy_key to SelectPartition.
-	for _, v := range values {
-		a.BM.Add(v)
+func (fn *boundedMeanFloat64Fn) AddInput(a boundedMeanAccumFloat64, partial boundedMeanPartialFloat64) boundedMeanAccumFloat64 {
+	// Each partial mean contains the values of a single (privacy_key, partition_key)
+	// pair. We need to add its values to BoundedMean but we need to add a single
+	// input for each privacy_key to SelectPartition. Adding partial.Count copies
+	// of the mean of the values gives BoundedMean the same count and normalized
+	// sum as adding the values themselves.
+	if partial.Count > 0 {
+		mean := midPoint(fn.Lower, fn.Upper) + partial.NormalizedSum/float64(partial.Count)
+		for i := int64(0); i < partial.Count; i++ {
+			a.BM.Add(mean)
+		}
 	}
 	if !fn.PartitionsSpecified {
 		a.SP.Increment()
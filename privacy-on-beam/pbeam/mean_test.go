@@ -17,6 +17,7 @@
 package pbeam
 
 import (
+	"math"
 	"reflect"
 	"testing"
 
@@ -36,11 +37,12 @@ func TestNewBoundedMeanFloat64Fn(t *testing.T) {
 		cmpopts.IgnoreUnexported(boundedMeanFloat64Fn{}),
 	}
 	for _, tc := range []struct {
-		desc      string
-		noiseKind noise.Kind
-		want      interface{}
+		desc                string
+		noiseKind           noise.Kind
+		countBudgetFraction float64
+		want                interface{}
 	}{
-		{"Laplace noise kind", noise.LaplaceNoise,
+		{"Laplace noise kind", noise.LaplaceNoise, 0,
 			&boundedMeanFloat64Fn{
 				NoiseEpsilon:                 0.5,
 				PartitionSelectionEpsilon:    0.5,
@@ -52,7 +54,19 @@ func TestNewBoundedMeanFloat64Fn(t *testing.T) {
 				Upper:                        10,
 				NoiseKind:                    noise.LaplaceNoise,
 			}},
-		{"Gaussian noise kind", noise.GaussianNoise,
+		{"Gaussian noise kind", noise.GaussianNoise, 0,
+			&boundedMeanFloat64Fn{
+				NoiseEpsilon:                 0.5,
+				PartitionSelectionEpsilon:    0.5,
+				NoiseDelta:                   5e-6,
+				PartitionSelectionDelta:      5e-6,
+				MaxPartitionsContributed:     17,
+				MaxContributionsPerPartition: 5,
+				Lower:                        0,
+				Upper:                        10,
+				NoiseKind:                    noise.GaussianNoise,
+			}},
+		{"CountBudgetFraction is set", noise.GaussianNoise, 0.2,
 			&boundedMeanFloat64Fn{
 				NoiseEpsilon:                 0.5,
 				PartitionSelectionEpsilon:    0.5,
@@ -62,16 +76,54 @@ func TestNewBoundedMeanFloat64Fn(t *testing.T) {
 				MaxContributionsPerPartition: 5,
 				Lower:                        0,
 				Upper:                        10,
+				CountBudgetFraction:          0.2,
 				NoiseKind:                    noise.GaussianNoise,
 			}},
 	} {
-		got := newBoundedMeanFloat64Fn(1, 1e-5, 17, 5, 0, 10, tc.noiseKind, false)
+		got := newBoundedMeanFloat64Fn(1, 1e-5, 17, 5, 0, 10, tc.countBudgetFraction, tc.noiseKind, false, dpagg.PreAggPartitionSelection)
 		if diff := cmp.Diff(tc.want, got, opts...); diff != "" {
 			t.Errorf("newBoundedMeanFn: for %q (-want +got):\n%s", tc.desc, diff)
 		}
 	}
 }
 
+func TestCheckCountBudgetFraction(t *testing.T) {
+	expectedMean, nan := 2.0, math.NaN()
+	for _, tc := range []struct {
+		desc                string
+		countBudgetFraction float64
+		expectedMean        *float64
+		wantErr             bool
+	}{
+		{"no parameter", 0, nil, false},
+		{"valid CountBudgetFraction", 0.3, nil, false},
+		{"CountBudgetFraction equal to 1", 1, nil, true},
+		{"valid ExpectedMean", 0, &expectedMean, false},
+		{"NaN ExpectedMean", 0, &nan, true},
+		{"both CountBudgetFraction and ExpectedMean", 0.3, &expectedMean, true},
+	} {
+		if err := checkCountBudgetFraction("test", tc.countBudgetFraction, tc.expectedMean); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that the CountBudgetFraction of a mean is derived from ExpectedMean
+// when it is set.
+func TestGetCountBudgetFraction(t *testing.T) {
+	expectedMean := 7.5
+	if got := getCountBudgetFraction(0.3, nil, noise.GaussianNoise, 0, 10); got != 0.3 {
+		t.Errorf("getCountBudgetFraction: without ExpectedMean got %f, want 0.3", got)
+	}
+	want, err := dpagg.CountBudgetFractionForExpectedMean(noise.Gaussian(), 0, 10, expectedMean)
+	if err != nil {
+		t.Fatalf("CountBudgetFractionForExpectedMean: got error %v", err)
+	}
+	if got := getCountBudgetFraction(0, &expectedMean, noise.GaussianNoise, 0, 10); got != want {
+		t.Errorf("getCountBudgetFraction: with ExpectedMean got %f, want %f", got, want)
+	}
+}
+
 func TestBoundedMeanFloat64FnSetup(t *testing.T) {
 	for _, tc := range []struct {
 		desc      string
@@ -80,7 +132,7 @@ func TestBoundedMeanFloat64FnSetup(t *testing.T) {
 	}{
 		{"Laplace noise kind", noise.LaplaceNoise, noise.Laplace()},
 		{"Gaussian noise kind", noise.GaussianNoise, noise.Gaussian()}} {
-		got := newBoundedMeanFloat64Fn(1, 1e-5, 17, 5, 0, 10, tc.noiseKind, false)
+		got := newBoundedMeanFloat64Fn(1, 1e-5, 17, 5, 0, 10, 0, tc.noiseKind, false, dpagg.PreAggPartitionSelection)
 		got.Setup()
 		if !cmp.Equal(tc.wantNoise, got.noise) {
 			t.Errorf("Setup: for %s got %v, want %v", tc.desc, got.noise, tc.wantNoise)
@@ -88,6 +140,36 @@ func TestBoundedMeanFloat64FnSetup(t *testing.T) {
 	}
 }
 
+// meanPartialFloat64 returns the partial mean of values, as computed by the
+// meanPartialFloat64Fn associated with fn.
+func meanPartialFloat64(fn *boundedMeanFloat64Fn, values ...float64) boundedMeanPartialFloat64 {
+	partialFn := newMeanPartialFloat64Fn(fn)
+	accum := partialFn.CreateAccumulator()
+	for _, v := range values {
+		accum = partialFn.AddInput(accum, v)
+	}
+	return partialFn.ExtractOutput(accum)
+}
+
+// Checks that partial means clamp values and skip NaN values.
+func TestMeanPartialFloat64Fn(t *testing.T) {
+	fn := newBoundedMeanFloat64Fn(1, 1e-5, 1, 3, 0, 5, 0, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
+	for _, tc := range []struct {
+		desc   string
+		values []float64
+		want   boundedMeanPartialFloat64
+	}{
+		{"no values", nil, boundedMeanPartialFloat64{}},
+		{"values within bounds", []float64{1, 2}, boundedMeanPartialFloat64{Count: 2, NormalizedSum: -2}},
+		{"values out of bounds", []float64{-1, 7}, boundedMeanPartialFloat64{Count: 2, NormalizedSum: 0}},
+		{"NaN value", []float64{4, math.NaN()}, boundedMeanPartialFloat64{Count: 1, NormalizedSum: 1.5}},
+	} {
+		if got := meanPartialFloat64(fn, tc.values...); got != tc.want {
+			t.Errorf("With %s, got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+}
+
 func TestBoundedMeanFloat64FnAddInput(t *testing.T) {
 	// δ=10⁻²³, ε=1e100 and l0Sensitivity=1 gives a threshold of =2.
 	// Since ε=1e100, the noise is added with probability in the order of exp(-1e100).
@@ -98,12 +180,12 @@ func TestBoundedMeanFloat64FnAddInput(t *testing.T) {
 	lower := 0.0
 	upper := 5.0
 	// ε is split by 2 for noise and for partition selection, so we use 2*ε to get a Laplace noise with ε.
-	fn := newBoundedMeanFloat64Fn(2*epsilon, delta, maxPartitionsContributed, maxContributionsPerPartition, lower, upper, noise.LaplaceNoise, false)
+	fn := newBoundedMeanFloat64Fn(2*epsilon, delta, maxPartitionsContributed, maxContributionsPerPartition, lower, upper, 0, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 	fn.Setup()
 
 	accum := fn.CreateAccumulator()
-	fn.AddInput(accum, []float64{2.0})
-	fn.AddInput(accum, []float64{4.0})
+	fn.AddInput(accum, meanPartialFloat64(fn, 2.0))
+	fn.AddInput(accum, meanPartialFloat64(fn, 4.0))
 
 	got := fn.ExtractOutput(accum)
 	exactSum := 6.0
@@ -119,6 +201,53 @@ func TestBoundedMeanFloat64FnAddInput(t *testing.T) {
 	}
 }
 
+// Checks that a partial mean with several values counts as a single privacy
+// unit for partition selection, and that it survives encoding.
+func TestBoundedMeanFloat64FnAddInputWithPartialMeans(t *testing.T) {
+	// δ=10⁻²³, ε=1e100 and l0Sensitivity=1 gives a threshold of =2.
+	// Since ε=1e100, the noise is added with probability in the order of exp(-1e100).
+	maxContributionsPerPartition := int64(3)
+	maxPartitionsContributed := int64(1)
+	epsilon := 1e100
+	delta := 1e-23
+	lower := 0.0
+	upper := 5.0
+	// ε is split by 2 for noise and for partition selection, so we use 2*ε to get a Laplace noise with ε.
+	fn := newBoundedMeanFloat64Fn(2*epsilon, delta, maxPartitionsContributed, maxContributionsPerPartition, lower, upper, 0, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
+	fn.Setup()
+
+	// A single privacy unit with 3 values is not enough to keep the partition.
+	accum := fn.CreateAccumulator()
+	fn.AddInput(accum, meanPartialFloat64(fn, 1.0, 2.0, 3.0))
+	if got := fn.ExtractOutput(accum); got != nil {
+		t.Errorf("ExtractOutput: for a single privacy unit with 3 values got: %f, want nil", *got)
+	}
+
+	accum = fn.CreateAccumulator()
+	encoded, err := encodeBoundedMeanPartialFloat64(meanPartialFloat64(fn, 1.0, 2.0, 3.0))
+	if err != nil {
+		t.Fatalf("encodeBoundedMeanPartialFloat64: got error %v", err)
+	}
+	decoded, err := decodeBoundedMeanPartialFloat64(encoded)
+	if err != nil {
+		t.Fatalf("decodeBoundedMeanPartialFloat64: got error %v", err)
+	}
+	fn.AddInput(accum, decoded)
+	fn.AddInput(accum, meanPartialFloat64(fn, 4.0, 5.0))
+	got := fn.ExtractOutput(accum)
+	exactSum := 15.0
+	exactCount := 5.0
+	exactMean := exactSum / exactCount
+	want := float64Ptr(exactMean)
+	tolerance, err := laplaceToleranceForMean(23, lower, upper, maxContributionsPerPartition, maxPartitionsContributed, epsilon, 1, exactCount, exactMean)
+	if err != nil {
+		t.Fatalf("laplaceToleranceForMean: got error %v", err)
+	}
+	if !cmp.Equal(want, got, cmpopts.EquateApprox(0, tolerance)) {
+		t.Errorf("AddInput: for 2 privacy units with 5 values got: %v, want %f", got, *want)
+	}
+}
+
 func TestBoundedMeanFloat64FnMergeAccumulators(t *testing.T) {
 	// δ=10⁻²³, ε=1e100 and l0Sensitivity=1 gives a threshold of =2.
 	// Since ε=1e100, the noise is added with probability in the order of exp(-1e100).
@@ -129,15 +258,15 @@ func TestBoundedMeanFloat64FnMergeAccumulators(t *testing.T) {
 	lower := 0.0
 	upper := 5.0
 	// ε is split by 2 for noise and for partition selection, so we use 2*ε to get a Laplace noise with ε.
-	fn := newBoundedMeanFloat64Fn(2*epsilon, delta, maxPartitionsContributed, maxContributionsPerPartition, lower, upper, noise.LaplaceNoise, false)
+	fn := newBoundedMeanFloat64Fn(2*epsilon, delta, maxPartitionsContributed, maxContributionsPerPartition, lower, upper, 0, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 	fn.Setup()
 
 	accum1 := fn.CreateAccumulator()
-	fn.AddInput(accum1, []float64{2.0})
-	fn.AddInput(accum1, []float64{3.0})
-	fn.AddInput(accum1, []float64{1.0})
+	fn.AddInput(accum1, meanPartialFloat64(fn, 2.0))
+	fn.AddInput(accum1, meanPartialFloat64(fn, 3.0))
+	fn.AddInput(accum1, meanPartialFloat64(fn, 1.0))
 	accum2 := fn.CreateAccumulator()
-	fn.AddInput(accum2, []float64{4.0})
+	fn.AddInput(accum2, meanPartialFloat64(fn, 4.0))
 	fn.MergeAccumulators(accum1, accum2)
 
 	got := fn.ExtractOutput(accum1)
@@ -167,7 +296,7 @@ func TestBoundedMeanFloat64FnExtractOutputReturnsNilForSmallPartitions(t *testin
 
 		// The choice of ε=1e100, δ=10⁻²³, and l0Sensitivity=1 gives a threshold of =2.
 		// ε is split by 2 for noise and for partition selection, so we use 2*ε to get a Laplace noise with ε.
-		fn := newBoundedMeanFloat64Fn(2*1e100, 1e-23, 1, 1, 0, 10, noise.LaplaceNoise, false)
+		fn := newBoundedMeanFloat64Fn(2*1e100, 1e-23, 1, 1, 0, 10, 0, noise.LaplaceNoise, false, dpagg.PreAggPartitionSelection)
 		fn.Setup()
 		accum := fn.CreateAccumulator()
 		for i := 0; i < tc.inputSize; i++ {
@@ -175,7 +304,7 @@ func TestBoundedMeanFloat64FnExtractOutputReturnsNilForSmallPartitions(t *testin
 			for i := 0; i < tc.datapointsPerPrivacyUnit; i++ {
 				values[i] = 1.0
 			}
-			fn.AddInput(accum, values)
+			fn.AddInput(accum, meanPartialFloat64(fn, values...))
 		}
 
 		got := fn.ExtractOutput(accum)
@@ -197,7 +326,7 @@ func TestBoundedMeanFloat64FnWithPartitionsExtractOutputDoesNotReturnNilForSmall
 		{"Input with 1 user with 1 contribution", 1, 1},
 	} {
 
-		fn := newBoundedMeanFloat64Fn(1e100, 0, 1, 1, 0, 10, noise.LaplaceNoise, true)
+		fn := newBoundedMeanFloat64Fn(1e100, 0, 1, 1, 0, 10, 0, noise.LaplaceNoise, true, dpagg.PreAggPartitionSelection)
 		fn.Setup()
 		accum := fn.CreateAccumulator()
 		for i := 0; i < tc.inputSize; i++ {
@@ -205,7 +334,7 @@ func TestBoundedMeanFloat64FnWithPartitionsExtractOutputDoesNotReturnNilForSmall
 			for i := 0; i < tc.datapointsPerUser; i++ {
 				values[i] = 1.0
 			}
-			fn.AddInput(accum, values)
+			fn.AddInput(accum, meanPartialFloat64(fn, values...))
 		}
 
 		got := fn.ExtractOutput(accum)
@@ -361,7 +490,7 @@ func TestMeanPerKeyWithPartitionsAddsNoiseFloat(t *testing.T) {
 			MinValue:                     lower,
 			MaxValue:                     upper,
 			NoiseKind:                    tc.noiseKind,
-			partitionsCol:                partitionsCol,
+			PublicPartitions:             partitionsCol,
 		})
 		got = beam.ParDo(s, kvToFloat64Metric, got)
 
@@ -589,7 +718,7 @@ func TestMeanPerKeyWithPartitionsNoNoiseFloatValues(t *testing.T) {
 			MinValue:                     lower,
 			MaxValue:                     upper,
 			NoiseKind:                    LaplaceNoise{},
-			partitionsCol:                partitionsCol,
+			PublicPartitions:             partitionsCol,
 		})
 
 		want = beam.ParDo(s, float64MetricToKV, want)
@@ -937,7 +1066,7 @@ func TestMeanPerKeyWithPartitionsReturnsNonNegativeFloat64(t *testing.T) {
 		MaxValue:                     upper,
 		MaxPartitionsContributed:     1,
 		NoiseKind:                    LaplaceNoise{},
-		partitionsCol:                partitionsCol,
+		PublicPartitions:             partitionsCol,
 	})
 	values := beam.DropKey(s, means)
 	beam.ParDo0(s, checkNoNegativeValuesFloat64Fn, values)
@@ -1054,7 +1183,7 @@ func TestMeanPerKeyWithPartitionsCrossPartitionContributionBounding(t *testing.T
 		MinValue:                     lower,
 		MaxValue:                     upper,
 		NoiseKind:                    LaplaceNoise{},
-		partitionsCol:                partitionsCol,
+		PublicPartitions:             partitionsCol,
 	})
 
 	means := beam.DropKey(s, got)
@@ -1139,7 +1268,7 @@ func TestMeanPerKeyWithPartitionsNoNoiseIntValues(t *testing.T) {
 			MinValue:                     tc.lower,
 			MaxValue:                     tc.upper,
 			NoiseKind:                    LaplaceNoise{},
-			partitionsCol:                partitionsCol,
+			PublicPartitions:             partitionsCol,
 		})
 		want = beam.ParDo(s, float64MetricToKV, want)
 
@@ -1211,7 +1340,7 @@ func TestMeanPerKeyWithEmptyPartitionsNoNoise(t *testing.T) {
 			MinValue:                     tc.lower,
 			MaxValue:                     tc.upper,
 			NoiseKind:                    LaplaceNoise{},
-			partitionsCol:                partitionsCol,
+			PublicPartitions:             partitionsCol,
 		})
 		want = beam.ParDo(s, float64MetricToKV, want)
 
@@ -72,8 +72,23 @@ import (
 //		- func(W, X, emit) error, where emit has type func(Y, Z)
 //		- func(context.Context error, W, X, emit), where emit has type func(Y, Z)
 //
-func ParDo(s beam.Scope, doFn interface{}, pcol PrivatePCollection) PrivatePCollection {
+// doFn can also be a structural DoFn, i.e. a pointer to a struct with a
+// ProcessElement method of one of the types above. The struct can have Setup,
+// StartBundle, FinishBundle and Teardown methods, taking an optional
+// context.Context and returning an optional error; they are called like with
+// beam.ParDo. For example, Setup can be used to load a lookup table once
+// instead of for every record. Like with beam.ParDo, only the exported fields
+// of the struct are serialized.
+//
+// Public side inputs can be passed as sideInputs. They are passed to doFn
+// after the record, in the same order, either as a singleton of type T or as an
+// iterator of type func(*T) bool or func() func(*T) bool. Side inputs of type
+// <K,V> are not supported. Privacy identifiers are never passed to doFn.
+func ParDo(s beam.Scope, doFn interface{}, pcol PrivatePCollection, sideInputs ...beam.SideInput) PrivatePCollection {
 	s = s.Scope("pbeam.ParDo")
+	if t := reflect.TypeOf(doFn); len(sideInputs) > 0 || (t != nil && t.Kind() != reflect.Func) {
+		return parDoWithReflection(s, doFn, pcol, sideInputs)
+	}
 	// Convert the doFn into a anonDoFn.
 	anonDoFn, err := buildDoFn(doFn)
 	if err != nil {
@@ -85,12 +100,16 @@ func ParDo(s beam.Scope, doFn interface{}, pcol PrivatePCollection) PrivatePColl
 			col:         beam.ParDo(s, anonDoFn.fn, pcol.col, anonDoFn.typeDef),
 			codec:       anonDoFn.codec,
 			privacySpec: pcol.privacySpec,
+			windowFn:    pcol.windowFn,
+			sampling:    pcol.sampling,
 		}
 	}
 	return PrivatePCollection{
 		col:         beam.ParDo(s, anonDoFn.fn, pcol.col),
 		codec:       anonDoFn.codec,
 		privacySpec: pcol.privacySpec,
+		windowFn:    pcol.windowFn,
+		sampling:    pcol.sampling,
 	}
 }
 
@@ -113,7 +132,7 @@ type anonDoFn struct {
 // buildDoFn validates the provided doFn and transforms it into an *anonDoFn.
 func buildDoFn(doFn interface{}) (*anonDoFn, error) {
 	if reflect.ValueOf(doFn).Type().Kind() != reflect.Func {
-		return nil, fmt.Errorf("pbeam.ParDo doesn't support structural DoFns for now: doFn must be a function")
+		return nil, fmt.Errorf("doFn must be a function, structural DoFns are handled by parDoWithReflection")
 	}
 	reflectxFn := reflectx.MakeFunc(doFn)
 	funcxFn, err := funcx.New(reflectxFn)
@@ -121,7 +140,7 @@ func buildDoFn(doFn interface{}) (*anonDoFn, error) {
 		return nil, fmt.Errorf("couldn't create funcx.Fn from doFn: %v", err)
 	}
 	if len(funcxFn.Params(funcx.FnIter|funcx.FnReIter)) > 0 {
-		return nil, fmt.Errorf("pbeam.ParDo doesn't support DoFns with side inputs")
+		return nil, fmt.Errorf("the DoFn parameter in pbeam.ParDo has iterator arguments, but no side inputs were passed to pbeam.ParDo")
 	}
 	if len(funcxFn.Params(funcx.FnEventTime|funcx.FnWindow)) > 0 {
 		return nil, fmt.Errorf("pbeam.PrivatePCollection don't support streaming mode, so DoFns with EventTime or Window arguments are forbidden")
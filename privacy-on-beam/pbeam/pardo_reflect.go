@@ -0,0 +1,516 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/funcx"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/reflectx"
+)
+
+// This file contains the implementation of ParDo for structural DoFns and for
+// DoFns with side inputs. Unlike the functional DoFns without side inputs,
+// which are wrapped in the generated transforms, these DoFns are called using
+// reflection: their signatures can have an arbitrary number of side inputs.
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*userDoFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*reflectDoFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*reflectSideInputDoFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*encodeSideInputFn)(nil)))
+	beam.RegisterType(reflect.TypeOf(sideInputRecord{}))
+}
+
+// lifecycleMethods are the methods of a structural DoFn, other than
+// ProcessElement, that are called by pbeam.ParDo.
+var lifecycleMethods = []string{"Setup", "StartBundle", "FinishBundle", "Teardown"}
+
+// parDoWithReflection applies a structural DoFn, or a DoFn with side inputs,
+// to pcol.
+func parDoWithReflection(s beam.Scope, doFn interface{}, pcol PrivatePCollection, sideInputs []beam.SideInput) PrivatePCollection {
+	_, valueT := beam.ValidateKVType(pcol.col)
+	var sideInputTypes []reflect.Type
+	for i, si := range sideInputs {
+		if typex.IsKV(si.Input.Type()) {
+			log.Exitf("pbeam.ParDo: side input %d has type %v, but side inputs of type <K,V> are not supported", i, si.Input.Type())
+		}
+		sideInputTypes = append(sideInputTypes, si.Input.Type().Type())
+	}
+	fn, outputTypes, err := newUserDoFn(doFn, pcol.codec, valueT.Type(), sideInputTypes)
+	if err != nil {
+		log.Exitf("couldn't initialize doFn in pbeam.ParDo: %v", err)
+	}
+	outputTypeDef := beam.TypeDefinition{Var: beam.YType, T: outputTypes[0]}
+	if len(outputTypes) == 2 {
+		outputTypeDef = beam.TypeDefinition{Var: beam.YType, T: reflect.TypeOf(kv.Pair{})}
+	}
+	if len(sideInputs) == 0 {
+		return PrivatePCollection{
+			col:         beam.ParDo(s, &reflectDoFn{DoFn: fn}, pcol.col, outputTypeDef),
+			codec:       fn.OutputCodec,
+			privacySpec: pcol.privacySpec,
+			windowFn:    pcol.windowFn,
+			sampling:    pcol.sampling,
+		}
+	}
+	// All side inputs are encoded and flattened into a single side input, so
+	// that the number of side inputs of the DoFn passed to Beam doesn't depend
+	// on the user DoFn.
+	encoded := make([]beam.PCollection, len(sideInputs))
+	for i, si := range sideInputs {
+		encoded[i] = beam.ParDo(s, newEncodeSideInputFn(i, si.Input.Type()), si.Input)
+	}
+	flattened := beam.Flatten(s, encoded...)
+	return PrivatePCollection{
+		col:         beam.ParDo(s, &reflectSideInputDoFn{DoFn: fn}, pcol.col, beam.SideInput{Input: flattened}, outputTypeDef),
+		codec:       fn.OutputCodec,
+		privacySpec: pcol.privacySpec,
+		windowFn:    pcol.windowFn,
+		sampling:    pcol.sampling,
+	}
+}
+
+// sideInputRecord is an encoded element of the side input with index Index.
+type sideInputRecord struct {
+	Index int
+	Value []byte
+}
+
+// encodeSideInputFn encodes the elements of a side input into
+// sideInputRecords.
+type encodeSideInputFn struct {
+	Index int
+	Type  beam.EncodedType
+	enc   beam.ElementEncoder
+}
+
+func newEncodeSideInputFn(index int, t typex.FullType) *encodeSideInputFn {
+	return &encodeSideInputFn{Index: index, Type: beam.EncodedType{t.Type()}}
+}
+
+func (fn *encodeSideInputFn) Setup() {
+	fn.enc = beam.NewElementEncoder(fn.Type.T)
+}
+
+func (fn *encodeSideInputFn) ProcessElement(v beam.T) sideInputRecord {
+	var buf bytes.Buffer
+	if err := fn.enc.Encode(v, &buf); err != nil {
+		log.Exitf("pbeam.encodeSideInputFn.ProcessElement: couldn't encode side input element %v: %v", v, err)
+	}
+	return sideInputRecord{Index: fn.Index, Value: buf.Bytes()}
+}
+
+// userDoFn contains a DoFn provided by the user, either a function or a
+// structural DoFn, in a form that can be serialized; and calls it using
+// reflection. Privacy identifiers are never passed to the user DoFn.
+type userDoFn struct {
+	// Set if the user DoFn is a function.
+	Fn *beam.EncodedFunc
+	// Set if the user DoFn is a structural DoFn: the type of the struct, and
+	// its exported fields encoded in JSON. Unexported fields are expected to be
+	// initialized in Setup.
+	StructType *beam.EncodedType
+	StructData []byte
+	// Set if the input of the user DoFn is a <K,V> pair.
+	InputCodec *kv.Codec
+	// Set if the output of the user DoFn is a <K,V> pair.
+	OutputCodec    *kv.Codec
+	SideInputTypes []beam.EncodedType
+
+	structValue   reflect.Value // pointer to the struct, for structural DoFns
+	process       reflectx.Func
+	processFn     *funcx.Fn
+	sideInputDecs []beam.ElementDecoder
+	sideInputs    map[beam.Window][][]interface{} // decoded side inputs of each window of the bundle
+}
+
+// newUserDoFn validates doFn, and returns a userDoFn wrapping it, along with
+// the types of its outputs.
+func newUserDoFn(doFn interface{}, inputCodec *kv.Codec, inputT reflect.Type, sideInputTypes []reflect.Type) (*userDoFn, []reflect.Type, error) {
+	fn := &userDoFn{InputCodec: inputCodec}
+	for _, t := range sideInputTypes {
+		fn.SideInputTypes = append(fn.SideInputTypes, beam.EncodedType{t})
+	}
+	doFnT := reflect.TypeOf(doFn)
+	var process reflect.Value
+	switch {
+	case doFnT == nil:
+		return nil, nil, fmt.Errorf("doFn must be a function or a pointer to a struct, got nil")
+	case doFnT.Kind() == reflect.Func:
+		process = reflect.ValueOf(doFn)
+		fn.Fn = &beam.EncodedFunc{Fn: reflectx.MakeFunc(doFn)}
+	case doFnT.Kind() == reflect.Ptr && doFnT.Elem().Kind() == reflect.Struct:
+		process = reflect.ValueOf(doFn).MethodByName("ProcessElement")
+		if !process.IsValid() {
+			return nil, nil, fmt.Errorf("structural doFn %v has no ProcessElement method", doFnT)
+		}
+		for _, name := range lifecycleMethods {
+			if err := checkLifecycleMethod(reflect.ValueOf(doFn), name); err != nil {
+				return nil, nil, err
+			}
+		}
+		data, err := json.Marshal(doFn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't encode structural doFn %v: %v", doFnT, err)
+		}
+		fn.StructType = &beam.EncodedType{doFnT.Elem()}
+		fn.StructData = data
+	default:
+		return nil, nil, fmt.Errorf("doFn must be a function or a pointer to a struct, got %v", doFnT)
+	}
+	inputTypes := []reflect.Type{inputT}
+	if inputCodec != nil {
+		inputTypes = []reflect.Type{inputCodec.KType.T, inputCodec.VType.T}
+	}
+	outputTypes, err := checkReflectDoFn(process.Interface(), inputTypes, sideInputTypes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(outputTypes) == 2 {
+		fn.OutputCodec = kv.NewCodec(outputTypes[0], outputTypes[1])
+	}
+	return fn, outputTypes, nil
+}
+
+// checkReflectDoFn checks that process is a valid DoFn taking main inputs of
+// the given types and side inputs with elements of the given types, and
+// returns the types of its outputs. Its parameters must be, in this order, an
+// optional context.Context, its main inputs, its side inputs (either
+// singletons or iterators) and an optional emit function.
+func checkReflectDoFn(process interface{}, inputTypes, sideInputTypes []reflect.Type) ([]reflect.Type, error) {
+	funcxFn, err := funcx.New(reflectx.MakeFunc(process))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create funcx.Fn from doFn: %v", err)
+	}
+	params := funcxFn.Param
+	if len(params) > 0 && params[0].Kind == funcx.FnContext {
+		params = params[1:]
+	}
+	var emit *funcx.FnParam
+	if len(params) > 0 && params[len(params)-1].Kind == funcx.FnEmit {
+		emit = &params[len(params)-1]
+		params = params[:len(params)-1]
+	}
+	if len(params) != len(inputTypes)+len(sideInputTypes) {
+		return nil, fmt.Errorf("doFn should have %d main input(s) and %d side input(s), optionally preceded by a context.Context and followed by an emit function, got %v", len(inputTypes), len(sideInputTypes), funcxFn.Fn.Type())
+	}
+	for i, t := range inputTypes {
+		if params[i].Kind != funcx.FnValue || !t.AssignableTo(params[i].T) {
+			return nil, fmt.Errorf("main input %d of doFn should have type %v, got %v", i, t, params[i].T)
+		}
+	}
+	for i, t := range sideInputTypes {
+		p := params[len(inputTypes)+i]
+		var elemT reflect.Type
+		switch p.Kind {
+		case funcx.FnValue:
+			elemT = p.T
+		case funcx.FnIter:
+			elemT = p.T.In(0).Elem()
+		case funcx.FnReIter:
+			elemT = p.T.Out(0).In(0).Elem()
+		default:
+			return nil, fmt.Errorf("side input %d of doFn should be a value or an iterator, got %v", i, p.T)
+		}
+		if !t.AssignableTo(elemT) {
+			return nil, fmt.Errorf("side input %d of doFn should have elements of type %v, got %v", i, t, elemT)
+		}
+	}
+	var outputTypes []reflect.Type
+	for _, r := range funcxFn.Ret {
+		switch r.Kind {
+		case funcx.RetValue:
+			outputTypes = append(outputTypes, r.T)
+		case funcx.RetError:
+		default:
+			return nil, fmt.Errorf("illegal DoFn return parameter in pbeam.ParDo")
+		}
+	}
+	if err := validateRetOrder(funcxFn); err != nil {
+		return nil, err
+	}
+	if emit != nil {
+		if len(outputTypes) > 0 {
+			return nil, fmt.Errorf("return value is not supported if DoFn has an emit function in param, got %d returns", len(outputTypes))
+		}
+		for i := 0; i < emit.T.NumIn(); i++ {
+			outputTypes = append(outputTypes, emit.T.In(i))
+		}
+	}
+	if len(outputTypes) != 1 && len(outputTypes) != 2 {
+		return nil, fmt.Errorf("the DoFn parameter in pbeam.ParDo should have one or two value outputs or has an emit function")
+	}
+	return outputTypes, nil
+}
+
+// checkLifecycleMethod checks that the method with the given name of a
+// structural DoFn, if it exists, only has an optional context.Context
+// parameter and an optional error return value.
+func checkLifecycleMethod(doFn reflect.Value, name string) error {
+	m := doFn.MethodByName(name)
+	if !m.IsValid() {
+		return nil
+	}
+	t := m.Type()
+	if t.NumIn() > 1 || (t.NumIn() == 1 && t.In(0) != reflect.TypeOf((*context.Context)(nil)).Elem()) {
+		return fmt.Errorf("method %s of a structural doFn can only have an optional context.Context parameter, got %v", name, t)
+	}
+	if t.NumOut() > 1 || (t.NumOut() == 1 && t.Out(0) != reflect.TypeOf((*error)(nil)).Elem()) {
+		return fmt.Errorf("method %s of a structural doFn can only return an optional error, got %v", name, t)
+	}
+	return nil
+}
+
+func (fn *userDoFn) setup(ctx context.Context) error {
+	if fn.InputCodec != nil {
+		if err := fn.InputCodec.Setup(); err != nil {
+			return err
+		}
+	}
+	if fn.OutputCodec != nil {
+		if err := fn.OutputCodec.Setup(); err != nil {
+			return err
+		}
+	}
+	fn.sideInputDecs = nil
+	for _, t := range fn.SideInputTypes {
+		fn.sideInputDecs = append(fn.sideInputDecs, beam.NewElementDecoder(t.T))
+	}
+	if fn.Fn != nil {
+		fn.process = fn.Fn.Fn
+	} else {
+		fn.structValue = reflect.New(fn.StructType.T)
+		if err := json.Unmarshal(fn.StructData, fn.structValue.Interface()); err != nil {
+			return fmt.Errorf("couldn't decode structural doFn %v: %v", fn.StructType.T, err)
+		}
+		fn.process = reflectx.MakeFunc(fn.structValue.MethodByName("ProcessElement").Interface())
+	}
+	processFn, err := funcx.New(fn.process)
+	if err != nil {
+		return err
+	}
+	fn.processFn = processFn
+	return fn.callLifecycleMethod(ctx, "Setup")
+}
+
+// callLifecycleMethod calls the method with the given name of a structural
+// DoFn, if it exists.
+func (fn *userDoFn) callLifecycleMethod(ctx context.Context, name string) error {
+	if fn.StructType == nil {
+		return nil
+	}
+	m := fn.structValue.MethodByName(name)
+	if !m.IsValid() {
+		return nil
+	}
+	var args []reflect.Value
+	if m.Type().NumIn() == 1 {
+		args = append(args, reflect.ValueOf(ctx))
+	}
+	if out := m.Call(args); len(out) == 1 && !out[0].IsNil() {
+		return out[0].Interface().(error)
+	}
+	return nil
+}
+
+// loadSideInputs returns the decoded side inputs for window w. Side inputs
+// are decoded once per window and bundle: elements of different windows see
+// different side inputs when the side inputs are windowed.
+func (fn *userDoFn) loadSideInputs(w beam.Window, iter func(*sideInputRecord) bool) ([][]interface{}, error) {
+	if sideInputs, ok := fn.sideInputs[w]; ok {
+		return sideInputs, nil
+	}
+	sideInputs := make([][]interface{}, len(fn.SideInputTypes))
+	var record sideInputRecord
+	for iter(&record) {
+		v, err := fn.sideInputDecs[record.Index].Decode(bytes.NewBuffer(record.Value))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode element of side input %d: %v", record.Index, err)
+		}
+		sideInputs[record.Index] = append(sideInputs[record.Index], v)
+	}
+	if fn.sideInputs == nil {
+		fn.sideInputs = make(map[beam.Window][][]interface{})
+	}
+	fn.sideInputs[w] = sideInputs
+	return sideInputs, nil
+}
+
+func (fn *userDoFn) processElement(ctx context.Context, id beam.W, x beam.X, sideInputs [][]interface{}, emit func(beam.W, beam.Y)) error {
+	var inputs []interface{}
+	if fn.InputCodec != nil {
+		k, v := fn.InputCodec.Decode(x.(kv.Pair))
+		inputs = []interface{}{k, v}
+	} else {
+		inputs = []interface{}{x}
+	}
+	emitOutputs := func(outputs []interface{}) {
+		if fn.OutputCodec != nil {
+			emit(id, fn.OutputCodec.Encode(outputs[0], outputs[1]))
+		} else {
+			emit(id, outputs[0])
+		}
+	}
+	var args []interface{}
+	sideInputIndex := 0
+	for i, p := range fn.processFn.Param {
+		t := fn.process.Type().In(i)
+		switch {
+		case p.Kind == funcx.FnContext:
+			args = append(args, ctx)
+		case p.Kind == funcx.FnEmit:
+			args = append(args, reflect.MakeFunc(t, func(outputs []reflect.Value) []reflect.Value {
+				values := make([]interface{}, len(outputs))
+				for i, o := range outputs {
+					values[i] = o.Interface()
+				}
+				emitOutputs(values)
+				return nil
+			}).Interface())
+		case len(inputs) > 0:
+			args = append(args, inputs[0])
+			inputs = inputs[1:]
+		default:
+			arg, err := sideInputArg(sideInputs[sideInputIndex], p.Kind, t)
+			if err != nil {
+				return fmt.Errorf("side input %d: %v", sideInputIndex, err)
+			}
+			args = append(args, arg)
+			sideInputIndex++
+		}
+	}
+	var outputs []interface{}
+	for i, out := range fn.process.Call(args) {
+		if fn.processFn.Ret[i].Kind == funcx.RetError {
+			if out != nil {
+				return out.(error)
+			}
+			continue
+		}
+		outputs = append(outputs, out)
+	}
+	if len(outputs) > 0 {
+		emitOutputs(outputs)
+	}
+	return nil
+}
+
+// sideInputArg returns the argument of type t passed to the user DoFn for a
+// side input with the given elements.
+func sideInputArg(elements []interface{}, kind funcx.FnParamKind, t reflect.Type) (interface{}, error) {
+	iter := func(iterT reflect.Type) reflect.Value {
+		i := 0
+		return reflect.MakeFunc(iterT, func(args []reflect.Value) []reflect.Value {
+			if i >= len(elements) {
+				return []reflect.Value{reflect.ValueOf(false)}
+			}
+			args[0].Elem().Set(valueOf(elements[i], iterT.In(0).Elem()))
+			i++
+			return []reflect.Value{reflect.ValueOf(true)}
+		})
+	}
+	switch kind {
+	case funcx.FnIter:
+		return iter(t).Interface(), nil
+	case funcx.FnReIter:
+		return reflect.MakeFunc(t, func([]reflect.Value) []reflect.Value {
+			return []reflect.Value{iter(t.Out(0))}
+		}).Interface(), nil
+	default:
+		if len(elements) != 1 {
+			return nil, fmt.Errorf("singleton side input should have exactly one element, got %d", len(elements))
+		}
+		return elements[0], nil
+	}
+}
+
+// valueOf returns v as a reflect.Value of type t, which handles v being nil
+// when t is an interface.
+func valueOf(v interface{}, t reflect.Type) reflect.Value {
+	if v == nil {
+		return reflect.Zero(t)
+	}
+	return reflect.ValueOf(v)
+}
+
+// reflectDoFn is the DoFn passed to Beam for a structural DoFn without side
+// inputs.
+type reflectDoFn struct {
+	DoFn *userDoFn
+}
+
+func (fn *reflectDoFn) Setup(ctx context.Context) error {
+	return fn.DoFn.setup(ctx)
+}
+
+func (fn *reflectDoFn) StartBundle(ctx context.Context, _ func(beam.W, beam.Y)) error {
+	return fn.DoFn.callLifecycleMethod(ctx, "StartBundle")
+}
+
+func (fn *reflectDoFn) ProcessElement(ctx context.Context, id beam.W, x beam.X, emit func(beam.W, beam.Y)) error {
+	return fn.DoFn.processElement(ctx, id, x, nil, emit)
+}
+
+func (fn *reflectDoFn) FinishBundle(ctx context.Context, _ func(beam.W, beam.Y)) error {
+	return fn.DoFn.callLifecycleMethod(ctx, "FinishBundle")
+}
+
+func (fn *reflectDoFn) Teardown(ctx context.Context) error {
+	return fn.DoFn.callLifecycleMethod(ctx, "Teardown")
+}
+
+// reflectSideInputDoFn is the DoFn passed to Beam for a DoFn with side inputs,
+// which have been flattened into a single side input.
+type reflectSideInputDoFn struct {
+	DoFn *userDoFn
+}
+
+func (fn *reflectSideInputDoFn) Setup(ctx context.Context) error {
+	return fn.DoFn.setup(ctx)
+}
+
+func (fn *reflectSideInputDoFn) StartBundle(ctx context.Context, _ func(*sideInputRecord) bool, _ func(beam.W, beam.Y)) error {
+	// Side inputs can change between bundles for unbounded inputs, so they are
+	// only kept for the duration of a bundle.
+	fn.DoFn.sideInputs = nil
+	return fn.DoFn.callLifecycleMethod(ctx, "StartBundle")
+}
+
+func (fn *reflectSideInputDoFn) ProcessElement(ctx context.Context, w beam.Window, id beam.W, x beam.X, sideInput func(*sideInputRecord) bool, emit func(beam.W, beam.Y)) error {
+	sideInputs, err := fn.DoFn.loadSideInputs(w, sideInput)
+	if err != nil {
+		return err
+	}
+	return fn.DoFn.processElement(ctx, id, x, sideInputs, emit)
+}
+
+func (fn *reflectSideInputDoFn) FinishBundle(ctx context.Context, _ func(*sideInputRecord) bool, _ func(beam.W, beam.Y)) error {
+	return fn.DoFn.callLifecycleMethod(ctx, "FinishBundle")
+}
+
+func (fn *reflectSideInputDoFn) Teardown(ctx context.Context) error {
+	return fn.DoFn.callLifecycleMethod(ctx, "Teardown")
+}
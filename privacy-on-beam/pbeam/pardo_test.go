@@ -17,6 +17,7 @@
 package pbeam
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -29,6 +30,7 @@ import (
 	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/funcx"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
 	"github.com/apache/beam/sdks/go/pkg/beam/runners/direct"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
@@ -1825,3 +1827,246 @@ func TestValidateReturnOrder(t *testing.T) {
 		})
 	}
 }
+
+// lookupDoFn is a structural doFn that loads a lookup table in Setup.
+type lookupDoFn struct {
+	Offset int
+	table  map[int]int
+}
+
+func (fn *lookupDoFn) Setup() {
+	fn.table = map[int]int{42: 1, 0: 2}
+}
+
+func (fn *lookupDoFn) StartBundle(_ context.Context) error {
+	if fn.table == nil {
+		return errors.New("Setup wasn't called before StartBundle")
+	}
+	return nil
+}
+
+func (fn *lookupDoFn) ProcessElement(v int) int {
+	return fn.table[v] + fn.Offset
+}
+
+func TestParDoStructuralDoFn(t *testing.T) {
+	want := []pairII{
+		{17, 11},
+		{99, 12},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, &lookupDoFn{Offset: 10}, pcol)
+	gotCol := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, gotCol, wantCol)
+	if err := execute(context.Background(), p); err != nil {
+		t.Errorf("DoFn(%v) = %v, expected %v: %v", col, gotCol, wantCol, err)
+	}
+}
+
+// swapDoFn is a structural doFn that swaps keys and values.
+type swapDoFn struct{}
+
+func (fn *swapDoFn) ProcessElement(k, v int, emit func(int, int)) {
+	emit(v, k)
+}
+
+func TestParDoStructuralDoFnKV(t *testing.T) {
+	want := []pairII{
+		{17, 43},
+		{99, 1},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, func(v int) (int, int) { return v, v + 1 }, pcol)
+	pcol = ParDo(s, &swapDoFn{}, pcol)
+	if diff := cmp.Diff(pcol.codec, codec, cmp.Comparer(compareCodecs)); diff != "" {
+		t.Errorf("ParDo returned a PrivatePCollection with unexpected codec, diff=%s", diff)
+	}
+	pcol = ParDo(s, func(k, v int) int { return k }, pcol)
+	gotCol := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, gotCol, wantCol)
+	if err := execute(context.Background(), p); err != nil {
+		t.Errorf("DoFn(%v) = %v, expected %v: %v", col, gotCol, wantCol, err)
+	}
+}
+
+func TestParDoWithSideInputs(t *testing.T) {
+	doFn := func(v int, offset int, multipliersIter func(*int) bool) int {
+		result := offset
+		var m int
+		for multipliersIter(&m) {
+			result += m * v
+		}
+		return result
+	}
+	want := []pairII{
+		{17, 129},
+		{99, 3},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+	offset := beam.Create(s, 3)
+	multipliers := beam.CreateList(s, []int{1, 2})
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, doFn, pcol, beam.SideInput{Input: offset}, beam.SideInput{Input: multipliers})
+	gotCol := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, gotCol, wantCol)
+	if err := execute(context.Background(), p); err != nil {
+		t.Errorf("DoFn(%v) = %v, expected %v: %v", col, gotCol, wantCol, err)
+	}
+}
+
+func TestParDoWithSideInputsKV(t *testing.T) {
+	doFn := func(_ context.Context, k, v int, names func() func(*string) bool, emit func(int, int)) error {
+		var name string
+		for iter := names(); iter(&name); {
+			emit(k, len(name))
+		}
+		return nil
+	}
+	want := []pairII{
+		{17, 43},
+		{17, 44},
+		{99, 1},
+		{99, 2},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+	names := beam.CreateList(s, []string{"a", "bb"})
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, func(v int) (int, int) { return v, v + 1 }, pcol)
+	pcol = ParDo(s, doFn, pcol, beam.SideInput{Input: names})
+	if diff := cmp.Diff(pcol.codec, codec, cmp.Comparer(compareCodecs)); diff != "" {
+		t.Errorf("ParDo returned a PrivatePCollection with unexpected codec, diff=%s", diff)
+	}
+	pcol = ParDo(s, func(k, v int) int { return k + v }, pcol)
+	gotCol := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, gotCol, wantCol)
+	if err := execute(context.Background(), p); err != nil {
+		t.Errorf("DoFn(%v) = %v, expected %v: %v", col, gotCol, wantCol, err)
+	}
+}
+
+// offsetDoFn is a structural doFn with a side input.
+type offsetDoFn struct{}
+
+func (fn *offsetDoFn) ProcessElement(v int, offset int) int {
+	return v + offset
+}
+
+func TestParDoStructuralDoFnWithSideInputs(t *testing.T) {
+	want := []pairII{
+		{17, 45},
+		{99, 3},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, &offsetDoFn{}, pcol, beam.SideInput{Input: beam.Create(s, 3)})
+	gotCol := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, gotCol, wantCol)
+	if err := execute(context.Background(), p); err != nil {
+		t.Errorf("DoFn(%v) = %v, expected %v: %v", col, gotCol, wantCol, err)
+	}
+}
+
+// Checks that the side inputs of a DoFn are loaded separately for each window.
+func TestLoadSideInputsPerWindow(t *testing.T) {
+	fn, _, err := newUserDoFn(&offsetDoFn{}, nil, reflect.TypeOf(0), []reflect.Type{reflect.TypeOf(0)})
+	if err != nil {
+		t.Fatalf("newUserDoFn: got error %v", err)
+	}
+	if err := fn.setup(context.Background()); err != nil {
+		t.Fatalf("setup: got error %v", err)
+	}
+	sideInput := func(offset int) func(*sideInputRecord) bool {
+		var buf bytes.Buffer
+		if err := beam.NewElementEncoder(reflect.TypeOf(0)).Encode(offset, &buf); err != nil {
+			t.Fatalf("couldn't encode side input: %v", err)
+		}
+		done := false
+		return func(r *sideInputRecord) bool {
+			if done {
+				return false
+			}
+			*r = sideInputRecord{Index: 0, Value: buf.Bytes()}
+			done = true
+			return true
+		}
+	}
+	w1 := window.IntervalWindow{Start: 0, End: 1000}
+	w2 := window.IntervalWindow{Start: 1000, End: 2000}
+	for _, tc := range []struct {
+		w      beam.Window
+		offset int
+		want   int
+	}{
+		{w1, 1, 1},
+		{w2, 2, 2},
+		// Side inputs are only read once per window.
+		{w1, 3, 1},
+	} {
+		got, err := fn.loadSideInputs(tc.w, sideInput(tc.offset))
+		if err != nil {
+			t.Fatalf("loadSideInputs: got error %v", err)
+		}
+		if len(got) != 1 || len(got[0]) != 1 || got[0][0] != tc.want {
+			t.Errorf("loadSideInputs(%v): got %v, want [[%d]]", tc.w, got, tc.want)
+		}
+	}
+}
+
+type noProcessElementDoFn struct{}
+
+type badSetupDoFn struct{}
+
+func (fn *badSetupDoFn) Setup(_ int)              {}
+func (fn *badSetupDoFn) ProcessElement(v int) int { return v }
+
+type badTeardownDoFn struct{}
+
+func (fn *badTeardownDoFn) Teardown() int            { return 0 }
+func (fn *badTeardownDoFn) ProcessElement(v int) int { return v }
+
+// Ensure that invalid structural DoFns or DoFns with side inputs return an
+// error.
+func TestNewUserDoFnInvalid(t *testing.T) {
+	intT, stringT := reflect.TypeOf(0), reflect.TypeOf("")
+	for _, tc := range []struct {
+		desc           string
+		doFn           interface{}
+		inputCodec     *kv.Codec
+		sideInputTypes []reflect.Type
+	}{
+		{"nil doFn", nil, nil, nil},
+		{"struct that is not a pointer", lookupDoFn{}, nil, nil},
+		{"no ProcessElement method", &noProcessElementDoFn{}, nil, nil},
+		{"Setup with invalid parameter", &badSetupDoFn{}, nil, nil},
+		{"Teardown with invalid return value", &badTeardownDoFn{}, nil, nil},
+		{"missing side input", func(v int) int { return v }, nil, []reflect.Type{intT}},
+		{"too many side inputs", func(v, w int) int { return v }, nil, nil},
+		{"wrong main input type", func(v string, w int) int { return w }, nil, []reflect.Type{intT}},
+		{"wrong side input type", func(v int, w string) int { return v }, nil, []reflect.Type{intT}},
+		{"wrong side input iterator type", func(v int, iter func(*string) bool) int { return v }, nil, []reflect.Type{intT}},
+		{"single input for a <K,V> PrivatePCollection", func(v, w int) int { return v }, codec, []reflect.Type{stringT}},
+		{"emit and return value", func(v, w int, emit func(int)) int { return v }, nil, []reflect.Type{intT}},
+		{"no output", func(v, w int) {}, nil, []reflect.Type{intT}},
+		{"too many outputs", func(v, w int) (int, int, int) { return v, v, v }, nil, []reflect.Type{intT}},
+	} {
+		got, _, err := newUserDoFn(tc.doFn, tc.inputCodec, intT, tc.sideInputTypes)
+		if got != nil {
+			t.Errorf("%s: newUserDoFn returned (non-nil function),%v; expected nil function and error", tc.desc, err)
+		}
+		if err == nil {
+			t.Errorf("%s: newUserDoFn returned <nil function>,<nil error>; expected an error", tc.desc)
+		}
+	}
+}
@@ -89,6 +89,15 @@
 // particular instance of this identifier (for example, user n°4217, event n°99,
 // or the pair (user n°4127,2020-06-24)).
 //
+// This guarantee is per window for PrivatePCollections windowed by WindowInto:
+// aggregations run independently on each window, and each window spends the
+// full (ε,δ) budget of the PrivacySpec. The inequality above then holds when
+// icol' is obtained by removing the records of a given privacy identifier in a
+// single window, not in all windows. To protect all the records of a privacy
+// identifier, bound the number of windows it contributes to with
+// BoundWindowContributions: if it contributes to at most n windows, the
+// outputs over all windows are (nε,nδ)-differentially private.
+//
 // Note that the interface contract of PrivatePCollection has limitations. this
 // library assumes that the user of the library is trusted with access to the
 // underlying raw data. This intended user is a well-meaning developer trying to
@@ -114,9 +123,11 @@ import (
 	"sync"
 
 	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/dpagg"
 	"github.com/google/differential-privacy/go/noise"
 	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
 	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -144,7 +155,11 @@ type PrivacySpec struct {
 	epsilon           float64 // ε budget available for this PrivatePCollection.
 	delta             float64 // δ budget available for this PrivatePCollection.
 	partiallyConsumed bool    // Whether some privacy budget has already been consumed from this PrivacySpec.
-	mux sync.Mutex
+	// Whether privacy identifiers are pseudonymized, and the secret key used to
+	// pseudonymize them (see PseudonymizeIDs).
+	pseudonymize        bool
+	pseudonymizationKey []byte
+	mux                 sync.Mutex
 }
 
 // consumeBudget consumes a differential privacy budget (ε,δ) from a
@@ -208,44 +223,122 @@ type PrivacySpecOption interface {
 }
 
 // getMaxPartitionsContributed returns a maxPartitionsContributed parameter
-// if it greater than zero, otherwise it fails.
-func getMaxPartitionsContributed(spec *PrivacySpec, maxPartitionsContributed int64) int64 {
+// if it greater than zero, otherwise it fails. The parameter is lowered to the
+// maximum number of records per privacy identifier of pcol, if known.
+func getMaxPartitionsContributed(pcol PrivatePCollection, maxPartitionsContributed int64) int64 {
 	if maxPartitionsContributed <= 0 {
 		// TODO: return error instead
 		log.Exitf("MaxPartitionsContributed must be set to a positive value.")
 	}
-	return maxPartitionsContributed
+	return boundByMaxContributions(pcol, maxPartitionsContributed)
 }
 
 // getMaxContributionsPerPartition returns a maxContributionsPerPartition parameter
-// if it greater than zero, otherwise it fails.
-func getMaxContributionsPerPartition(maxContributionsPerPartition int64) int64 {
+// if it greater than zero, otherwise it fails. The parameter is lowered to the
+// maximum number of records per privacy identifier of pcol, if known.
+func getMaxContributionsPerPartition(pcol PrivatePCollection, maxContributionsPerPartition int64) int64 {
 	if maxContributionsPerPartition <= 0 {
 		// TODO: return error instead
 		log.Exitf("MaxContributionsPerPartition must be set to a positive value.")
 	}
-	return maxContributionsPerPartition
+	return boundByMaxContributions(pcol, maxContributionsPerPartition)
+}
+
+// boundByMaxContributions returns the minimum of bound and of the maximum
+// number of records per privacy identifier of pcol, if known: a privacy
+// identifier with at most n records contributes to at most n partitions, and
+// at most n times to each of them.
+func boundByMaxContributions(pcol PrivatePCollection, bound int64) int64 {
+	if pcol.maxContributions > 0 && pcol.maxContributions < bound {
+		return pcol.maxContributions
+	}
+	return bound
 }
 
 // NoiseKind represents the kind of noise to be used in an aggregations.
 type NoiseKind interface {
-	toNoiseKind() noise.Kind
+	// toNoiseKind returns the kind of noise to be used in an aggregation with
+	// the given MaxPartitionsContributed and privacy budget.
+	toNoiseKind(maxPartitionsContributed int64, epsilon, delta float64, partitionsSpecified bool) noise.Kind
 }
 
 // GaussianNoise is an aggregations param that makes them use Gaussian Noise.
 type GaussianNoise struct{}
 
-func (gn GaussianNoise) toNoiseKind() noise.Kind {
+func (gn GaussianNoise) toNoiseKind(int64, float64, float64, bool) noise.Kind {
 	return noise.GaussianNoise
 }
 
 // LaplaceNoise is an aggregations param that makes them use Laplace Noise.
 type LaplaceNoise struct{}
 
-func (ln LaplaceNoise) toNoiseKind() noise.Kind {
+func (ln LaplaceNoise) toNoiseKind(int64, float64, float64, bool) noise.Kind {
 	return noise.LaplaceNoise
 }
 
+// AutoNoise is an aggregations param that makes them use whichever of Laplace
+// and Gaussian Noise has the smallest standard deviation given their privacy
+// budget and MaxPartitionsContributed (see noise.AdviseKind). When an
+// aggregation has public partitions, Gaussian Noise is compared with all of δ
+// since none of it is used for partition selection; and if Laplace Noise is
+// used, δ is not used at all.
+type AutoNoise struct{}
+
+func (an AutoNoise) toNoiseKind(maxPartitionsContributed int64, epsilon, delta float64, partitionsSpecified bool) noise.Kind {
+	if delta == 0 {
+		return noise.LaplaceNoise
+	}
+	// The L_∞ sensitivity doesn't matter since it scales both kinds of noise
+	// linearly. If the parameters are invalid, Gaussian Noise is returned: it
+	// checks all of them, so the aggregation reports the same error as with
+	// GaussianNoise{}.
+	if partitionsSpecified {
+		// There is no thresholding, so Gaussian Noise uses all of δ, unlike in
+		// noise.AdviseKind.
+		laplaceStdDev, err := noise.Laplace().StdDev(maxPartitionsContributed, 1, epsilon, 0)
+		if err != nil {
+			return noise.GaussianNoise
+		}
+		gaussianStdDev, err := noise.Gaussian().StdDev(maxPartitionsContributed, 1, epsilon, delta)
+		if err != nil || gaussianStdDev < laplaceStdDev {
+			return noise.GaussianNoise
+		}
+		return noise.LaplaceNoise
+	}
+	// ε is split by 2 between the noise and partition selection.
+	advice, err := noise.AdviseKind(maxPartitionsContributed, 1, epsilon/2, delta)
+	if err != nil {
+		return noise.GaussianNoise
+	}
+	return advice.Kind
+}
+
+// getNoiseKind returns the kind of noise to be used in an aggregation with the
+// given NoiseKind param, MaxPartitionsContributed and privacy budget, along
+// with the δ to be used by the aggregation: it is 0 if AutoNoise chose Laplace
+// Noise for an aggregation with public partitions, since δ is then unused.
+func getNoiseKind(noiseKind NoiseKind, maxPartitionsContributed int64, epsilon, delta float64, partitionsSpecified bool) (noise.Kind, float64) {
+	if noiseKind == nil {
+		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
+		return noise.LaplaceNoise, delta
+	}
+	kind := noiseKind.toNoiseKind(maxPartitionsContributed, epsilon, delta, partitionsSpecified)
+	if _, ok := noiseKind.(AutoNoise); ok && partitionsSpecified && kind == noise.LaplaceNoise {
+		return kind, 0
+	}
+	return kind, delta
+}
+
+// checkPartitionSelectionStrategy returns an error if strategy is not one of
+// the partition selection strategies supported by dpagg.
+func checkPartitionSelectionStrategy(label string, strategy dpagg.PartitionSelectionStrategy) error {
+	switch strategy {
+	case dpagg.PreAggPartitionSelection, dpagg.LaplacePartitionSelection, dpagg.GaussianPartitionSelection:
+		return nil
+	}
+	return fmt.Errorf("%s: unknown PartitionSelectionStrategy %v", label, strategy)
+}
+
 // NewPrivacySpec creates a new PrivacySpec with the specified privacy budget
 // and options.
 //
@@ -289,22 +382,42 @@ type PrivatePCollection struct {
 	codec *kv.Codec
 	// Privacy budget and parameters attached to this PrivatePCollection
 	privacySpec *PrivacySpec
+	// If positive, the maximum number of records associated with each privacy
+	// identifier (see BoundSubUnitContributions).
+	maxContributions int64
+	// If set, the windowing function applied to col (see WindowInto).
+	windowFn *window.Fn
+	// If set, the sample of privacy identifiers that col is computed from (see
+	// PoissonSample).
+	sampling *poissonSampling
+}
+
+// consumeBudget consumes a differential privacy budget (ε,δ) for an
+// aggregation on pcol from its PrivacySpec, like PrivacySpec.consumeBudget.
+// If pcol is sampled, the amplified budget is consumed from the PrivacySpec,
+// and the budget returned is the one with which the aggregation must be
+// computed on the sampled data.
+func (pcol PrivatePCollection) consumeBudget(epsilon, delta float64) (eps, del float64, err error) {
+	if pcol.sampling == nil {
+		return pcol.privacySpec.consumeBudget(epsilon, delta)
+	}
+	return pcol.sampling.consumeBudget(pcol.privacySpec, epsilon, delta)
 }
 
 // MakePrivate transforms a PCollection<K,V> into a PrivatePCollection<V>,
 // where <K> is the privacy unit.
-func MakePrivate(_ beam.Scope, col beam.PCollection, spec *PrivacySpec) PrivatePCollection {
+func MakePrivate(s beam.Scope, col beam.PCollection, spec *PrivacySpec) PrivatePCollection {
 	if !typex.IsKV(col.Type()) {
 		log.Exitf("MakePrivate: PCollection must be of KV type: %v", col)
 	}
 	return PrivatePCollection{
-		col:         col,
+		col:         pseudonymizeIDs(s, spec, col),
 		privacySpec: spec,
 	}
 }
 
 // MakePrivateFromStruct creates a PrivatePCollection from a PCollection of
-// structs and the qualified path (seperated by ".") of the struct field to
+// structs and the qualified paths (seperated by ".") of the struct fields to
 // use as a privacy key.
 // For example:
 //
@@ -318,20 +431,35 @@ func MakePrivate(_ beam.Scope, col beam.PCollection, spec *PrivacySpec) PrivateP
 //   }
 //
 // If col is a PCollection of exampleStruct1, you could use "IntField" or
-// "StructField.StringField" as idFieldPath.
+// "StructField.StringField" as idFieldPaths.
+//
+// The privacy key fields are set to their zero value in the structs of the
+// returned PrivatePCollection, so that the privacy key cannot be used by
+// mistake in later transforms.
+//
+// The privacy key keeps the type of its field: if col is a PCollection of
+// exampleStruct1 and idFieldPaths is "IntField", the privacy key is an int.
+// If several idFieldPaths are given, the privacy unit is the combination of
+// all these fields (e.g. a user and a device, or a household and a member),
+// and the privacy key is a struct containing all of them, in order. Two
+// elements have the same privacy key if and only if all these fields are
+// equal.
 //
 // Caution
 //
-// The privacy key field must be a simple type (e.g. int, string, etc.), or
-// a pointer to a simple type and all its parents must be structs or
+// The privacy key fields must be simple types (e.g. int, string, etc.), or
+// pointers to simple types and all their parents must be structs or
 // pointers to structs.
 //
-// If the privacy key field is not set, all elements without a set field
+// If a privacy key field is not set, all elements without a set field
 // will be attributed to the same (default) privacy unit, likely degrading utility
-// of future DP aggregations. Similarly, if the idFieldPath or any of its
+// of future DP aggregations. Similarly, if an idFieldPath or any of its
 // parents are nil, those elements will be attributed to the same (default)
 // privacy unit as well.
-func MakePrivateFromStruct(s beam.Scope, col beam.PCollection, spec *PrivacySpec, idFieldPath string) PrivatePCollection {
+//
+// To declare the privacy key, partition, value and contribution bounds
+// directly on the struct type, use MakePrivateFromTaggedStruct instead.
+func MakePrivateFromStruct(s beam.Scope, col beam.PCollection, spec *PrivacySpec, idFieldPaths ...string) PrivatePCollection {
 	s = s.Scope("pbeam.MakePrivateFromStruct")
 	msgTypex := col.Type()
 	if typex.IsKV(msgTypex) {
@@ -341,30 +469,152 @@ func MakePrivateFromStruct(s beam.Scope, col beam.PCollection, spec *PrivacySpec
 	if msgType.Kind() != reflect.Struct {
 		log.Exitf("MakePrivateFromStruct: PCollection must be composed of structs", col)
 	}
-	extractFn := &extractStructFieldFn{IDFieldPath: idFieldPath}
+	extractFn, err := newExtractStructFieldFn(msgType, idFieldPaths)
+	if err != nil {
+		log.Exitf("MakePrivateFromStruct: %v", err)
+	}
 	return PrivatePCollection{
-		col:         beam.ParDo(s, extractFn, col),
+		col:         pseudonymizeIDs(s, spec, beam.ParDo(s, extractFn, col, beam.TypeDefinition{Var: beam.WType, T: extractFn.IDType.T})),
 		privacySpec: spec,
 	}
 }
 
+// newIDType returns the type of privacy keys made of fields with the given
+// types: the type of the field if there is a single one, or a struct type
+// with a field per privacy key field otherwise.
+func newIDType(fieldTypes []reflect.Type) reflect.Type {
+	if len(fieldTypes) == 1 {
+		return fieldTypes[0]
+	}
+	fields := make([]reflect.StructField, len(fieldTypes))
+	for i, t := range fieldTypes {
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("Field%d", i), Type: t}
+	}
+	return reflect.StructOf(fields)
+}
+
+// makeID returns the privacy key of type idType made of the given fields.
+func makeID(idType reflect.Type, fields []interface{}) interface{} {
+	if len(fields) == 1 {
+		return fields[0]
+	}
+	id := reflect.New(idType).Elem()
+	for i, f := range fields {
+		id.Field(i).Set(reflect.ValueOf(f))
+	}
+	return id.Interface()
+}
+
 type extractStructFieldFn struct {
-	IDFieldPath string
+	IDFieldPaths []string
+	IDType       beam.EncodedType
+}
+
+// newExtractStructFieldFn returns an extractStructFieldFn extracting the
+// fields at idFieldPaths from structs of type structType.
+func newExtractStructFieldFn(structType reflect.Type, idFieldPaths []string) (*extractStructFieldFn, error) {
+	if len(idFieldPaths) == 0 {
+		return nil, fmt.Errorf("at least one ID field path is required")
+	}
+	fieldTypes := make([]reflect.Type, len(idFieldPaths))
+	for i, path := range idFieldPaths {
+		t, err := getIDFieldType(structType, path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID field %s: %v", path, err)
+		}
+		fieldTypes[i] = t
+	}
+	return &extractStructFieldFn{
+		IDFieldPaths: idFieldPaths,
+		IDType:       beam.EncodedType{newIDType(fieldTypes)},
+	}, nil
+}
+
+// getIDFieldType returns the type of the ID field at idFieldPath in
+// structType, dereferencing pointers.
+func getIDFieldType(structType reflect.Type, idFieldPath string) (reflect.Type, error) {
+	t := structType
+	for _, subFieldName := range strings.Split(idFieldPath, ".") {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("parent of %s (%v) should be a struct or a pointer to a struct", subFieldName, t)
+		}
+		f, ok := t.FieldByName(subFieldName)
+		if !ok {
+			return nil, fmt.Errorf("no such field %s in %v", subFieldName, t)
+		}
+		t = f.Type
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if err := checkSimpleKind(t.Kind()); err != nil {
+		return nil, err
+	}
+	return t, nil
 }
 
-func (ext *extractStructFieldFn) ProcessElement(v beam.V) (string, beam.V, error) {
-	idField, err := ext.getIDField(v)
+func (ext *extractStructFieldFn) ProcessElement(v beam.V) (beam.W, beam.V, error) {
+	id, err := ext.getID(v)
 	if err != nil {
-		return "", nil, fmt.Errorf("Couldn't retrieve ID field %s: %v", ext.IDFieldPath, err)
+		return nil, nil, err
+	}
+	return id, ext.clearIDFields(v), nil
+}
+
+// clearIDFields returns a copy of struct s in which the ID fields are set to
+// their zero value. The structs pointed to along the ID field paths are copied
+// rather than modified, since s may be used by other transforms.
+func (ext *extractStructFieldFn) clearIDFields(s interface{}) interface{} {
+	v := reflect.New(reflect.TypeOf(s)).Elem()
+	v.Set(reflect.ValueOf(s))
+	for _, path := range ext.IDFieldPaths {
+		clearStructField(v, strings.Split(path, "."))
+	}
+	return v.Interface()
+}
+
+// clearStructField sets the field at subFieldNames in the addressable struct v
+// to its zero value, copying the structs pointed to along the way.
+func clearStructField(v reflect.Value, subFieldNames []string) {
+	f := v.FieldByName(subFieldNames[0])
+	if len(subFieldNames) == 1 {
+		f.Set(reflect.Zero(f.Type()))
+		return
+	}
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			// The ID field is already unset.
+			return
+		}
+		c := reflect.New(f.Type().Elem())
+		c.Elem().Set(f.Elem())
+		f.Set(c)
+		f = c.Elem()
 	}
-	// We use %#v to guarantee two different keys map to different strings
-	return fmt.Sprintf("%#v", idField), v, nil
+	clearStructField(f, subFieldNames[1:])
 }
 
-// getIDField retrieves the ID field (specified by the IDFieldPath) from
+// getID retrieves the ID fields from struct or pointer to a struct s, and
+// returns the corresponding privacy key.
+func (ext *extractStructFieldFn) getID(s interface{}) (interface{}, error) {
+	fields := make([]interface{}, len(ext.IDFieldPaths))
+	for i, path := range ext.IDFieldPaths {
+		f, err := ext.getIDField(s, path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't retrieve ID field %s: %v", path, err)
+		}
+		fields[i] = f
+	}
+	return makeID(ext.IDType.T, fields), nil
+}
+
+// getIDField retrieves the ID field (specified by idFieldPath) from
 // struct or pointer to a struct s.
-func (ext *extractStructFieldFn) getIDField(s interface{}) (interface{}, error) {
-	subFieldNames := strings.Split(ext.IDFieldPath, ".")
+func (ext *extractStructFieldFn) getIDField(s interface{}, idFieldPath string) (interface{}, error) {
+	subFieldNames := strings.Split(idFieldPath, ".")
 	subField := reflect.ValueOf(s)
 	var subFieldPath bytes.Buffer
 	for _, subFieldName := range subFieldNames {
@@ -379,10 +629,9 @@ func (ext *extractStructFieldFn) getIDField(s interface{}) (interface{}, error)
 		}
 	}
 	subField = ext.getPointedValue(subField) // Retrieve the  pointed value if subField is a pointer, no-op otherwise.
-	if err := ext.checkSimpleType(subField); err != nil {
+	if err := checkSimpleKind(subField.Kind()); err != nil {
 		return nil, err
 	}
-	// TODO Set the ID field to default value.
 	return subField.Interface(), nil
 }
 
@@ -397,22 +646,27 @@ func (ext *extractStructFieldFn) getPointedValue(v reflect.Value) reflect.Value
 	return reflect.Zero(v.Type().Elem())
 }
 
-func (ext *extractStructFieldFn) checkSimpleType(v reflect.Value) error {
-	switch v.Kind() {
+func checkSimpleKind(k reflect.Kind) error {
+	switch k {
 	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint,
 		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64,
 		reflect.Complex64, reflect.Complex128, reflect.String:
 		return nil
 	default:
-		return fmt.Errorf("id field must be a simple type (e.g. int, string), got type %v instead", v.Kind())
+		return fmt.Errorf("id field must be a simple type (e.g. int, string), got type %v instead", k)
 	}
 }
 
 // MakePrivateFromProto creates a PrivatePCollection from a PCollection of
-// proto messages and the qualified name of the field to use as a privacy key.
-// The field and all its parents must be non-repeated, and the field itself
-// cannot be a submessage.
-func MakePrivateFromProto(s beam.Scope, col beam.PCollection, spec *PrivacySpec, idFieldPath string) PrivatePCollection {
+// proto messages and the qualified names of the fields to use as a privacy
+// key. The fields and all their parents must be non-repeated, and the fields
+// themselves cannot be submessages.
+//
+// The privacy key fields are cleared in the messages of the returned
+// PrivatePCollection. Like in MakePrivateFromStruct, the privacy key keeps the
+// Go type of its field (enums are represented as int32), and several idFieldPaths define a
+// composite privacy key.
+func MakePrivateFromProto(s beam.Scope, col beam.PCollection, spec *PrivacySpec, idFieldPaths ...string) PrivatePCollection {
 	s = s.Scope("pbeam.MakePrivateFromProto")
 	msgTypex := col.Type()
 	if typex.IsKV(msgTypex) {
@@ -423,67 +677,133 @@ func MakePrivateFromProto(s beam.Scope, col beam.PCollection, spec *PrivacySpec,
 	if !msgType.Implements(reflect.TypeOf(&dummyMessage).Elem()) {
 		log.Exitf("MakePrivateFromProto: PCollection must be composed of proto messages", col)
 	}
+	if len(idFieldPaths) == 0 {
+		log.Exitf("MakePrivateFromProto: at least one ID field path is required")
+	}
+	desc := reflect.New(msgType.Elem()).Interface().(proto.Message).ProtoReflect().Descriptor()
+	fieldTypes := make([]reflect.Type, len(idFieldPaths))
+	for i, path := range idFieldPaths {
+		fds, err := getProtoFieldDescriptors(desc, path)
+		if err != nil {
+			log.Exitf("MakePrivateFromProto: invalid ID field %s: %v", path, err)
+		}
+		fieldTypes[i] = protoKindToType(fds[len(fds)-1].Kind())
+	}
 	extractFn := &extractProtoFieldFn{
-		IDFieldPath: idFieldPath,
-		MsgType:     beam.EncodedType{msgType},
+		IDFieldPaths: idFieldPaths,
+		MsgType:      beam.EncodedType{msgType},
+		IDType:       beam.EncodedType{newIDType(fieldTypes)},
 	}
 	return PrivatePCollection{
-		col:         beam.ParDo(s, extractFn, col),
+		col:         pseudonymizeIDs(s, spec, beam.ParDo(s, extractFn, col, beam.TypeDefinition{Var: beam.WType, T: extractFn.IDType.T})),
 		privacySpec: spec,
 	}
 }
 
+// protoKindToType returns the Go type used to represent ID fields of the
+// given kind.
+func protoKindToType(kind protoreflect.Kind) reflect.Type {
+	switch kind {
+	case protoreflect.BoolKind:
+		return reflect.TypeOf(false)
+	case protoreflect.EnumKind, protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return reflect.TypeOf(int32(0))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return reflect.TypeOf(uint32(0))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return reflect.TypeOf(int64(0))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return reflect.TypeOf(uint64(0))
+	case protoreflect.FloatKind:
+		return reflect.TypeOf(float32(0))
+	case protoreflect.DoubleKind:
+		return reflect.TypeOf(float64(0))
+	case protoreflect.BytesKind:
+		return reflect.TypeOf([]byte{})
+	default:
+		return reflect.TypeOf("")
+	}
+}
+
 type extractProtoFieldFn struct {
-	IDFieldPath string
-	MsgType     beam.EncodedType
-	desc        protoreflect.MessageDescriptor
+	IDFieldPaths []string
+	MsgType      beam.EncodedType
+	IDType       beam.EncodedType
+	desc         protoreflect.MessageDescriptor
 }
 
-func (ext *extractProtoFieldFn) ProcessElement(v beam.V) (string, beam.V) {
-	pb := v.(proto.Message)
+func (ext *extractProtoFieldFn) ProcessElement(v beam.V) (beam.W, beam.V) {
+	// The ID fields are removed from a copy of the message, since v may be
+	// used by other transforms.
+	pb := proto.Clone(v.(proto.Message))
 	reflectPb := pb.ProtoReflect()
 	// If ext.desc hasn't been initialized, initialize it now.
 	if ext.desc == nil {
 		ext.desc = reflectPb.Descriptor()
 	}
-	idField, err := ext.extractField(reflectPb)
-	if err != nil {
-		log.Exitf("couldn't extract field %s from proto: %v", ext.IDFieldPath, err)
+	fields := make([]interface{}, len(ext.IDFieldPaths))
+	for i, path := range ext.IDFieldPaths {
+		idField, err := ext.extractField(reflectPb, path)
+		if err != nil {
+			log.Exitf("couldn't extract field %s from proto: %v", path, err)
+		}
+		fields[i] = idField
 	}
 	out := reflectPb.Interface()
-	return fmt.Sprint(idField), out
+	return makeID(ext.IDType.T, fields), out
 }
 
-// extractProtoField retrieves the value of a protoreflect.Message field based on
-// its fully qualified name, and deletes this field from the original message.
-// It fails if the field is a submessage, if it is repeated, or if any of its
-// parents are repeated.
-func (ext *extractProtoFieldFn) extractField(pb protoreflect.Message) (interface{}, error) {
-	parts := strings.Split(ext.IDFieldPath, ".")
-	curPb := pb
-	curDesc := ext.desc
+// getProtoFieldDescriptors returns the descriptors of the fields along the
+// fully qualified name idFieldPath. It fails if the field is a submessage, if
+// it is repeated, or if any of its parents are repeated.
+func getProtoFieldDescriptors(desc protoreflect.MessageDescriptor, idFieldPath string) ([]protoreflect.FieldDescriptor, error) {
+	parts := strings.Split(idFieldPath, ".")
+	var fds []protoreflect.FieldDescriptor
+	curDesc := desc
 	for i, part := range parts {
 		fieldDesc := curDesc.Fields().ByName((protoreflect.Name)(part))
 		if fieldDesc == nil {
 			return nil, fmt.Errorf("couldn't get field %s from the proto message", strings.Join(parts[:i+1], "."))
 		}
+		fds = append(fds, fieldDesc)
 		switch {
 		case fieldDesc.Cardinality() == protoreflect.Repeated:
 			return nil, fmt.Errorf("repeated field %s found in the proto message", strings.Join(parts[:i+1], "."))
 		case fieldDesc.Kind() == protoreflect.MessageKind || fieldDesc.Kind() == protoreflect.GroupKind:
 			// Continue looking into subfields.
 			curDesc = fieldDesc.Message()
-			if curPb.Has(fieldDesc) {
-				curPb = curPb.Get(fieldDesc).Message()
-			} else {
-				curPb = curPb.NewField(fieldDesc).Message()
-			}
 		default:
-			// Remove and return the (value) field as a string.
-			value := curPb.Get(fieldDesc).String()
-			// TODO Remove the ID field.
-			return value, nil
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("field %s is not a submessage", strings.Join(parts[:i+1], "."))
+			}
+			return fds, nil
 		}
 	}
-	return nil, fmt.Errorf("submessage field %s found in the proto message", ext.IDFieldPath)
+	return nil, fmt.Errorf("submessage field %s found in the proto message", idFieldPath)
+}
+
+// extractProtoField retrieves the value of a protoreflect.Message field based on
+// its fully qualified name, and deletes this field from the original message.
+// It fails if the field is a submessage, if it is repeated, or if any of its
+// parents are repeated.
+func (ext *extractProtoFieldFn) extractField(pb protoreflect.Message, idFieldPath string) (interface{}, error) {
+	fds, err := getProtoFieldDescriptors(ext.desc, idFieldPath)
+	if err != nil {
+		return nil, err
+	}
+	curPb := pb
+	for _, fieldDesc := range fds[:len(fds)-1] {
+		if curPb.Has(fieldDesc) {
+			curPb = curPb.Mutable(fieldDesc).Message()
+		} else {
+			curPb = curPb.NewField(fieldDesc).Message()
+		}
+	}
+	idDesc := fds[len(fds)-1]
+	value := curPb.Get(idDesc).Interface()
+	curPb.Clear(idDesc)
+	if enum, ok := value.(protoreflect.EnumNumber); ok {
+		return int32(enum), nil
+	}
+	return value, nil
 }
@@ -16,8 +16,12 @@
 package pbeam
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
+	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/google/differential-privacy/go/noise"
 	testpb "github.com/google/differential-privacy/privacy-on-beam/testdata"
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
@@ -88,8 +92,8 @@ func TestMakePrivateFromStruct(t *testing.T) {
 				{String: "42", Int: 42},
 				{String: "17", Int: 17}},
 			[]structPair{
-				{Key: "\"42\"", Value: ComplexStruct{String: "42", Int: 42}},
-				{Key: "\"17\"", Value: ComplexStruct{String: "17", Int: 17}}},
+				{Key: "42", Value: ComplexStruct{Int: 42}},
+				{Key: "17", Value: ComplexStruct{Int: 17}}},
 		},
 		{"top level string pointer id field",
 			"StringPointer",
@@ -97,8 +101,8 @@ func TestMakePrivateFromStruct(t *testing.T) {
 				{StringPointer: &fortyTwo, Int: 42},
 				{StringPointer: &seventeen, Int: 17}},
 			[]structPair{
-				{Key: "\"42\"", Value: ComplexStruct{StringPointer: &fortyTwo, Int: 42}},
-				{Key: "\"17\"", Value: ComplexStruct{StringPointer: &seventeen, Int: 17}}},
+				{Key: "42", Value: ComplexStruct{Int: 42}},
+				{Key: "17", Value: ComplexStruct{Int: 17}}},
 		},
 		{"bottom level string id field",
 			"SubStruct.String",
@@ -106,8 +110,8 @@ func TestMakePrivateFromStruct(t *testing.T) {
 				{SubStruct: &SimpleStruct{String: "42"}, Int: 42},
 				{SubStruct: &SimpleStruct{String: "17"}, Int: 17}},
 			[]structPair{
-				{Key: "\"42\"", Value: ComplexStruct{SubStruct: &SimpleStruct{String: "42"}, Int: 42}},
-				{Key: "\"17\"", Value: ComplexStruct{SubStruct: &SimpleStruct{String: "17"}, Int: 17}}},
+				{Key: "42", Value: ComplexStruct{SubStruct: &SimpleStruct{}, Int: 42}},
+				{Key: "17", Value: ComplexStruct{SubStruct: &SimpleStruct{}, Int: 17}}},
 		},
 	} {
 		p, s, col, want := ptest.CreateList2(tc.values, tc.want)
@@ -121,6 +125,95 @@ func TestMakePrivateFromStruct(t *testing.T) {
 	}
 }
 
+// countValuesPerID returns the privacy ID and the number of values associated
+// with it, formatted as a string.
+func countValuesPerID(id beam.W, values func(*beam.V) bool) string {
+	var v beam.V
+	count := 0
+	for values(&v) {
+		count++
+	}
+	return fmt.Sprintf("%+v:%d", id, count)
+}
+
+// Checks that MakePrivateFromStruct with several ID fields uses typed
+// composite privacy keys, without collisions between the fields.
+func TestMakePrivateFromStructCompositeID(t *testing.T) {
+	a, bc, ab, c := "a", "bc", "ab", "c"
+	values := []ComplexStruct{
+		{String: a, StringPointer: &bc, Int: 1},
+		{String: ab, StringPointer: &c, Int: 2},
+		{String: a, StringPointer: &bc, Int: 3},
+	}
+	want := []string{
+		"{Field0:a Field1:bc}:2",
+		"{Field0:ab Field1:c}:1",
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+
+	pcol := MakePrivateFromStruct(s, col, NewPrivacySpec(1, 1e-10), "String", "StringPointer")
+	got := beam.ParDo(s, countValuesPerID, beam.GroupByKey(s, pcol.col))
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("MakePrivateFromStruct with a composite ID: got %v, expected %v: %v", got, wantCol, err)
+	}
+}
+
+// Checks that clearIDFields clears the ID fields without modifying its
+// input.
+func TestClearIDFields(t *testing.T) {
+	eight := "8"
+	val := ComplexStruct{
+		String:        "0",
+		Int:           1,
+		StringPointer: &eight,
+		SubStruct:     &SimpleStruct{String: "2", Int: 3},
+	}
+	for _, tc := range []struct {
+		idFieldPaths []string
+		want         ComplexStruct
+	}{
+		{[]string{"String"}, ComplexStruct{Int: 1, StringPointer: &eight, SubStruct: &SimpleStruct{String: "2", Int: 3}}},
+		{[]string{"StringPointer"}, ComplexStruct{String: "0", Int: 1, SubStruct: &SimpleStruct{String: "2", Int: 3}}},
+		{[]string{"SubStruct.String", "Int"}, ComplexStruct{String: "0", StringPointer: &eight, SubStruct: &SimpleStruct{Int: 3}}},
+	} {
+		ext := extractStructFieldFn{IDFieldPaths: tc.idFieldPaths}
+		got := ext.clearIDFields(val)
+		if !cmp.Equal(got, tc.want) {
+			t.Errorf("clearIDFields with idFieldPaths=%v: got %+v, want %+v", tc.idFieldPaths, got, tc.want)
+		}
+	}
+	if want := "2"; val.SubStruct.String != want {
+		t.Errorf("clearIDFields modified its input: got SubStruct.String=%s, want %s", val.SubStruct.String, want)
+	}
+}
+
+func TestGetIDFieldType(t *testing.T) {
+	for _, tc := range []struct {
+		idFieldPath string
+		want        reflect.Type
+		wantErr     bool
+	}{
+		{"String", reflect.TypeOf(""), false},
+		{"Int", reflect.TypeOf(0), false},
+		{"SubStruct", nil, true},
+		{"SubStruct.StringPointer", reflect.TypeOf(""), false},
+		{"SubStruct.SubStruct.Int", reflect.TypeOf(0), false},
+		{"SubStruct.StringSlice", nil, true},
+		{"RecursiveStruct.RecursiveStruct.String", reflect.TypeOf(""), false},
+		{"nonexistent", nil, true},
+		{"String.nonexistent", nil, true},
+	} {
+		got, err := getIDFieldType(reflect.TypeOf(RecursiveStruct{}), tc.idFieldPath)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("getIDFieldType with idFieldPath=%s: got error %v, wantErr=%t.", tc.idFieldPath, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("getIDFieldType with idFieldPath=%s: got %v, want %v.", tc.idFieldPath, got, tc.want)
+		}
+	}
+}
+
 // Tests the GetIDField method in extractStructFieldFn.
 func TestGetIDField(t *testing.T) {
 	eight := "8"
@@ -165,8 +258,8 @@ func TestGetIDField(t *testing.T) {
 		{"RecursiveStruct.RecursiveStruct.Int", 0, false},
 		{"nonexistent", nil, true},
 	} {
-		ext := extractStructFieldFn{IDFieldPath: tc.idFieldPath}
-		got, err := ext.getIDField(val)
+		ext := extractStructFieldFn{}
+		got, err := ext.getIDField(val, tc.idFieldPath)
 		if (err != nil) != tc.wantErr {
 			t.Errorf("GetIDField with idFieldPath=%s: got error %v, wantErr=%t.", tc.idFieldPath, err, tc.wantErr)
 		}
@@ -183,9 +276,9 @@ func TestMakePrivateFromProto(t *testing.T) {
 		&testpb.TestAnon{Bar: proto.String("zero")},
 	}
 	result := []protoPair{
-		{"42", &testpb.TestAnon{Foo: proto.Int64(42), Bar: proto.String("fourty-two")}},
-		{"17", &testpb.TestAnon{Foo: proto.Int64(17), Bar: proto.String("seventeeen")}},
-		{"0", &testpb.TestAnon{Bar: proto.String("zero")}},
+		{42, &testpb.TestAnon{Bar: proto.String("fourty-two")}},
+		{17, &testpb.TestAnon{Bar: proto.String("seventeen")}},
+		{0, &testpb.TestAnon{Bar: proto.String("zero")}},
 	}
 	p, s, col, want := ptest.CreateList2(values, result)
 
@@ -197,6 +290,28 @@ func TestMakePrivateFromProto(t *testing.T) {
 	}
 }
 
+// Checks that MakePrivateFromProto with several ID fields uses typed
+// composite privacy keys.
+func TestMakePrivateFromProtoCompositeID(t *testing.T) {
+	values := []*testpb.TestAnon{
+		{Foo: proto.Int64(42), Bar: proto.String("x")},
+		{Foo: proto.Int64(42), Bar: proto.String("y")},
+		{Foo: proto.Int64(42), Bar: proto.String("x")},
+	}
+	want := []string{
+		"{Field0:42 Field1:x}:2",
+		"{Field0:42 Field1:y}:1",
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+
+	pcol := MakePrivateFromProto(s, col, NewPrivacySpec(1, 1e-10), "foo", "bar")
+	got := beam.ParDo(s, countValuesPerID, beam.GroupByKey(s, pcol.col))
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("MakePrivateFromProto with a composite ID: got %v, expected %v: %v", got, wantCol, err)
+	}
+}
+
 var (
 	repeat    = []string{"bar", "baz"}
 	subrepeat = []*testpb.TestComplex_Submessage{
@@ -244,9 +359,9 @@ func TestExtractProtoField(t *testing.T) {
 		wantMsg     *testpb.TestComplex
 		ok          bool
 	}{
-		{"simple", "foo", complexMsg, true},
+		{"simple", "foo", withoutSimple, true},
 		{"empty", "", complexMsg, true},
-		{"sub.simple", "boo", complexMsg, true},
+		{"sub.simple", "boo", withoutSubSimple, true},
 		{"repeat", "", nil, false},
 		{"sub.repeat", "", nil, false},
 		{"subrepeat.simple", "", nil, false},
@@ -254,12 +369,11 @@ func TestExtractProtoField(t *testing.T) {
 		{"nonexistent", "", nil, false},
 	} {
 		ext := &extractProtoFieldFn{
-			IDFieldPath: tc.idFieldPath,
-			desc:        (&testpb.TestComplex{}).ProtoReflect().Descriptor(),
+			desc: (&testpb.TestComplex{}).ProtoReflect().Descriptor(),
 		}
 		clone := &testpb.TestComplex{}
 		proto.Merge(clone, complexMsg)
-		gotField, err := ext.extractField(clone.ProtoReflect())
+		gotField, err := ext.extractField(clone.ProtoReflect(), tc.idFieldPath)
 		if (err == nil) != tc.ok {
 			t.Errorf("extractField with IDFieldPath=%s: got error %v, want ok=%t.", tc.idFieldPath, err, tc.ok)
 		}
@@ -275,6 +389,26 @@ func TestExtractProtoField(t *testing.T) {
 	}
 }
 
+// Checks that extractProtoFieldFn removes the ID field from a copy of its
+// input.
+func TestExtractProtoFieldFnClearsIDField(t *testing.T) {
+	ext := &extractProtoFieldFn{
+		IDFieldPaths: []string{"sub.simple"},
+		IDType:       beam.EncodedType{reflect.TypeOf("")},
+	}
+	input := proto.Clone(complexMsg)
+	id, out := ext.ProcessElement(input)
+	if id != "boo" {
+		t.Errorf("ProcessElement: got ID %v, want boo", id)
+	}
+	if !proto.Equal(out.(proto.Message), withoutSubSimple) {
+		t.Errorf("ProcessElement: got msg %v, want %v", out, withoutSubSimple)
+	}
+	if !proto.Equal(input, complexMsg) {
+		t.Errorf("ProcessElement modified its input: got %v, want %v", input, complexMsg)
+	}
+}
+
 // Tests that we can consume all the budget at once.
 func TestBudgetFullyConsumed(t *testing.T) {
 	values := []pairII{
@@ -352,3 +486,52 @@ func TestBudgetRounding(t *testing.T) {
 		t.Errorf("expected spec to be out of budget, but could consume (%f,%e) without any error", eps, del)
 	}
 }
+
+func TestGetNoiseKind(t *testing.T) {
+	for _, tc := range []struct {
+		desc                     string
+		noiseKind                NoiseKind
+		maxPartitionsContributed int64
+		delta                    float64
+		partitionsSpecified      bool
+		want                     noise.Kind
+		wantDelta                float64
+	}{
+		{"NoiseKind is not set", nil, 100, 1e-5, false, noise.LaplaceNoise, 1e-5},
+		{"LaplaceNoise", LaplaceNoise{}, 100, 1e-5, false, noise.LaplaceNoise, 1e-5},
+		{"LaplaceNoise with specified partitions", LaplaceNoise{}, 100, 1e-5, true, noise.LaplaceNoise, 1e-5},
+		{"GaussianNoise", GaussianNoise{}, 1, 1e-5, false, noise.GaussianNoise, 1e-5},
+		{"AutoNoise with no delta", AutoNoise{}, 100, 0, false, noise.LaplaceNoise, 0},
+		{"AutoNoise with small MaxPartitionsContributed", AutoNoise{}, 1, 1e-5, false, noise.LaplaceNoise, 1e-5},
+		{"AutoNoise with large MaxPartitionsContributed", AutoNoise{}, 100, 1e-5, false, noise.GaussianNoise, 1e-5},
+		{"AutoNoise with specified partitions and small MaxPartitionsContributed", AutoNoise{}, 1, 1e-5, true, noise.LaplaceNoise, 0},
+		{"AutoNoise with specified partitions and large MaxPartitionsContributed", AutoNoise{}, 100, 1e-5, true, noise.GaussianNoise, 1e-5},
+		// With MaxPartitionsContributed=7, Gaussian Noise has a smaller standard
+		// deviation than Laplace Noise with all of δ, but not with δ/2.
+		{"AutoNoise with specified partitions uses all of delta for Gaussian Noise", AutoNoise{}, 7, 1e-5, true, noise.GaussianNoise, 1e-5},
+		// The aggregation then reports the invalid MaxPartitionsContributed.
+		{"AutoNoise with invalid MaxPartitionsContributed", AutoNoise{}, 0, 1e-5, false, noise.GaussianNoise, 1e-5},
+	} {
+		got, gotDelta := getNoiseKind(tc.noiseKind, tc.maxPartitionsContributed, 1, tc.delta, tc.partitionsSpecified)
+		if got != tc.want || gotDelta != tc.wantDelta {
+			t.Errorf("getNoiseKind: when %s got (%v, %e), want (%v, %e)", tc.desc, got, gotDelta, tc.want, tc.wantDelta)
+		}
+	}
+}
+
+func TestCheckPartitionSelectionStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		strategy dpagg.PartitionSelectionStrategy
+		wantErr  bool
+	}{
+		{dpagg.PreAggPartitionSelection, false},
+		{dpagg.LaplacePartitionSelection, false},
+		{dpagg.GaussianPartitionSelection, false},
+		{dpagg.PartitionSelectionStrategy(-1), true},
+		{dpagg.PartitionSelectionStrategy(3), true},
+	} {
+		if err := checkPartitionSelectionStrategy("test", tc.strategy); (err != nil) != tc.wantErr {
+			t.Errorf("checkPartitionSelectionStrategy(%v): got error %v, wantErr %t", tc.strategy, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*keyByShardFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*policyGaussianFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*weightedGaussianThresholdFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*privacyIDPartitions)(nil)).Elem())
+	beam.RegisterFunction(splitPairFn)
+}
+
+// defaultCutoffMargin is the default CutoffMargin of PrivateSetUnion.
+const defaultCutoffMargin = 3
+
+// PrivateSetUnionParams specifies the parameters associated with a
+// PrivateSetUnion transform.
+type PrivateSetUnionParams struct {
+	// Differential privacy budget consumed by this transform. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed.
+	Epsilon, Delta float64
+	// The maximum number of distinct partitions that a given privacy
+	// identifier can influence. If a privacy identifier is associated with
+	// more partitions, random partitions will be dropped. Since the weight of
+	// each privacy identifier is spread over its partitions, the noise does
+	// not grow with MaxPartitionsContributed, and only the threshold grows
+	// slowly with it: MaxPartitionsContributed can be much larger than with
+	// SelectPartitions, e.g. in the thousands.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The weight above which a partition doesn't get more weight from privacy
+	// identifiers, in standard deviations of the noise above the threshold.
+	// A larger CutoffMargin makes partitions above the cutoff more likely to be
+	// kept, but leaves less weight for the other partitions.
+	//
+	// Defaults to 3.
+	CutoffMargin float64
+	// The number of groups of privacy identifiers whose weights are computed
+	// independently. The weights are computed sequentially within each group,
+	// so a single group can be a bottleneck on large inputs. With more groups,
+	// each group caps the weights of partitions independently, so more weight
+	// is given to the partitions above the cutoff.
+	//
+	// Defaults to 1.
+	NumShards int64
+}
+
+// PrivateSetUnion returns the union of the partitions contributed to by the
+// privacy identifiers of a PrivatePCollection, in a differentially private
+// way. It is useful to extract a large vocabulary of keys, e.g. frequent
+// n-grams, where each privacy identifier contributes to many keys.
+//
+// It uses the policy Gaussian mechanism: instead of counting each privacy
+// identifier once in each of its partitions, privacy identifiers are processed
+// one after the other, and each of them adds weights with an L_2 norm of at
+// most 1 to its partitions. These weights favor the partitions that are still
+// far below the cutoff, i.e. the threshold plus CutoffMargin standard
+// deviations of the noise: each privacy identifier moves the weights of its
+// partitions towards the cutoff, and partitions that already reached it get
+// no more weight. The budget of privacy identifiers is then spent on
+// partitions that wouldn't be kept otherwise, instead of on frequent partitions
+// that are kept anyway. Gaussian noise is then added to the total weight of
+// each partition, and partitions whose noisy weight is above a threshold are
+// kept. See "Differentially Private Set Union"
+// (https://arxiv.org/abs/2002.09745) for details.
+//
+// Like with SelectPartitions, the output can be used as PublicPartitions of
+// other aggregations.
+//
+// PrivateSetUnion transforms a PrivatePCollection<V> into a PCollection<V>,
+// and a PrivatePCollection<K,V> into a PCollection<K>.
+func PrivateSetUnion(s beam.Scope, pcol PrivatePCollection, params PrivateSetUnionParams) beam.PCollection {
+	s = s.Scope("pbeam.PrivateSetUnion")
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	err = checkPrivateSetUnionParams(params, epsilon, delta)
+	if err != nil {
+		log.Exit(err)
+	}
+	cutoffMargin := params.CutoffMargin
+	if cutoffMargin == 0 {
+		cutoffMargin = defaultCutoffMargin
+	}
+	numShards := params.NumShards
+	if numShards == 0 {
+		numShards = 1
+	}
+
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	// First, deduplicate (privacy ID, partition) pairs, and encode them.
+	decoded := distinctPartitionsPerPrivacyID(s, pcol)
+	idT, partitionT := beam.ValidateKVType(decoded)
+	fn, err := newWeightedGaussianThresholdFn(epsilon, delta, maxPartitionsContributed, partitionT.Type())
+	if err != nil {
+		log.Exit(err)
+	}
+	encoded := beam.ParDo(s, splitPairFn, beam.ParDo(s, kv.NewEncodeFn(idT, partitionT), decoded))
+	// Second, do contribution bounding, and group the partitions of each
+	// privacy ID.
+	grouped := beam.CombinePerKey(s,
+		newReservoirSampleFn(maxPartitionsContributed, reflect.TypeOf([]byte{})),
+		encoded)
+	// Third, compute the weights of the partitions with the policy Gaussian
+	// mechanism in each shard, and sum them over all shards.
+	shards := beam.ParDo(s, &keyByShardFn{NumShards: numShards}, grouped)
+	weights := beam.ParDo(s, &policyGaussianFn{Cutoff: fn.Threshold + cutoffMargin*fn.Sigma}, beam.GroupByKey(s, shards))
+	totalWeights := stats.SumPerKey(s, weights)
+	// Finally, add noise to the weights and keep the partitions whose noisy
+	// weight is above the threshold.
+	return beam.ParDo(s, fn, totalWeights, beam.TypeDefinition{Var: beam.VType, T: partitionT.Type()})
+}
+
+func checkPrivateSetUnionParams(params PrivateSetUnionParams, epsilon, delta float64) error {
+	err := checks.CheckEpsilonStrict("pbeam.PrivateSetUnion", epsilon)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckDeltaStrict("pbeam.PrivateSetUnion", delta)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckMaxPartitionsContributed("pbeam.PrivateSetUnion", params.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	if params.CutoffMargin < 0 || math.IsInf(params.CutoffMargin, 0) || math.IsNaN(params.CutoffMargin) {
+		return fmt.Errorf("pbeam.PrivateSetUnion: CutoffMargin should be non-negative and finite, got %f", params.CutoffMargin)
+	}
+	if params.NumShards < 0 {
+		return fmt.Errorf("pbeam.PrivateSetUnion: NumShards should not be negative, got %d", params.NumShards)
+	}
+	return nil
+}
+
+// splitPairFn transforms a PCollection<kv.Pair<codedK,codedV>> into a
+// PCollection<codedK,codedV>.
+func splitPairFn(p kv.Pair) ([]byte, []byte) {
+	return p.K, p.V
+}
+
+// privacyIDPartitions contains an encoded privacy ID and its encoded
+// partitions.
+type privacyIDPartitions struct {
+	ID         []byte
+	Partitions [][]byte
+}
+
+// keyByShardFn assigns each privacy ID with its partitions to one of NumShards
+// shards, based on a hash of the privacy ID.
+type keyByShardFn struct {
+	NumShards int64
+}
+
+func (fn *keyByShardFn) ProcessElement(id []byte, partitions [][]byte) (int64, privacyIDPartitions) {
+	h := fnv.New64a()
+	h.Write(id)
+	return int64(h.Sum64() % uint64(fn.NumShards)), privacyIDPartitions{ID: id, Partitions: partitions}
+}
+
+// policyGaussianFn computes the weights of the partitions of a shard with the
+// policy Gaussian mechanism, and emits each partition with its weight.
+type policyGaussianFn struct {
+	Cutoff float64
+}
+
+func (fn *policyGaussianFn) ProcessElement(_ int64, iter func(*privacyIDPartitions) bool, emit func([]byte, float64)) {
+	// The weights must not depend on the order in which privacy IDs are
+	// read, so privacy IDs are processed in the order of their encoding.
+	var ids []privacyIDPartitions
+	var id privacyIDPartitions
+	for iter(&id) {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i].ID, ids[j].ID) < 0 })
+	weights := make(map[string]float64)
+	for _, id := range ids {
+		updatePolicyGaussianWeights(weights, id.Partitions, fn.Cutoff)
+	}
+	for partition, weight := range weights {
+		emit([]byte(partition), weight)
+	}
+}
+
+// updatePolicyGaussianWeights adds the weights of a privacy ID contributing to
+// the given partitions: the weights of the partitions below cutoff are moved
+// towards cutoff, by a vector of L_2 norm at most 1.
+func updatePolicyGaussianWeights(weights map[string]float64, partitions [][]byte, cutoff float64) {
+	var squaredNorm float64
+	for _, p := range partitions {
+		if gap := cutoff - weights[string(p)]; gap > 0 {
+			squaredNorm += gap * gap
+		}
+	}
+	if squaredNorm == 0 {
+		return
+	}
+	scale := math.Min(1, 1/math.Sqrt(squaredNorm))
+	for _, p := range partitions {
+		if gap := cutoff - weights[string(p)]; gap > 0 {
+			weights[string(p)] += scale * gap
+		}
+	}
+}
+
+// weightedGaussianThresholdFn adds Gaussian noise to the total weight of each
+// encoded partition, and emits the decoded partitions whose noisy weight is
+// larger than or equal to Threshold. Do not initialize it yourself, use
+// newWeightedGaussianThresholdFn to create a weightedGaussianThresholdFn
+// instance.
+type weightedGaussianThresholdFn struct {
+	// Privacy spec parameters (set during initial construction).
+	Epsilon       float64
+	NoiseDelta    float64
+	Threshold     float64
+	Sigma         float64
+	PartitionType beam.EncodedType
+	noise         noise.Noise // Set during Setup phase.
+	partitionDec  beam.ElementDecoder
+}
+
+// newWeightedGaussianThresholdFn returns a weightedGaussianThresholdFn with the
+// given budget and parameters. δ is split equally between the noise and the
+// thresholding.
+func newWeightedGaussianThresholdFn(epsilon, delta float64, maxPartitionsContributed int64, partitionType reflect.Type) (*weightedGaussianThresholdFn, error) {
+	fn := &weightedGaussianThresholdFn{
+		Epsilon:       epsilon,
+		NoiseDelta:    delta / 2,
+		PartitionType: beam.EncodedType{partitionType},
+	}
+	threshold, err := weightedGaussianThreshold(maxPartitionsContributed, epsilon, delta/2, delta/2)
+	if err != nil {
+		return nil, err
+	}
+	fn.Threshold = threshold
+	// The L_0 and L_∞ sensitivities of 1 correspond to an L_2 sensitivity of 1.
+	fn.Sigma, err = noise.Gaussian().StdDev(1, 1, epsilon, delta/2)
+	if err != nil {
+		return nil, fmt.Errorf("pbeam.PrivateSetUnion: couldn't compute the noise standard deviation: %v", err)
+	}
+	return fn, nil
+}
+
+// weightedGaussianThreshold returns the smallest threshold ρ such that a
+// partition to which a single privacy ID contributes is kept with probability
+// at most thresholdDelta, whatever the number of partitions t ≤
+// maxPartitionsContributed of this privacy ID:
+//
+//   ρ = max_{1≤t≤maxPartitionsContributed} 1/√t + σΦ⁻¹((1-thresholdDelta)^{1/t})
+//
+// where σ is the standard deviation of the Gaussian noise for an L_2
+// sensitivity of 1, and Φ⁻¹ is the inverse CDF of the standard normal
+// distribution. To avoid rounding (1-thresholdDelta)^{1/t} to 1, the quantile
+// is computed from the upper tail 1-(1-thresholdDelta)^{1/t}.
+func weightedGaussianThreshold(maxPartitionsContributed int64, epsilon, noiseDelta, thresholdDelta float64) (float64, error) {
+	// The L_0 and L_∞ sensitivities of 1 correspond to an L_2 sensitivity of 1.
+	sigma, err := noise.Gaussian().StdDev(1, 1, epsilon, noiseDelta)
+	if err != nil {
+		return 0, fmt.Errorf("pbeam.PrivateSetUnion: couldn't compute threshold: %v", err)
+	}
+	threshold := math.Inf(-1)
+	for t := int64(1); t <= maxPartitionsContributed; t++ {
+		upperTail := -math.Expm1(math.Log1p(-thresholdDelta) / float64(t))
+		// Φ⁻¹(1-p) = √2·erfc⁻¹(2p), which is accurate for small p.
+		z := sigma * math.Sqrt2 * math.Erfcinv(2*upperTail)
+		threshold = math.Max(threshold, 1/math.Sqrt(float64(t))+z)
+	}
+	if math.IsInf(threshold, 0) || math.IsNaN(threshold) {
+		return 0, fmt.Errorf("pbeam.PrivateSetUnion: couldn't compute threshold, got %f with MaxPartitionsContributed=%d and delta=%e", threshold, maxPartitionsContributed, thresholdDelta)
+	}
+	return threshold, nil
+}
+
+func (fn *weightedGaussianThresholdFn) Setup() {
+	fn.noise = noise.Gaussian()
+	fn.partitionDec = beam.NewElementDecoder(fn.PartitionType.T)
+}
+
+func (fn *weightedGaussianThresholdFn) ProcessElement(encodedPartition []byte, weight float64, emit func(beam.V)) error {
+	if fn.noise.AddNoiseFloat64(weight, 1, 1, fn.Epsilon, fn.NoiseDelta) < fn.Threshold {
+		return nil
+	}
+	partition, err := fn.partitionDec.Decode(bytes.NewBuffer(encodedPartition))
+	if err != nil {
+		return fmt.Errorf("pbeam.weightedGaussianThresholdFn.ProcessElement: couldn't decode partition %v: %v", encodedPartition, err)
+	}
+	emit(partition)
+	return nil
+}
+
+func (fn *weightedGaussianThresholdFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
@@ -0,0 +1,240 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/differential-privacy/go/noise"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+// Checks that PrivateSetUnion keeps large partitions and drops small ones.
+func TestPrivateSetUnion(t *testing.T) {
+	epsilon, delta := 1.0, 1e-10
+	// Each privacy unit contributes to 3 partitions, all below the cutoff, so
+	// has a weight of 1/√3 in each of them. With 200 privacy units, partitions
+	// 0, 1 and 2 have a weight of ≈115. The threshold is ≈40 and the standard
+	// deviation of the noise is ≈6, so the cutoff is ≈130 with CutoffMargin=15,
+	// and these partitions are kept with probability greater than 1-10⁻²⁸.
+	// Partition 3 contains a single privacy unit and is kept with probability
+	// less than δ=10⁻¹⁰.
+	pairs := concatenatePairs(
+		makePairsWithFixedV(200, 0),
+		makePairsWithFixedV(200, 1),
+		makePairsWithFixedV(200, 2),
+		makePairsWithFixedVStartingFromKey(200, 1, 3))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	got := PrivateSetUnion(s, pcol, PrivateSetUnionParams{MaxPartitionsContributed: 3, CutoffMargin: 15})
+	passert.Equals(s, got, 0, 1, 2)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestPrivateSetUnion: PrivateSetUnion(%v) = %v, expected [0, 1, 2]: %v", col, got, err)
+	}
+}
+
+// Checks that PrivateSetUnion returns the keys of the selected partitions on a
+// PrivatePCollection<K,V>.
+func TestPrivateSetUnionKV(t *testing.T) {
+	triples := concatenateTriplesWithIntValue(
+		makeDummyTripleWithIntValue(1, 0),
+		makeTripleWithIntValueStartingFromKey(1, 200, 1, 3),
+		makeTripleWithIntValueStartingFromKey(1, 200, 1, 5))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	// The weight of partition 1 reaches the cutoff, 15 standard deviations of
+	// the noise above the threshold.
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	got := PrivateSetUnion(s, pcol, PrivateSetUnionParams{MaxPartitionsContributed: 1, CutoffMargin: 15})
+	passert.Equals(s, got, 1)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestPrivateSetUnionKV: PrivateSetUnion(%v) = %v, expected [1]: %v", col, got, err)
+	}
+}
+
+// Checks that PrivateSetUnion gives more weight to partitions that are below
+// the cutoff.
+func TestPrivateSetUnionFavorsSmallPartitions(t *testing.T) {
+	// Each of 1000 privacy units contributes to the 9 large partitions 0 to 8,
+	// and to one of the 50 small partitions 10 to 59, so that each small
+	// partition has 20 privacy units. If the weight of each privacy unit was
+	// split equally between its 10 partitions, the weight of a small partition
+	// would be ≈6.3, barely above the threshold of ≈5.5. With the policy
+	// Gaussian mechanism, the large partitions reach the cutoff after ≈40
+	// privacy units in each of the 4 shards, and the other privacy units give
+	// all their weight to their small partition, whose weight is then ≈18. The standard deviation
+	// of the noise is ≈0.7, so the cutoff is ≈12.4 with CutoffMargin=10, and
+	// all partitions are kept with probability greater than 1-10⁻²⁰.
+	var pairs []pairII
+	var want []int
+	for p := 0; p < 9; p++ {
+		pairs = append(pairs, makePairsWithFixedV(1000, p)...)
+		want = append(want, p)
+	}
+	for id := 0; id < 1000; id++ {
+		pairs = append(pairs, pairII{id, 10 + id%50})
+	}
+	for p := 10; p < 60; p++ {
+		want = append(want, p)
+	}
+	p, s, col, wantCol := ptest.CreateList2(pairs, want)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(10, 1e-10))
+	got := PrivateSetUnion(s, pcol, PrivateSetUnionParams{MaxPartitionsContributed: 10, CutoffMargin: 10, NumShards: 4})
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestPrivateSetUnionFavorsSmallPartitions: PrivateSetUnion(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that PrivateSetUnion is performing a random partition selection.
+func TestPrivateSetUnionNonDeterministic(t *testing.T) {
+	// With ε=1, δ=0.6, a single privacy unit yields a 30% chance of emitting
+	// any particular partition (since half of δ is used for thresholding).
+	// 300 distinct partitions implies that some (but not all) partitions are
+	// emitted with high probability (at least 1 - 1e-20).
+	numPartitions := 300
+	var pairs []pairII
+	for i := 0; i < numPartitions; i++ {
+		pairs = append(pairs, pairII{i, i})
+	}
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 0.6))
+	got := PrivateSetUnion(s, pcol, PrivateSetUnionParams{MaxPartitionsContributed: 1})
+
+	// Validate that partitions are selected randomly (i.e., some emitted and some dropped).
+	checkSomePartitionsAreDropped(s, got, numPartitions)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestWeightedGaussianThreshold(t *testing.T) {
+	epsilon, noiseDelta, thresholdDelta := 1.0, 1e-5, 1e-5
+	// With a single partition per privacy unit, the weighted Gaussian policy is
+	// the same as Gaussian thresholding.
+	got, err := weightedGaussianThreshold(1, epsilon, noiseDelta, thresholdDelta)
+	if err != nil {
+		t.Fatalf("weightedGaussianThreshold: got error %v", err)
+	}
+	want := noise.Gaussian().Threshold(1, 1, epsilon, noiseDelta, thresholdDelta)
+	if math.Abs(got-want) > 1e-6 {
+		t.Errorf("weightedGaussianThreshold(1): got %f, want %f", got, want)
+	}
+	// The threshold increases with maxPartitionsContributed, but much more
+	// slowly than the threshold of Gaussian thresholding with an L_0
+	// sensitivity of maxPartitionsContributed.
+	previous := got
+	for _, maxPartitionsContributed := range []int64{2, 10, 100} {
+		got, err := weightedGaussianThreshold(maxPartitionsContributed, epsilon, noiseDelta, thresholdDelta)
+		if err != nil {
+			t.Fatalf("weightedGaussianThreshold: got error %v", err)
+		}
+		if got < previous {
+			t.Errorf("weightedGaussianThreshold(%d): got %f, want at least %f", maxPartitionsContributed, got, previous)
+		}
+		if gaussianThreshold := noise.Gaussian().Threshold(maxPartitionsContributed, 1, epsilon, noiseDelta, thresholdDelta); got >= gaussianThreshold {
+			t.Errorf("weightedGaussianThreshold(%d): got %f, want less than %f", maxPartitionsContributed, got, gaussianThreshold)
+		}
+		previous = got
+	}
+	// The threshold is finite even when (1-thresholdDelta)^(1/t) rounds to 1.
+	got, err = weightedGaussianThreshold(1000000, epsilon, 1e-10, 1e-10)
+	if err != nil {
+		t.Fatalf("weightedGaussianThreshold(1000000): got error %v", err)
+	}
+	if math.IsInf(got, 0) || math.IsNaN(got) {
+		t.Errorf("weightedGaussianThreshold(1000000): got %f, want a finite threshold", got)
+	}
+}
+
+func TestUpdatePolicyGaussianWeights(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		weights    map[string]float64
+		partitions []string
+		cutoff     float64
+		want       map[string]float64
+	}{
+		{"all partitions far below the cutoff",
+			map[string]float64{},
+			[]string{"a", "b", "c", "d"}, 10,
+			map[string]float64{"a": 0.5, "b": 0.5, "c": 0.5, "d": 0.5}},
+		{"partitions above the cutoff get no weight",
+			map[string]float64{"a": 10, "b": 12, "c": 7, "d": 6},
+			[]string{"a", "b", "c", "d"}, 10,
+			// The gaps of c and d are 3 and 4, so the update has an L_2 norm of 1.
+			map[string]float64{"a": 10, "b": 12, "c": 7.6, "d": 6.8}},
+		{"partitions close to the cutoff reach it",
+			map[string]float64{"a": 9.5, "b": 9.5},
+			[]string{"a", "b"}, 10,
+			map[string]float64{"a": 10, "b": 10}},
+		{"privacy units only change their partitions",
+			map[string]float64{"a": 1, "b": 1},
+			[]string{"a"}, 10,
+			map[string]float64{"a": 2, "b": 1}},
+	} {
+		var partitions [][]byte
+		for _, p := range tc.partitions {
+			partitions = append(partitions, []byte(p))
+		}
+		updatePolicyGaussianWeights(tc.weights, partitions, tc.cutoff)
+		if len(tc.weights) != len(tc.want) {
+			t.Errorf("With %s, updatePolicyGaussianWeights: got %v, want %v", tc.desc, tc.weights, tc.want)
+			continue
+		}
+		for p, want := range tc.want {
+			if got := tc.weights[p]; math.Abs(got-want) > 1e-9 {
+				t.Errorf("With %s, updatePolicyGaussianWeights: got %v, want %v", tc.desc, tc.weights, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCheckPrivateSetUnionParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		epsilon float64
+		delta   float64
+		params  PrivateSetUnionParams
+		wantErr bool
+	}{
+		{"valid parameters", 1, 1e-5, PrivateSetUnionParams{MaxPartitionsContributed: 1}, false},
+		{"zero epsilon", 0, 1e-5, PrivateSetUnionParams{MaxPartitionsContributed: 1}, true},
+		{"zero delta", 1, 0, PrivateSetUnionParams{MaxPartitionsContributed: 1}, true},
+		{"negative MaxPartitionsContributed", 1, 1e-5, PrivateSetUnionParams{MaxPartitionsContributed: -1}, true},
+		{"valid CutoffMargin and NumShards", 1, 1e-5, PrivateSetUnionParams{MaxPartitionsContributed: 1, CutoffMargin: 5, NumShards: 10}, false},
+		{"negative CutoffMargin", 1, 1e-5, PrivateSetUnionParams{MaxPartitionsContributed: 1, CutoffMargin: -1}, true},
+		{"infinite CutoffMargin", 1, 1e-5, PrivateSetUnionParams{MaxPartitionsContributed: 1, CutoffMargin: math.Inf(1)}, true},
+		{"negative NumShards", 1, 1e-5, PrivateSetUnionParams{MaxPartitionsContributed: 1, NumShards: -1}, true},
+	} {
+		if err := checkPrivateSetUnionParams(tc.params, tc.epsilon, tc.delta); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
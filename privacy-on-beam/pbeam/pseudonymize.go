@@ -0,0 +1,104 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*pseudonymizeIDFn)(nil)))
+}
+
+// minPseudonymizationKeyLength is the minimum length of the secret key of
+// PseudonymizeIDs, in bytes.
+const minPseudonymizationKeyLength = 32
+
+// PseudonymizeIDs is a PrivacySpecOption that makes MakePrivate,
+// MakePrivateFromStruct, MakePrivateFromProto and MakePrivateFromTaggedStruct
+// replace privacy identifiers by their HMAC-SHA256 with a secret key right
+// after extracting them. Raw privacy identifiers then never appear in the
+// shuffles or in the intermediate data of the pipeline. Two privacy
+// identifiers are mapped to the same pseudonym if and only if they are equal
+// (barring hash collisions), so the privacy unit is unchanged.
+//
+// Key must be at least 32 bytes long, should be generated randomly for each
+// pipeline, and must be kept secret: anyone with the key can recompute the
+// pseudonym of a known identifier. Note that the key is part of the
+// serialized pipeline, like all the parameters of its transforms.
+type PseudonymizeIDs struct {
+	Key []byte
+}
+
+func (p PseudonymizeIDs) updatePrivacySpec(ps *PrivacySpec) {
+	ps.pseudonymize = true
+	ps.pseudonymizationKey = p.Key
+}
+
+func checkPseudonymizationKey(key []byte) error {
+	if len(key) < minPseudonymizationKeyLength {
+		return fmt.Errorf("PseudonymizeIDs: Key must be at least %d bytes long, got %d bytes", minPseudonymizationKeyLength, len(key))
+	}
+	return nil
+}
+
+// pseudonymizeIDs transforms a PCollection<ID,V> into a PCollection<[]byte,V>
+// where the privacy identifiers are replaced by their pseudonym, if the
+// PrivacySpec has the PseudonymizeIDs option. Otherwise, it returns col.
+func pseudonymizeIDs(s beam.Scope, spec *PrivacySpec, col beam.PCollection) beam.PCollection {
+	if !spec.pseudonymize {
+		return col
+	}
+	if err := checkPseudonymizationKey(spec.pseudonymizationKey); err != nil {
+		log.Exit(err)
+	}
+	idT, _ := beam.ValidateKVType(col)
+	return beam.ParDo(s.Scope("pbeam.PseudonymizeIDs"), newPseudonymizeIDFn(spec.pseudonymizationKey, beam.EncodedType{idT.Type()}), col)
+}
+
+// pseudonymizeIDFn replaces the privacy identifiers of a PCollection<ID,V> by
+// the HMAC-SHA256 of their encoding.
+type pseudonymizeIDFn struct {
+	Key    []byte
+	IDType beam.EncodedType
+	idEnc  beam.ElementEncoder
+}
+
+func newPseudonymizeIDFn(key []byte, idType beam.EncodedType) *pseudonymizeIDFn {
+	return &pseudonymizeIDFn{Key: key, IDType: idType}
+}
+
+func (fn *pseudonymizeIDFn) Setup() {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+}
+
+func (fn *pseudonymizeIDFn) ProcessElement(id beam.W, v beam.V) ([]byte, beam.V, error) {
+	var buf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &buf); err != nil {
+		return nil, nil, fmt.Errorf("pbeam.pseudonymizeIDFn.ProcessElement: couldn't encode privacy ID: %v", err)
+	}
+	mac := hmac.New(sha256.New, fn.Key)
+	mac.Write(buf.Bytes())
+	return mac.Sum(nil), v, nil
+}
@@ -0,0 +1,144 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+var testPseudonymizationKey = bytes.Repeat([]byte{42}, minPseudonymizationKeyLength)
+
+// countValuesPerPseudonym returns the length of a pseudonym and the number of
+// values associated with it.
+func countValuesPerPseudonym(id []byte, values func(*beam.V) bool) pairII {
+	var v beam.V
+	count := 0
+	for values(&v) {
+		count++
+	}
+	return pairII{len(id), count}
+}
+
+// Checks that MakePrivate replaces privacy IDs by pseudonyms, keeping records
+// with the same privacy ID together.
+func TestMakePrivatePseudonymizesIDs(t *testing.T) {
+	values := []pairII{
+		{17, 1},
+		{17, 2},
+		{42, 3},
+	}
+	// Pseudonyms are HMAC-SHA256 values, which are 32 bytes long.
+	want := []pairII{
+		{32, 2},
+		{32, 1},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10, PseudonymizeIDs{Key: testPseudonymizationKey}))
+	got := beam.ParDo(s, countValuesPerPseudonym, beam.GroupByKey(s, pcol.col))
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("MakePrivate with PseudonymizeIDs: got %v, want %v: %v", got, wantCol, err)
+	}
+}
+
+// Checks that MakePrivateFromStruct replaces privacy IDs by pseudonyms.
+func TestMakePrivateFromStructPseudonymizesIDs(t *testing.T) {
+	values := []SimpleStruct{
+		{String: "alice@example.com", Int: 1},
+		{String: "bob@example.com", Int: 2},
+		{String: "alice@example.com", Int: 3},
+	}
+	want := []pairII{
+		{32, 2},
+		{32, 1},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+
+	pcol := MakePrivateFromStruct(s, col, NewPrivacySpec(1, 1e-10, PseudonymizeIDs{Key: testPseudonymizationKey}), "String")
+	if idT, _ := beam.ValidateKVType(pcol.col); idT.Type() != reflect.TypeOf([]byte{}) {
+		t.Errorf("MakePrivateFromStruct with PseudonymizeIDs: got privacy ID type %v, want []byte", idT)
+	}
+	got := beam.ParDo(s, countValuesPerPseudonym, beam.GroupByKey(s, pcol.col))
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("MakePrivateFromStruct with PseudonymizeIDs: got %v, want %v: %v", got, wantCol, err)
+	}
+}
+
+func TestPseudonymizeIDFn(t *testing.T) {
+	otherKey := bytes.Repeat([]byte{17}, minPseudonymizationKeyLength)
+	pseudonym := func(key []byte, id string) []byte {
+		fn := newPseudonymizeIDFn(key, beam.EncodedType{reflect.TypeOf("")})
+		fn.Setup()
+		got, _, err := fn.ProcessElement(id, 0)
+		if err != nil {
+			t.Fatalf("ProcessElement(%s): got error %v", id, err)
+		}
+		return got
+	}
+	alice := pseudonym(testPseudonymizationKey, "alice")
+	if got := pseudonym(testPseudonymizationKey, "alice"); !bytes.Equal(got, alice) {
+		t.Errorf("pseudonyms of the same ID with the same key differ: %x and %x", got, alice)
+	}
+	if got := pseudonym(testPseudonymizationKey, "bob"); bytes.Equal(got, alice) {
+		t.Errorf("pseudonyms of different IDs are equal: %x", got)
+	}
+	if got := pseudonym(otherKey, "alice"); bytes.Equal(got, alice) {
+		t.Errorf("pseudonyms of the same ID with different keys are equal: %x", got)
+	}
+	if bytes.Contains(alice, []byte("alice")) {
+		t.Errorf("pseudonym %x contains the raw ID", alice)
+	}
+}
+
+// Checks that PseudonymizeIDs enables pseudonymization even without a key, so
+// that the key is checked instead of silently skipping pseudonymization.
+func TestPseudonymizeIDsWithoutKey(t *testing.T) {
+	spec := NewPrivacySpec(1, 1e-10, PseudonymizeIDs{})
+	if !spec.pseudonymize {
+		t.Errorf("NewPrivacySpec with PseudonymizeIDs{}: got pseudonymize=false, want true")
+	}
+	if spec := NewPrivacySpec(1, 1e-10); spec.pseudonymize {
+		t.Errorf("NewPrivacySpec without PseudonymizeIDs: got pseudonymize=true, want false")
+	}
+}
+
+func TestCheckPseudonymizationKey(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		key     []byte
+		wantErr bool
+	}{
+		{"32-byte key", make([]byte, 32), false},
+		{"64-byte key", make([]byte, 64), false},
+		{"16-byte key", make([]byte, 16), true},
+		{"empty key", []byte{}, true},
+		{"nil key", nil, true},
+	} {
+		if err := checkPseudonymizationKey(tc.key); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
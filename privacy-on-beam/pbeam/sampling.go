@@ -0,0 +1,207 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*poissonSampleFn)(nil)))
+}
+
+// samplingKeyLength is the length of the random secret key used by
+// PoissonSample to sample privacy identifiers, in bytes.
+const samplingKeyLength = 32
+
+// PoissonSample samples the privacy units of a PrivatePCollection: each
+// privacy identifier is kept independently with probability rate, together
+// with all its records, and dropped with all its records otherwise.
+//
+// Sampling amplifies privacy: aggregations that are together
+// (ε,δ)-differentially private on the sampled data are together
+// (ε',qδ)-differentially private on the original data, where q is the
+// sampling rate and ε'=ln(1+q(e^ε-1)). The budget of the PrivacySpec is
+// accounted for accordingly. All the aggregations on PrivatePCollections
+// derived from the same sample share the same amplification: after
+// aggregations requesting a total budget of (ε,δ), an aggregation requesting
+// (ε₁,δ₁) adds noise calibrated to (ε₁,δ₁), and consumes
+// (ln(1+q(e^(ε+ε₁)-1))-ln(1+q(e^ε-1)),qδ₁) from the PrivacySpec. Since ε' is
+// a convex function of ε, the amplification is larger for the first
+// aggregations than for the next ones. An aggregation that uses the entire
+// budget (ε',δ') of the PrivacySpec adds noise calibrated to the larger budget
+// (ln(1+(e^ε'-1)/q),δ'/q); δ'/q must then be at most 1.
+//
+// The results of aggregations are computed on the sampled data only, and are
+// not rescaled: e.g. the result of Count estimates q times the count of the
+// original data. Rescaling them (e.g. dividing counts and sums by rate) is
+// post-processing, and doesn't affect the privacy guarantees.
+//
+// Whether a privacy identifier is kept is derived from a random secret key
+// generated when constructing the pipeline, so all the records of a privacy
+// identifier are kept or dropped together without any shuffle.
+//
+// Sampling a PrivatePCollection that is already sampled doesn't amplify
+// privacy further: the budget of the aggregations on the returned
+// PrivatePCollection is accounted for with the rate of the first sample.
+// Similarly, Flatten and Join only keep the amplification if all their inputs
+// are derived from the same sample; the budget of aggregations on their output
+// is otherwise accounted for without amplification.
+//
+// rate must be in (0, 1].
+func PoissonSample(s beam.Scope, pcol PrivatePCollection, rate float64) PrivatePCollection {
+	s = s.Scope("pbeam.PoissonSample")
+	if err := checkSamplingRate(rate); err != nil {
+		log.Exit(err)
+	}
+	if rate == 1 {
+		return pcol
+	}
+	key := make([]byte, samplingKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		log.Exitf("pbeam.PoissonSample: couldn't generate the sampling key: %v", err)
+	}
+	sampling := pcol.sampling
+	if sampling == nil {
+		sampling = &poissonSampling{rate: rate}
+	}
+	idT, _ := beam.ValidateKVType(pcol.col)
+	return PrivatePCollection{
+		col:              beam.ParDo(s, newPoissonSampleFn(key, rate, beam.EncodedType{idT.Type()}), pcol.col),
+		codec:            pcol.codec,
+		privacySpec:      pcol.privacySpec,
+		maxContributions: pcol.maxContributions,
+		windowFn:         pcol.windowFn,
+		sampling:         sampling,
+	}
+}
+
+func checkSamplingRate(rate float64) error {
+	if !(rate > 0 && rate <= 1) {
+		return fmt.Errorf("pbeam.PoissonSample: rate should be in (0, 1], got %f", rate)
+	}
+	return nil
+}
+
+// poissonSampling is a sample of privacy identifiers, shared by all the
+// PrivatePCollections derived from it. It records the budget of all the
+// aggregations on these PrivatePCollections, to account for their amplified
+// budget together.
+type poissonSampling struct {
+	rate float64
+	// Total budget requested by the aggregations on the sample.
+	epsilon, delta float64
+	// Total amplified budget consumed from the PrivacySpec by these
+	// aggregations.
+	consumedEpsilon, consumedDelta float64
+	mux                            sync.Mutex
+}
+
+// consumeBudget consumes from ps the amplified budget of an aggregation on
+// the sample requesting (epsilon,delta), like PrivacySpec.consumeBudget.
+// Returns the budget with which the aggregation must be computed on the
+// sample.
+func (ps *poissonSampling) consumeBudget(spec *PrivacySpec, epsilon, delta float64) (eps, del float64, err error) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	spec.mux.Lock()
+	defer spec.mux.Unlock()
+	if epsilon == 0 && delta == 0 {
+		if spec.delta/ps.rate > 1 {
+			return 0, 0, fmt.Errorf("trying to consume entire budget of PrivacySpec for a sample with rate %f, but its delta=%e divided by the rate is larger than 1", ps.rate, spec.delta)
+		}
+		eps, del, err = spec.consumeEntireBudget()
+		if err != nil {
+			return 0, 0, err
+		}
+		epsilon, delta = nominalEpsilon(eps, ps.rate), del/ps.rate
+	} else {
+		// The amplified budget of all the aggregations on the sample, minus the
+		// budget that was already consumed for the previous aggregations.
+		eps = amplifiedEpsilon(ps.epsilon+epsilon, ps.rate) - ps.consumedEpsilon
+		del = ps.rate * delta
+		if eps-spec.epsilon > spec.epsilon/eqBudgetRelTol || del-spec.delta > spec.delta/eqBudgetRelTol {
+			return 0, 0, fmt.Errorf("not enough budget left for PrivacySpec: trying to consume epsilon=%f and delta=%e for a sample with rate %f out of %+v", eps, del, ps.rate, spec)
+		}
+		eps, del, err = spec.consumePartialBudget(eps, del)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	ps.epsilon += epsilon
+	ps.delta += delta
+	ps.consumedEpsilon += eps
+	ps.consumedDelta += del
+	return epsilon, delta, nil
+}
+
+// amplifiedEpsilon returns the privacy parameter ε' of the original data
+// given the privacy parameter epsilon of data sampled with the given rate.
+func amplifiedEpsilon(epsilon, rate float64) float64 {
+	return math.Log1p(rate * math.Expm1(epsilon))
+}
+
+// nominalEpsilon is the inverse of amplifiedEpsilon: it returns the privacy
+// parameter of data sampled with the given rate that corresponds to the
+// privacy parameter epsilon of the original data.
+func nominalEpsilon(epsilon, rate float64) float64 {
+	return math.Log1p(math.Expm1(epsilon) / rate)
+}
+
+// poissonSampleFn keeps the records of a PCollection<ID,V> whose privacy
+// identifier is sampled. A privacy identifier is sampled iff the HMAC-SHA256
+// of its encoding, read as a uniform number in [0,1), is less than Rate.
+type poissonSampleFn struct {
+	Key    []byte
+	Rate   float64
+	IDType beam.EncodedType
+	idEnc  beam.ElementEncoder
+}
+
+func newPoissonSampleFn(key []byte, rate float64, idType beam.EncodedType) *poissonSampleFn {
+	return &poissonSampleFn{Key: key, Rate: rate, IDType: idType}
+}
+
+func (fn *poissonSampleFn) Setup() {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+}
+
+func (fn *poissonSampleFn) ProcessElement(id beam.W, v beam.V, emit func(beam.W, beam.V)) error {
+	var buf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &buf); err != nil {
+		return fmt.Errorf("pbeam.poissonSampleFn.ProcessElement: couldn't encode privacy ID: %v", err)
+	}
+	mac := hmac.New(sha256.New, fn.Key)
+	mac.Write(buf.Bytes())
+	// The 53 first bits of the HMAC give a uniform float64 in [0,1).
+	u := float64(binary.BigEndian.Uint64(mac.Sum(nil))>>11) / (1 << 53)
+	if u < fn.Rate {
+		emit(id, v)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+)
+
+// countRecords returns the number of records of a privacy ID.
+func countRecords(_ int, values func(*int) bool) int {
+	var v, count int
+	for values(&v) {
+		count++
+	}
+	return count
+}
+
+func one(_ int) int {
+	return 1
+}
+
+// Checks that PoissonSample keeps about rate*n of n privacy IDs, with all
+// their records.
+func TestPoissonSample(t *testing.T) {
+	// 1000 privacy IDs each have 5 records.
+	var pairs []pairII
+	for id := 0; id < 1000; id++ {
+		pairs = append(pairs, makeDailyValues(id, 1, 5)...)
+	}
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = PoissonSample(s, pcol, 0.5)
+	if pcol.sampling == nil || pcol.sampling.rate != 0.5 {
+		t.Errorf("PoissonSample: got sampling=%+v, want a sample with rate 0.5", pcol.sampling)
+	}
+	perID := beam.ParDo(s, countRecords, beam.GroupByKey(s, pcol.col))
+	passert.True(s, perID, func(count int) bool { return count == 5 })
+	// The number of sampled privacy IDs follows a binomial distribution with
+	// n=1000 and p=0.5, whose standard deviation is ≈15.8: it is in [350,650]
+	// with a probability greater than 1-10⁻¹⁹.
+	numIDs := stats.Sum(s, beam.ParDo(s, one, perID))
+	passert.True(s, numIDs, func(n int) bool { return n >= 350 && n <= 650 })
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("PoissonSample: got %v privacy IDs with %v records each: %v", numIDs, perID, err)
+	}
+}
+
+// Checks that sampling with rate 1 doesn't change the PrivatePCollection, and
+// that sampling twice keeps the first sample for budget accounting.
+func TestPoissonSampleRates(t *testing.T) {
+	_, s, col := ptest.CreateList(makePairsWithFixedV(10, 1))
+	col = beam.ParDo(s, pairToKV, col)
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	if got := PoissonSample(s, pcol, 1); got != pcol {
+		t.Errorf("PoissonSample with rate 1: got %+v, want %+v", got, pcol)
+	}
+	sampled := PoissonSample(s, pcol, 0.5)
+	if got := PoissonSample(s, sampled, 0.2).sampling; got != sampled.sampling {
+		t.Errorf("PoissonSample twice: got sampling=%+v, want %+v", got, sampled.sampling)
+	}
+}
+
+// Checks that the sample of a PrivatePCollection is kept by transforms, and
+// only kept by Flatten and Join if all their inputs are derived from it.
+func TestSamplingPropagation(t *testing.T) {
+	_, s, col := ptest.CreateList(makePairsWithFixedV(10, 1))
+	col = beam.ParDo(s, pairToKV, col)
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	sampled1 := PoissonSample(s, pcol, 0.3)
+	sampled2 := PoissonSample(s, pcol, 0.4)
+	kv1 := ParDo(s, func(v int) (int, int) { return v, v }, sampled1)
+	kv2 := ParDo(s, func(v int) (int, int) { return v, v }, sampled2)
+	joinParams := JoinParams{MaxFanOut: 1}
+	for _, tc := range []struct {
+		desc string
+		pcol PrivatePCollection
+		want *poissonSampling
+	}{
+		{"ParDo", ParDo(s, func(v int) int { return v }, sampled1), sampled1.sampling},
+		{"Filter", Filter(s, func(v int) bool { return v > 0 }, sampled1), sampled1.sampling},
+		{"Flatten of the same sample", Flatten(s, sampled1, ParDo(s, func(v int) int { return v }, sampled1)), sampled1.sampling},
+		{"Flatten of different samples", Flatten(s, sampled1, sampled2), nil},
+		{"Flatten with a PrivatePCollection that isn't sampled", Flatten(s, sampled1, pcol), nil},
+		{"Join of the same sample", Join(s, func(v, w int) int { return v + w }, kv1, kv1, joinParams), sampled1.sampling},
+		{"Join of different samples", Join(s, func(v, w int) int { return v + w }, kv1, kv2, joinParams), nil},
+	} {
+		if tc.pcol.sampling != tc.want {
+			t.Errorf("%s: got sampling=%+v, want %+v", tc.desc, tc.pcol.sampling, tc.want)
+		}
+	}
+}
+
+// Checks that aggregations on a sampled PrivatePCollection consume the
+// amplified budget from the PrivacySpec.
+func TestConsumeBudgetWithSampling(t *testing.T) {
+	for _, tc := range []struct {
+		desc             string
+		samplingRate     float64
+		epsilon, delta   float64
+		wantEps, wantDel float64
+		wantRemainingEps float64
+		wantRemainingDel float64
+	}{
+		{"not sampled",
+			1, 1, 1e-6,
+			1, 1e-6,
+			2 - 1, 1e-5 - 1e-6},
+		{"partial budget",
+			0.5, math.Log(3), 1e-6,
+			math.Log(3), 1e-6,
+			2 - math.Log(2), 1e-5 - 5e-7},
+		{"entire budget",
+			0.5, 0, 0,
+			math.Log(1 + 2*math.Expm1(2)), 2e-5,
+			0, 0},
+	} {
+		spec := NewPrivacySpec(2, 1e-5)
+		pcol := PrivatePCollection{privacySpec: spec}
+		if tc.samplingRate < 1 {
+			pcol.sampling = &poissonSampling{rate: tc.samplingRate}
+		}
+		eps, del, err := pcol.consumeBudget(tc.epsilon, tc.delta)
+		if err != nil {
+			t.Fatalf("With %s, consumeBudget: got error %v", tc.desc, err)
+		}
+		if math.Abs(eps-tc.wantEps) > 1e-9 || math.Abs(del-tc.wantDel) > 1e-15 {
+			t.Errorf("With %s, consumeBudget: got (%f,%e), want (%f,%e)", tc.desc, eps, del, tc.wantEps, tc.wantDel)
+		}
+		if math.Abs(spec.epsilon-tc.wantRemainingEps) > 1e-9 || math.Abs(spec.delta-tc.wantRemainingDel) > 1e-15 {
+			t.Errorf("With %s, remaining budget: got (%f,%e), want (%f,%e)", tc.desc, spec.epsilon, spec.delta, tc.wantRemainingEps, tc.wantRemainingDel)
+		}
+	}
+}
+
+// Checks that several aggregations on the same sample are accounted for
+// together: their total budget is amplified, not the budget of each of them.
+func TestConsumeBudgetWithSamplingComposes(t *testing.T) {
+	spec := NewPrivacySpec(6, 1e-5)
+	sampling := &poissonSampling{rate: 0.01}
+	for _, pcol := range []PrivatePCollection{
+		{privacySpec: spec, sampling: sampling},
+		{privacySpec: spec, sampling: sampling},
+	} {
+		eps, del, err := pcol.consumeBudget(5, 1e-4)
+		if err != nil {
+			t.Fatalf("consumeBudget: got error %v", err)
+		}
+		if eps != 5 || del != 1e-4 {
+			t.Errorf("consumeBudget: got (%f,%e), want (5,1e-4)", eps, del)
+		}
+	}
+	// Both aggregations are together (10,2e-4)-DP on the sample.
+	wantEps, wantDel := 6-math.Log1p(0.01*math.Expm1(10)), 1e-5-2e-6
+	if math.Abs(spec.epsilon-wantEps) > 1e-9 || math.Abs(spec.delta-wantDel) > 1e-15 {
+		t.Errorf("Remaining budget: got (%f,%e), want (%f,%e)", spec.epsilon, spec.delta, wantEps, wantDel)
+	}
+	// The remaining budget can't cover a third aggregation with ε=5 on the
+	// sample, even though ln(1+0.01(e^5-1)) would be smaller than it.
+	if _, _, err := (PrivatePCollection{privacySpec: spec, sampling: sampling}).consumeBudget(5, 0); err == nil {
+		t.Errorf("consumeBudget: got no error for a third aggregation, want an error")
+	}
+}
+
+// Checks that using the entire budget of a PrivacySpec on a sample fails if
+// the resulting delta would be larger than 1.
+func TestConsumeEntireBudgetWithSamplingLargeDelta(t *testing.T) {
+	spec := NewPrivacySpec(1, 0.5)
+	pcol := PrivatePCollection{privacySpec: spec, sampling: &poissonSampling{rate: 0.1}}
+	if _, _, err := pcol.consumeBudget(0, 0); err == nil {
+		t.Errorf("consumeBudget: got no error with delta/rate=5, want an error")
+	}
+}
+
+func TestAmplifiedEpsilon(t *testing.T) {
+	for _, tc := range []struct {
+		epsilon, rate float64
+		want          float64
+	}{
+		{math.Log(3), 1, math.Log(3)},
+		{math.Log(3), 0.5, math.Log(2)},
+		{math.Log(5), 0.25, math.Log(2)},
+		{0, 0.1, 0},
+	} {
+		got := amplifiedEpsilon(tc.epsilon, tc.rate)
+		if math.Abs(got-tc.want) > 1e-6*tc.want {
+			t.Errorf("amplifiedEpsilon(%f, %f): got %f, want %f", tc.epsilon, tc.rate, got, tc.want)
+		}
+		if back := nominalEpsilon(got, tc.rate); math.Abs(back-tc.epsilon) > 1e-9 {
+			t.Errorf("nominalEpsilon(amplifiedEpsilon(%f, %f)): got %f, want %f", tc.epsilon, tc.rate, back, tc.epsilon)
+		}
+	}
+}
+
+func TestCheckSamplingRate(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		rate    float64
+		wantErr bool
+	}{
+		{"valid rate", 0.1, false},
+		{"rate of 1", 1, false},
+		{"zero rate", 0, true},
+		{"negative rate", -0.5, true},
+		{"rate larger than 1", 1.5, true},
+		{"NaN rate", math.NaN(), true},
+	} {
+		if err := checkSamplingRate(tc.rate); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
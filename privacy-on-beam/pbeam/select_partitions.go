@@ -0,0 +1,221 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/filter"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*partitionSelectionFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*dropValuesFn)(nil)))
+	beam.RegisterFunction(emitSelectedPartitionsFn)
+}
+
+// SelectPartitionsParams specifies the parameters associated with a
+// SelectPartitions transform.
+type SelectPartitionsParams struct {
+	// Differential privacy budget consumed by this transform. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed.
+	Epsilon, Delta float64
+	// The maximum number of distinct partitions that a given privacy
+	// identifier can influence. If a privacy identifier is associated with
+	// more partitions, random partitions will be dropped. There is an inherent
+	// trade-off when choosing this parameter: a larger MaxPartitionsContributed
+	// leads to less data loss due to contribution bounding, but fewer
+	// partitions are kept.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// Strategy used for selecting the partitions (see
+	// dpagg.PartitionSelectionStrategy).
+	//
+	// Defaults to dpagg.PreAggPartitionSelection.
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+}
+
+// SelectPartitions returns the partitions of a PrivatePCollection that are
+// selected in a differentially private way, without computing any aggregate
+// value. Partitions with a low number of distinct privacy identifiers are
+// dropped, like with other aggregations.
+//
+// The output does not contain any private information other than which
+// partitions are selected, so it can be used freely by the rest of the
+// pipeline. In particular, it can be passed as PublicPartitions to several
+// aggregations without spending budget on partition selection each time, or
+// joined with public data.
+//
+// SelectPartitions transforms a PrivatePCollection<V> into a PCollection<V>,
+// and a PrivatePCollection<K,V> into a PCollection<K>.
+func SelectPartitions(s beam.Scope, pcol PrivatePCollection, params SelectPartitionsParams) beam.PCollection {
+	s = s.Scope("pbeam.SelectPartitions")
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	err = checkSelectPartitionsParams(params, epsilon, delta)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	// First, deduplicate (privacy ID, partition) pairs.
+	decoded := distinctPartitionsPerPrivacyID(s, pcol)
+	// Second, do contribution bounding.
+	decoded = boundContributions(s, decoded, maxPartitionsContributed)
+	// Third, now that KV pairs are deduplicated and contribution bounding is
+	// done, remove the keys and decide for each partition whether to keep it.
+	partitions := beam.DropKey(s, decoded)
+	dummyCounts := beam.ParDo(s, addOneValueFn, partitions)
+	selected := beam.CombinePerKey(s,
+		newPartitionSelectionFn(epsilon, delta, maxPartitionsContributed, params.PartitionSelectionStrategy),
+		dummyCounts)
+	// Finally, drop the partitions that are not selected and return the result.
+	return beam.ParDo(s, emitSelectedPartitionsFn, selected)
+}
+
+// distinctPartitionsPerPrivacyID transforms a PrivatePCollection<V> into a
+// PCollection<ID,V>, and a PrivatePCollection<K,V> into a PCollection<ID,K>,
+// where each (privacy ID, partition) pair appears at most once.
+func distinctPartitionsPerPrivacyID(s beam.Scope, pcol PrivatePCollection) beam.PCollection {
+	// Obtain type information from the underlying PCollection<K,V>.
+	idT, partitionT := beam.ValidateKVType(pcol.col)
+	col := pcol.col
+	// For a PrivatePCollection<K,V>, the partitions are the keys.
+	if partitionT.Type() == reflect.TypeOf(kv.Pair{}) {
+		if pcol.codec == nil {
+			log.Exitf("%s: no codec found for the input PrivatePCollection.", s)
+		}
+		col = beam.ParDo(s,
+			&dropValuesFn{Codec: pcol.codec},
+			col,
+			beam.TypeDefinition{Var: beam.VType, T: pcol.codec.KType.T})
+		_, partitionT = beam.ValidateKVType(col)
+	}
+	// Deduplicate KV pairs by encoding them and calling Distinct.
+	coded := beam.ParDo(s, kv.NewEncodeFn(idT, partitionT), col)
+	distinct := filter.Distinct(s, coded)
+	return beam.ParDo(s,
+		kv.NewDecodeFn(idT, partitionT),
+		distinct,
+		beam.TypeDefinition{Var: beam.TType, T: idT.Type()},
+		beam.TypeDefinition{Var: beam.VType, T: partitionT.Type()})
+}
+
+func checkSelectPartitionsParams(params SelectPartitionsParams, epsilon, delta float64) error {
+	err := checks.CheckEpsilonStrict("pbeam.SelectPartitions", epsilon)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckDeltaStrict("pbeam.SelectPartitions", delta)
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionStrategy("pbeam.SelectPartitions", params.PartitionSelectionStrategy)
+	if err != nil {
+		return err
+	}
+	return checks.CheckMaxPartitionsContributed("pbeam.SelectPartitions", params.MaxPartitionsContributed)
+}
+
+// dropValuesFn transforms a PCollection<ID,kv.Pair<K,V>> into a
+// PCollection<ID,K>.
+type dropValuesFn struct {
+	Codec *kv.Codec
+}
+
+func (fn *dropValuesFn) Setup() error {
+	return fn.Codec.Setup()
+}
+
+func (fn *dropValuesFn) ProcessElement(id beam.U, pair kv.Pair) (beam.U, beam.V) {
+	k, _ := fn.Codec.Decode(pair)
+	return id, k
+}
+
+// partitionSelectionFn is a differentially private combineFn deciding whether
+// to keep partitions. Do not initialize it yourself, use newPartitionSelectionFn
+// to create a partitionSelectionFn instance.
+type partitionSelectionFn struct {
+	// Privacy spec parameters (set during initial construction).
+	Epsilon                    float64
+	Delta                      float64
+	MaxPartitionsContributed   int64
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+}
+
+// newPartitionSelectionFn returns a partitionSelectionFn with the given budget
+// and parameters.
+func newPartitionSelectionFn(epsilon, delta float64, maxPartitionsContributed int64, partitionSelectionStrategy dpagg.PartitionSelectionStrategy) *partitionSelectionFn {
+	return &partitionSelectionFn{
+		Epsilon:                    epsilon,
+		Delta:                      delta,
+		MaxPartitionsContributed:   maxPartitionsContributed,
+		PartitionSelectionStrategy: partitionSelectionStrategy,
+	}
+}
+
+type partitionSelectionAccum struct {
+	SP *dpagg.PreAggSelectPartition
+}
+
+func (fn *partitionSelectionFn) CreateAccumulator() partitionSelectionAccum {
+	return partitionSelectionAccum{SP: dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+		Epsilon:                  fn.Epsilon,
+		Delta:                    fn.Delta,
+		MaxPartitionsContributed: fn.MaxPartitionsContributed,
+		Strategy:                 fn.PartitionSelectionStrategy,
+	})}
+}
+
+// AddInput increments the count of privacy identifiers in the partition. It
+// ignores the actual contents of value.
+func (fn *partitionSelectionFn) AddInput(a partitionSelectionAccum, value int64) partitionSelectionAccum {
+	a.SP.Increment()
+	return a
+}
+
+func (fn *partitionSelectionFn) MergeAccumulators(a, b partitionSelectionAccum) partitionSelectionAccum {
+	a.SP.Merge(b.SP)
+	return a
+}
+
+func (fn *partitionSelectionFn) ExtractOutput(a partitionSelectionAccum) bool {
+	return a.SP.ShouldKeepPartition()
+}
+
+func (fn *partitionSelectionFn) String() string {
+	return fmt.Sprintf("%#v", fn)
+}
+
+// emitSelectedPartitionsFn emits the partitions that are selected, i.e. those
+// for which keep is true.
+func emitSelectedPartitionsFn(partition beam.V, keep bool, emit func(beam.V)) {
+	if keep {
+		emit(partition)
+	}
+}
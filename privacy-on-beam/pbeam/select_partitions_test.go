@@ -0,0 +1,158 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+
+	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+// hardThresholdForSelectPartitions returns a number of privacy units for which
+// a partition is always kept by SelectPartitions.
+func hardThresholdForSelectPartitions(epsilon, delta float64, maxPartitionsContributed int64) int {
+	return dpagg.NewPreAggSelectPartition(&dpagg.PreAggSelectPartitionOptions{
+		Epsilon:                  epsilon,
+		Delta:                    delta,
+		MaxPartitionsContributed: maxPartitionsContributed,
+	}).GetHardThreshold()
+}
+
+// Checks that SelectPartitions keeps large partitions and drops small ones
+// on a PrivatePCollection<V>.
+func TestSelectPartitionsV(t *testing.T) {
+	epsilon, delta := 1.0, 1e-10
+	numIDs := hardThresholdForSelectPartitions(epsilon, delta, 1)
+	// Partition 0 contains numIDs privacy units and is always kept. Partition 1
+	// contains a single privacy unit and is kept with probability δ=10⁻¹⁰.
+	pairs := concatenatePairs(
+		makePairsWithFixedV(numIDs, 0),
+		makePairsWithFixedVStartingFromKey(numIDs, 1, 1))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	got := SelectPartitions(s, pcol, SelectPartitionsParams{MaxPartitionsContributed: 1})
+	passert.Equals(s, got, 0)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSelectPartitionsV: SelectPartitions(%v) = %v, expected [0]: %v", col, got, err)
+	}
+}
+
+// Checks that SelectPartitions returns the keys of the selected partitions on a
+// PrivatePCollection<K,V>.
+func TestSelectPartitionsKV(t *testing.T) {
+	epsilon, delta := 1.0, 1e-10
+	numIDs := hardThresholdForSelectPartitions(epsilon, delta, 1)
+	// Partition 0 contains a single privacy unit and is kept with probability
+	// δ=10⁻¹⁰. Partition 1 contains numIDs privacy units, each contributing
+	// several values, and is always kept.
+	triples := concatenateTriplesWithIntValue(
+		makeDummyTripleWithIntValue(1, 0),
+		makeTripleWithIntValueStartingFromKey(1, numIDs, 1, 3),
+		makeTripleWithIntValueStartingFromKey(1, numIDs, 1, 5))
+	p, s, col := ptest.CreateList(triples)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	got := SelectPartitions(s, pcol, SelectPartitionsParams{MaxPartitionsContributed: 1})
+	passert.Equals(s, got, 1)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSelectPartitionsKV: SelectPartitions(%v) = %v, expected [1]: %v", col, got, err)
+	}
+}
+
+// Checks that SelectPartitions is performing a random partition selection.
+func TestSelectPartitionsNonDeterministic(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		strategy dpagg.PartitionSelectionStrategy
+	}{
+		// With ε=1, δ=0.3, a single privacy unit yields a 30% chance of emitting
+		// any particular partition (since δ_emit=0.3).
+		{"PreAgg", dpagg.PreAggPartitionSelection},
+		{"Laplace thresholding", dpagg.LaplacePartitionSelection},
+		// GaussianPartitionSelection uses half of δ for thresholding, yielding a
+		// 15% chance of emitting any particular partition.
+		{"Gaussian thresholding", dpagg.GaussianPartitionSelection},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// 300 distinct partitions implies that some (but not all) partitions are
+			// emitted with high probability (at least 1 - 1e-20).
+			numPartitions := 300
+			var pairs []pairII
+			for i := 0; i < numPartitions; i++ {
+				pairs = append(pairs, pairII{i, i})
+			}
+			p, s, col := ptest.CreateList(pairs)
+			col = beam.ParDo(s, pairToKV, col)
+
+			pcol := MakePrivate(s, col, NewPrivacySpec(1, 0.3))
+			got := SelectPartitions(s, pcol, SelectPartitionsParams{MaxPartitionsContributed: 1, PartitionSelectionStrategy: tc.strategy})
+
+			// Validate that partitions are selected randomly (i.e., some emitted and some dropped).
+			checkSomePartitionsAreDropped(s, got, numPartitions)
+			if err := ptest.Run(p); err != nil {
+				t.Errorf("%v", err)
+			}
+		})
+	}
+}
+
+// Checks that the output of SelectPartitions can be used as PublicPartitions
+// in an aggregation.
+func TestSelectPartitionsAsPublicPartitions(t *testing.T) {
+	numIDs := hardThresholdForSelectPartitions(1, 1e-10, 1)
+	pairs := concatenatePairs(
+		makePairsWithFixedV(numIDs, 0),
+		makePairsWithFixedVStartingFromKey(numIDs, 1, 1))
+	p, s, col := ptest.CreateList(pairs)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(2, 1e-10))
+	partitions := SelectPartitions(s, pcol, SelectPartitionsParams{Epsilon: 1, Delta: 1e-10, MaxPartitionsContributed: 1})
+	got := Count(s, pcol, CountParams{Epsilon: 1, MaxValue: 1, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}, PublicPartitions: partitions})
+	countedPartitions := beam.DropValue(s, got)
+	passert.Equals(s, countedPartitions, 0)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSelectPartitionsAsPublicPartitions: %v", err)
+	}
+}
+
+func TestCheckSelectPartitionsParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		epsilon float64
+		delta   float64
+		params  SelectPartitionsParams
+		wantErr bool
+	}{
+		{"valid parameters", 1, 1e-5, SelectPartitionsParams{MaxPartitionsContributed: 1}, false},
+		{"zero epsilon", 0, 1e-5, SelectPartitionsParams{MaxPartitionsContributed: 1}, true},
+		{"zero delta", 1, 0, SelectPartitionsParams{MaxPartitionsContributed: 1}, true},
+		{"negative MaxPartitionsContributed", 1, 1e-5, SelectPartitionsParams{MaxPartitionsContributed: -1}, true},
+		{"unknown strategy", 1, 1e-5, SelectPartitionsParams{MaxPartitionsContributed: 1, PartitionSelectionStrategy: -1}, true},
+	} {
+		if err := checkSelectPartitionsParams(tc.params, tc.epsilon, tc.delta); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
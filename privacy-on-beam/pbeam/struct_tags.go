@@ -0,0 +1,322 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*extractTaggedFieldFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*extractTaggedKVFn)(nil)))
+}
+
+// StructTags contains the privacy configuration read from the `dp` tags of
+// the fields of a struct type. It is returned by MakePrivateFromTaggedStruct.
+type StructTags struct {
+	// Names of the fields tagged with "id", in order. If there are several
+	// of them, the privacy key is composite, like in MakePrivateFromStruct.
+	IDFields []string
+	// Names of the fields tagged with "partition" and "value". They are empty
+	// if no field has the corresponding tag.
+	PartitionField, ValueField string
+	// Options of the "id" tags. They are 0 if not set.
+	MaxPartitionsContributed, MaxContributionsPerPartition int64
+	// Options of the "value" tag. They are 0 if not set.
+	MinValue, MaxValue float64
+}
+
+// CountParams returns CountParams with the contribution bounds of t.
+func (t StructTags) CountParams() CountParams {
+	return CountParams{
+		MaxPartitionsContributed: t.MaxPartitionsContributed,
+		MaxValue:                 t.MaxContributionsPerPartition,
+	}
+}
+
+// SumParams returns SumParams with the contribution bounds and the value
+// bounds of t.
+func (t StructTags) SumParams() SumParams {
+	return SumParams{
+		MaxPartitionsContributed: t.MaxPartitionsContributed,
+		MinValue:                 t.MinValue,
+		MaxValue:                 t.MaxValue,
+	}
+}
+
+// MeanParams returns MeanParams with the contribution bounds and the value
+// bounds of t.
+func (t StructTags) MeanParams() MeanParams {
+	return MeanParams{
+		MaxPartitionsContributed:     t.MaxPartitionsContributed,
+		MaxContributionsPerPartition: t.MaxContributionsPerPartition,
+		MinValue:                     t.MinValue,
+		MaxValue:                     t.MaxValue,
+	}
+}
+
+// MakePrivateFromTaggedStruct creates a PrivatePCollection from a PCollection
+// of structs whose fields are annotated with `dp` tags, and returns the
+// privacy configuration read from these tags. The following tags are
+// supported, on top-level fields of the struct.
+//
+// 	dp:"id[,max_partitions=<int>][,max_contributions=<int>]"
+// 		The privacy key. Required, on at least one field: several fields
+// 		tagged with "id" define a composite privacy key. The options set
+// 		the MaxPartitionsContributed and MaxContributionsPerPartition
+// 		contribution bounds, and can each be set on only one of these
+// 		fields.
+// 	dp:"partition"
+// 		The partition key. Optional.
+// 	dp:"value[,min=<float>][,max=<float>]"
+// 		The value to aggregate, which must have a numeric type. Optional.
+// 		The options set the MinValue and MaxValue bounds.
+//
+// For example:
+//
+//   type visit struct {
+//     VisitorID string  `dp:"id,max_partitions=3"`
+//     Day       int     `dp:"partition"`
+//     Spent     float64 `dp:"value,min=0,max=100"`
+//   }
+//
+// The returned PrivatePCollection contains the tagged fields: it is a
+// PrivatePCollection<partition,value> if both the partition and the value
+// fields are tagged, a PrivatePCollection<partition> or a
+// PrivatePCollection<value> if only one of them is, and a
+// PrivatePCollection<struct> if neither is; in the latter case, the privacy
+// key fields are set to their zero value. The returned StructTags can be
+// used to get default aggregation parameters, e.g.:
+//
+//   pcol, tags := MakePrivateFromTaggedStruct(s, col, spec)
+//   sums := SumPerKey(s, pcol, tags.SumParams())
+//
+// The privacy key fields are handled like in MakePrivateFromStruct.
+func MakePrivateFromTaggedStruct(s beam.Scope, col beam.PCollection, spec *PrivacySpec) (PrivatePCollection, StructTags) {
+	s = s.Scope("pbeam.MakePrivateFromTaggedStruct")
+	if typex.IsKV(col.Type()) {
+		log.Exitf("MakePrivateFromTaggedStruct: PCollection cannot be of KV type: %v", col)
+	}
+	structT := col.Type().Type()
+	tags, err := parseStructTags(structT)
+	if err != nil {
+		log.Exitf("MakePrivateFromTaggedStruct: %v", err)
+	}
+	idExtractor, err := newExtractStructFieldFn(structT, tags.IDFields)
+	if err != nil {
+		log.Exitf("MakePrivateFromTaggedStruct: %v", err)
+	}
+	idDef := beam.TypeDefinition{Var: beam.UType, T: idExtractor.IDType.T}
+	if tags.PartitionField != "" && tags.ValueField != "" {
+		partitionF, _ := structT.FieldByName(tags.PartitionField)
+		valueF, _ := structT.FieldByName(tags.ValueField)
+		extractFn := &extractTaggedKVFn{
+			IDExtractor:    idExtractor,
+			PartitionField: tags.PartitionField,
+			ValueField:     tags.ValueField,
+			Codec:          kv.NewCodec(partitionF.Type, valueF.Type),
+		}
+		return PrivatePCollection{
+			col:         pseudonymizeIDs(s, spec, beam.ParDo(s, extractFn, col, idDef)),
+			codec:       extractFn.Codec,
+			privacySpec: spec,
+		}, tags
+	}
+	extractFn := &extractTaggedFieldFn{IDExtractor: idExtractor, Field: tags.PartitionField}
+	if tags.ValueField != "" {
+		extractFn.Field = tags.ValueField
+	}
+	outputT := structT
+	if extractFn.Field != "" {
+		f, _ := structT.FieldByName(extractFn.Field)
+		outputT = f.Type
+	}
+	return PrivatePCollection{
+		col:         pseudonymizeIDs(s, spec, beam.ParDo(s, extractFn, col, idDef, beam.TypeDefinition{Var: beam.WType, T: outputT})),
+		privacySpec: spec,
+	}, tags
+}
+
+// parseStructTags reads the `dp` tags of the fields of structT.
+func parseStructTags(structT reflect.Type) (StructTags, error) {
+	var tags StructTags
+	setOptions := make(map[string]bool)
+	if structT.Kind() != reflect.Struct {
+		return tags, fmt.Errorf("PCollection must be composed of structs, got %v", structT)
+	}
+	for i := 0; i < structT.NumField(); i++ {
+		f := structT.Field(i)
+		tag, ok := f.Tag.Lookup("dp")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		options, err := parseTagOptions(parts[1:])
+		if err != nil {
+			return tags, fmt.Errorf("invalid tag on field %s: %v", f.Name, err)
+		}
+		switch role := strings.TrimSpace(parts[0]); role {
+		case "id":
+			for key := range options {
+				if setOptions[key] {
+					return tags, fmt.Errorf("option %s is set on several fields tagged with \"id\"", key)
+				}
+				setOptions[key] = true
+			}
+			tags.IDFields = append(tags.IDFields, f.Name)
+			err = setTagOptions(options, map[string]interface{}{
+				"max_partitions":    &tags.MaxPartitionsContributed,
+				"max_contributions": &tags.MaxContributionsPerPartition,
+			})
+		case "partition":
+			if tags.PartitionField != "" {
+				return tags, fmt.Errorf("fields %s and %s are both tagged with \"partition\"", tags.PartitionField, f.Name)
+			}
+			tags.PartitionField = f.Name
+			err = setTagOptions(options, nil)
+		case "value":
+			if tags.ValueField != "" {
+				return tags, fmt.Errorf("fields %s and %s are both tagged with \"value\"", tags.ValueField, f.Name)
+			}
+			if !isNumericKind(f.Type.Kind()) {
+				return tags, fmt.Errorf("value field %s must have a numeric type, got %v", f.Name, f.Type)
+			}
+			tags.ValueField = f.Name
+			err = setTagOptions(options, map[string]interface{}{
+				"min": &tags.MinValue,
+				"max": &tags.MaxValue,
+			})
+		default:
+			return tags, fmt.Errorf("unknown tag %q on field %s, must be \"id\", \"partition\" or \"value\"", role, f.Name)
+		}
+		if err != nil {
+			return tags, fmt.Errorf("invalid tag on field %s: %v", f.Name, err)
+		}
+	}
+	if len(tags.IDFields) == 0 {
+		return tags, fmt.Errorf("no field of %v is tagged with \"id\"", structT)
+	}
+	if tags.MaxPartitionsContributed < 0 || tags.MaxContributionsPerPartition < 0 {
+		return tags, fmt.Errorf("max_partitions and max_contributions must not be negative, got %d and %d",
+			tags.MaxPartitionsContributed, tags.MaxContributionsPerPartition)
+	}
+	if tags.MinValue != 0 || tags.MaxValue != 0 {
+		if err := checks.CheckBoundsFloat64("MakePrivateFromTaggedStruct", tags.MinValue, tags.MaxValue); err != nil {
+			return tags, err
+		}
+	}
+	return tags, nil
+}
+
+// parseTagOptions parses "key=value" options.
+func parseTagOptions(parts []string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, part := range parts {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("option %q must have the form key=value", part)
+		}
+		key := strings.TrimSpace(keyValue[0])
+		if _, ok := options[key]; ok {
+			return nil, fmt.Errorf("option %s is set twice", key)
+		}
+		options[key] = strings.TrimSpace(keyValue[1])
+	}
+	return options, nil
+}
+
+// setTagOptions parses the options into the *int64 or *float64 targets with
+// the same key. Options without target are errors.
+func setTagOptions(options map[string]string, targets map[string]interface{}) error {
+	for key, value := range options {
+		var err error
+		switch target := targets[key].(type) {
+		case *int64:
+			*target, err = strconv.ParseInt(value, 10, 64)
+		case *float64:
+			*target, err = strconv.ParseFloat(value, 64)
+		default:
+			return fmt.Errorf("unknown option %s", key)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't parse option %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// extractTaggedFieldFn transforms a PCollection<V> of structs into a
+// PCollection<U,W>, where the key is the privacy ID, and W is either the
+// given field or the whole struct if Field is empty.
+type extractTaggedFieldFn struct {
+	IDExtractor *extractStructFieldFn
+	Field       string
+}
+
+func (fn *extractTaggedFieldFn) ProcessElement(v beam.V) (beam.U, beam.W, error) {
+	id, err := fn.IDExtractor.getID(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fn.Field == "" {
+		return id, fn.IDExtractor.clearIDFields(v), nil
+	}
+	return id, reflect.ValueOf(v).FieldByName(fn.Field).Interface(), nil
+}
+
+// extractTaggedKVFn transforms a PCollection<V> of structs into a
+// PCollection<U,kv.Pair>, where the key is the privacy ID, and the kv.Pair
+// contains the encoded partition and value fields.
+type extractTaggedKVFn struct {
+	IDExtractor    *extractStructFieldFn
+	PartitionField string
+	ValueField     string
+	Codec          *kv.Codec
+}
+
+func (fn *extractTaggedKVFn) Setup() error {
+	return fn.Codec.Setup()
+}
+
+func (fn *extractTaggedKVFn) ProcessElement(v beam.V) (beam.U, kv.Pair, error) {
+	id, err := fn.IDExtractor.getID(v)
+	if err != nil {
+		return nil, kv.Pair{}, err
+	}
+	s := reflect.ValueOf(v)
+	return id, fn.Codec.Encode(s.FieldByName(fn.PartitionField).Interface(), s.FieldByName(fn.ValueField).Interface()), nil
+}
@@ -0,0 +1,230 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+type taggedVisit struct {
+	VisitorID string  `dp:"id,max_partitions=1,max_contributions=2"`
+	Day       int     `dp:"partition"`
+	Spent     float64 `dp:"value, min=0, max=10"`
+	Comment   string
+}
+
+type taggedVisitor struct {
+	VisitorID int `dp:"id"`
+	Day       int `dp:"partition"`
+}
+
+func makeTaggedVisits(firstID, numIDs, day int, spent float64) []taggedVisit {
+	visits := make([]taggedVisit, numIDs)
+	for i := range visits {
+		visits[i] = taggedVisit{VisitorID: fmt.Sprint(firstID + i), Day: day, Spent: spent}
+	}
+	return visits
+}
+
+// Checks that MakePrivateFromTaggedStruct creates a PrivatePCollection<K,V>
+// and aggregation parameters that can be used for aggregations.
+func TestMakePrivateFromTaggedStructKV(t *testing.T) {
+	visits := append(makeTaggedVisits(0, 10, 1, 20.0), makeTaggedVisits(10, 5, 2, 3.0)...)
+	// The spent values are clamped to [0, 10] because of the tags.
+	result := []testFloat64Metric{
+		{1, 100.0},
+		{2, 15.0},
+	}
+	p, s, col, want := ptest.CreateList2(visits, result)
+	partitionsCol := beam.CreateList(s, []int{1, 2})
+
+	// We have ε=50, δ=0 and l1Sensitivity=10.
+	// We have 2 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 10⁻²⁵ probability (k=25).
+	epsilon := 50.0
+	pcol, tags := MakePrivateFromTaggedStruct(s, col, NewPrivacySpec(epsilon, 0))
+	params := tags.SumParams()
+	params.NoiseKind = LaplaceNoise{}
+	params.PublicPartitions = partitionsCol
+	got := SumPerKey(s, pcol, params)
+
+	want = beam.ParDo(s, float64MetricToKV, want)
+	if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(25, 10.0, epsilon)); err != nil {
+		t.Fatalf("TestMakePrivateFromTaggedStructKV: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestMakePrivateFromTaggedStructKV: SumPerKey(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+// Checks that MakePrivateFromTaggedStruct keeps only the partition field when
+// no field is tagged with "value".
+func TestMakePrivateFromTaggedStructPartitionOnly(t *testing.T) {
+	values := []taggedVisitor{
+		{VisitorID: 17, Day: 1},
+		{VisitorID: 42, Day: 3},
+	}
+	want := []pairII{
+		{17, 1},
+		{42, 3},
+	}
+	p, s, col, wantCol := ptest.CreateList2(values, want)
+
+	pcol, _ := MakePrivateFromTaggedStruct(s, col, NewPrivacySpec(1, 1e-10))
+	got := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("MakePrivateFromTaggedStruct(%v) = %v, expected %v: %v", col, got, wantCol, err)
+	}
+}
+
+func TestParseStructTags(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		value   interface{}
+		want    StructTags
+		wantErr bool
+	}{
+		{"all tags",
+			taggedVisit{},
+			StructTags{
+				IDFields:                     []string{"VisitorID"},
+				PartitionField:               "Day",
+				ValueField:                   "Spent",
+				MaxPartitionsContributed:     1,
+				MaxContributionsPerPartition: 2,
+				MinValue:                     0,
+				MaxValue:                     10,
+			},
+			false},
+		{"id and partition",
+			taggedVisitor{},
+			StructTags{IDFields: []string{"VisitorID"}, PartitionField: "Day"},
+			false},
+		{"no tags",
+			SimpleStruct{},
+			StructTags{},
+			true},
+		{"not a struct",
+			0,
+			StructTags{},
+			true},
+		{"composite id",
+			struct {
+				A int    `dp:"id,max_partitions=2"`
+				B string `dp:"id,max_contributions=3"`
+			}{},
+			StructTags{IDFields: []string{"A", "B"}, MaxPartitionsContributed: 2, MaxContributionsPerPartition: 3},
+			false},
+		{"option set on two id fields",
+			struct {
+				A int    `dp:"id,max_partitions=2"`
+				B string `dp:"id,max_partitions=3"`
+			}{},
+			StructTags{},
+			true},
+		{"two partition fields",
+			struct {
+				A int `dp:"id"`
+				B int `dp:"partition"`
+				C int `dp:"partition"`
+			}{},
+			StructTags{},
+			true},
+		{"unknown tag",
+			struct {
+				A int `dp:"id"`
+				B int `dp:"key"`
+			}{},
+			StructTags{},
+			true},
+		{"unknown option",
+			struct {
+				A int `dp:"id,min=0"`
+			}{},
+			StructTags{},
+			true},
+		{"option without value",
+			struct {
+				A int `dp:"id,max_partitions"`
+			}{},
+			StructTags{},
+			true},
+		{"non-integer max_partitions",
+			struct {
+				A int `dp:"id,max_partitions=1.5"`
+			}{},
+			StructTags{},
+			true},
+		{"negative max_contributions",
+			struct {
+				A int `dp:"id,max_contributions=-1"`
+			}{},
+			StructTags{},
+			true},
+		{"non-numeric value field",
+			struct {
+				A int    `dp:"id"`
+				B string `dp:"value"`
+			}{},
+			StructTags{},
+			true},
+		{"min greater than max",
+			struct {
+				A int     `dp:"id"`
+				B float64 `dp:"value,min=5,max=1"`
+			}{},
+			StructTags{},
+			true},
+	} {
+		got, err := parseStructTags(reflect.TypeOf(tc.value))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+		if err == nil && !cmp.Equal(got, tc.want) {
+			t.Errorf("With %s, got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestStructTagsParams(t *testing.T) {
+	tags := StructTags{
+		MaxPartitionsContributed:     3,
+		MaxContributionsPerPartition: 2,
+		MinValue:                     -1,
+		MaxValue:                     5,
+	}
+	count := tags.CountParams()
+	if count.MaxPartitionsContributed != 3 || count.MaxValue != 2 {
+		t.Errorf("CountParams: got %+v, want MaxPartitionsContributed=3 and MaxValue=2", count)
+	}
+	sum := tags.SumParams()
+	if sum.MaxPartitionsContributed != 3 || sum.MinValue != -1 || sum.MaxValue != 5 {
+		t.Errorf("SumParams: got %+v, want MaxPartitionsContributed=3, MinValue=-1 and MaxValue=5", sum)
+	}
+	mean := tags.MeanParams()
+	if mean.MaxPartitionsContributed != 3 || mean.MaxContributionsPerPartition != 2 || mean.MinValue != -1 || mean.MaxValue != 5 {
+		t.Errorf("MeanParams: got %+v, want MaxPartitionsContributed=3, MaxContributionsPerPartition=2, MinValue=-1 and MaxValue=5", mean)
+	}
+}
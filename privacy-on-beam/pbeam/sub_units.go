@@ -0,0 +1,244 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/reflectx"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*keyBySubUnitFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*expandSubUnitValuesFn)(nil)))
+}
+
+// SubUnitParams specifies the contribution bounds of BoundSubUnitContributions.
+type SubUnitParams struct {
+	// The maximum number of distinct sub-units (e.g. days) that a given
+	// privacy identifier can contribute to. If a privacy identifier is
+	// associated with more sub-units, random sub-units will be dropped.
+	//
+	// Required.
+	MaxSubUnits int64
+	// The maximum number of records that a given privacy identifier can
+	// contribute to a single sub-unit. If a privacy identifier is associated
+	// with more records for a sub-unit, random records will be dropped.
+	//
+	// Required.
+	MaxContributionsPerSubUnit int64
+}
+
+// BoundSubUnitContributions bounds the contributions of each privacy
+// identifier at two levels: the privacy unit (e.g. a user) is split into
+// sub-units (e.g. user-days) by subUnitFn, each privacy identifier keeps at
+// most params.MaxContributionsPerSubUnit records per sub-unit, and at most
+// params.MaxSubUnits sub-units. This way, the records of a privacy identifier
+// that is very active during a few sub-units don't crowd out its records in
+// other sub-units. The privacy unit is unchanged: differential privacy still
+// protects all the records of each privacy identifier.
+//
+// Each privacy identifier of the returned PrivatePCollection has at most
+// MaxSubUnits*MaxContributionsPerSubUnit records. Aggregations use this bound
+// to calibrate their noise: their MaxPartitionsContributed and per-partition
+// contribution bounds (MaxContributionsPerPartition, or MaxValue for Count)
+// are lowered to this bound if they are larger. The bound is kept by Filter
+// and Distinct, but not by ParDo, which can emit several records per input.
+//
+// subUnitFn must have one of the following types, where S is the type of the
+// sub-unit:
+//
+// 	For a PrivatePCollection<V>:
+//		- func(V) S
+//
+// 	For a PrivatePCollection<K,V>:
+//		- func(K, V) S
+//
+// BoundSubUnitContributions transforms a PrivatePCollection<V> into a
+// PrivatePCollection<V>, and a PrivatePCollection<K,V> into a
+// PrivatePCollection<K,V>.
+func BoundSubUnitContributions(s beam.Scope, subUnitFn interface{}, pcol PrivatePCollection, params SubUnitParams) PrivatePCollection {
+	s = s.Scope("pbeam.BoundSubUnitContributions")
+	idT, valueT := beam.ValidateKVType(pcol.col)
+	var inputTypes []reflect.Type
+	if pcol.codec != nil {
+		inputTypes = []reflect.Type{pcol.codec.KType.T, pcol.codec.VType.T}
+	} else {
+		inputTypes = []reflect.Type{valueT.Type()}
+	}
+	if err := checkSubUnitFn(subUnitFn, inputTypes); err != nil {
+		log.Exitf("pbeam.BoundSubUnitContributions: %v", err)
+	}
+	if err := checkSubUnitParams(params); err != nil {
+		log.Exit(err)
+	}
+	// First, key the records by (privacy ID, sub-unit), and do per-sub-unit
+	// contribution bounding.
+	keyed := beam.ParDo(s, newKeyBySubUnitFn(subUnitFn, idT.Type(), pcol.codec), pcol.col)
+	keyed = boundContributions(s, keyed, params.MaxContributionsPerSubUnit)
+	// Second, group the records of each (privacy ID, sub-unit) pair, re-key by
+	// privacy ID and bound the number of sub-units per privacy ID.
+	grouped := beam.ParDo(s, newGroupPartitionValuesFn(beam.EncodedType{valueT.Type()}), beam.GroupByKey(s, keyed))
+	grouped = boundContributions(s, grouped, params.MaxSubUnits)
+	// Third, get back the original records.
+	bounded := beam.ParDo(s,
+		newExpandSubUnitValuesFn(idT.Type(), valueT.Type()),
+		grouped,
+		beam.TypeDefinition{Var: beam.WType, T: idT.Type()},
+		beam.TypeDefinition{Var: beam.VType, T: valueT.Type()})
+
+	maxContributions := params.MaxSubUnits * params.MaxContributionsPerSubUnit
+	if pcol.maxContributions > 0 && pcol.maxContributions < maxContributions {
+		maxContributions = pcol.maxContributions
+	}
+	return PrivatePCollection{
+		col:              bounded,
+		codec:            pcol.codec,
+		privacySpec:      pcol.privacySpec,
+		windowFn:         pcol.windowFn,
+		sampling:         pcol.sampling,
+		maxContributions: maxContributions,
+	}
+}
+
+func checkSubUnitParams(params SubUnitParams) error {
+	if params.MaxSubUnits <= 0 {
+		return fmt.Errorf("pbeam.BoundSubUnitContributions: MaxSubUnits should be strictly positive, got %d", params.MaxSubUnits)
+	}
+	if params.MaxContributionsPerSubUnit <= 0 {
+		return fmt.Errorf("pbeam.BoundSubUnitContributions: MaxContributionsPerSubUnit should be strictly positive, got %d", params.MaxContributionsPerSubUnit)
+	}
+	if params.MaxSubUnits > math.MaxInt64/params.MaxContributionsPerSubUnit {
+		return fmt.Errorf("pbeam.BoundSubUnitContributions: MaxSubUnits (%d) times MaxContributionsPerSubUnit (%d) overflows int64",
+			params.MaxSubUnits, params.MaxContributionsPerSubUnit)
+	}
+	return nil
+}
+
+// checkSubUnitFn checks that fn is a function taking arguments of the given
+// types and returning a single value.
+func checkSubUnitFn(fn interface{}, inputTypes []reflect.Type) error {
+	if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("subUnitFn must be a function, got %T instead", fn)
+	}
+	fnT := reflect.TypeOf(fn)
+	if fnT.NumOut() != 1 {
+		return fmt.Errorf("subUnitFn must return a single value, got %v instead", fnT)
+	}
+	if fnT.NumIn() != len(inputTypes) {
+		return fmt.Errorf("subUnitFn must take %d argument(s) for a PrivatePCollection of type %v, got %v instead", len(inputTypes), inputTypes, fnT)
+	}
+	for i, t := range inputTypes {
+		if !t.AssignableTo(fnT.In(i)) {
+			return fmt.Errorf("argument %d of subUnitFn must have type %v, got %v instead", i, t, fnT.In(i))
+		}
+	}
+	return nil
+}
+
+// keyBySubUnitFn transforms a PCollection<ID,V> into a
+// PCollection<kv.Pair{ID,S},V>, where S is the sub-unit of the record returned
+// by SubUnitFn. If Codec is set, V is a kv.Pair decoded before calling
+// SubUnitFn.
+type keyBySubUnitFn struct {
+	SubUnitFn   beam.EncodedFunc
+	IDType      beam.EncodedType
+	SubUnitType beam.EncodedType
+	Codec       *kv.Codec
+	fn          reflectx.Func
+	idEnc       beam.ElementEncoder
+	subUnitEnc  beam.ElementEncoder
+}
+
+func newKeyBySubUnitFn(subUnitFn interface{}, idType reflect.Type, codec *kv.Codec) *keyBySubUnitFn {
+	return &keyBySubUnitFn{
+		SubUnitFn:   beam.EncodedFunc{Fn: reflectx.MakeFunc(subUnitFn)},
+		IDType:      beam.EncodedType{idType},
+		SubUnitType: beam.EncodedType{reflect.TypeOf(subUnitFn).Out(0)},
+		Codec:       codec,
+	}
+}
+
+func (fn *keyBySubUnitFn) Setup() error {
+	fn.fn = fn.SubUnitFn.Fn
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+	fn.subUnitEnc = beam.NewElementEncoder(fn.SubUnitType.T)
+	if fn.Codec != nil {
+		return fn.Codec.Setup()
+	}
+	return nil
+}
+
+func (fn *keyBySubUnitFn) ProcessElement(id beam.W, v beam.V) (kv.Pair, beam.V, error) {
+	var args []interface{}
+	if fn.Codec != nil {
+		k, v := fn.Codec.Decode(v.(kv.Pair))
+		args = []interface{}{k, v}
+	} else {
+		args = []interface{}{v}
+	}
+	subUnit := fn.fn.Call(args)[0]
+	var idBuf, subUnitBuf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
+		return kv.Pair{}, nil, fmt.Errorf("pbeam.keyBySubUnitFn.ProcessElement: couldn't encode privacy ID %v: %v", id, err)
+	}
+	if err := fn.subUnitEnc.Encode(subUnit, &subUnitBuf); err != nil {
+		return kv.Pair{}, nil, fmt.Errorf("pbeam.keyBySubUnitFn.ProcessElement: couldn't encode sub-unit %v: %v", subUnit, err)
+	}
+	return kv.Pair{idBuf.Bytes(), subUnitBuf.Bytes()}, v, nil
+}
+
+// expandSubUnitValuesFn takes a PCollection<[]byte,partitionValues> as input,
+// where the key is an encoded privacy ID and the partition is a sub-unit, and
+// returns a PCollection<ID,V> containing each of the values with its privacy
+// ID.
+type expandSubUnitValuesFn struct {
+	IDType    beam.EncodedType
+	ValueType beam.EncodedType
+	idDec     beam.ElementDecoder
+	valueDec  beam.ElementDecoder
+}
+
+func newExpandSubUnitValuesFn(idType, valueType reflect.Type) *expandSubUnitValuesFn {
+	return &expandSubUnitValuesFn{IDType: beam.EncodedType{idType}, ValueType: beam.EncodedType{valueType}}
+}
+
+func (fn *expandSubUnitValuesFn) Setup() {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+	fn.valueDec = beam.NewElementDecoder(fn.ValueType.T)
+}
+
+func (fn *expandSubUnitValuesFn) ProcessElement(encodedID []byte, pv partitionValues, emit func(beam.W, beam.V)) error {
+	id, err := fn.idDec.Decode(bytes.NewBuffer(encodedID))
+	if err != nil {
+		return fmt.Errorf("pbeam.expandSubUnitValuesFn.ProcessElement: couldn't decode privacy ID %v: %v", encodedID, err)
+	}
+	for _, encoded := range pv.Values {
+		v, err := fn.valueDec.Decode(bytes.NewBuffer(encoded))
+		if err != nil {
+			return fmt.Errorf("pbeam.expandSubUnitValuesFn.ProcessElement: couldn't decode value %v: %v", encoded, err)
+		}
+		emit(id, v)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+// dayOf returns the day of a value: values in [100*d, 100*d+99] are in day d.
+func dayOf(v int) int {
+	return v / 100
+}
+
+// dayOfKV returns the day of the value of a <K,V> pair.
+func dayOfKV(_, v int) int {
+	return dayOf(v)
+}
+
+// summarizeDays returns the privacy ID, its number of values, its number of
+// distinct days and the maximum number of values in a day, as a string.
+func summarizeDays(id int, values func(*int) bool) string {
+	perDay := make(map[int]int)
+	var v, count, maxPerDay int
+	for values(&v) {
+		count++
+		perDay[dayOf(v)]++
+		if perDay[dayOf(v)] > maxPerDay {
+			maxPerDay = perDay[dayOf(v)]
+		}
+	}
+	return fmt.Sprintf("%d:%d:%d:%d", id, count, len(perDay), maxPerDay)
+}
+
+// makeDailyValues returns pairs associating privacy ID id with valuesPerDay
+// values in each day between 0 and numDays-1.
+func makeDailyValues(id, numDays, valuesPerDay int) []pairII {
+	var pairs []pairII
+	for d := 0; d < numDays; d++ {
+		for i := 0; i < valuesPerDay; i++ {
+			pairs = append(pairs, pairII{id, 100*d + i})
+		}
+	}
+	return pairs
+}
+
+// Checks that BoundSubUnitContributions bounds both the number of sub-units
+// per privacy ID and the number of records per sub-unit.
+func TestBoundSubUnitContributions(t *testing.T) {
+	pairs := concatenatePairs(makeDailyValues(1, 5, 10), makeDailyValues(2, 1, 2))
+	want := []string{
+		"1:6:2:3",
+		"2:2:1:2",
+	}
+	p, s, col, wantCol := ptest.CreateList2(pairs, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = BoundSubUnitContributions(s, dayOf, pcol, SubUnitParams{MaxSubUnits: 2, MaxContributionsPerSubUnit: 3})
+	if pcol.maxContributions != 6 {
+		t.Errorf("BoundSubUnitContributions: got maxContributions=%d, want 6", pcol.maxContributions)
+	}
+	got := beam.ParDo(s, summarizeDays, beam.GroupByKey(s, pcol.col))
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("BoundSubUnitContributions: got %v, want %v: %v", got, wantCol, err)
+	}
+}
+
+// Checks that Count uses the bound on the contributions set by
+// BoundSubUnitContributions.
+func TestBoundSubUnitContributionsCount(t *testing.T) {
+	// 100 privacy IDs each have 10 values in each of 5 days.
+	var pairs []pairII
+	for id := 0; id < 100; id++ {
+		pairs = append(pairs, makeDailyValues(id, 5, 10)...)
+	}
+	// With at most 1 value per privacy ID and day, the count of each day is
+	// 100, even though Count is called with a larger MaxValue.
+	var result []testInt64Metric
+	for d := 0; d < 5; d++ {
+		result = append(result, testInt64Metric{d, 100})
+	}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	colKV := beam.ParDo(s, pairToKV, col)
+
+	// We have ε=50, δ=0 and l1Sensitivity=25, since the bounds of Count are
+	// lowered to 5 by BoundSubUnitContributions.
+	// We have 5 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 10⁻²⁴ probability (k=24).
+	epsilon := 50.0
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(epsilon, 0))
+	pcol = ParDo(s, dayOf, pcol)
+	pcol = BoundSubUnitContributions(s, func(d int) int { return d }, pcol, SubUnitParams{MaxSubUnits: 5, MaxContributionsPerSubUnit: 1})
+	got := Count(s, pcol, CountParams{
+		MaxPartitionsContributed: 10,
+		MaxValue:                 10,
+		NoiseKind:                LaplaceNoise{},
+		PublicPartitions:         beam.CreateList(s, []int{0, 1, 2, 3, 4}),
+	})
+
+	want = beam.ParDo(s, int64MetricToKV, want)
+	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(24, 25.0, epsilon)); err != nil {
+		t.Fatalf("TestBoundSubUnitContributionsCount: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestBoundSubUnitContributionsCount: Count(%v) = %v, want %v, error %v", col, got, want, err)
+	}
+}
+
+// Checks that BoundSubUnitContributions works on PrivatePCollection<K,V>.
+func TestBoundSubUnitContributionsKV(t *testing.T) {
+	pairs := concatenatePairs(makeDailyValues(1, 5, 10), makeDailyValues(2, 1, 2))
+	want := []string{
+		"1:6:2:3",
+		"2:2:1:2",
+	}
+	p, s, col, wantCol := ptest.CreateList2(pairs, want)
+	colKV := beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, func(v int) (int, int) { return 0, v }, pcol)
+	pcol = BoundSubUnitContributions(s, dayOfKV, pcol, SubUnitParams{MaxSubUnits: 2, MaxContributionsPerSubUnit: 3})
+	values := ParDo(s, func(_, v int) int { return v }, pcol)
+	got := beam.ParDo(s, summarizeDays, beam.GroupByKey(s, values.col))
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("BoundSubUnitContributions: got %v, want %v: %v", got, wantCol, err)
+	}
+}
+
+func TestBoundByMaxContributions(t *testing.T) {
+	for _, tc := range []struct {
+		desc             string
+		maxContributions int64
+		bound            int64
+		want             int64
+	}{
+		{"unknown maximum number of contributions", 0, 5, 5},
+		{"larger maximum number of contributions", 10, 5, 5},
+		{"smaller maximum number of contributions", 3, 5, 3},
+	} {
+		pcol := PrivatePCollection{maxContributions: tc.maxContributions}
+		if got := boundByMaxContributions(pcol, tc.bound); got != tc.want {
+			t.Errorf("With %s, got %d, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+// Checks that Filter keeps the bound on the contributions, and ParDo doesn't.
+func TestMaxContributionsPropagation(t *testing.T) {
+	_, s, col := ptest.CreateList(makeDailyValues(1, 2, 2))
+	colKV := beam.ParDo(s, pairToKV, col)
+	pcol := MakePrivate(s, colKV, NewPrivacySpec(1, 1e-10))
+	pcol = BoundSubUnitContributions(s, dayOf, pcol, SubUnitParams{MaxSubUnits: 2, MaxContributionsPerSubUnit: 1})
+	if got := Filter(s, func(v int) bool { return v > 0 }, pcol).maxContributions; got != 2 {
+		t.Errorf("Filter: got maxContributions=%d, want 2", got)
+	}
+	if got := Distinct(s, pcol).maxContributions; got != 2 {
+		t.Errorf("Distinct: got maxContributions=%d, want 2", got)
+	}
+	if got := ParDo(s, func(v int) int { return v }, pcol).maxContributions; got != 0 {
+		t.Errorf("ParDo: got maxContributions=%d, want 0", got)
+	}
+}
+
+func TestCheckSubUnitParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  SubUnitParams
+		wantErr bool
+	}{
+		{"valid parameters", SubUnitParams{MaxSubUnits: 7, MaxContributionsPerSubUnit: 3}, false},
+		{"zero MaxSubUnits", SubUnitParams{MaxContributionsPerSubUnit: 3}, true},
+		{"negative MaxContributionsPerSubUnit", SubUnitParams{MaxSubUnits: 7, MaxContributionsPerSubUnit: -1}, true},
+		{"overflowing product", SubUnitParams{MaxSubUnits: math.MaxInt64 / 2, MaxContributionsPerSubUnit: 3}, true},
+	} {
+		if err := checkSubUnitParams(tc.params); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckSubUnitFn(t *testing.T) {
+	intT := reflect.TypeOf(0)
+	for _, tc := range []struct {
+		desc       string
+		fn         interface{}
+		inputTypes []reflect.Type
+		wantErr    bool
+	}{
+		{"valid function for <V>", dayOf, []reflect.Type{intT}, false},
+		{"valid function for <K,V>", dayOfKV, []reflect.Type{intT, intT}, false},
+		{"not a function", 42, []reflect.Type{intT}, true},
+		{"wrong number of arguments", dayOfKV, []reflect.Type{intT}, true},
+		{"wrong argument type", func(string) int { return 0 }, []reflect.Type{intT}, true},
+		{"no output", func(int) {}, []reflect.Type{intT}, true},
+	} {
+		if err := checkSubUnitFn(tc.fn, tc.inputTypes); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -19,10 +19,12 @@ package pbeam
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"reflect"
 
 	log "github.com/golang/glog"
 	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/dpagg"
 	"github.com/google/differential-privacy/go/noise"
 	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
 	"github.com/apache/beam/sdks/go/pkg/beam"
@@ -37,7 +39,7 @@ func init() {
 
 // SumParams specifies the parameters associated with a Sum aggregation.
 type SumParams struct {
-	// Noise type (which is either LaplaceNoise{} or GaussianNoise{}).
+	// Noise type (which is either LaplaceNoise{}, GaussianNoise{} or AutoNoise{}).
 	//
 	// Defaults to LaplaceNoise{}.
 	NoiseKind NoiseKind
@@ -65,12 +67,33 @@ type SumParams struct {
 	// large MaxValue means that less records will be clamped, but that more
 	// noise will be added.
 	//
-	// Required.
+	// Required, unless MinValueInt64 or MaxValueInt64 is set.
 	MinValue, MaxValue float64
-	// Client-specified partitions.
+	// Bounds on the total contribution of a given privacy identifier to a
+	// partition for integer values. They have the same meaning as MinValue
+	// and MaxValue, but are not converted from float64, so that any int64
+	// bound can be represented exactly. If either of them is set, they are
+	// used instead of MinValue and MaxValue, which must then be left to 0.
+	//
+	// Optional; can only be used with integer values.
+	MinValueInt64, MaxValueInt64 int64
+	// Strategy used for selecting the partitions that are kept in the output,
+	// when partitions are not specified. Instead of the default pre-aggregation
+	// partition selection, partitions can be selected by adding Laplace or
+	// Gaussian noise to the number of privacy identifiers and thresholding it
+	// (see dpagg.PartitionSelectionStrategy).
+	//
+	// Defaults to dpagg.PreAggPartitionSelection.
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+	// Partitions to keep in the output, if they are known in advance. When
+	// PublicPartitions is set, no budget is spent on partition selection:
+	// partitions that are not in PublicPartitions are dropped, and partitions
+	// in PublicPartitions without any data are added to the output.
+	// PublicPartitions must not depend on private data, except through a
+	// differentially private transform such as SelectPartitions.
 	//
 	// Optional.
-	partitionsCol beam.PCollection
+	PublicPartitions beam.PCollection
 }
 
 // SumPerKey sums the values associated with each key in a
@@ -83,7 +106,11 @@ type SumParams struct {
 //
 // SumPerKey transforms a PrivatePCollection<K,V> either into a
 // PCollection<K,int64> or a PCollection<K,float64>, depending on whether its
-// input is an integer type or a float type.
+// input is an integer type (int, int8, int16, int32, int64, uint, uint8,
+// uint16, uint32 or uint64) or a float type (float32 or float64). Values are
+// converted to int64 or float64 before being summed, so partial sums cannot
+// overflow the input type. uint and uint64 values larger than math.MaxInt64
+// are converted to math.MaxInt64.
 func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCollection {
 	s = s.Scope("pbeam.SumPerKey")
 	// Obtain & validate type information from the underlying PCollection<K,V>.
@@ -96,32 +123,26 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 	}
 
 	// Get privacy parameters.
-	spec := pcol.privacySpec
-	epsilon, delta, err := spec.consumeBudget(params.Epsilon, params.Delta)
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
 	if err != nil {
 		log.Exitf("couldn't consume budget: %v", err)
 	}
 
-	var noiseKind noise.Kind
-	if params.NoiseKind == nil {
-		noiseKind = noise.LaplaceNoise
-		log.Infof("No NoiseKind specified, using Laplace Noise by default.")
-	} else {
-		noiseKind = params.NoiseKind.toNoiseKind()
-	}
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	noiseKind, delta := getNoiseKind(params.NoiseKind, maxPartitionsContributed, epsilon, delta, (params.PublicPartitions).IsValid())
 	err = checkSumPerKeyParams(params, epsilon, delta, noiseKind)
 	if err != nil {
 		log.Exit(err)
 	}
 
-	maxPartitionsContributed := getMaxPartitionsContributed(spec, params.MaxPartitionsContributed)
 	// Drop unspecified partitions, if partitions are specified.
-	if (params.partitionsCol).IsValid() {
-		if pcol.codec.KType.T != (params.partitionsCol).Type().Type() {
+	if (params.PublicPartitions).IsValid() {
+		if pcol.codec.KType.T != (params.PublicPartitions).Type().Type() {
 			log.Exitf("Specified partitions must be of type %v. Got type %v instead.",
-				pcol.codec.KType.T, params.partitionsCol.Type().Type())
+				pcol.codec.KType.T, params.PublicPartitions.Type().Type())
 		}
-		pcol.col = dropUnspecifiedPartitionsKVFn(s, params.partitionsCol, pcol, pcol.codec.KType)
+		params.PublicPartitions = windowPublicPartitions(s, pcol, params.PublicPartitions)
+		pcol.col = dropUnspecifiedPartitionsKVFn(s, params.PublicPartitions, pcol, pcol.codec.KType)
 	}
 	// First, group together the privacy ID and the partition ID, and sum the
 	// values per-privacy unit and per-partition.
@@ -129,10 +150,10 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 		newPrepareSumFn(idT, pcol.codec),
 		pcol.col,
 		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
-	summed := stats.SumPerKey(s, decoded)
-	// Second, convert the sum to int64 or float64, and re-key.
-	_, sumT := beam.ValidateKVType(summed)
-	convertFn, err := findConvertFn(sumT)
+	// Convert the values to int64 or float64 before summing them, so that the
+	// partial sums cannot overflow the input type.
+	_, valueT := beam.ValidateKVType(decoded)
+	convertFn, err := findConvertFn(valueT)
 	if err != nil {
 		log.Exit(err)
 	}
@@ -140,8 +161,13 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 	if err != nil {
 		log.Exit(err)
 	}
-	converted := beam.ParDo(s, convertFn, summed)
-	rekeyed := beam.ParDo(s, findRekeyFn(vKind), converted)
+	if hasInt64Bounds(params) && vKind != reflect.Int64 {
+		log.Exitf("pbeam.SumPerKey: MinValueInt64 and MaxValueInt64 can only be used with integer values, got values of type %v", valueT)
+	}
+	converted := beam.ParDo(s, convertFn, decoded)
+	summed := stats.SumPerKey(s, converted)
+	// Second, re-key by privacy ID.
+	rekeyed := beam.ParDo(s, findRekeyFn(vKind), summed)
 	// Third, do per-privacy unit contribution bounding.
 	rekeyed = boundContributions(s, rekeyed, maxPartitionsContributed)
 	// Fourth, now that contribution bounding is done, remove the privacy keys,
@@ -153,17 +179,17 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 		partialSumPairs,
 		beam.TypeDefinition{Var: beam.XType, T: partitionT})
 	// Add specified partitions and return the aggregation output, if partitions are specified.
-	if (params.partitionsCol).IsValid() {
+	if (params.PublicPartitions).IsValid() {
 		return addSpecifiedPartitionsForSum(s, epsilon, delta, maxPartitionsContributed,
 			params, noiseKind, vKind, partialSumKV)
 	}
 	sums := beam.CombinePerKey(s,
-		newBoundedSumFn(epsilon, delta, maxPartitionsContributed, params.MinValue, params.MaxValue, noiseKind, vKind, false),
+		newSumPerKeyFn(epsilon, delta, maxPartitionsContributed, params, noiseKind, vKind, false),
 		partialSumKV)
 	// Drop thresholded partitions.
 	sums = beam.ParDo(s, findDropThresholdedPartitionsFn(vKind), sums)
-	// Clamp negative counts to zero when MinValue is non-negative.
-	if params.MinValue >= 0 {
+	// Clamp negative counts to zero when the lower bound is non-negative.
+	if hasNonNegativeLowerBound(params) {
 		sums = beam.ParDo(s, findClampNegativePartitionsFn(vKind), sums)
 	}
 	return sums
@@ -172,28 +198,28 @@ func SumPerKey(s beam.Scope, pcol PrivatePCollection, params SumParams) beam.PCo
 func addSpecifiedPartitionsForSum(s beam.Scope, epsilon, delta float64, maxPartitionsContributed int64, params SumParams, noiseKind noise.Kind, vKind reflect.Kind, partialSumKV beam.PCollection) beam.PCollection {
 	// Calculate sums with unspecified partitions dropped. Result is PCollection<partition, int64> or PCollection<partition, float64>.
 	sums := beam.CombinePerKey(s,
-		newBoundedSumFn(epsilon, delta, maxPartitionsContributed, params.MinValue, params.MaxValue, noiseKind, vKind, true),
+		newSumPerKeyFn(epsilon, delta, maxPartitionsContributed, params, noiseKind, vKind, true),
 		partialSumKV)
 	partitionT, _ := beam.ValidateKVType(sums)
 	dummySums := sums
 	sumsPartitions := beam.DropValue(s, dummySums)
 	// Create map with partitions in the data as keys.
 	partitionMap := beam.Combine(s, newPartitionsMapFn(beam.EncodedType{partitionT.Type()}), sumsPartitions)
-	partitionsCol := params.partitionsCol
+	partitionsCol := params.PublicPartitions
 	// Add value of 0 to each partition key in partitionsCol.
 	specifiedPartitionsWithValues := beam.ParDo(s, newAddDummyValuesToSpecifiedPartitionsFn(vKind), partitionsCol)
 	// emptySpecifiedPartitions are the partitions that are specified but not found in the data.
 	emptySpecifiedPartitions := beam.ParDo(s, newEmitPartitionsNotInTheDataFn(partitionT), specifiedPartitionsWithValues, beam.SideInput{Input: partitionMap})
 	// Add noise to the empty specified partitions.
 	unspecifiedSums := beam.CombinePerKey(s,
-		newBoundedSumFn(epsilon, delta, maxPartitionsContributed, params.MinValue, params.MaxValue, noiseKind, vKind, true),
+		newSumPerKeyFn(epsilon, delta, maxPartitionsContributed, params, noiseKind, vKind, true),
 		emptySpecifiedPartitions)
 	sums = beam.ParDo(s, findDereferenceValueFn(vKind), sums)
 	unspecifiedSums = beam.ParDo(s, findDereferenceValueFn(vKind), unspecifiedSums)
 	// Merge sums from data with sums from the empty specified partitions.
 	allSums := beam.Flatten(s, sums, unspecifiedSums)
-	// Clamp negative counts to zero when MinValue is non-negative.
-	if params.MinValue >= 0 {
+	// Clamp negative counts to zero when the lower bound is non-negative.
+	if hasNonNegativeLowerBound(params) {
 		allSums = beam.ParDo(s, findClampNegativePartitionsFn(vKind), allSums)
 	}
 	return allSums
@@ -204,7 +230,7 @@ func checkSumPerKeyParams(params SumParams, epsilon, delta float64, noiseKind no
 	if err != nil {
 		return err
 	}
-	if (params.partitionsCol).IsValid() && noiseKind == noise.LaplaceNoise {
+	if (params.PublicPartitions).IsValid() && noiseKind == noise.LaplaceNoise {
 		err = checks.CheckNoDelta("pbeam.SumPerKey", delta)
 	} else {
 		err = checks.CheckDeltaStrict("pbeam.SumPerKey", delta)
@@ -212,13 +238,48 @@ func checkSumPerKeyParams(params SumParams, epsilon, delta float64, noiseKind no
 	if err != nil {
 		return err
 	}
-	err = checks.CheckBoundsFloat64("pbeam.SumPerKey", params.MinValue, params.MaxValue)
+	if hasInt64Bounds(params) {
+		if params.MinValue != 0 || params.MaxValue != 0 {
+			return fmt.Errorf("pbeam.SumPerKey: MinValue (%f) and MaxValue (%f) must be 0 when MinValueInt64 or MaxValueInt64 is set", params.MinValue, params.MaxValue)
+		}
+		err = checks.CheckBoundsInt64("pbeam.SumPerKey", params.MinValueInt64, params.MaxValueInt64)
+	} else {
+		err = checks.CheckBoundsFloat64("pbeam.SumPerKey", params.MinValue, params.MaxValue)
+	}
+	if err != nil {
+		return err
+	}
+	err = checkPartitionSelectionStrategy("pbeam.SumPerKey", params.PartitionSelectionStrategy)
 	if err != nil {
 		return err
 	}
 	return checks.CheckMaxPartitionsContributed("pbeam.SumPerKey", params.MaxPartitionsContributed)
 }
 
+// hasInt64Bounds returns whether the integer bounds MinValueInt64 and
+// MaxValueInt64 of params are used instead of MinValue and MaxValue.
+func hasInt64Bounds(params SumParams) bool {
+	return params.MinValueInt64 != 0 || params.MaxValueInt64 != 0
+}
+
+// hasNonNegativeLowerBound returns whether the lower bound of params is
+// non-negative, in which case negative sums can be clamped to zero.
+func hasNonNegativeLowerBound(params SumParams) bool {
+	if hasInt64Bounds(params) {
+		return params.MinValueInt64 >= 0
+	}
+	return params.MinValue >= 0
+}
+
+// newSumPerKeyFn returns the differentially private combineFn summing values
+// of kind vKind with the bounds of params.
+func newSumPerKeyFn(epsilon, delta float64, maxPartitionsContributed int64, params SumParams, noiseKind noise.Kind, vKind reflect.Kind, partitionsSpecified bool) interface{} {
+	if hasInt64Bounds(params) {
+		return newBoundedSumInt64Fn(epsilon, delta, maxPartitionsContributed, params.MinValueInt64, params.MaxValueInt64, noiseKind, partitionsSpecified, params.PartitionSelectionStrategy)
+	}
+	return newBoundedSumFn(epsilon, delta, maxPartitionsContributed, params.MinValue, params.MaxValue, noiseKind, vKind, partitionsSpecified, params.PartitionSelectionStrategy)
+}
+
 // prepareSumFn takes a PCollection<ID,kv.Pair{K,V}> as input, and returns a
 // PCollection<kv.Pair{ID,K},V>; where ID has been coded, and V has been
 // decoded.
@@ -298,6 +359,9 @@ func convertInt64ToInt64Fn(z beam.Z, i int64) (beam.Z, int64) {
 	return z, i
 }
 func convertUintToInt64Fn(z beam.Z, i uint) (beam.Z, int64) {
+	if uint64(i) > math.MaxInt64 {
+		return z, math.MaxInt64
+	}
 	return z, int64(i)
 }
 func convertUint8ToInt64Fn(z beam.Z, i uint8) (beam.Z, int64) {
@@ -310,6 +374,9 @@ func convertUint32ToInt64Fn(z beam.Z, i uint32) (beam.Z, int64) {
 	return z, int64(i)
 }
 func convertUint64ToInt64Fn(z beam.Z, i uint64) (beam.Z, int64) {
+	if i > math.MaxInt64 {
+		return z, math.MaxInt64
+	}
 	return z, int64(i)
 }
 
@@ -18,10 +18,12 @@ package pbeam
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 
 	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/google/differential-privacy/go/noise"
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/core/typex"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
@@ -124,7 +126,7 @@ func TestSumPerKeyWithPartitionsNoNoiseInt(t *testing.T) {
 		epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0*tc.lInfSensitivity
 		pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 		pcol = ParDo(s, tripleWithIntValueToKV, pcol)
-		got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: tc.lower, MaxValue: tc.upper, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+		got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: tc.lower, MaxValue: tc.upper, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 		want = beam.ParDo(s, int64MetricToKV, want)
 		if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
 			t.Fatalf("TestSumPerKeyWithPartitionsNoNoiseInt: %v", err)
@@ -185,7 +187,7 @@ func TestSumPerKeyWithPartitionsNegativeBoundsInt(t *testing.T) {
 	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
-	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: -3, MaxValue: -2, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: -3, MaxValue: -2, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 	want = beam.ParDo(s, int64MetricToKV, want)
 	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
 		t.Fatalf("TestSumPerKeyWithPartitionsNegativeBoundsInt: %v", err)
@@ -277,7 +279,7 @@ func TestSumPerKeyWithPartitionsNoNoiseFloat(t *testing.T) {
 		epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0*tc.lInfSensitivity
 		pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 		pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
-		got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: tc.lower, MaxValue: tc.upper, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+		got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: tc.lower, MaxValue: tc.upper, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 		want = beam.ParDo(s, float64MetricToKV, want)
 		if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
 			t.Fatalf("TestSumPerKeyWithPartitionsNoNoiseFloat: %v", err)
@@ -336,7 +338,7 @@ func TestSumPerKeyWithPartitionsNegativeBoundsFloat(t *testing.T) {
 	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 	pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
-	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: -3.0, MaxValue: -2.0, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: -3.0, MaxValue: -2.0, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 	want = beam.ParDo(s, float64MetricToKV, want)
 	if err := approxEqualsKVFloat64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
 		t.Fatalf("TestSumPerKeyWithPartitionsNegativeBoundsFloat: %v", err)
@@ -452,7 +454,7 @@ func TestSumPerKeyWithPartitionsAddsNoiseInt(t *testing.T) {
 
 		pcol := MakePrivate(s, col, NewPrivacySpec(tc.epsilon, tc.delta))
 		pcol = ParDo(s, tripleWithIntValueToKV, pcol)
-		got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 1, MinValue: 0, MaxValue: 1, NoiseKind: tc.noiseKind, partitionsCol: partitionsCol})
+		got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 1, MinValue: 0, MaxValue: 1, NoiseKind: tc.noiseKind, PublicPartitions: partitionsCol})
 		got = beam.ParDo(s, kvToInt64Metric, got)
 
 		checkInt64MetricsAreNoisy(s, got, 10, tolerance)
@@ -580,7 +582,7 @@ func TestSumPerKeyWithPartitionsCrossPartitionContributionBoundingInt(t *testing
 	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
-	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: 0, MaxValue: 1, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: 0, MaxValue: 1, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 	// With a max contribution of 3, all of the data going to three partitions
 	// should be kept. The sum of all elements must then be 150.
 	counts := beam.DropKey(s, got)
@@ -652,7 +654,7 @@ func TestSumPerKeyWithPartitionsCrossPartitionContributionBoundingFloat(t *testi
 	epsilon, delta, k, l1Sensitivity := 50.0, 0.0, 25.0, 3.0
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 	pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
-	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: 0.0, MaxValue: 1.0, NoiseKind: LaplaceNoise{}, partitionsCol: partitionsCol})
+	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 3, MinValue: 0.0, MaxValue: 1.0, NoiseKind: LaplaceNoise{}, PublicPartitions: partitionsCol})
 	// With a max contribution of 3, all of the data for three partitions should be kept.
 	// The sum of all elements must then be 150.
 	counts := beam.DropKey(s, got)
@@ -961,7 +963,7 @@ func TestSumPerKeyWithPartitionsReturnsNonNegativeFloat64(t *testing.T) {
 	epsilon, delta, maxValue := 0.001, 0.999, 1e8
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 	pcol = ParDo(s, tripleWithFloatValueToKV, pcol)
-	sums := SumPerKey(s, pcol, SumParams{MinValue: 0, MaxValue: maxValue, MaxPartitionsContributed: 1, NoiseKind: GaussianNoise{}, partitionsCol: partitionsCol})
+	sums := SumPerKey(s, pcol, SumParams{MinValue: 0, MaxValue: maxValue, MaxPartitionsContributed: 1, NoiseKind: GaussianNoise{}, PublicPartitions: partitionsCol})
 	values := beam.DropKey(s, sums)
 	beam.ParDo0(s, checkNoNegativeValuesFloat64Fn, values)
 	if err := ptest.Run(p); err != nil {
@@ -1009,7 +1011,7 @@ func TestSumPerKeyWithPartitionsReturnsNonNegativeInt64(t *testing.T) {
 	epsilon, delta, maxValue := 0.001, 0.999, 1e8
 	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
 	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
-	sums := SumPerKey(s, pcol, SumParams{MinValue: 0, MaxValue: maxValue, MaxPartitionsContributed: 1, NoiseKind: GaussianNoise{}, partitionsCol: partitionsCol})
+	sums := SumPerKey(s, pcol, SumParams{MinValue: 0, MaxValue: maxValue, MaxPartitionsContributed: 1, NoiseKind: GaussianNoise{}, PublicPartitions: partitionsCol})
 	values := beam.DropKey(s, sums)
 	beam.ParDo0(s, checkNoNegativeValuesInt64Fn, values)
 	if err := ptest.Run(p); err != nil {
@@ -1069,3 +1071,102 @@ func TestSumPerKeyNoClampingForNegativeMinValueInt64(t *testing.T) {
 		t.Errorf("TestSumPerKeyNoClampingForNegativeMinValueInt64 returned errors: %v", err)
 	}
 }
+
+// tripleWithIntValueToKVInt8 extracts the partition ID and the value from a
+// tripleWithIntValue, converting the value to int8.
+func tripleWithIntValueToKVInt8(t tripleWithIntValue) (int, int8) {
+	return t.Partition, int8(t.Value)
+}
+
+// Checks that SumPerKey doesn't overflow when summing the values of a privacy
+// unit in a partition for small integer types.
+func TestSumPerKeySmallIntTypeDoesNotOverflow(t *testing.T) {
+	var triples []tripleWithIntValue
+	for id := 1; id <= 100; id++ {
+		// The partial sum of each privacy unit is 200, which overflows int8.
+		triples = append(triples, tripleWithIntValue{id, 0, 100})
+		triples = append(triples, tripleWithIntValue{id, 0, 100})
+	}
+	result := []testInt64Metric{
+		{0, 20000},
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	// ε=50, δ=10⁻²⁰⁰ and l1Sensitivity=200 gives a threshold of ≈58.
+	// We have 1 partition. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²³ probability (k=23).
+	epsilon, delta, k, l1Sensitivity := 50.0, 1e-200, 23.0, 200.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = ParDo(s, tripleWithIntValueToKVInt8, pcol)
+	got := SumPerKey(s, pcol, SumParams{MaxPartitionsContributed: 1, MinValue: 0, MaxValue: 200, NoiseKind: LaplaceNoise{}})
+	want = beam.ParDo(s, int64MetricToKV, want)
+	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestSumPerKeySmallIntTypeDoesNotOverflow: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSumPerKeySmallIntTypeDoesNotOverflow: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that SumPerKey uses MinValueInt64 and MaxValueInt64 to bound integer
+// contributions.
+func TestSumPerKeyWithInt64BoundsNoNoise(t *testing.T) {
+	var triples []tripleWithIntValue
+	for id := 1; id <= 50; id++ {
+		triples = append(triples, tripleWithIntValue{id, 0, -17}) // should clamp to lower bound
+		triples = append(triples, tripleWithIntValue{id, 1, 42})  // should clamp to upper bound
+	}
+	result := []testInt64Metric{
+		{0, 100}, // each aggregated record in partition 0 must be clamped to 2
+		{1, 150}, // each aggregated record in partition 1 must be clamped to 3
+	}
+	p, s, col, want := ptest.CreateList2(triples, result)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	// ε=60, δ=0.01 and l1Sensitivity=6 gives a threshold of ≈2.
+	// We have 2 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁵ probability (k=25).
+	epsilon, delta, k, l1Sensitivity := 60.0, 0.01, 25.0, 6.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	got := SumPerKey(s, pcol, SumParams{MinValueInt64: 2, MaxValueInt64: 3, MaxPartitionsContributed: 2, NoiseKind: LaplaceNoise{}})
+	want = beam.ParDo(s, int64MetricToKV, want)
+	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestSumPerKeyWithInt64BoundsNoNoise: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestSumPerKeyWithInt64BoundsNoNoise: SumPerKey(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+func TestCheckSumPerKeyParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		params  SumParams
+		wantErr bool
+	}{
+		{"valid float64 bounds", SumParams{MinValue: -1, MaxValue: 1, MaxPartitionsContributed: 1}, false},
+		{"valid int64 bounds", SumParams{MinValueInt64: -1, MaxValueInt64: math.MaxInt64, MaxPartitionsContributed: 1}, false},
+		{"only MaxValueInt64 set", SumParams{MaxValueInt64: 1, MaxPartitionsContributed: 1}, false},
+		{"lower float64 bound larger than upper bound", SumParams{MinValue: 1, MaxValue: -1, MaxPartitionsContributed: 1}, true},
+		{"lower int64 bound larger than upper bound", SumParams{MinValueInt64: 1, MaxValueInt64: -1, MaxPartitionsContributed: 1}, true},
+		{"both float64 and int64 bounds set", SumParams{MinValue: -1, MaxValue: 1, MinValueInt64: -1, MaxValueInt64: 1, MaxPartitionsContributed: 1}, true},
+	} {
+		if err := checkSumPerKeyParams(tc.params, 1, 1e-5, noise.LaplaceNoise); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestConvertUnsignedToInt64FnSaturates(t *testing.T) {
+	if _, got := convertUint64ToInt64Fn(0, math.MaxUint64); got != math.MaxInt64 {
+		t.Errorf("convertUint64ToInt64Fn(MaxUint64): got %d, want %d", got, int64(math.MaxInt64))
+	}
+	if _, got := convertUint64ToInt64Fn(0, 42); got != 42 {
+		t.Errorf("convertUint64ToInt64Fn(42): got %d, want 42", got)
+	}
+	if _, got := convertUintToInt64Fn(0, math.MaxUint64); got != math.MaxInt64 {
+		t.Errorf("convertUintToInt64Fn(MaxUint64): got %d, want %d", got, int64(math.MaxInt64))
+	}
+}
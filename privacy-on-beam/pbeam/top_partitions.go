@@ -0,0 +1,482 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/go/checks"
+	"github.com/google/differential-privacy/go/dpagg"
+	"github.com/google/differential-privacy/go/rand"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/top"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*clampInt64Fn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*clampFloat64Fn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*addGumbelNoiseFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*emitTopPartitionsFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*scoredPartition)(nil)).Elem())
+	beam.RegisterFunction(sumCandidateCountsFn)
+	beam.RegisterFunction(sumCandidateSumsFn)
+	beam.RegisterFunction(lessScoredPartitionFn)
+}
+
+// TopPartitionsParams specifies the parameters associated with a
+// TopPartitions transform.
+type TopPartitionsParams struct {
+	// Differential privacy budget consumed by this transform. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed.
+	Epsilon, Delta float64
+	// The number of partitions to return.
+	//
+	// Required.
+	K int64
+	// The maximum number of distinct values that a given privacy identifier
+	// can influence. If a privacy identifier is associated with more values,
+	// random values will be dropped. When PublicPartitions is not set, a larger
+	// MaxPartitionsContributed leads to less data loss due to contribution
+	// bounding, but fewer partitions are candidates for the top K. It doesn't
+	// affect the noise added to the counts of the candidates.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The maximum number of times that a privacy identifier can contribute to
+	// a single count, like in CountParams. The noise added to the counts is
+	// scaled according to MaxValue.
+	//
+	// Required.
+	MaxValue int64
+	// Strategy used for selecting the candidate partitions, when partitions
+	// are not specified (see dpagg.PartitionSelectionStrategy).
+	//
+	// Defaults to dpagg.PreAggPartitionSelection.
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+	// Candidate partitions, if they are known in advance. When
+	// PublicPartitions is set, no budget is spent on selecting candidates:
+	// partitions that are not in PublicPartitions are never returned, and
+	// partitions in PublicPartitions without any data can be returned.
+	// PublicPartitions must not depend on private data, except through a
+	// differentially private transform such as SelectPartitions.
+	//
+	// Optional.
+	PublicPartitions beam.PCollection
+}
+
+// TopPartitions returns the K partitions of a PrivatePCollection with the
+// largest counts, i.e. the K values that appear the most often, selected in a
+// differentially private way. Unlike calling Count and keeping the K largest
+// noisy counts, it only spends budget on the selection of the top K, and no
+// other partition is released.
+//
+// The top K is selected among candidate partitions with the exponential
+// mechanism, implemented by adding Gumbel noise to the count of each
+// candidate and returning the K largest noisy counts (see "Practical
+// Differentially Private Top-k Selection with Pay-what-you-get Composition"
+// by Durfee and Rogers). When PublicPartitions is not set, the candidates are
+// the partitions selected by thresholding the number of privacy identifiers,
+// like in SelectPartitions, and half of the ε budget is spent on this
+// selection. In that case, fewer than K partitions are returned if fewer than
+// K partitions are selected. When PublicPartitions is set, Delta must be 0.
+//
+// The counts themselves are not returned: to release them, call Count with
+// the returned partitions as PublicPartitions, using another part of the
+// budget. To select the partitions with the largest sums of values instead,
+// use TopPartitionsBySum.
+//
+// TopPartitions transforms a PrivatePCollection<V> into a PCollection<V>.
+func TopPartitions(s beam.Scope, pcol PrivatePCollection, params TopPartitionsParams) beam.PCollection {
+	s = s.Scope("pbeam.TopPartitions")
+	// Obtain type information from the underlying PCollection<K,V>.
+	idT, partitionT := beam.ValidateKVType(pcol.col)
+
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	err = checkTopPartitionsParams(params, epsilon, delta)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	params.MaxValue = boundByMaxContributions(pcol, params.MaxValue)
+	// Drop unspecified partitions, if partitions are specified.
+	if (params.PublicPartitions).IsValid() {
+		if partitionT.Type() != params.PublicPartitions.Type().Type() {
+			log.Exitf("Specified partitions must be of type %v. Got type %v instead.",
+				partitionT.Type(), params.PublicPartitions.Type().Type())
+		}
+		params.PublicPartitions = windowPublicPartitions(s, pcol, params.PublicPartitions)
+		partitionEncodedType := beam.EncodedType{partitionT.Type()}
+		pcol.col = dropUnspecifiedPartitionsVFn(s, params.PublicPartitions, pcol, partitionEncodedType)
+	}
+	// First, encode KV pairs, count how many times each one appears,
+	// and re-key by the original privacy key.
+	coded := beam.ParDo(s, kv.NewEncodeFn(idT, partitionT), pcol.col)
+	kvCounts := stats.Count(s, coded)
+	counts64 := beam.ParDo(s, vToInt64Fn, kvCounts)
+	rekeyed := beam.ParDo(s, rekeyInt64Fn, counts64)
+	// Second, do cross-partition contribution bounding.
+	rekeyed = boundContributions(s, rekeyed, maxPartitionsContributed)
+	// Third, remove the privacy keys, decode the value, and bound the
+	// contribution of each privacy ID to each count.
+	countsKV := beam.ParDo(s,
+		newDecodePairInt64Fn(partitionT.Type()),
+		beam.DropKey(s, rekeyed),
+		beam.TypeDefinition{Var: beam.XType, T: partitionT.Type()})
+	countsKV = beam.ParDo(s, &clampInt64Fn{MaxValue: params.MaxValue}, countsKV)
+	// Fourth, get the candidate partitions, and compute the count of each
+	// candidate, including those without data.
+	candidates, topEpsilon := topPartitionCandidates(s, countsKV, params.PublicPartitions, epsilon, delta, maxPartitionsContributed, params.PartitionSelectionStrategy)
+	dummyCandidates := beam.ParDo(s, addDummyValuesToSpecifiedPartitionsInt64Fn, candidates)
+	scores := beam.ParDo(s, sumCandidateCountsFn, beam.CoGroupByKey(s, dummyCandidates, countsKV))
+	// Finally, add Gumbel noise to the counts and return the partitions with
+	// the K largest noisy counts.
+	return largestNoisyScores(s, scores, gumbelScale(topEpsilon, params.K, float64(params.MaxValue)), params.K, partitionT.Type())
+}
+
+// topPartitionCandidates returns the candidate partitions of the top K, along
+// with the budget left for selecting the top K among them. perIDKV has one
+// element per (privacy ID, partition) pair, so when publicPartitions is not
+// set, partitions can be selected using the number of elements of each
+// partition; half of epsilon is then spent on this selection.
+func topPartitionCandidates(s beam.Scope, perIDKV, publicPartitions beam.PCollection, epsilon, delta float64, maxPartitionsContributed int64, strategy dpagg.PartitionSelectionStrategy) (beam.PCollection, float64) {
+	if publicPartitions.IsValid() {
+		return publicPartitions, epsilon
+	}
+	topEpsilon := epsilon / 2
+	dummyCounts := beam.ParDo(s, addOneValueFn, beam.DropValue(s, perIDKV))
+	selected := beam.CombinePerKey(s,
+		newPartitionSelectionFn(epsilon-topEpsilon, delta, maxPartitionsContributed, strategy),
+		dummyCounts)
+	return beam.ParDo(s, emitSelectedPartitionsFn, selected), topEpsilon
+}
+
+// largestNoisyScores adds Gumbel noise of the given scale to the scores of a
+// PCollection<K,float64>, and returns the partitions with the k largest noisy
+// scores.
+func largestNoisyScores(s beam.Scope, scores beam.PCollection, scale float64, k int64, partitionT reflect.Type) beam.PCollection {
+	noisyScores := beam.ParDo(s, newAddGumbelNoiseFn(scale, partitionT), scores)
+	topK := top.Largest(s, noisyScores, int(k), lessScoredPartitionFn)
+	return beam.ParDo(s,
+		newEmitTopPartitionsFn(partitionT),
+		topK,
+		beam.TypeDefinition{Var: beam.VType, T: partitionT})
+}
+
+func checkTopPartitionsParams(params TopPartitionsParams, epsilon, delta float64) error {
+	err := checks.CheckEpsilonStrict("pbeam.TopPartitions", epsilon)
+	if err != nil {
+		return err
+	}
+	if (params.PublicPartitions).IsValid() {
+		err = checks.CheckNoDelta("pbeam.TopPartitions", delta)
+	} else {
+		err = checks.CheckDeltaStrict("pbeam.TopPartitions", delta)
+	}
+	if err != nil {
+		return err
+	}
+	if params.K <= 0 {
+		return fmt.Errorf("pbeam.TopPartitions: K should be strictly positive, got %d", params.K)
+	}
+	err = checks.CheckMaxPartitionsContributed("pbeam.TopPartitions", params.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	if params.MaxValue <= 0 {
+		return fmt.Errorf("pbeam.TopPartitions: MaxValue should be strictly positive, got %d", params.MaxValue)
+	}
+	return checkPartitionSelectionStrategy("pbeam.TopPartitions", params.PartitionSelectionStrategy)
+}
+
+// TopPartitionsBySumParams specifies the parameters associated with a
+// TopPartitionsBySum transform.
+type TopPartitionsBySumParams struct {
+	// Differential privacy budget consumed by this transform. If there is
+	// only one aggregation, both Epsilon and Delta can be left 0; in that
+	// case, the entire budget of the PrivacySpec is consumed.
+	Epsilon, Delta float64
+	// The number of partitions to return.
+	//
+	// Required.
+	K int64
+	// The maximum number of distinct keys that a given privacy identifier can
+	// influence, like in TopPartitionsParams.
+	//
+	// Required.
+	MaxPartitionsContributed int64
+	// The total contribution of a given privacy identifier to a partition is
+	// clamped to [MinValue, MaxValue], like in SumParams. The noise added to the
+	// sums is scaled according to max(|MinValue|, |MaxValue|).
+	//
+	// Required.
+	MinValue, MaxValue float64
+	// Strategy used for selecting the candidate partitions, when partitions
+	// are not specified (see dpagg.PartitionSelectionStrategy).
+	//
+	// Defaults to dpagg.PreAggPartitionSelection.
+	PartitionSelectionStrategy dpagg.PartitionSelectionStrategy
+	// Candidate partitions, if they are known in advance, like in
+	// TopPartitionsParams.
+	//
+	// Optional.
+	PublicPartitions beam.PCollection
+}
+
+// TopPartitionsBySum returns the K keys of a PrivatePCollection<K,V> with the
+// largest sums of values, selected in a differentially private way. It works
+// like TopPartitions, except that the Gumbel noise is added to the sum of the
+// values of each candidate: the contribution of each privacy identifier to a
+// sum is bounded like in SumPerKey, and the noise is scaled according to
+// max(|MinValue|, |MaxValue|). Candidates are selected in the same way as in
+// TopPartitions, and so are the rules for Delta.
+//
+// The sums themselves are not returned: to release them, call SumPerKey with
+// the returned partitions as PublicPartitions, using another part of the
+// budget.
+//
+// TopPartitionsBySum transforms a PrivatePCollection<K,V> into a
+// PCollection<K>. V must be an integer type (int, int8, int16, int32, int64,
+// uint, uint8, uint16, uint32 or uint64) or a float type (float32 or float64).
+func TopPartitionsBySum(s beam.Scope, pcol PrivatePCollection, params TopPartitionsBySumParams) beam.PCollection {
+	s = s.Scope("pbeam.TopPartitionsBySum")
+	// Obtain & validate type information from the underlying PCollection<K,V>.
+	idT, kvT := beam.ValidateKVType(pcol.col)
+	if kvT.Type() != reflect.TypeOf(kv.Pair{}) || pcol.codec == nil {
+		log.Exitf("pbeam.TopPartitionsBySum must be used on a PrivatePCollection of type <K,V>, got type %v instead", kvT)
+	}
+
+	// Get privacy parameters.
+	epsilon, delta, err := pcol.consumeBudget(params.Epsilon, params.Delta)
+	if err != nil {
+		log.Exitf("couldn't consume budget: %v", err)
+	}
+	err = checkTopPartitionsBySumParams(params, epsilon, delta)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	maxPartitionsContributed := getMaxPartitionsContributed(pcol, params.MaxPartitionsContributed)
+	partitionT := pcol.codec.KType.T
+	// Drop unspecified partitions, if partitions are specified.
+	if (params.PublicPartitions).IsValid() {
+		if partitionT != params.PublicPartitions.Type().Type() {
+			log.Exitf("Specified partitions must be of type %v. Got type %v instead.",
+				partitionT, params.PublicPartitions.Type().Type())
+		}
+		params.PublicPartitions = windowPublicPartitions(s, pcol, params.PublicPartitions)
+		pcol.col = dropUnspecifiedPartitionsKVFn(s, params.PublicPartitions, pcol, pcol.codec.KType)
+	}
+	// First, group together the privacy ID and the partition ID, convert the
+	// values to float64, and sum them per privacy ID and partition.
+	decoded := beam.ParDo(s,
+		newPrepareSumFn(idT, pcol.codec),
+		pcol.col,
+		beam.TypeDefinition{Var: beam.VType, T: pcol.codec.VType.T})
+	_, valueT := beam.ValidateKVType(decoded)
+	convertFn, err := findConvertToFloat64Fn(valueT)
+	if err != nil {
+		log.Exit(err)
+	}
+	summed := stats.SumPerKey(s, beam.ParDo(s, convertFn, decoded))
+	// Second, do cross-partition contribution bounding.
+	rekeyed := beam.ParDo(s, rekeyFloat64Fn, summed)
+	rekeyed = boundContributions(s, rekeyed, maxPartitionsContributed)
+	// Third, remove the privacy keys, decode the value, and clamp the
+	// contribution of each privacy ID to each sum.
+	sumsKV := beam.ParDo(s,
+		newDecodePairFloat64Fn(partitionT),
+		beam.DropKey(s, rekeyed),
+		beam.TypeDefinition{Var: beam.XType, T: partitionT})
+	sumsKV = beam.ParDo(s, &clampFloat64Fn{MinValue: params.MinValue, MaxValue: params.MaxValue}, sumsKV)
+	// Fourth, get the candidate partitions, and compute the sum of each
+	// candidate, including those without data.
+	candidates, topEpsilon := topPartitionCandidates(s, sumsKV, params.PublicPartitions, epsilon, delta, maxPartitionsContributed, params.PartitionSelectionStrategy)
+	dummyCandidates := beam.ParDo(s, addDummyValuesToSpecifiedPartitionsInt64Fn, candidates)
+	scores := beam.ParDo(s, sumCandidateSumsFn, beam.CoGroupByKey(s, dummyCandidates, sumsKV))
+	// Finally, add Gumbel noise to the sums and return the partitions with the
+	// K largest noisy sums.
+	lInfSensitivity := math.Max(math.Abs(params.MinValue), math.Abs(params.MaxValue))
+	return largestNoisyScores(s, scores, gumbelScale(topEpsilon, params.K, lInfSensitivity), params.K, partitionT)
+}
+
+func checkTopPartitionsBySumParams(params TopPartitionsBySumParams, epsilon, delta float64) error {
+	err := checks.CheckEpsilonStrict("pbeam.TopPartitionsBySum", epsilon)
+	if err != nil {
+		return err
+	}
+	if (params.PublicPartitions).IsValid() {
+		err = checks.CheckNoDelta("pbeam.TopPartitionsBySum", delta)
+	} else {
+		err = checks.CheckDeltaStrict("pbeam.TopPartitionsBySum", delta)
+	}
+	if err != nil {
+		return err
+	}
+	if params.K <= 0 {
+		return fmt.Errorf("pbeam.TopPartitionsBySum: K should be strictly positive, got %d", params.K)
+	}
+	err = checks.CheckMaxPartitionsContributed("pbeam.TopPartitionsBySum", params.MaxPartitionsContributed)
+	if err != nil {
+		return err
+	}
+	err = checks.CheckBoundsFloat64("pbeam.TopPartitionsBySum", params.MinValue, params.MaxValue)
+	if err != nil {
+		return err
+	}
+	return checkPartitionSelectionStrategy("pbeam.TopPartitionsBySum", params.PartitionSelectionStrategy)
+}
+
+// gumbelScale returns the scale of the Gumbel noise to add to the scores of
+// the candidates to select the top k with budget epsilon. Adding or removing a
+// privacy identifier changes each score by at most lInfSensitivity, so this is
+// equivalent to k successive exponential mechanisms with budget epsilon/k and
+// a utility of sensitivity lInfSensitivity.
+func gumbelScale(epsilon float64, k int64, lInfSensitivity float64) float64 {
+	return 2 * lInfSensitivity * float64(k) / epsilon
+}
+
+// clampInt64Fn clamps the values of a PCollection<K,int64> to MaxValue.
+type clampInt64Fn struct {
+	MaxValue int64
+}
+
+func (fn *clampInt64Fn) ProcessElement(k beam.X, v int64) (beam.X, int64) {
+	if v > fn.MaxValue {
+		return k, fn.MaxValue
+	}
+	return k, v
+}
+
+// clampFloat64Fn clamps the values of a PCollection<K,float64> to
+// [MinValue, MaxValue].
+type clampFloat64Fn struct {
+	MinValue, MaxValue float64
+}
+
+func (fn *clampFloat64Fn) ProcessElement(k beam.X, v float64) (beam.X, float64) {
+	return k, math.Min(math.Max(v, fn.MinValue), fn.MaxValue)
+}
+
+// sumCandidateCountsFn sums the counts of a candidate partition, and drops
+// the partitions that are not candidates.
+func sumCandidateCountsFn(partition beam.X, candidate func(*int64) bool, counts func(*int64) bool, emit func(beam.X, float64)) {
+	var v int64
+	if !candidate(&v) {
+		return
+	}
+	var sum int64
+	for counts(&v) {
+		sum += v
+	}
+	emit(partition, float64(sum))
+}
+
+// sumCandidateSumsFn sums the partial sums of a candidate partition, and
+// drops the partitions that are not candidates.
+func sumCandidateSumsFn(partition beam.X, candidate func(*int64) bool, sums func(*float64) bool, emit func(beam.X, float64)) {
+	var c int64
+	if !candidate(&c) {
+		return
+	}
+	var sum, v float64
+	for sums(&v) {
+		sum += v
+	}
+	emit(partition, sum)
+}
+
+// scoredPartition contains an encoded partition and its noisy score.
+type scoredPartition struct {
+	Partition []byte
+	Score     float64
+}
+
+func lessScoredPartitionFn(a, b scoredPartition) bool {
+	return a.Score < b.Score
+}
+
+// addGumbelNoiseFn transforms a PCollection<K,float64> into a
+// PCollection<scoredPartition> by adding Gumbel noise of the given scale to
+// each score.
+type addGumbelNoiseFn struct {
+	Scale         float64
+	PartitionType beam.EncodedType
+	partitionEnc  beam.ElementEncoder
+}
+
+func newAddGumbelNoiseFn(scale float64, partitionType reflect.Type) *addGumbelNoiseFn {
+	return &addGumbelNoiseFn{Scale: scale, PartitionType: beam.EncodedType{partitionType}}
+}
+
+func (fn *addGumbelNoiseFn) Setup() {
+	fn.partitionEnc = beam.NewElementEncoder(fn.PartitionType.T)
+}
+
+func (fn *addGumbelNoiseFn) ProcessElement(partition beam.X, score float64) (scoredPartition, error) {
+	var buf bytes.Buffer
+	if err := fn.partitionEnc.Encode(partition, &buf); err != nil {
+		return scoredPartition{}, fmt.Errorf("pbeam.addGumbelNoiseFn.ProcessElement: couldn't encode partition %v: %v", partition, err)
+	}
+	return scoredPartition{Partition: buf.Bytes(), Score: score + fn.Scale*gumbel()}, nil
+}
+
+// gumbel returns a sample of the standard Gumbel distribution.
+func gumbel() float64 {
+	u := rand.Uniform()
+	// rand.Uniform returns a value in (0,1], and -ln(-ln(1)) is infinite.
+	for u == 1 {
+		u = rand.Uniform()
+	}
+	return -math.Log(-math.Log(u))
+}
+
+// emitTopPartitionsFn emits the decoded partitions of the top K.
+type emitTopPartitionsFn struct {
+	PartitionType beam.EncodedType
+	partitionDec  beam.ElementDecoder
+}
+
+func newEmitTopPartitionsFn(partitionType reflect.Type) *emitTopPartitionsFn {
+	return &emitTopPartitionsFn{PartitionType: beam.EncodedType{partitionType}}
+}
+
+func (fn *emitTopPartitionsFn) Setup() {
+	fn.partitionDec = beam.NewElementDecoder(fn.PartitionType.T)
+}
+
+func (fn *emitTopPartitionsFn) ProcessElement(topK []scoredPartition, emit func(beam.V)) error {
+	for _, sp := range topK {
+		partition, err := fn.partitionDec.Decode(bytes.NewBuffer(sp.Partition))
+		if err != nil {
+			return fmt.Errorf("pbeam.emitTopPartitionsFn.ProcessElement: couldn't decode partition %v: %v", sp.Partition, err)
+		}
+		emit(partition)
+	}
+	return nil
+}
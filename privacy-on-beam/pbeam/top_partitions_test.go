@@ -0,0 +1,274 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+// Checks that TopPartitions returns the K partitions with the largest counts.
+func TestTopPartitions(t *testing.T) {
+	// Partition p has 100*(p+1) privacy IDs, for p in [0,9].
+	var pairs []pairII
+	for p := 0; p < 10; p++ {
+		pairs = append(pairs, makePairsWithFixedVStartingFromKey(1000*p, 100*(p+1), p)...)
+	}
+	p, s, col, want := ptest.CreateList2(pairs, []int{7, 8, 9})
+	col = beam.ParDo(s, pairToKV, col)
+
+	// With ε=10, half of the budget is used for partition selection, whose
+	// threshold is then ≈5 with δ=10⁻¹⁰, so all partitions are candidates. The
+	// scale of the Gumbel noise is 2*K/5=1.2, so the noise of a partition is
+	// larger than half of the difference of 100 between consecutive counts
+	// with probability less than 10⁻¹⁸.
+	pcol := MakePrivate(s, col, NewPrivacySpec(10, 1e-10))
+	got := TopPartitions(s, pcol, TopPartitionsParams{K: 3, MaxPartitionsContributed: 1, MaxValue: 1})
+	passert.Equals(s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TopPartitions: got %v, want %v: %v", got, want, err)
+	}
+}
+
+// Checks that TopPartitions only returns partitions that pass partition
+// selection when partitions are not specified.
+func TestTopPartitionsSelectsPartitions(t *testing.T) {
+	// Partition 1 has 100 privacy IDs, and partition 2 has a single privacy
+	// ID with many records.
+	var pairs []pairII
+	pairs = append(pairs, makePairsWithFixedV(100, 1)...)
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, pairII{1000, 2})
+	}
+	p, s, col, want := ptest.CreateList2(pairs, []int{1})
+	col = beam.ParDo(s, pairToKV, col)
+
+	// The threshold of partition selection is ≈5 with ε=5 and δ=10⁻¹⁰: a
+	// partition with a single privacy ID is kept with probability less than
+	// 10⁻¹⁰.
+	pcol := MakePrivate(s, col, NewPrivacySpec(10, 1e-10))
+	got := TopPartitions(s, pcol, TopPartitionsParams{K: 2, MaxPartitionsContributed: 1, MaxValue: 100})
+	passert.Equals(s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TopPartitions: got %v, want %v: %v", got, want, err)
+	}
+}
+
+// Checks that TopPartitions only returns public partitions when they are
+// specified, including partitions without data.
+func TestTopPartitionsWithPartitions(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		k    int64
+		want []int
+	}{
+		{"K smaller than the number of partitions", 2, []int{2, 3}},
+		{"K larger than the number of partitions", 5, []int{2, 3, 4}},
+	} {
+		// Partitions 1, 2 and 3 have 100, 60 and 30 privacy IDs, and partition 4
+		// has no data.
+		pairs := concatenatePairs(
+			makePairsWithFixedVStartingFromKey(0, 100, 1),
+			makePairsWithFixedVStartingFromKey(100, 60, 2),
+			makePairsWithFixedVStartingFromKey(200, 30, 3),
+		)
+		p, s, col, want := ptest.CreateList2(pairs, tc.want)
+		col = beam.ParDo(s, pairToKV, col)
+		publicPartitions := beam.CreateList(s, []int{2, 3, 4})
+
+		// The scale of the Gumbel noise is at most 2*5/50=0.2, so the noise of a
+		// partition is larger than half of the difference of 30 between counts
+		// with probability less than 10⁻²⁰.
+		pcol := MakePrivate(s, col, NewPrivacySpec(50, 0))
+		got := TopPartitions(s, pcol, TopPartitionsParams{
+			K:                        tc.k,
+			MaxPartitionsContributed: 1,
+			MaxValue:                 1,
+			PublicPartitions:         publicPartitions,
+		})
+		passert.Equals(s, got, want)
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("TopPartitions: with %s, got %v, want %v: %v", tc.desc, got, want, err)
+		}
+	}
+}
+
+// Checks that TopPartitions bounds the contributions of each privacy ID to
+// each count by MaxValue.
+func TestTopPartitionsBoundsContributions(t *testing.T) {
+	// Partition 1 has 50 privacy IDs, and partition 2 has 10 privacy IDs with
+	// 100 records each.
+	pairs := makePairsWithFixedV(50, 1)
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, makePairsWithFixedVStartingFromKey(100, 10, 2)...)
+	}
+	p, s, col, want := ptest.CreateList2(pairs, []int{1})
+	col = beam.ParDo(s, pairToKV, col)
+	publicPartitions := beam.CreateList(s, []int{1, 2})
+
+	// With MaxValue=2, the count of partition 2 is 20 instead of 1000. The scale
+	// of the Gumbel noise is 2*2*1/50=0.08, so the noise of a partition is
+	// larger than half of the difference of 30 between counts with probability
+	// less than 10⁻²⁰.
+	pcol := MakePrivate(s, col, NewPrivacySpec(50, 0))
+	got := TopPartitions(s, pcol, TopPartitionsParams{
+		K:                        1,
+		MaxPartitionsContributed: 1,
+		MaxValue:                 2,
+		PublicPartitions:         publicPartitions,
+	})
+	passert.Equals(s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TopPartitions: got %v, want %v: %v", got, want, err)
+	}
+}
+
+func TestCheckTopPartitionsParams(t *testing.T) {
+	_, _, publicPartitions := ptest.CreateList([]int{0})
+	for _, tc := range []struct {
+		desc    string
+		epsilon float64
+		delta   float64
+		params  TopPartitionsParams
+		wantErr bool
+	}{
+		{"valid parameters", 1.0, 1e-5, TopPartitionsParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1}, false},
+		{"valid parameters with partitions", 1.0, 0, TopPartitionsParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: publicPartitions}, false},
+		{"zero epsilon", 0, 1e-5, TopPartitionsParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1}, true},
+		{"zero delta without partitions", 1.0, 0, TopPartitionsParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1}, true},
+		{"non-zero delta with partitions", 1.0, 1e-5, TopPartitionsParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: publicPartitions}, true},
+		{"zero K", 1.0, 1e-5, TopPartitionsParams{K: 0, MaxPartitionsContributed: 1, MaxValue: 1}, true},
+		{"negative MaxPartitionsContributed", 1.0, 1e-5, TopPartitionsParams{K: 10, MaxPartitionsContributed: -1, MaxValue: 1}, true},
+		{"zero MaxValue", 1.0, 1e-5, TopPartitionsParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 0}, true},
+	} {
+		if err := checkTopPartitionsParams(tc.params, tc.epsilon, tc.delta); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that TopPartitionsBySum returns the K partitions with the largest
+// sums, which are not those with the largest counts.
+func TestTopPartitionsBySum(t *testing.T) {
+	// Partition 0 has 2000 privacy IDs with value 0, and partition p in [1,4]
+	// has 1000 privacy IDs with value p, so its sum is 1000*p.
+	triples := makeTripleWithIntValue(2000, 0, 0)
+	for p := 1; p <= 4; p++ {
+		triples = append(triples, makeTripleWithIntValueStartingFromKey(2000*p, 1000, p, p)...)
+	}
+	p, s, col, want := ptest.CreateList2(triples, []int{3, 4})
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	// With ε=10, half of the budget is used for partition selection, so all
+	// partitions are candidates. The scale of the Gumbel noise is
+	// 2*5*K/5=4, so the noise of a partition is larger than half of the
+	// difference of 1000 between consecutive sums with probability less than
+	// 10⁻⁵⁰.
+	pcol := MakePrivate(s, col, NewPrivacySpec(10, 1e-10))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	got := TopPartitionsBySum(s, pcol, TopPartitionsBySumParams{K: 2, MaxPartitionsContributed: 1, MinValue: 0, MaxValue: 5})
+	passert.Equals(s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TopPartitionsBySum: got %v, want %v: %v", got, want, err)
+	}
+}
+
+// Checks that TopPartitionsBySum clamps the contribution of each privacy ID
+// to each sum to [MinValue, MaxValue], and only returns public partitions
+// when they are specified.
+func TestTopPartitionsBySumClampsContributions(t *testing.T) {
+	// Partition 1 has 50 privacy IDs with value 1, partition 2 has 10 privacy
+	// IDs with value 100, and partition 3 is not public.
+	triples := concatenateTriplesWithIntValue(
+		makeTripleWithIntValue(50, 1, 1),
+		makeTripleWithIntValueStartingFromKey(100, 10, 2, 100),
+		makeTripleWithIntValueStartingFromKey(200, 100, 3, 100))
+	p, s, col, want := ptest.CreateList2(triples, []int{1})
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+	publicPartitions := beam.CreateList(s, []int{1, 2})
+
+	// With MaxValue=2, the sum of partition 2 is 20 instead of 1000. The scale
+	// of the Gumbel noise is 2*2*1/50=0.08, so the noise of a partition is
+	// larger than half of the difference of 30 between sums with probability
+	// less than 10⁻²⁰.
+	pcol := MakePrivate(s, col, NewPrivacySpec(50, 0))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	got := TopPartitionsBySum(s, pcol, TopPartitionsBySumParams{
+		K:                        1,
+		MaxPartitionsContributed: 1,
+		MinValue:                 -2,
+		MaxValue:                 2,
+		PublicPartitions:         publicPartitions,
+	})
+	passert.Equals(s, got, want)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TopPartitionsBySum: got %v, want %v: %v", got, want, err)
+	}
+}
+
+func TestCheckTopPartitionsBySumParams(t *testing.T) {
+	_, _, publicPartitions := ptest.CreateList([]int{0})
+	for _, tc := range []struct {
+		desc    string
+		epsilon float64
+		delta   float64
+		params  TopPartitionsBySumParams
+		wantErr bool
+	}{
+		{"valid parameters", 1.0, 1e-5, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: 1, MinValue: -1, MaxValue: 1}, false},
+		{"valid parameters with partitions", 1.0, 0, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: publicPartitions}, false},
+		{"zero epsilon", 0, 1e-5, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1}, true},
+		{"zero delta without partitions", 1.0, 0, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1}, true},
+		{"non-zero delta with partitions", 1.0, 1e-5, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: 1, MaxValue: 1, PublicPartitions: publicPartitions}, true},
+		{"zero K", 1.0, 1e-5, TopPartitionsBySumParams{K: 0, MaxPartitionsContributed: 1, MaxValue: 1}, true},
+		{"negative MaxPartitionsContributed", 1.0, 1e-5, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: -1, MaxValue: 1}, true},
+		{"MinValue larger than MaxValue", 1.0, 1e-5, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: 1, MinValue: 2, MaxValue: 1}, true},
+		{"infinite MaxValue", 1.0, 1e-5, TopPartitionsBySumParams{K: 10, MaxPartitionsContributed: 1, MaxValue: math.Inf(1)}, true},
+	} {
+		if err := checkTopPartitionsBySumParams(tc.params, tc.epsilon, tc.delta); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that gumbel returns samples of the standard Gumbel distribution,
+// whose mean is the Euler–Mascheroni constant and whose variance is π²/6.
+func TestGumbel(t *testing.T) {
+	const numberOfSamples = 100000
+	var sum, sumSquares float64
+	for i := 0; i < numberOfSamples; i++ {
+		g := gumbel()
+		sum += g
+		sumSquares += g * g
+	}
+	mean := sum / numberOfSamples
+	variance := sumSquares/numberOfSamples - mean*mean
+	// The tolerance is set to the 99.9995% quantile of the anticipated
+	// distribution of the sample mean. Thus, the test falsely rejects with a
+	// probability of 10⁻⁵.
+	wantMean, wantVariance := 0.5772156649, math.Pi*math.Pi/6
+	if tolerance := 4.41717 * math.Sqrt(wantVariance/numberOfSamples); math.Abs(mean-wantMean) > tolerance {
+		t.Errorf("gumbel: got mean %f, want %f", mean, wantMean)
+	}
+	if math.Abs(variance-wantVariance) > 0.05*wantVariance {
+		t.Errorf("gumbel: got variance %f, want %f", variance, wantVariance)
+	}
+}
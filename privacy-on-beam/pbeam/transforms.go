@@ -0,0 +1,240 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/util/reflectx"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/filter"
+)
+
+// This file contains transforms of PrivatePCollections that do not aggregate
+// data, and that propagate privacy identifiers like ParDo.
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*filterFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*filterKVFn)(nil)))
+}
+
+// Filter keeps the records of a PrivatePCollection for which the predicate fn
+// returns true, and drops the others. Privacy identifiers are kept unchanged.
+// fn must have one of the following types.
+//
+// 	Filters a PrivatePCollection<X>:
+//		- func(X) bool
+//
+// 	Filters a PrivatePCollection<K,V>:
+//		- func(K, V) bool
+func Filter(s beam.Scope, fn interface{}, pcol PrivatePCollection) PrivatePCollection {
+	s = s.Scope("pbeam.Filter")
+	_, valueT := beam.ValidateKVType(pcol.col)
+	var inputTypes []reflect.Type
+	if pcol.codec != nil {
+		inputTypes = []reflect.Type{pcol.codec.KType.T, pcol.codec.VType.T}
+	} else {
+		inputTypes = []reflect.Type{valueT.Type()}
+	}
+	if err := checkFilterFn(fn, inputTypes); err != nil {
+		log.Exitf("pbeam.Filter: %v", err)
+	}
+	var doFn interface{}
+	if pcol.codec != nil {
+		doFn = &filterKVFn{Predicate: beam.EncodedFunc{Fn: reflectx.MakeFunc(fn)}, Codec: pcol.codec}
+	} else {
+		doFn = &filterFn{Predicate: beam.EncodedFunc{Fn: reflectx.MakeFunc(fn)}}
+	}
+	return PrivatePCollection{
+		col:              beam.ParDo(s, doFn, pcol.col),
+		codec:            pcol.codec,
+		privacySpec:      pcol.privacySpec,
+		windowFn:         pcol.windowFn,
+		sampling:         pcol.sampling,
+		maxContributions: pcol.maxContributions,
+	}
+}
+
+// checkFilterFn checks that fn is a function taking arguments of the given
+// types and returning a bool.
+func checkFilterFn(fn interface{}, inputTypes []reflect.Type) error {
+	if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("fn must be a function, got %T instead", fn)
+	}
+	fnT := reflect.TypeOf(fn)
+	if fnT.NumOut() != 1 || fnT.Out(0) != reflect.TypeOf(false) {
+		return fmt.Errorf("fn must return a single bool, got %v instead", fnT)
+	}
+	if fnT.NumIn() != len(inputTypes) {
+		return fmt.Errorf("fn must take %d argument(s) to filter a PrivatePCollection of type %v, got %v instead", len(inputTypes), inputTypes, fnT)
+	}
+	for i, t := range inputTypes {
+		if !t.AssignableTo(fnT.In(i)) {
+			return fmt.Errorf("argument %d of fn must have type %v, got %v instead", i, t, fnT.In(i))
+		}
+	}
+	return nil
+}
+
+// filterFn keeps the <ID,V> pairs for which Predicate returns true.
+type filterFn struct {
+	Predicate beam.EncodedFunc
+	pfn       reflectx.Func1x1
+}
+
+func (fn *filterFn) Setup() {
+	fn.pfn = reflectx.ToFunc1x1(fn.Predicate.Fn)
+}
+
+func (fn *filterFn) ProcessElement(id beam.W, v beam.V, emit func(beam.W, beam.V)) {
+	if fn.pfn.Call1x1(v).(bool) {
+		emit(id, v)
+	}
+}
+
+// filterKVFn keeps the <ID,kv.Pair<K,V>> pairs for which Predicate returns
+// true on the decoded <K,V> pair.
+type filterKVFn struct {
+	Predicate beam.EncodedFunc
+	pfn       reflectx.Func2x1
+	Codec     *kv.Codec
+}
+
+func (fn *filterKVFn) Setup() error {
+	fn.pfn = reflectx.ToFunc2x1(fn.Predicate.Fn)
+	return fn.Codec.Setup()
+}
+
+func (fn *filterKVFn) ProcessElement(id beam.W, pair kv.Pair, emit func(beam.W, kv.Pair)) {
+	k, v := fn.Codec.Decode(pair)
+	if fn.pfn.Call2x1(k, v).(bool) {
+		emit(id, pair)
+	}
+}
+
+// Flatten merges several PrivatePCollections of the same type into a single
+// PrivatePCollection. All the PrivatePCollections must have been created with
+// the same PrivacySpec, so that the privacy budget is shared between them, and
+// the same privacy unit: a privacy identifier contributing to several of the
+// inputs is a single privacy identifier in the output. They must also have the
+// same windowing function.
+//
+// If the number of records per privacy identifier is bounded in all the inputs
+// (see BoundSubUnitContributions), it is bounded in the output by the sum of
+// these bounds.
+//
+// Flatten transforms several PrivatePCollection<V> into a
+// PrivatePCollection<V>, and several PrivatePCollection<K,V> into a
+// PrivatePCollection<K,V>.
+func Flatten(s beam.Scope, pcols ...PrivatePCollection) PrivatePCollection {
+	s = s.Scope("pbeam.Flatten")
+	if err := checkFlattenInputs(pcols); err != nil {
+		log.Exitf("pbeam.Flatten: %v", err)
+	}
+	cols := make([]beam.PCollection, len(pcols))
+	// The output is only derived from a sample if all the inputs are derived
+	// from it. A privacy identifier has at most as many records in the output
+	// as in all the inputs together, so the maximum number of records per
+	// privacy identifier is only known if it is known for all the inputs.
+	sampling := pcols[0].sampling
+	var maxContributions int64
+	for i, pcol := range pcols {
+		cols[i] = pcol.col
+		if pcol.sampling != sampling {
+			sampling = nil
+		}
+		if maxContributions >= 0 {
+			maxContributions = addMaxContributions(maxContributions, pcol.maxContributions)
+		}
+	}
+	if maxContributions < 0 {
+		maxContributions = 0
+	}
+	return PrivatePCollection{
+		col:              beam.Flatten(s, cols...),
+		codec:            pcols[0].codec,
+		privacySpec:      pcols[0].privacySpec,
+		maxContributions: maxContributions,
+		windowFn:         pcols[0].windowFn,
+		sampling:         sampling,
+	}
+}
+
+// addMaxContributions returns the sum of two maximum numbers of records per
+// privacy identifier, or -1 if one of them is unknown or if the sum overflows.
+func addMaxContributions(a, b int64) int64 {
+	if b <= 0 || a > math.MaxInt64-b {
+		return -1
+	}
+	return a + b
+}
+
+func checkFlattenInputs(pcols []PrivatePCollection) error {
+	if len(pcols) == 0 {
+		return fmt.Errorf("at least one PrivatePCollection is required")
+	}
+	first := pcols[0]
+	for i, pcol := range pcols[1:] {
+		if pcol.privacySpec != first.privacySpec {
+			return fmt.Errorf("PrivatePCollection %d doesn't have the same PrivacySpec as PrivatePCollection 0", i+1)
+		}
+		if !sameWindowFn(pcol, first) {
+			return fmt.Errorf("PrivatePCollection %d has windowing function %v, but PrivatePCollection 0 has windowing function %v", i+1, pcol.windowFn, first.windowFn)
+		}
+		if (pcol.codec == nil) != (first.codec == nil) {
+			return fmt.Errorf("PrivatePCollection %d and PrivatePCollection 0 must both be of type <V> or both be of type <K,V>", i+1)
+		}
+		if pcol.codec != nil && (pcol.codec.KType.T != first.codec.KType.T || pcol.codec.VType.T != first.codec.VType.T) {
+			return fmt.Errorf("PrivatePCollection %d has type <%v,%v>, but PrivatePCollection 0 has type <%v,%v>",
+				i+1, pcol.codec.KType.T, pcol.codec.VType.T, first.codec.KType.T, first.codec.VType.T)
+		}
+	}
+	return nil
+}
+
+// Distinct deduplicates the records of each privacy identifier of a
+// PrivatePCollection: if a privacy identifier is associated with the same
+// record several times, it is kept only once. Records that are equal but
+// associated with different privacy identifiers are all kept.
+//
+// Distinct transforms a PrivatePCollection<V> into a PrivatePCollection<V>,
+// and a PrivatePCollection<K,V> into a PrivatePCollection<K,V>.
+func Distinct(s beam.Scope, pcol PrivatePCollection) PrivatePCollection {
+	s = s.Scope("pbeam.Distinct")
+	idT, valueT := beam.ValidateKVType(pcol.col)
+	// Deduplicate (privacy ID, record) pairs by encoding them and calling
+	// Distinct.
+	coded := beam.ParDo(s, kv.NewEncodeFn(idT, valueT), pcol.col)
+	distinct := filter.Distinct(s, coded)
+	decoded := beam.ParDo(s,
+		kv.NewDecodeFn(idT, valueT),
+		distinct,
+		beam.TypeDefinition{Var: beam.TType, T: idT.Type()},
+		beam.TypeDefinition{Var: beam.VType, T: valueT.Type()})
+	return PrivatePCollection{
+		col:              decoded,
+		codec:            pcol.codec,
+		privacySpec:      pcol.privacySpec,
+		windowFn:         pcol.windowFn,
+		sampling:         pcol.sampling,
+		maxContributions: pcol.maxContributions,
+	}
+}
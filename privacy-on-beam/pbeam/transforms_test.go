@@ -0,0 +1,201 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Checks that Filter keeps the records of a PrivatePCollection<V> for which the
+// predicate returns true, along with their privacy identifiers.
+func TestFilterV(t *testing.T) {
+	pairs := []pairII{{1, 1}, {1, 2}, {2, 3}, {3, 4}, {4, 4}}
+	want := []pairII{{1, 2}, {3, 4}, {4, 4}}
+	p, s, col, wantCol := ptest.CreateList2(pairs, want)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = Filter(s, func(v int) bool { return v%2 == 0 }, pcol)
+	got := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestFilterV: Filter(%v) = %v, expected %v: %v", col, got, wantCol, err)
+	}
+}
+
+// Checks that Filter keeps the records of a PrivatePCollection<K,V> for which
+// the predicate returns true, and that the codec is kept.
+func TestFilterKV(t *testing.T) {
+	triples := []tripleWithIntValue{{1, 0, 1}, {1, 1, 2}, {2, 0, 3}, {3, 1, 4}}
+	want := []pairII{{1, 2}, {3, 4}}
+	p, s, col, wantCol := ptest.CreateList2(triples, want)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	wantCodec := pcol.codec
+	pcol = Filter(s, func(k, v int) bool { return k == 1 }, pcol)
+	if diff := cmp.Diff(pcol.codec, wantCodec, cmp.Comparer(compareCodecs)); diff != "" {
+		t.Errorf("TestFilterKV: Filter returned a PrivatePCollection with unexpected codec, diff=%s", diff)
+	}
+	values := ParDo(s, func(k, v int) int { return v }, pcol)
+	got := beam.ParDo(s, kvToPair, values.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestFilterKV: Filter(%v) = %v, expected %v: %v", col, got, wantCol, err)
+	}
+}
+
+func TestCheckFilterFn(t *testing.T) {
+	intT := reflect.TypeOf(0)
+	for _, tc := range []struct {
+		desc       string
+		fn         interface{}
+		inputTypes []reflect.Type
+		wantErr    bool
+	}{
+		{"valid predicate on values", func(int) bool { return true }, []reflect.Type{intT}, false},
+		{"valid predicate on KV pairs", func(int, string) bool { return true }, []reflect.Type{intT, reflect.TypeOf("")}, false},
+		{"predicate with interface argument", func(interface{}) bool { return true }, []reflect.Type{intT}, false},
+		{"not a function", 42, []reflect.Type{intT}, true},
+		{"nil function", nil, []reflect.Type{intT}, true},
+		{"non-bool return", func(int) int { return 0 }, []reflect.Type{intT}, true},
+		{"two returns", func(int) (bool, error) { return true, nil }, []reflect.Type{intT}, true},
+		{"wrong number of arguments", func(int) bool { return true }, []reflect.Type{intT, intT}, true},
+		{"wrong argument type", func(string) bool { return true }, []reflect.Type{intT}, true},
+	} {
+		if err := checkFilterFn(tc.fn, tc.inputTypes); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that Flatten merges PrivatePCollections, keeping privacy identifiers.
+func TestFlatten(t *testing.T) {
+	pairs1 := []pairII{{1, 1}, {2, 2}}
+	pairs2 := []pairII{{1, 3}, {3, 3}}
+	want := []pairII{{1, 1}, {2, 2}, {1, 3}, {3, 3}}
+	p, s, col1, col2 := ptest.CreateList2(pairs1, pairs2)
+	wantCol := beam.CreateList(s, want)
+	col1 = beam.ParDo(s, pairToKV, col1)
+	col2 = beam.ParDo(s, pairToKV, col2)
+
+	spec := NewPrivacySpec(1, 1e-10)
+	pcol := Flatten(s, MakePrivate(s, col1, spec), MakePrivate(s, col2, spec))
+	got := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestFlatten: Flatten(%v, %v) = %v, expected %v: %v", col1, col2, got, wantCol, err)
+	}
+}
+
+func TestFlattenMaxContributions(t *testing.T) {
+	for _, tc := range []struct {
+		desc             string
+		maxContributions []int64
+		want             int64
+	}{
+		{"all bounded", []int64{2, 3}, 5},
+		{"one unbounded", []int64{2, 0}, 0},
+		{"sum overflows", []int64{math.MaxInt64, 1}, 0},
+	} {
+		_, s, col := ptest.CreateList([]pairII{{1, 1}})
+		col = beam.ParDo(s, pairToKV, col)
+		spec := NewPrivacySpec(1, 1e-10)
+		var pcols []PrivatePCollection
+		for _, m := range tc.maxContributions {
+			pcol := MakePrivate(s, col, spec)
+			pcol.maxContributions = m
+			pcols = append(pcols, pcol)
+		}
+		if got := Flatten(s, pcols...).maxContributions; got != tc.want {
+			t.Errorf("With %s, got maxContributions=%d, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestCheckFlattenInputs(t *testing.T) {
+	spec1, spec2 := NewPrivacySpec(1, 1e-10), NewPrivacySpec(1, 1e-10)
+	intCodec := kv.NewCodec(reflect.TypeOf(0), reflect.TypeOf(0))
+	stringCodec := kv.NewCodec(reflect.TypeOf(""), reflect.TypeOf(0))
+	for _, tc := range []struct {
+		desc    string
+		pcols   []PrivatePCollection
+		wantErr bool
+	}{
+		{"same PrivacySpec", []PrivatePCollection{{privacySpec: spec1}, {privacySpec: spec1}}, false},
+		{"same PrivacySpec and codec types", []PrivatePCollection{{privacySpec: spec1, codec: intCodec}, {privacySpec: spec1, codec: kv.NewCodec(reflect.TypeOf(0), reflect.TypeOf(0))}}, false},
+		{"no PrivatePCollection", nil, true},
+		{"different PrivacySpecs", []PrivatePCollection{{privacySpec: spec1}, {privacySpec: spec2}}, true},
+		{"<V> and <K,V> inputs", []PrivatePCollection{{privacySpec: spec1}, {privacySpec: spec1, codec: intCodec}}, true},
+		{"different key types", []PrivatePCollection{{privacySpec: spec1, codec: intCodec}, {privacySpec: spec1, codec: stringCodec}}, true},
+		{"same windowing functions", []PrivatePCollection{{privacySpec: spec1, windowFn: window.NewFixedWindows(time.Hour)}, {privacySpec: spec1, windowFn: window.NewFixedWindows(time.Hour)}}, false},
+		{"global windows and no windowing function", []PrivatePCollection{{privacySpec: spec1, windowFn: window.NewGlobalWindows()}, {privacySpec: spec1}}, false},
+		{"different windowing functions", []PrivatePCollection{{privacySpec: spec1, windowFn: window.NewFixedWindows(time.Hour)}, {privacySpec: spec1, windowFn: window.NewFixedWindows(time.Minute)}}, true},
+		{"windowed and not windowed", []PrivatePCollection{{privacySpec: spec1, windowFn: window.NewFixedWindows(time.Hour)}, {privacySpec: spec1}}, true},
+	} {
+		if err := checkFlattenInputs(tc.pcols); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+// Checks that Distinct deduplicates the records of each privacy identifier,
+// but not records of different privacy identifiers.
+func TestDistinctV(t *testing.T) {
+	pairs := []pairII{{1, 1}, {1, 1}, {1, 2}, {2, 1}, {2, 1}, {2, 1}}
+	want := []pairII{{1, 1}, {1, 2}, {2, 1}}
+	p, s, col, wantCol := ptest.CreateList2(pairs, want)
+	col = beam.ParDo(s, pairToKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = Distinct(s, pcol)
+	got := beam.ParDo(s, kvToPair, pcol.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestDistinctV: Distinct(%v) = %v, expected %v: %v", col, got, wantCol, err)
+	}
+}
+
+// Checks that Distinct deduplicates the <K,V> records of each privacy
+// identifier in a PrivatePCollection<K,V>.
+func TestDistinctKV(t *testing.T) {
+	triples := []tripleWithIntValue{{1, 0, 1}, {1, 0, 1}, {1, 1, 1}, {2, 0, 1}, {2, 0, 1}}
+	want := []pairII{{1, 0}, {1, 1}, {2, 0}}
+	p, s, col, wantCol := ptest.CreateList2(triples, want)
+	col = beam.ParDo(s, extractIDFromTripleWithIntValue, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = ParDo(s, tripleWithIntValueToKV, pcol)
+	pcol = Distinct(s, pcol)
+	partitions := ParDo(s, func(k, v int) int { return k }, pcol)
+	got := beam.ParDo(s, kvToPair, partitions.col)
+	passert.Equals(s, got, wantCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestDistinctKV: Distinct(%v) = %v, expected %v: %v", col, got, wantCol, err)
+	}
+}
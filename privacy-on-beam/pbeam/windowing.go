@@ -0,0 +1,252 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+
+	log "github.com/golang/glog"
+	"github.com/google/differential-privacy/privacy-on-beam/internal/kv"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*keyByWindowFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*expandWindowValuesFn)(nil)))
+	beam.RegisterType(reflect.TypeOf((*timestampedValue)(nil)).Elem())
+}
+
+// WindowInto applies the windowing function ws to a PrivatePCollection, like
+// beam.WindowInto does for PCollections. The records are assigned to windows
+// according to their event timestamps, which must be set before calling
+// MakePrivate (e.g. by a DoFn emitting a beam.EventTime).
+//
+// Aggregations on a windowed PrivatePCollection work independently on each
+// window: contribution bounding, partition selection and noise addition are
+// done per window, and the results of a window are emitted once, when the
+// window closes. Aggregations can then be used on unbounded PCollections in
+// streaming pipelines.
+//
+// Each window gets the full privacy budget of each aggregation: the (ε,δ)
+// guarantee of the PrivacySpec applies to the records of a privacy identifier
+// within a single window. To protect all the records of a privacy identifier,
+// use BoundWindowContributions: if each privacy identifier contributes to at
+// most n windows, the outputs over all windows are (nε,nδ)-differentially
+// private.
+//
+// Aggregations only emit the public partitions of a window if PublicPartitions
+// contains them in this window: ws is applied to PublicPartitions, so their
+// elements must have timestamps in each window whose results must be released
+// (e.g. by being emitted periodically in a streaming pipeline).
+//
+// ws must be a global, fixed or sliding windowing function: session windows
+// are not supported, since their boundaries depend on the private data.
+// Global aggregations (GlobalCount, GlobalSum, etc.) don't support windowed
+// PrivatePCollections; per-partition aggregations with a single public
+// partition can be used instead.
+func WindowInto(s beam.Scope, ws *window.Fn, pcol PrivatePCollection) PrivatePCollection {
+	s = s.Scope("pbeam.WindowInto")
+	if err := checkWindowFn(ws); err != nil {
+		log.Exit(err)
+	}
+	return PrivatePCollection{
+		col:              beam.WindowInto(s, ws, pcol.col),
+		codec:            pcol.codec,
+		privacySpec:      pcol.privacySpec,
+		maxContributions: pcol.maxContributions,
+		windowFn:         ws,
+		sampling:         pcol.sampling,
+	}
+}
+
+func checkWindowFn(ws *window.Fn) error {
+	if ws == nil {
+		return fmt.Errorf("pbeam.WindowInto: the windowing function must be set")
+	}
+	switch ws.Kind {
+	case window.GlobalWindows, window.FixedWindows, window.SlidingWindows:
+		return nil
+	default:
+		return fmt.Errorf("pbeam.WindowInto: windowing function %v is not supported, must be global, fixed or sliding windows", ws)
+	}
+}
+
+// isWindowed returns whether pcol is windowed with a non-global windowing
+// function.
+func isWindowed(pcol PrivatePCollection) bool {
+	return pcol.windowFn != nil && pcol.windowFn.Kind != window.GlobalWindows
+}
+
+// sameWindowFn returns whether pcols a and b have the same windowing
+// function. PrivatePCollections without a windowing function are in the global
+// window.
+func sameWindowFn(a, b PrivatePCollection) bool {
+	wa, wb := a.windowFn, b.windowFn
+	if wa == nil {
+		wa = window.NewGlobalWindows()
+	}
+	if wb == nil {
+		wb = window.NewGlobalWindows()
+	}
+	return wa.Equals(wb)
+}
+
+// checkNotWindowed returns an error if pcol is windowed. It is used by
+// aggregations that can't be computed per window.
+func checkNotWindowed(label string, pcol PrivatePCollection) error {
+	if isWindowed(pcol) {
+		return fmt.Errorf("%s doesn't support windowed PrivatePCollections, got windowing function %v", label, pcol.windowFn)
+	}
+	return nil
+}
+
+// windowPublicPartitions applies the windowing function of pcol, if any, to
+// the public partitions of an aggregation on pcol.
+func windowPublicPartitions(s beam.Scope, pcol PrivatePCollection, publicPartitions beam.PCollection) beam.PCollection {
+	if pcol.windowFn == nil {
+		return publicPartitions
+	}
+	return beam.WindowInto(s, pcol.windowFn, publicPartitions)
+}
+
+// BoundWindowContributions bounds the number of windows that each privacy
+// identifier contributes to: if a privacy identifier has records in more than
+// maxWindows windows, the records of random windows are dropped. The records
+// of the windows that are kept are unchanged. Aggregations on the returned
+// PrivatePCollection still bound contributions within each window.
+//
+// pcol must be windowed with fixed windows by WindowInto. Since the records of
+// each privacy identifier need to be grouped across windows, this can only be
+// used on bounded PrivatePCollections.
+func BoundWindowContributions(s beam.Scope, pcol PrivatePCollection, maxWindows int64) PrivatePCollection {
+	s = s.Scope("pbeam.BoundWindowContributions")
+	if pcol.windowFn == nil || pcol.windowFn.Kind != window.FixedWindows {
+		log.Exitf("pbeam.BoundWindowContributions: pcol must be windowed with fixed windows by pbeam.WindowInto, got windowing function %v", pcol.windowFn)
+	}
+	if maxWindows <= 0 {
+		log.Exitf("pbeam.BoundWindowContributions: maxWindows should be strictly positive, got %d", maxWindows)
+	}
+	idT, valueT := beam.ValidateKVType(pcol.col)
+	// First, key the records by (privacy ID, window), keeping their timestamps,
+	// and move them to the global window.
+	keyed := beam.ParDo(s, newKeyByWindowFn(idT.Type(), valueT.Type()), pcol.col)
+	keyed = beam.WindowInto(s, window.NewGlobalWindows(), keyed)
+	// Second, group the records of each (privacy ID, window) pair, re-key by
+	// privacy ID and bound the number of windows per privacy ID.
+	grouped := beam.ParDo(s, newGroupPartitionValuesFn(beam.EncodedType{reflect.TypeOf(timestampedValue{})}), beam.GroupByKey(s, keyed))
+	grouped = boundContributions(s, grouped, maxWindows)
+	// Third, get back the original records with their timestamps, and their
+	// windows.
+	bounded := beam.ParDo(s,
+		newExpandWindowValuesFn(idT.Type(), valueT.Type()),
+		grouped,
+		beam.TypeDefinition{Var: beam.WType, T: idT.Type()},
+		beam.TypeDefinition{Var: beam.VType, T: valueT.Type()})
+	return PrivatePCollection{
+		col:              beam.WindowInto(s, pcol.windowFn, bounded),
+		codec:            pcol.codec,
+		privacySpec:      pcol.privacySpec,
+		maxContributions: pcol.maxContributions,
+		windowFn:         pcol.windowFn,
+		sampling:         pcol.sampling,
+	}
+}
+
+// timestampedValue is an encoded value with its event timestamp, in
+// milliseconds since the Unix epoch.
+type timestampedValue struct {
+	Timestamp int64
+	Value     []byte
+}
+
+// keyByWindowFn transforms a PCollection<ID,V> into a
+// PCollection<kv.Pair{ID,W},timestampedValue>, where W is the window of the
+// record, identified by its maximum timestamp.
+type keyByWindowFn struct {
+	IDType    beam.EncodedType
+	ValueType beam.EncodedType
+	idEnc     beam.ElementEncoder
+	valueEnc  beam.ElementEncoder
+}
+
+func newKeyByWindowFn(idType, valueType reflect.Type) *keyByWindowFn {
+	return &keyByWindowFn{IDType: beam.EncodedType{idType}, ValueType: beam.EncodedType{valueType}}
+}
+
+func (fn *keyByWindowFn) Setup() {
+	fn.idEnc = beam.NewElementEncoder(fn.IDType.T)
+	fn.valueEnc = beam.NewElementEncoder(fn.ValueType.T)
+}
+
+func (fn *keyByWindowFn) ProcessElement(w beam.Window, ts beam.EventTime, id beam.W, v beam.V) (kv.Pair, timestampedValue, error) {
+	var idBuf, valueBuf bytes.Buffer
+	if err := fn.idEnc.Encode(id, &idBuf); err != nil {
+		return kv.Pair{}, timestampedValue{}, fmt.Errorf("pbeam.keyByWindowFn.ProcessElement: couldn't encode privacy ID %v: %v", id, err)
+	}
+	if err := fn.valueEnc.Encode(v, &valueBuf); err != nil {
+		return kv.Pair{}, timestampedValue{}, fmt.Errorf("pbeam.keyByWindowFn.ProcessElement: couldn't encode value %v: %v", v, err)
+	}
+	windowBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(windowBuf, uint64(w.MaxTimestamp()))
+	return kv.Pair{idBuf.Bytes(), windowBuf}, timestampedValue{Timestamp: int64(ts), Value: valueBuf.Bytes()}, nil
+}
+
+// expandWindowValuesFn takes a PCollection<[]byte,partitionValues> as input,
+// where the key is an encoded privacy ID and the values are encoded
+// timestampedValues, and returns a PCollection<ID,V> containing each of the
+// values with its privacy ID and its original timestamp.
+type expandWindowValuesFn struct {
+	IDType    beam.EncodedType
+	ValueType beam.EncodedType
+	idDec     beam.ElementDecoder
+	tsDec     beam.ElementDecoder
+	valueDec  beam.ElementDecoder
+}
+
+func newExpandWindowValuesFn(idType, valueType reflect.Type) *expandWindowValuesFn {
+	return &expandWindowValuesFn{IDType: beam.EncodedType{idType}, ValueType: beam.EncodedType{valueType}}
+}
+
+func (fn *expandWindowValuesFn) Setup() {
+	fn.idDec = beam.NewElementDecoder(fn.IDType.T)
+	fn.tsDec = beam.NewElementDecoder(reflect.TypeOf(timestampedValue{}))
+	fn.valueDec = beam.NewElementDecoder(fn.ValueType.T)
+}
+
+func (fn *expandWindowValuesFn) ProcessElement(encodedID []byte, pv partitionValues, emit func(beam.EventTime, beam.W, beam.V)) error {
+	id, err := fn.idDec.Decode(bytes.NewBuffer(encodedID))
+	if err != nil {
+		return fmt.Errorf("pbeam.expandWindowValuesFn.ProcessElement: couldn't decode privacy ID %v: %v", encodedID, err)
+	}
+	for _, encoded := range pv.Values {
+		decoded, err := fn.tsDec.Decode(bytes.NewBuffer(encoded))
+		if err != nil {
+			return fmt.Errorf("pbeam.expandWindowValuesFn.ProcessElement: couldn't decode timestamped value %v: %v", encoded, err)
+		}
+		tv := decoded.(timestampedValue)
+		v, err := fn.valueDec.Decode(bytes.NewBuffer(tv.Value))
+		if err != nil {
+			return fmt.Errorf("pbeam.expandWindowValuesFn.ProcessElement: couldn't decode value %v: %v", tv.Value, err)
+		}
+		emit(beam.EventTime(tv.Timestamp), id, v)
+	}
+	return nil
+}
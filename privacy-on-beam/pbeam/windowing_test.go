@@ -0,0 +1,209 @@
+//
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pbeam
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/mtime"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/graph/window"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+// In the tests of this file, values in [100*h, 100*h+99] have a timestamp in
+// hour h, and are in partition v%100.
+var hourlyWindows = window.NewFixedWindows(time.Hour)
+
+func hourTimestamp(v int) beam.EventTime {
+	return mtime.FromDuration(time.Duration(v/100) * time.Hour)
+}
+
+func pairToTimestampedKV(p pairII) (beam.EventTime, int, int) {
+	return hourTimestamp(p.B), p.A, p.B
+}
+
+func int64MetricToTimestampedKV(tm testInt64Metric) (beam.EventTime, int, int64) {
+	return hourTimestamp(tm.Value), tm.Value % 100, tm.Metric
+}
+
+func valueToTimestampedPartition(v int) (beam.EventTime, int) {
+	return hourTimestamp(v), v % 100
+}
+
+func partitionOf(v int) int {
+	return v % 100
+}
+
+// Checks that Count selects partitions and bounds contributions per window.
+func TestCountWindowed(t *testing.T) {
+	// Privacy IDs contribute to partition 1 in both hours 0 and 1, and
+	// partition 2 in hour 1 has too few privacy IDs to be kept.
+	pairs := concatenatePairs(
+		makePairsWithFixedV(52, 1),
+		makePairsWithFixedV(99, 101),
+		makePairsWithFixedVStartingFromKey(99, 7, 102),
+	)
+	result := []testInt64Metric{
+		{1, 52},
+		{101, 99},
+	}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, pairToTimestampedKV, col)
+
+	// ε=50, δ=10⁻²⁰⁰ and l1Sensitivity=1 gives a threshold of ≈10.
+	// We have 3 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we need to have each partition pass with 1-10⁻²⁵ probability (k=25).
+	epsilon, delta, k, l1Sensitivity := 50.0, 1e-200, 25.0, 1.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, delta))
+	pcol = WindowInto(s, hourlyWindows, pcol)
+	pcol = ParDo(s, partitionOf, pcol)
+	got := Count(s, pcol, CountParams{MaxValue: 1, MaxPartitionsContributed: 1, NoiseKind: LaplaceNoise{}})
+	want = beam.WindowInto(s, hourlyWindows, beam.ParDo(s, int64MetricToTimestampedKV, want))
+	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestCountWindowed: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountWindowed: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that Count emits the public partitions of each window.
+func TestCountWindowedWithPartitions(t *testing.T) {
+	pairs := concatenatePairs(
+		makePairsWithFixedV(10, 1),
+		makePairsWithFixedV(20, 102),
+	)
+	result := []testInt64Metric{
+		{1, 10},
+		{2, 0},
+		{3, 0},
+		{101, 0},
+		{102, 20},
+		{103, 0},
+	}
+	p, s, col, want := ptest.CreateList2(pairs, result)
+	col = beam.ParDo(s, pairToTimestampedKV, col)
+	publicPartitions := beam.ParDo(s, valueToTimestampedPartition, beam.CreateList(s, []int{1, 2, 3, 101, 102, 103}))
+
+	// We have ε=50, δ=0 and l1Sensitivity=1.
+	// We have 6 partitions. So, to get an overall flakiness of 10⁻²³,
+	// we can have each partition fail with 10⁻²⁴ probability (k=24).
+	epsilon, k, l1Sensitivity := 50.0, 24.0, 1.0
+	pcol := MakePrivate(s, col, NewPrivacySpec(epsilon, 0))
+	pcol = WindowInto(s, hourlyWindows, pcol)
+	pcol = ParDo(s, partitionOf, pcol)
+	got := Count(s, pcol, CountParams{
+		MaxValue:                 1,
+		MaxPartitionsContributed: 1,
+		NoiseKind:                LaplaceNoise{},
+		PublicPartitions:         publicPartitions,
+	})
+	want = beam.WindowInto(s, hourlyWindows, beam.ParDo(s, int64MetricToTimestampedKV, want))
+	if err := approxEqualsKVInt64(s, got, want, laplaceTolerance(k, l1Sensitivity, epsilon)); err != nil {
+		t.Fatalf("TestCountWindowedWithPartitions: %v", err)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("TestCountWindowedWithPartitions: Count(%v) = %v, expected %v: %v", col, got, want, err)
+	}
+}
+
+// Checks that BoundWindowContributions bounds the number of windows per
+// privacy ID, and keeps the records in their original windows.
+func TestBoundWindowContributions(t *testing.T) {
+	pairs := concatenatePairs(makeDailyValues(1, 5, 3), makeDailyValues(2, 1, 2))
+	// makeDailyValues uses the same encoding for days as this file for hours.
+	wantAcrossWindows := []string{
+		"1:6:2:3",
+		"2:2:1:2",
+	}
+	wantPerWindow := []string{
+		"1:3:1:3",
+		"1:3:1:3",
+		"2:2:1:2",
+	}
+	p, s, col, wantAcrossWindowsCol := ptest.CreateList2(pairs, wantAcrossWindows)
+	wantPerWindowCol := beam.CreateList(s, wantPerWindow)
+	col = beam.ParDo(s, pairToTimestampedKV, col)
+
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = WindowInto(s, hourlyWindows, pcol)
+	pcol = BoundWindowContributions(s, pcol, 2)
+	if pcol.windowFn != hourlyWindows {
+		t.Errorf("BoundWindowContributions: got windowing function %v, want %v", pcol.windowFn, hourlyWindows)
+	}
+	perWindow := beam.ParDo(s, summarizeDays, beam.GroupByKey(s, pcol.col))
+	passert.Equals(s, beam.WindowInto(s, window.NewGlobalWindows(), perWindow), wantPerWindowCol)
+	global := beam.WindowInto(s, window.NewGlobalWindows(), pcol.col)
+	acrossWindows := beam.ParDo(s, summarizeDays, beam.GroupByKey(s, global))
+	passert.Equals(s, acrossWindows, wantAcrossWindowsCol)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("BoundWindowContributions: got %v and %v, want %v and %v: %v", acrossWindows, perWindow, wantAcrossWindowsCol, wantPerWindowCol, err)
+	}
+}
+
+// Checks that the windowing function of a PrivatePCollection is kept by
+// transforms.
+func TestWindowIntoPropagation(t *testing.T) {
+	_, s, col := ptest.CreateList(makePairsWithFixedV(10, 1))
+	col = beam.ParDo(s, pairToTimestampedKV, col)
+	pcol := MakePrivate(s, col, NewPrivacySpec(1, 1e-10))
+	pcol = WindowInto(s, hourlyWindows, pcol)
+	if got := ParDo(s, partitionOf, pcol).windowFn; got != hourlyWindows {
+		t.Errorf("ParDo: got windowing function %v, want %v", got, hourlyWindows)
+	}
+	if got := Filter(s, func(v int) bool { return v > 0 }, pcol).windowFn; got != hourlyWindows {
+		t.Errorf("Filter: got windowing function %v, want %v", got, hourlyWindows)
+	}
+}
+
+func TestCheckWindowFn(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		ws      *window.Fn
+		wantErr bool
+	}{
+		{"global windows", window.NewGlobalWindows(), false},
+		{"fixed windows", window.NewFixedWindows(time.Hour), false},
+		{"sliding windows", window.NewSlidingWindows(time.Hour, 2*time.Hour), false},
+		{"sessions", window.NewSessions(time.Hour), true},
+		{"nil windowing function", nil, true},
+	} {
+		if err := checkWindowFn(tc.ws); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckNotWindowed(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		pcol    PrivatePCollection
+		wantErr bool
+	}{
+		{"no windowing function", PrivatePCollection{}, false},
+		{"global windows", PrivatePCollection{windowFn: window.NewGlobalWindows()}, false},
+		{"fixed windows", PrivatePCollection{windowFn: hourlyWindows}, true},
+	} {
+		if err := checkNotWindowed("pbeam.GlobalCount", tc.pcol); (err != nil) != tc.wantErr {
+			t.Errorf("With %s, got=%v, wantErr=%t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+